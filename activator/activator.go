@@ -34,6 +34,15 @@ type Activator interface {
 	DActivateDCombination(sum float64, output float64) float64
 }
 
+// SecondDerivActivator is an Activator which can also compute the second derivative
+// of the activation function with respect to the weighted sum. It is needed
+// for computing Hessian-vector products. Like DActivateDCombination it takes in
+// both the weighted sum and the output of Activate.
+type SecondDerivActivator interface {
+	Activator
+	D2ActivateDCombination2(sum float64, output float64) float64
+}
+
 // Sigmoid is an activation function which is the sigmoid function,
 // out = 1/(1 + exp(-sum))
 type Sigmoid struct{}
@@ -49,6 +58,12 @@ func (n Sigmoid) DActivateDCombination(sum, output float64) float64 {
 	return output * (1 - output)
 }
 
+// D2ActivateDCombination2 computes the second derivative of the activation
+// function with respect to the weighted sum
+func (n Sigmoid) D2ActivateDCombination2(sum, output float64) float64 {
+	return output * (1 - output) * (1 - 2*output)
+}
+
 // Linear neuron has a the identity activation function out = sum
 type Linear struct{}
 
@@ -66,6 +81,12 @@ func (a Linear) DActivateDCombination(sum, output float64) float64 {
 	return 1.0
 }
 
+// D2ActivateDCombination2 computes the second derivative of the linear activation
+// function with respect to the weighted sum
+func (a Linear) D2ActivateDCombination2(sum, output float64) float64 {
+	return 0
+}
+
 const (
 	// http://www.wolframalpha.com/input/?i=1.7159+*+2%2F3
 	TanhDerivConst = 1.14393333333333333333333333333333333333333333333333333333333333333333
@@ -94,6 +115,13 @@ func (a Tanh) DActivateDCombination(sum, output float64) float64 {
 	return TanhDerivConst * (1.0 - math.Tanh(TwoThirds*sum)*math.Tanh(TwoThirds*sum))
 }
 
+// D2ActivateDCombination2 computes the second derivative of the Tanh activation
+// function with respect to the weighted sum
+func (a Tanh) D2ActivateDCombination2(sum, output float64) float64 {
+	t := math.Tanh(TwoThirds * sum)
+	return -2 * TanhDerivConst * TwoThirds * t * (1.0 - t*t)
+}
+
 func (a Tanh) String() string {
 	return tanhString
 }
@@ -119,3 +147,10 @@ func (a LinearTanh) Activate(sum float64) float64 {
 func (a LinearTanh) DActivateDCombination(sum, output float64) float64 {
 	return TanhDerivConst*(1.0-math.Tanh(TwoThirds*sum)*math.Tanh(TwoThirds*sum)) + 0.01
 }
+
+// D2ActivateDCombination2 computes the second derivative of the LinearTanh activation
+// function with respect to the weighted sum
+func (a LinearTanh) D2ActivateDCombination2(sum, output float64) float64 {
+	t := math.Tanh(TwoThirds * sum)
+	return -2 * TanhDerivConst * TwoThirds * t * (1.0 - t*t)
+}
@@ -9,8 +9,29 @@ import (
 
 // TODO: Add better tests for JSON
 
+const (
+	activatorFDStep = 1e-6
+	activatorFDTol  = 1e-8
+)
+
+// testSecondDeriv checks the second derivative against a finite difference of the
+// first derivative
+func testSecondDeriv(t *testing.T, a SecondDerivActivator) {
+	for _, sum := range []float64{-2.1, -0.3, 0, 0.7, 1.23456789} {
+		output := a.Activate(sum)
+		deriv := a.D2ActivateDCombination2(sum, output)
+		d1 := a.DActivateDCombination(sum+activatorFDStep, a.Activate(sum+activatorFDStep))
+		d2 := a.DActivateDCombination(sum-activatorFDStep, a.Activate(sum-activatorFDStep))
+		fd := (d1 - d2) / (2 * activatorFDStep)
+		if math.Abs(fd-deriv) > activatorFDTol {
+			t.Errorf("Second derivative does not match at %v. %v expected, %v found", sum, fd, deriv)
+		}
+	}
+}
+
 func TestSigmoid(t *testing.T) {
 	s := Sigmoid{}
+	testSecondDeriv(t, s)
 	sum := 1.23456789
 	// const gotten from wolfram alpha
 	// http://www.wolframalpha.com/input/?i=1%2F%281%2B+exp%28-1.23456789%29%29
@@ -34,6 +55,7 @@ func TestSigmoid(t *testing.T) {
 
 func TestLinear(t *testing.T) {
 	s := Linear{}
+	testSecondDeriv(t, s)
 	sum := 1.23456789
 	trueOut := sum
 	trueDeriv := 1.0
@@ -55,6 +77,7 @@ func TestLinear(t *testing.T) {
 
 func TestTanh(t *testing.T) {
 	s := Tanh{}
+	testSecondDeriv(t, s)
 	sum := 1.23456789
 	// const gotten from wolfram alpha
 	// http://www.wolframalpha.com/input/?i=1.7159+*+tanh%282%2F3+*+1.23456789%29
@@ -77,6 +100,7 @@ func TestTanh(t *testing.T) {
 
 func TestLinearTanh(t *testing.T) {
 	s := LinearTanh{}
+	testSecondDeriv(t, s)
 	sum := 1.23456789
 	// const gotten from wolfram alpha
 	// http://www.wolframalpha.com/input/?i=1.7159+*+tanh%282%2F3+*+1.23456789%29+%2B+0.01+*+1.23456789
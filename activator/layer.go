@@ -0,0 +1,72 @@
+package activator
+
+import (
+	"encoding/gob"
+	"math"
+
+	"github.com/btracey/nnet/common"
+)
+
+func init() {
+	gob.Register(Softmax{})
+	common.Register(Softmax{})
+}
+
+// LayerActivator is an activation function which acts on all of the neurons
+// of a layer at once, rather than on each neuron individually. The outputs of
+// the layer are a vector function of the combinations of all of the neurons.
+// VecDActivateDCombination stores the product of v with the Jacobian of the outputs
+// with respect to the combinations, dst_j = sum_i v_i * d output_i / d combination_j,
+// without forming the Jacobian. dst and v may be the same slice. Like Activator,
+// it takes in both the combinations and the outputs.
+type LayerActivator interface {
+	Activate(combinations, outputs []float64)
+	VecDActivateDCombination(combinations, outputs, v, dst []float64)
+}
+
+// LogSumExp computes log(sum_i exp(x_i)) in a numerically stable way by
+// shifting by the maximum value
+func LogSumExp(x []float64) float64 {
+	max := math.Inf(-1)
+	for _, val := range x {
+		if val > max {
+			max = val
+		}
+	}
+	if math.IsInf(max, 0) {
+		return max
+	}
+	var sum float64
+	for _, val := range x {
+		sum += math.Exp(val - max)
+	}
+	return max + math.Log(sum)
+}
+
+// Softmax is the softmax function, out_i = exp(sum_i) / sum_j exp(sum_j). The
+// outputs are positive and sum to one, and so can be interpreted as the
+// probability of each class. An output layer with a Softmax activation is trained
+// with loss.ProbabilityCrossEntropy rather than loss.CrossEntropy, which takes the
+// logits.
+type Softmax struct{}
+
+// Activate computes the softmax of the combinations using log-sum-exp to avoid overflow
+func (s Softmax) Activate(combinations, outputs []float64) {
+	lse := LogSumExp(combinations)
+	for i, val := range combinations {
+		outputs[i] = math.Exp(val - lse)
+	}
+}
+
+// VecDActivateDCombination computes the product of v with the Jacobian of the softmax
+// function, d out_i / d sum_j = out_i * (delta_ij - out_j), so
+// dst_j = out_j * (v_j - sum_i v_i * out_i)
+func (s Softmax) VecDActivateDCombination(combinations, outputs, v, dst []float64) {
+	var dot float64
+	for i, out := range outputs {
+		dot += v[i] * out
+	}
+	for j, out := range outputs {
+		dst[j] = out * (v[j] - dot)
+	}
+}
@@ -0,0 +1,65 @@
+package activator
+
+import (
+	"math"
+	"testing"
+
+	"github.com/btracey/nnet/common"
+	"github.com/gonum/floats"
+)
+
+func TestLogSumExp(t *testing.T) {
+	x := []float64{1, 2, 3}
+	trueLSE := math.Log(math.Exp(1) + math.Exp(2) + math.Exp(3))
+	if math.Abs(LogSumExp(x)-trueLSE) > 1e-14 {
+		t.Errorf("LogSumExp does not match. %v expected, %v found", trueLSE, LogSumExp(x))
+	}
+	// Should not overflow
+	x = []float64{1000, 1000}
+	if math.Abs(LogSumExp(x)-(1000+math.Ln2)) > 1e-12 {
+		t.Errorf("LogSumExp overflow. %v expected, %v found", 1000+math.Ln2, LogSumExp(x))
+	}
+}
+
+func TestSoftmax(t *testing.T) {
+	s := Softmax{}
+	comb := []float64{0.3, -1.2, 2.5, 800}
+	out := make([]float64, len(comb))
+	s.Activate(comb, out)
+	if math.Abs(floats.Sum(out)-1) > 1e-14 {
+		t.Errorf("Softmax outputs do not sum to one: %v", out)
+	}
+	comb[3] = 0.4
+	s.Activate(comb, out)
+
+	v := []float64{0.7, -0.2, 1.3, 0.5}
+	vecJac := make([]float64, len(comb))
+	s.VecDActivateDCombination(comb, out, v, vecJac)
+	out1 := make([]float64, len(comb))
+	out2 := make([]float64, len(comb))
+	for j := range comb {
+		comb[j] += activatorFDStep
+		s.Activate(comb, out1)
+		comb[j] -= 2 * activatorFDStep
+		s.Activate(comb, out2)
+		comb[j] += activatorFDStep
+		var fd float64
+		for i := range out {
+			fd += v[i] * (out1[i] - out2[i]) / (2 * activatorFDStep)
+		}
+		if math.Abs(fd-vecJac[j]) > activatorFDTol {
+			t.Errorf("Vector-Jacobian product mismatch for %v. %v expected, %v found", j, fd, vecJac[j])
+		}
+	}
+
+	// The product may be stored in place
+	s.VecDActivateDCombination(comb, out, v, v)
+	if !floats.Equal(v, vecJac) {
+		t.Errorf("In place vector-Jacobian product mismatch")
+	}
+
+	err := common.InterfaceTestMarshalAndUnmarshal(s)
+	if err != nil {
+		t.Errorf("Error marshaling and unmarshaling")
+	}
+}
@@ -0,0 +1,308 @@
+// Package gradcheck checks the derivatives of activators, neurons, loss functions
+// and nets against central finite differences at random points. It is meant to be
+// called from the tests of custom types, for example
+//
+//	r := gradcheck.Neuron(myNeuron, 4, nil)
+//	if r.Max() > 1e-6 {
+//		t.Errorf("bad derivative: %v", r)
+//	}
+//
+// The error of a derivative is |d - fd| / max(1, |d|, |fd|), where d is the
+// derivative computed by the type and fd is the finite difference, so it is the
+// relative error for large derivatives and the absolute error for small ones.
+// The worst error over all of the points is reported.
+package gradcheck
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+
+	"github.com/btracey/nnet/activator"
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/nnet"
+	"github.com/btracey/nnet/scale"
+)
+
+const (
+	DefaultStep   = 1e-6 // Default step of the central differences
+	DefaultPoints = 10   // Default number of random points
+)
+
+// Settings are the settings of the checks. A nil *Settings uses the defaults.
+type Settings struct {
+	Step   float64     // Step of the central differences. DefaultStep is used if zero
+	Points int         // Number of random points. DefaultPoints is used if zero
+	Src    rand.Source // Source of the random points. The global source in math/rand is used if nil
+
+	// Point sets x to a random point. It is used for the inputs of activators,
+	// neurons and nets, and for the predictions and truths of Lossers. If it is
+	// nil, the elements are drawn from a standard normal distribution. It should
+	// be set for functions which are not defined everywhere, for example to
+	// draw positive points for loss.LogSquared.
+	Point func(rnd *rand.Rand, x []float64)
+}
+
+func (s *Settings) step() float64 {
+	if s == nil || s.Step == 0 {
+		return DefaultStep
+	}
+	return s.Step
+}
+
+func (s *Settings) points() int {
+	if s == nil || s.Points == 0 {
+		return DefaultPoints
+	}
+	return s.Points
+}
+
+func (s *Settings) rand() *rand.Rand {
+	if s == nil || s.Src == nil {
+		return rand.New(rand.NewSource(rand.Int63()))
+	}
+	return rand.New(s.Src)
+}
+
+func (s *Settings) point(rnd *rand.Rand, x []float64) {
+	if s != nil && s.Point != nil {
+		s.Point(rnd, x)
+		return
+	}
+	for i := range x {
+		x[i] = rnd.NormFloat64()
+	}
+}
+
+// Result is the worst error of each of the derivatives over all of the points
+type Result struct {
+	Combination float64   // Derivative of the output with respect to the combination (activators and neurons)
+	Parameters  []float64 // Derivative with respect to each parameter (neurons and nets)
+	Inputs      []float64 // Derivative with respect to each input, or each element of the prediction for Lossers
+}
+
+// Max returns the worst error of all of the derivatives
+func (r Result) Max() float64 {
+	max := r.Combination
+	for _, v := range r.Parameters {
+		max = math.Max(max, v)
+	}
+	for _, v := range r.Inputs {
+		max = math.Max(max, v)
+	}
+	return max
+}
+
+// relErr returns the error of the derivative d with respect to the finite difference fd
+func relErr(d, fd float64) float64 {
+	if math.IsNaN(d) || math.IsNaN(fd) {
+		return math.Inf(1)
+	}
+	return math.Abs(d-fd) / math.Max(1, math.Max(math.Abs(d), math.Abs(fd)))
+}
+
+// centralDiff returns the central difference of f with respect to x[i]. x is
+// restored before returning.
+func centralDiff(f func() float64, x []float64, i int, step float64) float64 {
+	orig := x[i]
+	x[i] = orig + step
+	plus := f()
+	x[i] = orig - step
+	minus := f()
+	x[i] = orig
+	return (plus - minus) / (2 * step)
+}
+
+// Activator checks DActivateDCombination of the activator at random combinations
+func Activator(a activator.Activator, s *Settings) Result {
+	step := s.step()
+	rnd := s.rand()
+	var r Result
+	x := make([]float64, 1)
+	for p := 0; p < s.points(); p++ {
+		s.point(rnd, x)
+		d := a.DActivateDCombination(x[0], a.Activate(x[0]))
+		fd := centralDiff(func() float64 { return a.Activate(x[0]) }, x, 0, step)
+		r.Combination = math.Max(r.Combination, relErr(d, fd))
+	}
+	return r
+}
+
+// Neuron checks DActivateDCombination, DCombineDParameters and DCombineDInput of
+// the neuron with nInputs inputs. The parameters are randomized at each point with
+// RandomizeFrom if the neuron is a nnet.SeededRandomizer, and with Randomize otherwise.
+func Neuron(n nnet.Neuron, nInputs int, s *Settings) Result {
+	step := s.step()
+	rnd := s.rand()
+	nParameters := n.NumParameters(nInputs)
+	r := Result{
+		Parameters: make([]float64, nParameters),
+		Inputs:     make([]float64, nInputs),
+	}
+	params := make([]float64, nParameters)
+	inputs := make([]float64, nInputs)
+	dParams := make([]float64, nParameters)
+	dInputs := make([]float64, nInputs)
+	combine := func() float64 { return n.Combine(params, inputs) }
+	for p := 0; p < s.points(); p++ {
+		if seeded, ok := n.(nnet.SeededRandomizer); ok {
+			seeded.RandomizeFrom(params, rnd)
+		} else {
+			n.Randomize(params)
+		}
+		s.point(rnd, inputs)
+		comb := combine()
+
+		c := []float64{comb}
+		d := n.DActivateDCombination(comb, n.Activate(comb))
+		fd := centralDiff(func() float64 { return n.Activate(c[0]) }, c, 0, step)
+		r.Combination = math.Max(r.Combination, relErr(d, fd))
+
+		n.DCombineDParameters(params, inputs, comb, dParams)
+		for i := range params {
+			fd := centralDiff(combine, params, i, step)
+			r.Parameters[i] = math.Max(r.Parameters[i], relErr(dParams[i], fd))
+		}
+		n.DCombineDInput(params, inputs, comb, dInputs)
+		for i := range inputs {
+			fd := centralDiff(combine, inputs, i, step)
+			r.Inputs[i] = math.Max(r.Inputs[i], relErr(dInputs[i], fd))
+		}
+	}
+	return r
+}
+
+// Losser checks the derivative of the loss with respect to a prediction of length
+// nPrediction at random predictions and truths of length nTruth. The errors are
+// stored in Inputs.
+func Losser(l loss.Losser, nPrediction, nTruth int, s *Settings) Result {
+	step := s.step()
+	rnd := s.rand()
+	r := Result{Inputs: make([]float64, nPrediction)}
+	pred := make([]float64, nPrediction)
+	truth := make([]float64, nTruth)
+	deriv := make([]float64, nPrediction)
+	tmp := make([]float64, nPrediction)
+	f := func() float64 { return l.LossAndDeriv(pred, truth, tmp) }
+	for p := 0; p < s.points(); p++ {
+		s.point(rnd, pred)
+		s.point(rnd, truth)
+		l.LossAndDeriv(pred, truth, deriv)
+		for i := range pred {
+			fd := centralDiff(f, pred, i, step)
+			r.Inputs[i] = math.Max(r.Inputs[i], relErr(deriv[i], fd))
+		}
+	}
+	return r
+}
+
+// Net checks the derivative of the loss of the net with respect to its trainable
+// parameters (see nnet.Net.TrainableParametersSlice) at its current parameters,
+// with a batch of random (scaled) inputs and truths of length nTruth. If nTruth is
+// zero, the truths have the length of the outputs of the net. The derivative is
+// computed with nnet.SeqLossDeriv, so the check uses the Mode of the net, and the
+// dropout masks are the same for every evaluation.
+//
+// If the scalers of the net are set and implement scale.Differentiable, Inputs
+// contains the worst error of nnet.Net.InputJacobian with respect to each input
+// at the random inputs. Otherwise Inputs is nil. The parameters of the net are
+// restored before returning, and the running statistics of batch normalization
+// are not changed.
+func Net(net *nnet.Net, nTruth int, s *Settings) (Result, error) {
+	if net.Losser == nil {
+		return Result{}, errors.New("gradcheck: net has no Losser")
+	}
+	if nTruth == 0 {
+		nTruth = net.Outputs()
+	}
+	step := s.step()
+	rnd := s.rand()
+	nPoints := s.points()
+	inputs := make([][]float64, nPoints)
+	truths := make([][]float64, nPoints)
+	weights := make([]float64, nPoints)
+	for i := range inputs {
+		inputs[i] = make([]float64, net.Inputs())
+		s.point(rnd, inputs[i])
+		truths[i] = make([]float64, nTruth)
+		s.point(rnd, truths[i])
+		weights[i] = 1 / float64(nPoints)
+	}
+
+	// Use the same dropout masks for every evaluation of the loss
+	dropoutSource := net.DropoutSource
+	defer func() { net.DropoutSource = dropoutSource }()
+	seed := rnd.Int63()
+
+	orig := make([]float64, net.NumTrainableParameters())
+	net.TrainableParametersSlice(orig)
+	defer net.SetTrainableParametersSlice(orig)
+	params := make([]float64, len(orig))
+	copy(params, orig)
+
+	dLossDParam, dLossDParamFlat := net.NewPerParameterMemory()
+	lossDeriv := func() float64 {
+		net.SetTrainableParametersSlice(params)
+		// The memory keeps the source of the dropout masks, so it is allocated each time
+		net.DropoutSource = rand.NewSource(seed)
+		mem := nnet.NewParLossDerivMemory(net)
+		return nnet.SeqLossDeriv(inputs, truths, weights, net, dLossDParam, mem)
+	}
+	lossDeriv()
+	deriv := make([]float64, len(params))
+	net.TrainableSlice(dLossDParamFlat, deriv)
+
+	r := Result{Parameters: make([]float64, len(params))}
+	for i := range params {
+		fd := centralDiff(lossDeriv, params, i, step)
+		r.Parameters[i] = relErr(deriv[i], fd)
+	}
+	net.SetTrainableParametersSlice(orig)
+
+	if net.InputScaler == nil || net.OutputScaler == nil {
+		return r, nil
+	}
+	if !net.InputScaler.IsScaled() || !net.OutputScaler.IsScaled() {
+		return r, nil
+	}
+	if _, ok := net.InputScaler.(scale.Differentiable); !ok {
+		return r, nil
+	}
+	if _, ok := net.OutputScaler.(scale.Differentiable); !ok {
+		return r, nil
+	}
+	if net.OutputScaler.Dimensions() != net.Outputs() {
+		// For example mixture density nets, whose outputs are not scaled
+		return r, nil
+	}
+	jac := make([][]float64, net.Outputs())
+	for i := range jac {
+		jac[i] = make([]float64, net.Inputs())
+	}
+	r.Inputs = make([]float64, net.Inputs())
+	for _, input := range inputs {
+		err := net.InputJacobian(input, jac)
+		if err != nil {
+			return Result{}, err
+		}
+		for j := range input {
+			orig := input[j]
+			input[j] = orig + step
+			plus, err := net.Predict(append([]float64(nil), input...))
+			if err != nil {
+				return Result{}, err
+			}
+			input[j] = orig - step
+			minus, err := net.Predict(append([]float64(nil), input...))
+			if err != nil {
+				return Result{}, err
+			}
+			input[j] = orig
+			for i := range plus {
+				fd := (plus[i] - minus[i]) / (2 * step)
+				r.Inputs[j] = math.Max(r.Inputs[j], relErr(jac[i][j], fd))
+			}
+		}
+	}
+	return r, nil
+}
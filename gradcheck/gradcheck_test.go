@@ -0,0 +1,198 @@
+package gradcheck
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/btracey/nnet/activator"
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/nnet"
+	"github.com/btracey/nnet/scale"
+)
+
+const gradcheckTol = 1e-5
+
+// wrongActivator is tanh with a derivative which is off by a factor of two
+type wrongActivator struct {
+	activator.Tanh
+}
+
+func (w wrongActivator) DActivateDCombination(sum, output float64) float64 {
+	return 2 * w.Tanh.DActivateDCombination(sum, output)
+}
+
+// wrongNeuron is a SumNeuron with the derivative with respect to the first input missing
+type wrongNeuron struct {
+	*nnet.SumNeuron
+}
+
+func (w wrongNeuron) DCombineDInput(params, inputs []float64, combination float64, deriv []float64) {
+	w.SumNeuron.DCombineDInput(params, inputs, combination, deriv)
+	deriv[0] = 0
+}
+
+func TestActivator(t *testing.T) {
+	for _, a := range []activator.Activator{activator.Sigmoid{}, activator.Linear{}, activator.Tanh{}, activator.LinearTanh{}} {
+		r := Activator(a, &Settings{Src: rand.NewSource(1)})
+		if r.Max() > gradcheckTol {
+			t.Errorf("Activator %T: error %v", a, r.Max())
+		}
+	}
+	r := Activator(wrongActivator{}, &Settings{Src: rand.NewSource(1)})
+	if r.Combination < 0.1 {
+		t.Errorf("Wrong derivative of the activator not found")
+	}
+}
+
+func TestNeuron(t *testing.T) {
+	nInputs := 4
+	for _, n := range []nnet.Neuron{&nnet.TanhNeuron, &nnet.LinearNeuron, &nnet.SigmoidNeuron, &nnet.RBFNeuron{}, &nnet.RBFNeuron{PerDimensionWidth: true}} {
+		r := Neuron(n, nInputs, &Settings{Src: rand.NewSource(1)})
+		if len(r.Parameters) != n.NumParameters(nInputs) {
+			t.Errorf("Neuron %T: wrong number of parameters", n)
+		}
+		if len(r.Inputs) != nInputs {
+			t.Errorf("Neuron %T: wrong number of inputs", n)
+		}
+		if r.Max() > gradcheckTol {
+			t.Errorf("Neuron %T: error %v", n, r.Max())
+			fmt.Println(r)
+		}
+	}
+	n := wrongNeuron{&nnet.TanhNeuron}
+	r := Neuron(n, nInputs, nil)
+	if r.Inputs[0] < 1e-3 {
+		t.Errorf("Wrong derivative of the neuron not found")
+	}
+	for i := 1; i < nInputs; i++ {
+		if r.Inputs[i] > gradcheckTol {
+			t.Errorf("Error reported for a correct derivative")
+		}
+	}
+	if r.Max() != r.Inputs[0] {
+		t.Errorf("Max is not the worst error")
+	}
+}
+
+func TestLosser(t *testing.T) {
+	for _, test := range []struct {
+		losser      loss.Losser
+		nPrediction int
+		nTruth      int
+		settings    *Settings
+	}{
+		{loss.SquaredDistance{}, 3, 3, nil},
+		{loss.LogSquared{}, 3, 3, nil},
+		{loss.RelativeSquared(0.1), 3, 3, nil},
+		{loss.CrossEntropy{}, 4, 4, nil},
+		{loss.MixtureDensity{Components: 3}, loss.MixtureDensity{Components: 3}.NumOutputs(2), 2, nil},
+	} {
+		r := Losser(test.losser, test.nPrediction, test.nTruth, test.settings)
+		if len(r.Inputs) != test.nPrediction {
+			t.Errorf("Losser %T: wrong length of Inputs", test.losser)
+		}
+		if r.Max() > gradcheckTol {
+			t.Errorf("Losser %T: error %v", test.losser, r.Max())
+			fmt.Println(r)
+		}
+	}
+}
+
+func TestNet(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	net, err := nnet.DefaultRegressionInit(nInputs, nOutputs, 2, 5, nil, rand.NewSource(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	net.InputScaler = &scale.Normal{}
+	net.OutputScaler = &scale.Normal{}
+	data := make([][]float64, 20)
+	for i := range data {
+		data[i] = []float64{rand.NormFloat64(), 2 * rand.NormFloat64(), rand.NormFloat64() - 1}
+	}
+	net.InputScaler.SetScale(data)
+	for i := range data {
+		data[i] = data[i][:nOutputs]
+	}
+	net.OutputScaler.SetScale(data)
+
+	before := make([]float64, net.TotalNumParameters())
+	net.ParametersSlice(before)
+	r, err := Net(net, 0, &Settings{Src: rand.NewSource(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Parameters) != net.TotalNumParameters() {
+		t.Errorf("Wrong number of parameters")
+	}
+	if len(r.Inputs) != nInputs {
+		t.Errorf("Wrong number of inputs")
+	}
+	if r.Max() > gradcheckTol {
+		t.Errorf("Net: error %v", r.Max())
+		fmt.Println(r)
+	}
+	after := make([]float64, net.TotalNumParameters())
+	net.ParametersSlice(after)
+	for i := range before {
+		if before[i] != after[i] {
+			t.Errorf("Parameters of the net changed")
+			break
+		}
+	}
+
+	// Only the trainable parameters are checked
+	net.SetLayerFrozen(0, true)
+	r, err = Net(net, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Parameters) != net.NumTrainableParameters() {
+		t.Errorf("Frozen parameters were checked")
+	}
+	if r.Max() > gradcheckTol {
+		t.Errorf("Frozen net: error %v", r.Max())
+	}
+	net.SetLayerFrozen(0, false)
+
+	// Dropout masks must be the same for every evaluation
+	layers := []nnet.Layer{
+		{Neurons: []nnet.Neuron{&nnet.TanhNeuron, &nnet.TanhNeuron, &nnet.TanhNeuron, &nnet.TanhNeuron}, Dropout: 0.5},
+		{Neurons: []nnet.Neuron{&nnet.LinearNeuron, &nnet.LinearNeuron}},
+	}
+	dropoutNet, err := nnet.NewNetInit(nInputs, layers, nil, rand.NewSource(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropoutNet.Losser = loss.SquaredDistance{}
+	r, err = Net(dropoutNet, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Inputs != nil {
+		t.Errorf("Inputs checked without scalers")
+	}
+	if r.Max() > gradcheckTol {
+		t.Errorf("Dropout net: error %v", r.Max())
+	}
+
+	// The truths of a mixture density net do not have the length of the outputs
+	mdn := nnet.DefaultMixtureDensity(nInputs, 2, 3, 1, 5)
+	if err := mdn.Initialize(nil, rand.NewSource(1)); err != nil {
+		t.Fatal(err)
+	}
+	r, err = Net(mdn, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Max() > gradcheckTol {
+		t.Errorf("Mixture density net: error %v", r.Max())
+	}
+
+	dropoutNet.Losser = nil
+	if _, err := Net(dropoutNet, 0, nil); err == nil {
+		t.Errorf("No error for a net without a Losser")
+	}
+}
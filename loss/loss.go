@@ -6,12 +6,16 @@ import (
 	"math"
 
 	"fmt"
+
+	"github.com/btracey/nnet/activator"
+	"github.com/gonum/floats"
 )
 
 func init() {
 	gob.Register(SquaredDistance{})
 	gob.Register(ManhattanDistance{})
 	gob.Register(RelativeSquared(0))
+	gob.Register(RelativeLog(0))
 	gob.Register(LogSquared{})
 	common.Register(SquaredDistance{})
 	common.Register(ManhattanDistance{})
@@ -20,7 +24,12 @@ func init() {
 	b := RelativeLog(0)
 	common.Register(b)
 	common.Register(LogSquared{})
-
+	gob.Register(CrossEntropy{})
+	common.Register(CrossEntropy{})
+	gob.Register(ProbabilityCrossEntropy{})
+	common.Register(ProbabilityCrossEntropy{})
+	gob.Register(MixtureDensity{})
+	common.Register(MixtureDensity{})
 }
 
 // Losser is an interface for a loss function. It takes in three inputs
@@ -35,6 +44,15 @@ type Losser interface {
 	LossAndDeriv(prediction []float64, truth []float64, derivative []float64) float64
 }
 
+// HessVecLosser is a Losser which can also compute the product of the Hessian of the
+// loss function (with respect to the prediction) with a vector v. The result is stored
+// in place into hessVec. It is needed for computing Hessian-vector products with
+// respect to the parameters of a net.
+type HessVecLosser interface {
+	Losser
+	HessVec(prediction, truth, v, hessVec []float64)
+}
+
 // SquaredDistance is the same as the two-norm of (truth - pred) divided by the length
 type SquaredDistance struct{}
 
@@ -53,6 +71,13 @@ func (l SquaredDistance) LossAndDeriv(prediction, truth, derivative []float64) (
 	return loss
 }
 
+// HessVec stores the product of the Hessian of the loss and v into hessVec
+func (l SquaredDistance) HessVec(prediction, truth, v, hessVec []float64) {
+	for i := range v {
+		hessVec[i] = 2 * v[i] / float64(len(prediction))
+	}
+}
+
 // Manhattan distance is the same as the one-norm of (truth - pred)
 type ManhattanDistance struct{}
 
@@ -73,6 +98,14 @@ func (m ManhattanDistance) LossAndDeriv(prediction, truth, derivative []float64)
 	return loss
 }
 
+// HessVec stores the product of the Hessian of the loss and v into hessVec. The
+// Hessian is zero everywhere it is defined
+func (m ManhattanDistance) HessVec(prediction, truth, v, hessVec []float64) {
+	for i := range hessVec {
+		hessVec[i] = 0
+	}
+}
+
 // Relative squared is the relative error with the value of RelativeSquared added in the denominator
 type RelativeSquared float64
 
@@ -97,6 +130,15 @@ func (r RelativeSquared) LossAndDeriv(prediction, truth, derivative []float64) (
 	return loss
 }
 
+// HessVec stores the product of the Hessian of the loss and v into hessVec
+func (r RelativeSquared) HessVec(prediction, truth, v, hessVec []float64) {
+	nSamples := float64(len(prediction))
+	for i := range v {
+		denom := math.Abs(truth[i]) + float64(r)
+		hessVec[i] = 2 * v[i] / (denom * denom * nSamples)
+	}
+}
+
 // LogRelative finds the relative difference between the two samples and takes the log
 // of the absolute value of the difference as the loss function
 type RelativeLog float64
@@ -150,3 +192,159 @@ func (l LogSquared) LossAndDeriv(prediction, truth, deravitive []float64) (loss
 	loss /= nSamples
 	return loss
 }
+
+// HessVec stores the product of the Hessian of the loss and v into hessVec
+func (l LogSquared) HessVec(prediction, truth, v, hessVec []float64) {
+	nSamples := float64(len(prediction))
+	for i := range v {
+		diff := prediction[i] - truth[i]
+		diffSqPlus1 := diff*diff + 1
+		hessVec[i] = 2 * (1 - diff*diff) / (diffSqPlus1 * diffSqPlus1) / nSamples * v[i]
+	}
+}
+
+// CrossEntropy is the categorical cross-entropy loss, -sum_i truth_i * log(p_i), where
+// p is the softmax of the prediction. The predictions are the logits (unnormalized log
+// probabilities) of the classes, as from a layer with no activation, and truth is the
+// true distribution over the classes (often all zeros except a one for the true class).
+// The loss is computed from the logits as sum(truth) * logsumexp(prediction) - truth · prediction,
+// so that the derivative, sum(truth) * p - truth, does not vanish when the prediction is
+// confidently wrong. The probabilities are found with activator.Softmax. CrossEntropy
+// must not be used with an output layer with a Softmax activation, which would apply
+// the softmax twice; use ProbabilityCrossEntropy for such a layer.
+type CrossEntropy struct{}
+
+func (c CrossEntropy) LossAndDeriv(prediction, truth, derivative []float64) (loss float64) {
+	lse := activator.LogSumExp(prediction)
+	sumTruth := floats.Sum(truth)
+	loss = sumTruth * lse
+	for i, z := range prediction {
+		loss -= truth[i] * z
+		derivative[i] = sumTruth*math.Exp(z-lse) - truth[i]
+	}
+	return loss
+}
+
+// minProbability is the smallest probability used by ProbabilityCrossEntropy, so that
+// the loss and derivative of a probability which underflows to zero are finite
+const minProbability = 1e-300
+
+// ProbabilityCrossEntropy is the categorical cross-entropy loss, -sum_i truth_i * log(p_i),
+// where the predictions p are the probabilities of the classes, as from an output layer
+// with a Softmax activation. The derivative is -truth_i / p_i, which through the
+// Jacobian of the softmax gives sum(truth) * p - truth with respect to the logits, as for
+// CrossEntropy. Probabilities less than 1e-300 are taken to be 1e-300, so the loss of
+// a confidently wrong prediction is finite, but its derivative vanishes once the
+// probability underflows to zero. CrossEntropy on the logits does not have this limit.
+type ProbabilityCrossEntropy struct{}
+
+func (c ProbabilityCrossEntropy) LossAndDeriv(prediction, truth, derivative []float64) (loss float64) {
+	for i, p := range prediction {
+		p = math.Max(p, minProbability)
+		loss -= truth[i] * math.Log(p)
+		derivative[i] = -truth[i] / p
+	}
+	return loss
+}
+
+// MixtureDensity is the negative log-likelihood of the truth under a mixture of
+// Components Gaussians with diagonal covariances, as in Bishop, "Mixture density
+// networks", 1994. It is used for targets whose distribution has several modes, where
+// the mean from SquaredDistance is not meaningful. For truths of dimension d, the
+// prediction has Components*(1+2*d) elements. The first Components are the unnormalized
+// log weights of the components, which are mapped to the weights with a softmax. They
+// are followed by the d means of each component in turn, and then the d log-variances
+// of each component in turn.
+type MixtureDensity struct {
+	Components int
+}
+
+// NumOutputs returns the length of the prediction for truths of dimension nDim
+func (m MixtureDensity) NumOutputs(nDim int) int {
+	return m.Components * (1 + 2*nDim)
+}
+
+// dim returns the dimension of the truth from the length of the prediction
+func (m MixtureDensity) dim(nPrediction int) int {
+	if m.Components < 1 {
+		panic("loss: mixture density must have at least one component")
+	}
+	nDim := (nPrediction/m.Components - 1) / 2
+	if m.NumOutputs(nDim) != nPrediction {
+		panic(fmt.Sprintf("loss: prediction of length %v does not match a mixture of %v components", nPrediction, m.Components))
+	}
+	return nDim
+}
+
+// Mixture returns the weights, means and variances of the components of the
+// mixture from the prediction
+func (m MixtureDensity) Mixture(prediction []float64) (weights []float64, means, variances [][]float64) {
+	nDim := m.dim(len(prediction))
+	k := m.Components
+	weights = make([]float64, k)
+	logSoftmax(prediction[:k], weights)
+	for i := range weights {
+		weights[i] = math.Exp(weights[i])
+	}
+	means = make([][]float64, k)
+	variances = make([][]float64, k)
+	for i := range means {
+		means[i] = make([]float64, nDim)
+		copy(means[i], prediction[k+i*nDim:k+(i+1)*nDim])
+		variances[i] = make([]float64, nDim)
+		for j, s := range prediction[k+(k+i)*nDim : k+(k+i+1)*nDim] {
+			variances[i][j] = math.Exp(s)
+		}
+	}
+	return weights, means, variances
+}
+
+// logSoftmax stores the log of the softmax of x into logP and returns the log of
+// the sum of the exponentials of x
+func logSoftmax(x, logP []float64) float64 {
+	lse := activator.LogSumExp(x)
+	for i, v := range x {
+		logP[i] = v - lse
+	}
+	return lse
+}
+
+func (m MixtureDensity) LossAndDeriv(prediction, truth, derivative []float64) (loss float64) {
+	nDim := m.dim(len(prediction))
+	if nDim != len(truth) {
+		panic(fmt.Sprintf("loss: prediction of length %v does not match a mixture of %v components for truth of length %v", len(prediction), m.Components, len(truth)))
+	}
+	k := m.Components
+	logits := prediction[:k]
+	means := prediction[k : k+k*nDim]
+	logVars := prediction[k+k*nDim:]
+
+	// logJoint[i] is log(weight_i * N(truth; mean_i, var_i))
+	logWeights := make([]float64, k)
+	logSoftmax(logits, logWeights)
+	logJoint := make([]float64, k)
+	for i := range logJoint {
+		logJoint[i] = logWeights[i]
+		for j, y := range truth {
+			s := logVars[i*nDim+j]
+			diff := y - means[i*nDim+j]
+			logJoint[i] -= 0.5 * (math.Log(2*math.Pi) + s + diff*diff*math.Exp(-s))
+		}
+	}
+	// The loss is -log(sum_i weight_i * N_i). The derivatives are in terms of the
+	// posterior probability of each component, r_i = weight_i * N_i / sum_j weight_j * N_j
+	logPosterior := make([]float64, k)
+	loss = -logSoftmax(logJoint, logPosterior)
+	for i := range logPosterior {
+		r := math.Exp(logPosterior[i])
+		derivative[i] = math.Exp(logWeights[i]) - r
+		for j, y := range truth {
+			s := logVars[i*nDim+j]
+			diff := y - means[i*nDim+j]
+			invVar := math.Exp(-s)
+			derivative[k+i*nDim+j] = -r * diff * invVar
+			derivative[k+(k+i)*nDim+j] = 0.5 * r * (1 - diff*diff*invVar)
+		}
+	}
+	return loss
+}
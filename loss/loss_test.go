@@ -1,6 +1,9 @@
 package loss
 
 import (
+	"bytes"
+	"encoding/gob"
+	"github.com/btracey/nnet/activator"
 	"github.com/btracey/nnet/common"
 	"github.com/gonum/floats"
 	"math"
@@ -34,6 +37,42 @@ func finiteDifferenceLosser(losser Losser, prediction, truth []float64) (derivat
 	return
 }
 
+// finiteDifferenceHessVec compares HessVec with a finite difference of the derivative
+// in the direction v
+func finiteDifferenceHessVec(losser HessVecLosser, prediction, truth, v []float64) (hessVec, fdHessVec []float64) {
+	hessVec = make([]float64, len(prediction))
+	losser.HessVec(prediction, truth, v, hessVec)
+
+	fdHessVec = make([]float64, len(prediction))
+	derivative1 := make([]float64, len(prediction))
+	derivative2 := make([]float64, len(prediction))
+	for i := range prediction {
+		prediction[i] += FDStep * v[i]
+	}
+	losser.LossAndDeriv(prediction, truth, derivative1)
+	for i := range prediction {
+		prediction[i] -= 2 * FDStep * v[i]
+	}
+	losser.LossAndDeriv(prediction, truth, derivative2)
+	for i := range prediction {
+		prediction[i] += FDStep * v[i]
+		fdHessVec[i] = (derivative1[i] - derivative2[i]) / (2 * FDStep)
+	}
+	return
+}
+
+func TestHessVec(t *testing.T) {
+	prediction := []float64{1, -2, 3}
+	truth := []float64{1.1, -2.2, 2.7}
+	v := []float64{0.3, -1.2, 0.8}
+	for _, losser := range []HessVecLosser{SquaredDistance{}, ManhattanDistance{}, RelativeSquared(1e-2), LogSquared{}} {
+		hessVec, fdHessVec := finiteDifferenceHessVec(losser, prediction, truth, v)
+		if !floats.EqualApprox(hessVec, fdHessVec, FDTol) {
+			t.Errorf("HessVec doesn't match for %T. \n hessVec: %v \n fdHessVec: %v ", losser, hessVec, fdHessVec)
+		}
+	}
+}
+
 func TestSquaredDistance(t *testing.T) {
 	prediction := []float64{1, 2, 3}
 	truth := []float64{1.1, 2.2, 2.7}
@@ -123,6 +162,22 @@ func TestRelativeLog(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error marshaling and unmarshaling: " + err.Error())
 	}
+
+	// RelativeLog is registered with gob, so it can be encoded as a Losser
+	var l Losser = sq
+	w := &bytes.Buffer{}
+	err = gob.NewEncoder(w).Encode(&l)
+	if err != nil {
+		t.Fatalf("Error gob encoding: %v", err)
+	}
+	var l2 Losser
+	err = gob.NewDecoder(w).Decode(&l2)
+	if err != nil {
+		t.Fatalf("Error gob decoding: %v", err)
+	}
+	if l2 != l {
+		t.Errorf("Losser changed after gob encoding. Want %v, got %v", l, l2)
+	}
 }
 
 func TestLogSquared(t *testing.T) {
@@ -145,3 +200,134 @@ func TestLogSquared(t *testing.T) {
 		t.Errorf("Error marshaling and unmarshaling")
 	}
 }
+
+func TestCrossEntropy(t *testing.T) {
+	prediction := []float64{0.2, 1.5, -0.3}
+	truth := []float64{0, 1, 0}
+	probs := make([]float64, len(prediction))
+	activator.Softmax{}.Activate(prediction, probs)
+	trueloss := -math.Log(probs[1])
+	derivative := []float64{0, 0, 0}
+
+	c := CrossEntropy{}
+	loss := c.LossAndDeriv(prediction, truth, derivative)
+	if math.Abs(loss-trueloss) > TOL {
+		t.Errorf("Loss doesn't match. %v found, %v expected", loss, trueloss)
+	}
+	truth = []float64{0.3, 0.5, 0.2}
+	derivative, fdDerivative := finiteDifferenceLosser(c, prediction, truth)
+	if !floats.EqualApprox(derivative, fdDerivative, FDTol) {
+		t.Errorf("Derivative doesn't match. \n deriv: %v \n fdDeriv: %v ", derivative, fdDerivative)
+	}
+
+	// Saturated logits should give a finite loss and a derivative which does not
+	// vanish when the prediction is confidently wrong
+	for _, logits := range [][]float64{{-700, 0}, {-800, 0}} {
+		derivative = make([]float64, 2)
+		loss = c.LossAndDeriv(logits, []float64{1, 0}, derivative)
+		if math.Abs(loss+logits[0]) > TOL {
+			t.Errorf("Loss for saturated logits %v: %v found, %v expected", logits, loss, -logits[0])
+		}
+		if !floats.EqualApprox(derivative, []float64{-1, 1}, TOL) {
+			t.Errorf("Derivative for saturated logits %v: %v found, [-1 1] expected", logits, derivative)
+		}
+	}
+
+	err := common.InterfaceTestMarshalAndUnmarshal(c)
+	if err != nil {
+		t.Errorf("Error marshaling and unmarshaling")
+	}
+}
+
+func TestProbabilityCrossEntropy(t *testing.T) {
+	logits := []float64{0.2, 1.5, -0.3}
+	prediction := make([]float64, len(logits))
+	activator.Softmax{}.Activate(logits, prediction)
+	c := ProbabilityCrossEntropy{}
+	for _, truth := range [][]float64{{0, 1, 0}, {0.3, 0.5, 0.2}} {
+		// The loss of the probabilities is the loss of the logits
+		trueloss := CrossEntropy{}.LossAndDeriv(logits, truth, make([]float64, len(logits)))
+		derivative := make([]float64, len(prediction))
+		loss := c.LossAndDeriv(prediction, truth, derivative)
+		if math.Abs(loss-trueloss) > TOL {
+			t.Errorf("Loss doesn't match. %v found, %v expected", loss, trueloss)
+		}
+		derivative, fdDerivative := finiteDifferenceLosser(c, prediction, truth)
+		if !floats.EqualApprox(derivative, fdDerivative, FDTol) {
+			t.Errorf("Derivative doesn't match. \n deriv: %v \n fdDeriv: %v ", derivative, fdDerivative)
+		}
+	}
+
+	// A probability which underflows gives a finite loss and derivative
+	derivative := make([]float64, 2)
+	loss := c.LossAndDeriv([]float64{0, 1}, []float64{1, 0}, derivative)
+	if math.IsInf(loss, 0) || math.IsNaN(loss) || math.IsInf(derivative[0], 0) || math.IsNaN(derivative[0]) {
+		t.Errorf("Loss or derivative not finite for a zero probability: %v, %v", loss, derivative)
+	}
+
+	err := common.InterfaceTestMarshalAndUnmarshal(c)
+	if err != nil {
+		t.Errorf("Error marshaling and unmarshaling")
+	}
+}
+
+func TestMixtureDensity(t *testing.T) {
+	m := MixtureDensity{Components: 3}
+	nDim := 2
+	prediction := []float64{
+		0.3, -1, 0.5, // log weights
+		0.1, 0.2, -1, 0.5, 2, 1, // means
+		-0.5, 0.1, 0.3, -1, 0.2, 0, // log-variances
+	}
+	if m.NumOutputs(nDim) != len(prediction) {
+		t.Errorf("Wrong number of outputs")
+	}
+	truth := []float64{0.4, -0.3}
+
+	// Compare the loss with the density found directly from the mixture
+	weights, means, variances := m.Mixture(prediction)
+	if math.Abs(floats.Sum(weights)-1) > TOL {
+		t.Errorf("Weights do not sum to one")
+	}
+	var density float64
+	for i := range weights {
+		p := weights[i]
+		for j, y := range truth {
+			diff := y - means[i][j]
+			p *= math.Exp(-diff*diff/(2*variances[i][j])) / math.Sqrt(2*math.Pi*variances[i][j])
+		}
+		density += p
+	}
+	derivative := make([]float64, len(prediction))
+	loss := m.LossAndDeriv(prediction, truth, derivative)
+	if math.Abs(loss+math.Log(density)) > 1e-12 {
+		t.Errorf("Loss doesn't match. %v found, %v expected", loss, -math.Log(density))
+	}
+
+	derivative = make([]float64, len(prediction))
+	m.LossAndDeriv(prediction, truth, derivative)
+	fdDerivative := make([]float64, len(prediction))
+	d := make([]float64, len(prediction))
+	for i := range prediction {
+		prediction[i] += FDStep
+		loss1 := m.LossAndDeriv(prediction, truth, d)
+		prediction[i] -= 2 * FDStep
+		loss2 := m.LossAndDeriv(prediction, truth, d)
+		prediction[i] += FDStep
+		fdDerivative[i] = (loss1 - loss2) / (2 * FDStep)
+	}
+	if !floats.EqualApprox(derivative, fdDerivative, FDTol) {
+		t.Errorf("Derivative doesn't match. \n deriv: %v \n fdDeriv: %v ", derivative, fdDerivative)
+	}
+
+	// Far from all of the components, the loss should still be finite
+	loss = m.LossAndDeriv(prediction, []float64{1e3, -1e3}, derivative)
+	if math.IsInf(loss, 0) || math.IsNaN(loss) {
+		t.Errorf("Loss not finite far from the components: %v", loss)
+	}
+
+	err := common.InterfaceTestMarshalAndUnmarshal(m)
+	if err != nil {
+		t.Errorf("Error marshaling and unmarshaling")
+	}
+}
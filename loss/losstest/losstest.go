@@ -0,0 +1,105 @@
+// Package losstest checks that implementations of loss.Losser satisfy the
+// contract of the interface, so that nets which use them can be saved and loaded.
+// The derivatives of a Losser can be checked with package gradcheck.
+package losstest
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math"
+	"testing"
+
+	"github.com/btracey/nnet/common"
+	"github.com/btracey/nnet/loss"
+	"github.com/gonum/floats"
+)
+
+// Test checks the Losser at each pair of predictions and truths. It checks that
+//   - LossAndDeriv does not modify the prediction or the truth
+//   - The loss and derivative are finite, and are the same when computed twice
+//   - The Losser is the same after JSON encoding through common.InterfaceMarshaler
+//     (so the type must be registered with common.Register) and after gob encoding
+//     as a loss.Losser (so the type must be registered with gob.Register)
+func Test(t testing.TB, l loss.Losser, predictions, truths [][]float64) {
+	if len(predictions) != len(truths) {
+		panic("losstest: length mismatch")
+	}
+	for i := range predictions {
+		pred := append([]float64(nil), predictions[i]...)
+		truth := append([]float64(nil), truths[i]...)
+		deriv := make([]float64, len(pred))
+		v := l.LossAndDeriv(pred, truth, deriv)
+		if !floats.Equal(pred, predictions[i]) {
+			t.Errorf("losstest: %T: LossAndDeriv modified the prediction", l)
+		}
+		if !floats.Equal(truth, truths[i]) {
+			t.Errorf("losstest: %T: LossAndDeriv modified the truth", l)
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			t.Errorf("losstest: %T: loss is %v at prediction %v and truth %v", l, v, pred, truth)
+		}
+		for _, d := range deriv {
+			if math.IsNaN(d) || math.IsInf(d, 0) {
+				t.Errorf("losstest: %T: derivative is %v at prediction %v and truth %v", l, deriv, pred, truth)
+				break
+			}
+		}
+		deriv2 := make([]float64, len(pred))
+		v2 := l.LossAndDeriv(pred, truth, deriv2)
+		if v2 != v || !floats.Equal(deriv2, deriv) {
+			t.Errorf("losstest: %T: loss and derivative changed when computed again", l)
+		}
+	}
+
+	im := &common.InterfaceMarshaler{I: l}
+	b, err := im.MarshalJSON()
+	if err != nil {
+		t.Errorf("losstest: %T: error marshaling JSON: %v", l, err)
+	} else {
+		im2 := &common.InterfaceMarshaler{}
+		err = im2.UnmarshalJSON(b)
+		if err != nil {
+			t.Errorf("losstest: %T: error unmarshaling JSON: %v", l, err)
+		} else {
+			checkSame(t, "JSON", l, im2.I, predictions, truths)
+		}
+	}
+
+	w := &bytes.Buffer{}
+	err = gob.NewEncoder(w).Encode(&l)
+	if err != nil {
+		t.Errorf("losstest: %T: error gob encoding: %v", l, err)
+		return
+	}
+	var l2 loss.Losser
+	err = gob.NewDecoder(w).Decode(&l2)
+	if err != nil {
+		t.Errorf("losstest: %T: error gob decoding: %v", l, err)
+		return
+	}
+	checkSame(t, "gob", l, l2, predictions, truths)
+}
+
+// checkSame checks that the decoded Losser has exactly the same loss and derivative as l
+func checkSame(t testing.TB, encoding string, l loss.Losser, decoded interface{}, predictions, truths [][]float64) {
+	l2, ok := decoded.(loss.Losser)
+	if !ok {
+		t.Errorf("losstest: %T: decoded %v is %T, which is not a loss.Losser", l, encoding, decoded)
+		return
+	}
+	if _, ok := l.(loss.HessVecLosser); ok {
+		if _, ok := l2.(loss.HessVecLosser); !ok {
+			t.Errorf("losstest: %T: decoded %v is %T, which is not a loss.HessVecLosser", l, encoding, l2)
+		}
+	}
+	for i := range predictions {
+		deriv := make([]float64, len(predictions[i]))
+		deriv2 := make([]float64, len(predictions[i]))
+		v := l.LossAndDeriv(predictions[i], truths[i], deriv)
+		v2 := l2.LossAndDeriv(predictions[i], truths[i], deriv2)
+		if v != v2 || !floats.Equal(deriv, deriv2) {
+			t.Errorf("losstest: %T: loss changed after %v decoding. Expected: %v, found %v", l, encoding, v, v2)
+			return
+		}
+	}
+}
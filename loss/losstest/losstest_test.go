@@ -0,0 +1,81 @@
+package losstest
+
+import (
+	"encoding/gob"
+	"math/rand"
+	"testing"
+
+	"github.com/btracey/nnet/common"
+	"github.com/btracey/nnet/loss"
+)
+
+func init() {
+	gob.Register(modifier{})
+	common.Register(modifier{})
+}
+
+func randomPoints(n, dim int, positive bool) [][]float64 {
+	points := make([][]float64, n)
+	for i := range points {
+		points[i] = make([]float64, dim)
+		for j := range points[i] {
+			if positive {
+				points[i][j] = 0.1 + rand.Float64()
+			} else {
+				points[i][j] = rand.NormFloat64()
+			}
+		}
+	}
+	return points
+}
+
+func TestLossers(t *testing.T) {
+	nSamples := 10
+	for _, l := range []loss.Losser{
+		loss.SquaredDistance{},
+		loss.ManhattanDistance{},
+		loss.RelativeSquared(0.1),
+		loss.LogSquared{},
+	} {
+		Test(t, l, randomPoints(nSamples, 3, false), randomPoints(nSamples, 3, false))
+	}
+	Test(t, loss.CrossEntropy{}, randomPoints(nSamples, 4, false), randomPoints(nSamples, 4, true))
+	m := loss.MixtureDensity{Components: 3}
+	Test(t, m, randomPoints(nSamples, m.NumOutputs(2), false), randomPoints(nSamples, 2, false))
+}
+
+// unregistered is a Losser which has not been registered with common or gob
+type unregistered struct {
+	loss.SquaredDistance
+}
+
+// modifier is a (registered) Losser which modifies the prediction
+type modifier struct {
+	loss.SquaredDistance
+}
+
+func (m modifier) LossAndDeriv(prediction, truth, derivative []float64) float64 {
+	v := m.SquaredDistance.LossAndDeriv(prediction, truth, derivative)
+	prediction[0] = 0
+	return v
+}
+
+func TestBadLossers(t *testing.T) {
+	for _, l := range []loss.Losser{unregistered{}, modifier{}} {
+		ft := &fakeT{}
+		Test(ft, l, randomPoints(3, 2, false), randomPoints(3, 2, false))
+		if !ft.failed {
+			t.Errorf("%T passed", l)
+		}
+	}
+}
+
+// fakeT records whether a test failed
+type fakeT struct {
+	testing.TB
+	failed bool
+}
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.failed = true
+}
@@ -0,0 +1,402 @@
+package nnet
+
+import (
+	"math"
+	"math/rand"
+)
+
+// BatchNorm normalizes the combinations of the neurons of a layer before they are
+// activated, as in Ioffe and Szegedy, "Batch normalization: Accelerating deep network
+// training by reducing internal covariate shift", 2015. The normalized combinations are
+// multiplied by gamma and shifted by beta, which are parameters of the net. They are
+// stored after the parameters of the neurons of the layer, first all of the gammas
+// and then all of the betas.
+//
+// When the Mode of the net is Train, SeqLossDeriv normalizes the combinations by their
+// mean and variance over all of the samples. The batch is the chunk, so the derivative
+// from ParLossDeriv and Evaluator depends on the chunk size (but not on GOMAXPROCS).
+// Otherwise, and always in Predict, the running statistics are used instead.
+// The running statistics are not trainable. ParLossDerivStatistics and Evaluator.LossDeriv
+// in the Train mode only return the statistics over all of their samples (pooled over
+// the chunks in the order of the chunks), and UpdateRunningStatistics updates the running
+// statistics from them with a moving average, where Momentum is the weight of the
+// returned statistics. This way an optimizer which evaluates several points per step
+// (as in a line search) updates the running statistics once per step.
+type BatchNorm struct {
+	Epsilon     float64   // Added to the variance for numerical stability
+	Momentum    float64   // Weight of the newest batch in the running statistics
+	RunningMean []float64 // Running mean of the combination of each neuron
+	RunningVar  []float64 // Running variance of the combination of each neuron
+}
+
+// NewBatchNorm returns a BatchNorm with the default Epsilon and Momentum. The running
+// statistics are set to zero mean and unit variance when the net is created
+func NewBatchNorm() *BatchNorm {
+	return &BatchNorm{
+		Epsilon:  1e-5,
+		Momentum: 0.1,
+	}
+}
+
+// init sets the running statistics to zero mean and unit variance if they do
+// not have one entry per neuron
+func (b *BatchNorm) init(nNeurons int) {
+	if len(b.RunningMean) == nNeurons && len(b.RunningVar) == nNeurons {
+		return
+	}
+	b.RunningMean = make([]float64, nNeurons)
+	b.RunningVar = make([]float64, nNeurons)
+	for i := range b.RunningVar {
+		b.RunningVar[i] = 1
+	}
+}
+
+// hasBatchNorm returns true if any of the layers have batch normalization
+func hasBatchNorm(layers []Layer) bool {
+	for i := range layers {
+		if layers[i].BatchNorm != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// batchNormParameters returns the gammas and the betas of the layer
+func (l *Layer) batchNormParameters(parameters [][]float64) (gamma, beta []float64) {
+	n := len(l.Neurons)
+	return parameters[n][:n], parameters[n][n:]
+}
+
+// combine stores the combinations of all of the neurons of the layer (before
+// the normalization) into combinations
+func (l *Layer) combine(parameters [][]float64, inputs, combinations []float64) {
+	for i, neuron := range l.Neurons {
+		combinations[i] = neuron.Combine(parameters[i], inputs)
+	}
+}
+
+// newUnnormalizedMemory makes memory for the combinations before the normalization
+// of the layers with batch normalization. It is nil for the other layers.
+func (net *Net) newUnnormalizedMemory() [][]float64 {
+	if !hasBatchNorm(net.layers) {
+		return nil
+	}
+	mem := make([][]float64, len(net.layers))
+	for i, layer := range net.layers {
+		if layer.BatchNorm != nil {
+			mem[i] = make([]float64, len(layer.Neurons))
+		}
+	}
+	return mem
+}
+
+// normalize normalizes the combinations in place with the running statistics. Does
+// nothing if the layer does not have batch normalization
+func (l *Layer) normalize(parameters [][]float64, combinations []float64) {
+	b := l.BatchNorm
+	if b == nil {
+		return
+	}
+	gamma, beta := l.batchNormParameters(parameters)
+	for j, comb := range combinations {
+		combinations[j] = gamma[j]*(comb-b.RunningMean[j])/math.Sqrt(b.RunningVar[j]+b.Epsilon) + beta[j]
+	}
+}
+
+// dLossDUnnormalized changes the derivative of the loss with respect to the normalized
+// combinations into the derivative with respect to the combinations of the neurons
+// in place, as for normalize. The derivative of the loss with respect to gamma and
+// beta is stored into dLossDBatchNormParam if it is not nil.
+func (l *Layer) dLossDUnnormalized(parameters [][]float64, combinations, dLossDCombination, dLossDBatchNormParam []float64) {
+	b := l.BatchNorm
+	n := len(l.Neurons)
+	gamma, _ := l.batchNormParameters(parameters)
+	for j, d := range dLossDCombination {
+		sigma := math.Sqrt(b.RunningVar[j] + b.Epsilon)
+		if dLossDBatchNormParam != nil {
+			dLossDBatchNormParam[j] = d * (combinations[j] - b.RunningMean[j]) / sigma
+			dLossDBatchNormParam[n+j] = d
+		}
+		dLossDCombination[j] = d * gamma[j] / sigma
+	}
+}
+
+// batchMemory is the temporary memory for computing the loss and derivative of
+// all of the samples at once, which is needed when the samples are coupled through
+// the batch statistics. The memories are indexed by sample, then layer and then neuron.
+type batchMemory struct {
+	combinations [][][]float64    // The combinations before the normalization
+	normalized   [][][]float64    // The same as combinations for layers without batch normalization
+	outputs      [][][]float64    // The outputs before dropout
+	dLossDOutput [][][]float64    // Also stores the derivative with respect to the combinations
+	dropout      []*dropoutMemory // nil if the net does not have dropout
+	visible      [][][]float64    // The outputs after dropout, which are the inputs of the later layers
+
+	*BatchStatistics
+}
+
+// BatchStatistics are the batch statistics of batch normalization over the samples of
+// an evaluation in the Train mode. They are returned by ParLossDerivStatistics and
+// Evaluator.BatchStatistics for UpdateRunningStatistics.
+type BatchStatistics struct {
+	nSamples int         // The number of samples of the batch statistics
+	mean     [][]float64 // The batch mean and variance of each layer (nil without batch normalization)
+	variance [][]float64
+}
+
+func (net *Net) newBatchMemory(nSamples int) *batchMemory {
+	m := &batchMemory{
+		combinations: make([][][]float64, nSamples),
+		normalized:   make([][][]float64, nSamples),
+		outputs:      make([][][]float64, nSamples),
+		dLossDOutput: make([][][]float64, nSamples),
+		visible:      make([][][]float64, nSamples),
+
+		BatchStatistics: net.newBatchStatistics(),
+	}
+	dropout := net.hasDropout()
+	if dropout {
+		m.dropout = make([]*dropoutMemory, nSamples)
+	}
+	for s := 0; s < nSamples; s++ {
+		m.combinations[s] = net.NewPerNeuronMemory()
+		m.normalized[s] = net.NewPerNeuronMemory()
+		m.outputs[s] = net.NewPerNeuronMemory()
+		m.dLossDOutput[s] = net.NewPerNeuronMemory()
+		for l, layer := range net.layers {
+			if layer.BatchNorm == nil {
+				m.normalized[s][l] = m.combinations[s][l]
+			}
+		}
+		m.visible[s] = m.outputs[s]
+		if dropout {
+			m.dropout[s] = net.newDropoutMemory()
+			m.visible[s] = m.dropout[s].maskedOutputs(m.outputs[s])
+		}
+	}
+	return m
+}
+
+// newBatchStatistics returns the memory for the batch statistics of the net
+func (net *Net) newBatchStatistics() *BatchStatistics {
+	m := &BatchStatistics{
+		mean:     make([][]float64, len(net.layers)),
+		variance: make([][]float64, len(net.layers)),
+	}
+	for l, layer := range net.layers {
+		if layer.BatchNorm != nil {
+			m.mean[l] = make([]float64, len(layer.Neurons))
+			m.variance[l] = make([]float64, len(layer.Neurons))
+		}
+	}
+	return m
+}
+
+// copyStatistics copies the batch statistics of src into m
+func (m *BatchStatistics) copyStatistics(src *BatchStatistics) {
+	m.nSamples = src.nSamples
+	for l := range m.mean {
+		copy(m.mean[l], src.mean[l])
+		copy(m.variance[l], src.variance[l])
+	}
+}
+
+// seqLossDerivBatch is SeqLossDeriv for nets with batch normalization in the Train
+// mode. All of the samples are processed together so the combinations can be normalized
+// by the batch statistics. Dropout masks are also applied if the net has dropout.
+func seqLossDerivBatch(inputs, truths [][]float64, weights []float64, net *Net, dLossDParam [][][]float64, p *ParLossDerivMemory) (loss float64) {
+	nSamples := len(inputs)
+	if p.batch == nil || len(p.batch.combinations) < nSamples {
+		p.batch = net.newBatchMemory(nSamples)
+	}
+	if p.batch.dropout != nil && p.rand == nil {
+		p.rand = rand.New(rand.NewSource(net.dropoutSeed()))
+	}
+	m := p.batch
+	m.nSamples = nSamples
+	layers := net.layers
+	parameters := net.parameters
+	nLayers := len(layers)
+
+	layerInputs := p.derivTmp.layerInputs
+	dLossDLayerInputs := p.derivTmp.dLossDLayerInput
+
+	if m.dropout != nil {
+		for s := 0; s < nSamples; s++ {
+			m.dropout[s].sample(layers, p.rand)
+		}
+	}
+
+	// Forward pass
+	for l := range layers {
+		layer := &layers[l]
+		for s := 0; s < nSamples; s++ {
+			in := net.layerInput(l, inputs[s], m.visible[s], layerInputs)
+			for j, neuron := range layer.Neurons {
+				m.combinations[s][l][j] = neuron.Combine(parameters[l][j], in)
+			}
+		}
+		if b := layer.BatchNorm; b != nil {
+			gamma, beta := layer.batchNormParameters(parameters[l])
+			mean, variance := m.mean[l], m.variance[l]
+			for j := range mean {
+				var sum float64
+				for s := 0; s < nSamples; s++ {
+					sum += m.combinations[s][l][j]
+				}
+				mean[j] = sum / float64(nSamples)
+				var sumSq float64
+				for s := 0; s < nSamples; s++ {
+					diff := m.combinations[s][l][j] - mean[j]
+					sumSq += diff * diff
+				}
+				variance[j] = sumSq / float64(nSamples)
+				sigma := math.Sqrt(variance[j] + b.Epsilon)
+				for s := 0; s < nSamples; s++ {
+					m.normalized[s][l][j] = gamma[j]*(m.combinations[s][l][j]-mean[j])/sigma + beta[j]
+				}
+			}
+		}
+		for s := 0; s < nSamples; s++ {
+			layer.activate(m.normalized[s][l], m.outputs[s][l])
+			if m.dropout != nil {
+				if mask := m.dropout[s].masks[l]; mask != nil {
+					for j, val := range m.outputs[s][l] {
+						m.dropout[s].dropped[l][j] = val * mask[j]
+					}
+				}
+			}
+		}
+	}
+
+	// Loss and derivative with respect to the predictions
+	lowest := net.lowestTrainableLayer()
+	dLossDPred := p.derivTmp.dLossDPred
+	for s := 0; s < nSamples; s++ {
+		prediction := m.visible[s][nLayers-1]
+		loss += weights[s] * net.Losser.LossAndDeriv(prediction, truths[s], dLossDPred)
+		for j, val := range dLossDPred {
+			m.dLossDOutput[s][nLayers-1][j] = weights[s] * val
+		}
+		net.zeroDLossDOutput(lowest, m.dLossDOutput[s])
+	}
+
+	// Backward pass
+	dLossDInput := p.derivTmp.dLossDInput
+	dLossDParamTmp := p.dLossDParamTmp
+	for l := nLayers - 1; l >= lowest; l-- {
+		layer := &layers[l]
+		for s := 0; s < nSamples; s++ {
+			if m.dropout != nil {
+				if mask := m.dropout[s].masks[l]; mask != nil {
+					for j := range m.dLossDOutput[s][l] {
+						m.dLossDOutput[s][l][j] *= mask[j]
+					}
+				}
+			}
+			layer.dLossDCombination(m.normalized[s][l], m.outputs[s][l], m.dLossDOutput[s][l], m.dLossDOutput[s][l])
+		}
+		if b := layer.BatchNorm; b != nil {
+			// With y = gamma * xhat + beta and xhat = (x - mean) / sigma,
+			// dLoss/dx_s = gamma / sigma * (dLoss/dy_s - mean_s(dLoss/dy) - xhat_s * mean_s(dLoss/dy * xhat))
+			n := len(layer.Neurons)
+			gamma, _ := layer.batchNormParameters(parameters[l])
+			dLossDBatchNormParam := dLossDParam[l][n]
+			for j := 0; j < n; j++ {
+				sigma := math.Sqrt(m.variance[l][j] + b.Epsilon)
+				var sumD, sumDXHat float64
+				for s := 0; s < nSamples; s++ {
+					xHat := (m.combinations[s][l][j] - m.mean[l][j]) / sigma
+					sumD += m.dLossDOutput[s][l][j]
+					sumDXHat += m.dLossDOutput[s][l][j] * xHat
+				}
+				dLossDBatchNormParam[j] = sumDXHat
+				dLossDBatchNormParam[n+j] = sumD
+				meanD := sumD / float64(nSamples)
+				meanDXHat := sumDXHat / float64(nSamples)
+				for s := 0; s < nSamples; s++ {
+					xHat := (m.combinations[s][l][j] - m.mean[l][j]) / sigma
+					m.dLossDOutput[s][l][j] = gamma[j] / sigma * (m.dLossDOutput[s][l][j] - meanD - xHat*meanDXHat)
+				}
+			}
+		}
+		for j := range layer.Neurons {
+			for k := range dLossDParam[l][j] {
+				dLossDParam[l][j][k] = 0
+			}
+		}
+		for s := 0; s < nSamples; s++ {
+			in := net.layerInput(l, inputs[s], m.visible[s], layerInputs)
+			for j, neuron := range layer.Neurons {
+				dLossNeuronCombination(neuron, parameters[l][j], in, m.combinations[s][l][j], m.dLossDOutput[s][l][j], dLossDParamTmp[l][j], dLossDInput[l][j])
+				for k, val := range dLossDParamTmp[l][j] {
+					dLossDParam[l][j][k] += val
+				}
+			}
+			if dLossDLayerInput := net.dLossDLayerInput(l, lowest, false, m.dLossDOutput[s], dLossDLayerInputs); dLossDLayerInput != nil {
+				DInputToDOutput(dLossDInput[l], dLossDLayerInput)
+				net.scatter(l, lowest, dLossDLayerInput, m.dLossDOutput[s], nil)
+			}
+		}
+	}
+	return loss
+}
+
+// poolBatchStatistics pools the batch statistics of the chunks, in the order of
+// the chunks, into dst. Returns nil if there are no samples and dst otherwise
+func (net *Net) poolBatchStatistics(dst *BatchStatistics, batches []*BatchStatistics) *BatchStatistics {
+	dst.nSamples = 0
+	for _, m := range batches {
+		dst.nSamples += m.nSamples
+	}
+	if dst.nSamples == 0 {
+		return nil
+	}
+	nTotal := float64(dst.nSamples)
+	for l, layer := range net.layers {
+		if layer.BatchNorm == nil {
+			continue
+		}
+		for j := range layer.Neurons {
+			var mean float64
+			for _, m := range batches {
+				mean += float64(m.nSamples) * m.mean[l][j]
+			}
+			mean /= nTotal
+			var variance float64
+			for _, m := range batches {
+				diff := m.mean[l][j] - mean
+				variance += float64(m.nSamples) * (m.variance[l][j] + diff*diff)
+			}
+			dst.mean[l][j] = mean
+			dst.variance[l][j] = variance / nTotal
+		}
+	}
+	return dst
+}
+
+// UpdateRunningStatistics updates the running statistics of the layers with batch
+// normalization with the batch statistics m of an evaluation in the Train mode (see
+// BatchNorm). It should be called once per step of the optimization. Does nothing
+// if m is nil.
+func (net *Net) UpdateRunningStatistics(m *BatchStatistics) {
+	if m == nil || m.nSamples == 0 {
+		return
+	}
+	nTotal := m.nSamples
+	for l, layer := range net.layers {
+		b := layer.BatchNorm
+		if b == nil {
+			continue
+		}
+		for j := range layer.Neurons {
+			variance := m.variance[l][j]
+			// Use the unbiased variance for the running variance
+			if nTotal > 1 {
+				variance *= float64(nTotal) / float64(nTotal-1)
+			}
+			b.RunningMean[j] = (1-b.Momentum)*b.RunningMean[j] + b.Momentum*m.mean[l][j]
+			b.RunningVar[j] = (1-b.Momentum)*b.RunningVar[j] + b.Momentum*variance
+		}
+	}
+}
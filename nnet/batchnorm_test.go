@@ -0,0 +1,278 @@
+package nnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/btracey/nnet/scale"
+	"github.com/gonum/floats"
+)
+
+func newBatchNormNet(nInputs, nOutputs int) *Net {
+	layers := make([]Layer, 3)
+	layers[0].Neurons = []Neuron{&TanhNeuron, &TanhNeuron, &SigmoidNeuron, &TanhNeuron}
+	layers[0].BatchNorm = NewBatchNorm()
+	layers[1].Neurons = []Neuron{&TanhNeuron, &TanhNeuron, &TanhNeuron}
+	layers[1].BatchNorm = NewBatchNorm()
+	layers[2].Neurons = make([]Neuron, nOutputs)
+	for j := range layers[2].Neurons {
+		layers[2].Neurons[j] = &LinearNeuron
+	}
+	net := newTestNet(nInputs, layers, &scale.Normal{}, &scale.Normal{})
+
+	// Make the gammas, betas and running statistics non-trivial
+	for _, l := range []int{0, 1} {
+		gamma, beta := layers[l].batchNormParameters(net.parameters[l])
+		for j := range gamma {
+			gamma[j] = 0.5 + rand.Float64()
+			beta[j] = rand.NormFloat64()
+			layers[l].BatchNorm.RunningMean[j] = rand.NormFloat64()
+			layers[l].BatchNorm.RunningVar[j] = 0.5 + rand.Float64()
+		}
+	}
+	return net
+}
+
+// batchNormFD compares the derivative from SeqLossDeriv with finite differences
+func batchNormFD(t *testing.T, net *Net, inputs, truths [][]float64, weights []float64, name string) {
+	seqLossDeriv := func(dLossDParam [][][]float64) float64 {
+		p := NewParLossDerivMemory(net)
+		p.rand = rand.New(rand.NewSource(1))
+		return SeqLossDeriv(inputs, truths, weights, net, dLossDParam, p)
+	}
+	dLossDParam, dLossFlat := net.NewPerParameterMemory()
+	seqLossDeriv(dLossDParam)
+
+	params := make([]float64, net.TotalNumParameters())
+	net.ParametersSlice(params)
+	fdDLossFlat := make([]float64, len(params))
+	d, _ := net.NewPerParameterMemory()
+	for i := range params {
+		params[i] += netFDStep
+		net.SetParametersSlice(params)
+		loss1 := seqLossDeriv(d)
+		params[i] -= 2 * netFDStep
+		net.SetParametersSlice(params)
+		loss2 := seqLossDeriv(d)
+		params[i] += netFDStep
+		net.SetParametersSlice(params)
+		fdDLossFlat[i] = (loss1 - loss2) / (2 * netFDStep)
+	}
+	for i := range params {
+		if !floats.EqualWithinAbsOrRel(dLossFlat[i], fdDLossFlat[i], 1e-5, 1e-5) {
+			t.Errorf("Finite difference doesn't match derivative for %v", name)
+			for i := range dLossFlat {
+				fmt.Println(i, dLossFlat[i], fdDLossFlat[i], dLossFlat[i]-fdDLossFlat[i])
+			}
+			return
+		}
+	}
+}
+
+func TestBatchNormDeriv(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	nSamples := 15
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := RandomSliceOfSlice(nSamples, nOutputs)
+	weights := RandomWeights(nSamples)
+
+	net := newBatchNormNet(nInputs, nOutputs)
+	batchNormFD(t, net, inputs, truths, weights, "train mode")
+
+	net.Mode = Inference
+	batchNormFD(t, net, inputs, truths, weights, "inference mode")
+
+	net.Mode = Train
+	net.layers[1].Neurons[1] = perNeuronSumNeuron{&TanhNeuron}
+	net.layers[0].Dropout = 0.3
+	batchNormFD(t, net, inputs, truths, weights, "train mode with dropout")
+
+	// In the inference mode the loss is the same as for the predictions
+	net.Mode = Inference
+	net.layers[0].Dropout = 0
+	d, _ := net.NewPerParameterMemory()
+	loss := SeqLossDeriv(inputs, truths, weights, net, d, NewParLossDerivMemory(net))
+	var predLoss float64
+	pred := make([]float64, nOutputs)
+	tmp := net.NewPredictTmpMemory()
+	for i := range inputs {
+		Predict(inputs[i], net, pred, tmp.combinations, tmp.outputs)
+		predLoss += weights[i] * net.Losser.LossAndDeriv(pred, truths[i], make([]float64, nOutputs))
+	}
+	if !floats.EqualWithinAbsOrRel(loss, predLoss, 1e-12, 1e-12) {
+		t.Errorf("Inference loss does not match the predictions: %v, %v", loss, predLoss)
+	}
+}
+
+func TestBatchNormRunningStatistics(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	nSamples := 40
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := RandomSliceOfSlice(nSamples, nOutputs)
+	weights := RandomWeights(nSamples)
+
+	net := newBatchNormNet(nInputs, nOutputs)
+	b := net.layers[0].BatchNorm
+	b.Momentum = 1
+
+	// The running statistics of the first layer are the statistics of the
+	// combinations over all of the samples
+	combs := make([][]float64, nSamples)
+	for i, input := range inputs {
+		combs[i] = make([]float64, len(net.layers[0].Neurons))
+		net.layers[0].combine(net.parameters[0], input, combs[i])
+	}
+	d, _ := net.NewPerParameterMemory()
+	stats := runningStatistics(net)
+	// The statistics are only returned, so evaluating several times does not change
+	// the running statistics
+	var batch *BatchStatistics
+	for _, reduction := range []Reduction{Unordered, Ordered} {
+		net.Reduction = reduction
+		_, batch = ParLossDerivStatistics(inputs, truths, weights, net, d, 7)
+		if !predictionsMatch(runningStatistics(net), stats, 0) {
+			t.Errorf("Running statistics updated by ParLossDerivStatistics")
+		}
+	}
+	net.UpdateRunningStatistics(batch)
+	for j := range net.layers[0].Neurons {
+		var mean float64
+		for i := range combs {
+			mean += combs[i][j]
+		}
+		mean /= float64(nSamples)
+		var variance float64
+		for i := range combs {
+			variance += (combs[i][j] - mean) * (combs[i][j] - mean)
+		}
+		variance /= float64(nSamples - 1)
+		if !floats.EqualWithinAbsOrRel(b.RunningMean[j], mean, 1e-12, 1e-12) {
+			t.Errorf("Running mean mismatch for neuron %v: %v, %v", j, b.RunningMean[j], mean)
+		}
+		if !floats.EqualWithinAbsOrRel(b.RunningVar[j], variance, 1e-12, 1e-12) {
+			t.Errorf("Running variance mismatch for neuron %v: %v, %v", j, b.RunningVar[j], variance)
+		}
+	}
+
+	// No statistics do not update the running statistics
+	stats = runningStatistics(net)
+	net.UpdateRunningStatistics(nil)
+	if !predictionsMatch(runningStatistics(net), stats, 0) {
+		t.Errorf("Running statistics updated without statistics")
+	}
+
+	// The statistics pooled in the order of the chunks do not depend on the reduction
+	net.layers[1].BatchNorm.Momentum = 1
+	net.Reduction = Unordered
+	_, batch = ParLossDerivStatistics(inputs, truths, weights, net, d, 7)
+	net.UpdateRunningStatistics(batch)
+	unordered := runningStatistics(net)
+	net.Reduction = Ordered
+	_, batch = ParLossDerivStatistics(inputs, truths, weights, net, d, 7)
+	net.UpdateRunningStatistics(batch)
+	if !predictionsMatch(runningStatistics(net), unordered, 0) {
+		t.Errorf("Running statistics depend on the reduction")
+	}
+
+	// The running statistics are not recorded in the inference mode
+	net.Mode = Inference
+	mean := make([]float64, len(b.RunningMean))
+	copy(mean, b.RunningMean)
+	_, batch = ParLossDerivStatistics(inputs, truths, weights, net, d, 7)
+	if batch != nil {
+		t.Errorf("Batch statistics returned in the inference mode")
+	}
+	net.UpdateRunningStatistics(batch)
+	if !floats.Equal(mean, b.RunningMean) {
+		t.Errorf("Running statistics updated in the inference mode")
+	}
+}
+
+// Concurrent evaluations of the same net each get their own batch statistics
+func TestBatchNormConcurrentStatistics(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	net := newBatchNormNet(nInputs, nOutputs)
+	nCallers := 4
+	inputs := make([][][]float64, nCallers)
+	truths := make([][][]float64, nCallers)
+	weights := make([][]float64, nCallers)
+	want := make([]*BatchStatistics, nCallers)
+	for i := range inputs {
+		nSamples := 10 + 5*i
+		inputs[i] = RandomSliceOfSlice(nSamples, nInputs)
+		truths[i] = RandomSliceOfSlice(nSamples, nOutputs)
+		weights[i] = RandomWeights(nSamples)
+		d, _ := net.NewPerParameterMemory()
+		_, want[i] = ParLossDerivStatistics(inputs[i], truths[i], weights[i], net, d, 3)
+	}
+
+	got := make([]*BatchStatistics, nCallers)
+	var wg sync.WaitGroup
+	for i := range inputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d, _ := net.NewPerParameterMemory()
+			_, got[i] = ParLossDerivStatistics(inputs[i], truths[i], weights[i], net, d, 3)
+		}(i)
+	}
+	wg.Wait()
+	for i := range got {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("Batch statistics of caller %v mismatch", i)
+		}
+	}
+}
+
+func TestBatchNormSerialize(t *testing.T) {
+	net := newBatchNormNet(3, 2)
+	inputs := RandomSliceOfSlice(10, 3)
+	pred1, err := net.PredictSlice(inputs)
+	if err != nil {
+		t.Fatalf("Error predicting: %v", err)
+	}
+
+	b, err := json.Marshal(net)
+	if err != nil {
+		t.Fatalf("Error marshaling: %v", err)
+	}
+	net2 := &Net{}
+	if err := json.Unmarshal(b, net2); err != nil {
+		t.Fatalf("Error unmarshaling: %v", err)
+	}
+	if !reflect.DeepEqual(net, net2) {
+		t.Errorf("Nets don't match after JSON")
+	}
+
+	b, err = net.GobEncode()
+	if err != nil {
+		t.Fatalf("Error gob encoding: %v", err)
+	}
+	net3 := &Net{}
+	if err := net3.GobDecode(b); err != nil {
+		t.Fatalf("Error gob decoding: %v", err)
+	}
+	if !reflect.DeepEqual(net.layers, net3.layers) {
+		t.Errorf("Layers don't match after gob")
+	}
+
+	for _, n := range []*Net{net2, net3} {
+		pred2, err := n.PredictSlice(inputs)
+		if err != nil {
+			t.Fatalf("Error predicting: %v", err)
+		}
+		for i := range pred1 {
+			if !floats.EqualApprox(pred1[i], pred2[i], 1e-14) {
+				t.Errorf("Predictions don't match after serializing")
+				return
+			}
+		}
+	}
+}
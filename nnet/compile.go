@@ -0,0 +1,344 @@
+package nnet
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/btracey/nnet/activator"
+	"github.com/btracey/nnet/scale"
+)
+
+// Precision is the precision of the weights of a Compiled net
+type Precision int
+
+const (
+	// Float32 stores the weights and biases as float32
+	Float32 Precision = iota
+	// Int8 stores the weights as int8 with one symmetric scale per layer, so
+	// the weight is the scale times the stored value. The biases are float32.
+	Int8
+)
+
+func (p Precision) String() string {
+	switch p {
+	case Float32:
+		return "Float32"
+	case Int8:
+		return "Int8"
+	}
+	return fmt.Sprintf("Precision(%d)", int(p))
+}
+
+// Compiled is a read-only net for inference with low-precision weights, compiled from
+// a Net with Compile. The scaling of the inputs and the unscaling of the outputs are
+// stored as float32 factors, and the batch normalization of each layer (with the
+// running statistics) as a float32 factor per neuron and the biases. They are applied
+// separately from the weights, so the quantization of the weights of a layer does not
+// depend on the range of the inputs or on the batch statistics. The sums are computed
+// in float64, so only the storage of the parameters is in low precision.
+type Compiled struct {
+	precision Precision
+	nInputs   int
+	nOutputs  int
+	layers    []compiledLayer
+	inScale   []float32 // The scaled input is inScale*x + inShift
+	inShift   []float32
+	outScale  []float32 // The unscaled output is outScale*y + outShift
+	outShift  []float32
+}
+
+type compiledLayer struct {
+	nInputs    int
+	weights32  []float32                // Row-major, one row per neuron. nil for Int8
+	weights8   []int8                   // Row-major, one row per neuron. nil for Float32
+	scale      float64                  // The scale of the int8 weights
+	rowScale   []float32                // The factor of the batch normalization of each neuron. nil without batch normalization
+	biases     []float32                // The biases with the shift of the batch normalization
+	activators []activator.Activator    // The activator of each neuron, if activation is nil
+	activation activator.LayerActivator // The activation of the layer
+}
+
+// Compile compiles the net into a Compiled net with weights of the given precision.
+// The net must be sequential, all of the neurons must be SumNeurons, and the scalers
+// must be scale.None, scale.Linear or scale.Normal (which are affine in each dimension)
+// and must be set.
+// Dropout is not applied, as in Predict.
+func Compile(net *Net, precision Precision) (*Compiled, error) {
+	if precision != Float32 && precision != Int8 {
+		return nil, fmt.Errorf("nnet: unknown precision %v", precision)
+	}
+	if !net.isSequential() {
+		return nil, errors.New("nnet: cannot compile a graph net")
+	}
+	if net.InputScaler == nil || !net.InputScaler.IsScaled() || net.OutputScaler == nil || !net.OutputScaler.IsScaled() {
+		return nil, errors.New("nnet: scale must be set before compiling")
+	}
+	inScale, inShift, err := affineScale(net.InputScaler, net.nInputs, true)
+	if err != nil {
+		return nil, fmt.Errorf("nnet: cannot fold the input scaler: %v", err)
+	}
+	outScale, outShift, err := affineScale(net.OutputScaler, net.nOutputs, false)
+	if err != nil {
+		return nil, fmt.Errorf("nnet: cannot fold the output scaler: %v", err)
+	}
+
+	c := &Compiled{
+		precision: precision,
+		nInputs:   net.nInputs,
+		nOutputs:  net.nOutputs,
+		layers:    make([]compiledLayer, len(net.layers)),
+		inScale:   toFloat32(inScale),
+		inShift:   toFloat32(inShift),
+		outScale:  toFloat32(outScale),
+		outShift:  toFloat32(outShift),
+	}
+	layerInputs := net.layerInputs()
+	for i := range net.layers {
+		layer := &net.layers[i]
+		if !layer.isSumLayer() {
+			return nil, fmt.Errorf("nnet: layer %v does not only have SumNeurons", i)
+		}
+		nIn := layerInputs[i]
+		nNeurons := len(layer.Neurons)
+
+		weights := make([]float64, nNeurons*nIn)
+		biases := make([]float64, nNeurons)
+		for j := range layer.Neurons {
+			p := net.parameters[i][j]
+			copy(weights[j*nIn:(j+1)*nIn], p[:nIn])
+			biases[j] = p[nIn]
+		}
+		// The batch normalization is g*(w·x + bias - mean) + beta, so it is a factor
+		// of the sum and a shift of the bias
+		var rowScale []float64
+		if b := layer.BatchNorm; b != nil {
+			gamma, beta := layer.batchNormParameters(net.parameters[i])
+			rowScale = make([]float64, nNeurons)
+			for j := range biases {
+				g := gamma[j] / math.Sqrt(b.RunningVar[j]+b.Epsilon)
+				rowScale[j] = g
+				biases[j] = (biases[j]-b.RunningMean[j])*g + beta[j]
+			}
+		}
+
+		cl := compiledLayer{
+			nInputs:    nIn,
+			biases:     toFloat32(biases),
+			activation: layer.Activation,
+		}
+		if rowScale != nil {
+			cl.rowScale = toFloat32(rowScale)
+		}
+		if layer.Activation == nil {
+			cl.activators = make([]activator.Activator, nNeurons)
+			for j, neuron := range layer.Neurons {
+				cl.activators[j] = neuron.(*SumNeuron).Activator
+			}
+		}
+		switch precision {
+		case Float32:
+			cl.weights32 = toFloat32(weights)
+		case Int8:
+			cl.weights8, cl.scale = quantizeInt8(weights)
+		}
+		c.layers[i] = cl
+	}
+	return c, nil
+}
+
+// affineScale returns a and b such that the scaled point is a*x + b if scaling, or
+// the unscaled point if unscaling. The scaler must be None, Linear or Normal.
+func affineScale(s scale.Scaler, dim int, scaling bool) (a, b []float64, err error) {
+	if s.Dimensions() != dim {
+		return nil, nil, fmt.Errorf("scaler has %v dimensions, but the net has %v", s.Dimensions(), dim)
+	}
+	a = make([]float64, dim)
+	b = make([]float64, dim)
+	var shift, width []float64
+	switch s := s.(type) {
+	case *scale.None:
+		for i := range a {
+			a[i] = 1
+		}
+		return a, b, nil
+	case *scale.Linear:
+		shift = s.Min
+		width = make([]float64, dim)
+		for i := range width {
+			width[i] = s.Max[i] - s.Min[i]
+		}
+	case *scale.Normal:
+		shift = s.Mu
+		width = s.Sigma
+	default:
+		return nil, nil, fmt.Errorf("scaler %T is not affine", s)
+	}
+	for i := range a {
+		if scaling {
+			a[i] = 1 / width[i]
+			b[i] = -shift[i] / width[i]
+		} else {
+			a[i] = width[i]
+			b[i] = shift[i]
+		}
+	}
+	return a, b, nil
+}
+
+// quantizeInt8 quantizes the weights symmetrically with one scale, so that the
+// largest weight is ±127
+func quantizeInt8(weights []float64) (q []int8, scale float64) {
+	var max float64
+	for _, w := range weights {
+		max = math.Max(max, math.Abs(w))
+	}
+	q = make([]int8, len(weights))
+	if max == 0 {
+		return q, 0
+	}
+	scale = max / 127
+	for i, w := range weights {
+		q[i] = int8(math.Max(-127, math.Min(127, math.Floor(w/scale+0.5))))
+	}
+	return q, scale
+}
+
+func toFloat32(x []float64) []float32 {
+	y := make([]float32, len(x))
+	for i, v := range x {
+		y[i] = float32(v)
+	}
+	return y
+}
+
+// Precision returns the precision of the weights
+func (c *Compiled) Precision() Precision {
+	return c.precision
+}
+
+// Inputs returns the number of inputs of the compiled net
+func (c *Compiled) Inputs() int {
+	return c.nInputs
+}
+
+// Outputs returns the number of outputs of the compiled net
+func (c *Compiled) Outputs() int {
+	return c.nOutputs
+}
+
+// Predict predicts the (unscaled) value at the (unscaled) input. The input is not
+// modified. Predict may be called from multiple goroutines.
+func (c *Compiled) Predict(input []float64) ([]float64, error) {
+	pred := make([]float64, c.nOutputs)
+	if err := c.PredictInto(input, pred); err != nil {
+		return nil, err
+	}
+	return pred, nil
+}
+
+// compiledPool holds the scratch memory of Compiled.PredictInto. It is shared by all
+// compiled nets, and the memory is resliced to fit the net it is used with.
+var compiledPool = sync.Pool{New: func() interface{} { return &compiledScratch{} }}
+
+// compiledScratch is the memory for predicting at one input with a Compiled net.
+// The layers alternate between the two output buffers.
+type compiledScratch struct {
+	input        []float64 // The scaled input
+	combinations []float64
+	outputs      [2][]float64
+}
+
+// PredictInto is Predict, but stores the prediction into pred, which must have
+// length c.Outputs(). The scratch memory is reused between calls, so PredictInto
+// does not allocate.
+func (c *Compiled) PredictInto(input, pred []float64) error {
+	if len(input) != c.nInputs {
+		return InputMismatch{Provided: len(input), Expected: c.nInputs}
+	}
+	if len(pred) != c.nOutputs {
+		return errors.New("nnet: prediction length must match the number of outputs")
+	}
+	var width int
+	for i := range c.layers {
+		if n := len(c.layers[i].biases); n > width {
+			width = n
+		}
+	}
+	s := compiledPool.Get().(*compiledScratch)
+	defer compiledPool.Put(s)
+	s.input = resizeFloats(s.input, c.nInputs)
+	s.combinations = resizeFloats(s.combinations, width)
+	s.outputs[0] = resizeFloats(s.outputs[0], width)
+	s.outputs[1] = resizeFloats(s.outputs[1], width)
+
+	layerInput := s.input
+	for k, v := range input {
+		layerInput[k] = float64(c.inScale[k])*v + float64(c.inShift[k])
+	}
+	var outputs []float64
+	for i := range c.layers {
+		l := &c.layers[i]
+		nNeurons := len(l.biases)
+		combinations := s.combinations[:nNeurons]
+		for j := range combinations {
+			var sum float64
+			if l.weights8 != nil {
+				row := l.weights8[j*l.nInputs : (j+1)*l.nInputs]
+				for k, w := range row {
+					sum += float64(w) * layerInput[k]
+				}
+				sum *= l.scale
+			} else {
+				row := l.weights32[j*l.nInputs : (j+1)*l.nInputs]
+				for k, w := range row {
+					sum += float64(w) * layerInput[k]
+				}
+			}
+			if l.rowScale != nil {
+				sum *= float64(l.rowScale[j])
+			}
+			combinations[j] = sum + float64(l.biases[j])
+		}
+		outputs = s.outputs[i%2][:nNeurons]
+		if l.activation != nil {
+			l.activation.Activate(combinations, outputs)
+		} else {
+			for j, a := range l.activators {
+				outputs[j] = a.Activate(combinations[j])
+			}
+		}
+		layerInput = outputs
+	}
+	for i := range pred {
+		pred[i] = float64(c.outScale[i])*outputs[i] + float64(c.outShift[i])
+	}
+	return nil
+}
+
+// MaxError returns the largest absolute difference between the predictions of the
+// compiled net and of net over the calibration inputs, and the output where it occurs.
+// net should be the net the Compiled was compiled from.
+func (c *Compiled) MaxError(net *Net, inputs [][]float64) (maxErr float64, output int, err error) {
+	if net.Inputs() != c.nInputs || net.Outputs() != c.nOutputs {
+		return 0, 0, errors.New("nnet: net does not match the compiled net")
+	}
+	for _, input := range inputs {
+		pred, err := c.Predict(input)
+		if err != nil {
+			return 0, 0, err
+		}
+		want, err := net.Predict(input)
+		if err != nil {
+			return 0, 0, err
+		}
+		for j := range pred {
+			if e := math.Abs(pred[j] - want[j]); e > maxErr {
+				maxErr = e
+				output = j
+			}
+		}
+	}
+	return maxErr, output, nil
+}
@@ -0,0 +1,210 @@
+package nnet
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/btracey/nnet/activator"
+	"github.com/btracey/nnet/scale"
+	"github.com/gonum/floats"
+)
+
+func TestCompile(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	inputs := RandomSliceOfSlice(50, nInputs)
+	for i := range inputs {
+		for j := range inputs[i] {
+			inputs[i][j] = 3*inputs[i][j] - 1
+		}
+	}
+
+	linear, err := DefaultRegressionInit(nInputs, nOutputs, 2, 8, nil, rand.NewSource(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	linear.InputScaler = &scale.Linear{}
+	linear.InputScaler.SetScale(RandomData(nInputs, 10))
+	linear.OutputScaler = &scale.Linear{}
+	linear.OutputScaler.SetScale(RandomData(nOutputs, 10))
+
+	classification, err := DefaultClassificationInit(nInputs, 3, 1, 6, nil, rand.NewSource(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	classification.layers[len(classification.layers)-1].Activation = activator.Softmax{}
+	classification.InputScaler.SetScale(RandomData(nInputs, 10))
+	classification.OutputScaler.SetScale(RandomData(3, 10))
+
+	for _, test := range []struct {
+		name       string
+		net        *Net
+		float32Tol float64
+		int8Tol    float64
+	}{
+		{"normal", newPruneNet(nInputs, nOutputs), 1e-5, 0.1},
+		{"linear", linear, 1e-5, 0.1},
+		{"batch norm", newBatchNormNet(nInputs, nOutputs), 1e-5, 0.1},
+		{"classification", classification, 1e-5, 0.1},
+	} {
+		net := test.net
+		orig := make([][]float64, len(inputs))
+		for i := range inputs {
+			orig[i] = append([]float64(nil), inputs[i]...)
+		}
+		want := make([][]float64, len(inputs))
+		for i := range inputs {
+			var err error
+			want[i], err = net.Predict(append([]float64(nil), inputs[i]...))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, precision := range []Precision{Float32, Int8} {
+			c, err := Compile(net, precision)
+			if err != nil {
+				t.Fatalf("%v %v: error compiling: %v", test.name, precision, err)
+			}
+			if c.Inputs() != net.Inputs() || c.Outputs() != net.Outputs() || c.Precision() != precision {
+				t.Errorf("%v %v: wrong size or precision", test.name, precision)
+			}
+			maxErr, _, err := c.MaxError(net, inputs)
+			if err != nil {
+				t.Fatalf("%v %v: error computing the error: %v", test.name, precision, err)
+			}
+			tol := test.float32Tol
+			if precision == Int8 {
+				tol = test.int8Tol
+			}
+			if maxErr > tol {
+				t.Errorf("%v %v: error too large. Want less than %v, got %v", test.name, precision, tol, maxErr)
+			}
+
+			// MaxError is the largest difference from the predictions
+			var e float64
+			for i, input := range inputs {
+				pred, err := c.Predict(input)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for j := range pred {
+					e = math.Max(e, math.Abs(pred[j]-want[i][j]))
+				}
+			}
+			if math.Abs(e-maxErr) > 1e-14 {
+				t.Errorf("%v %v: MaxError mismatch. Want %v, got %v", test.name, precision, e, maxErr)
+			}
+			if !predictionsMatch(inputs, orig, 0) {
+				t.Errorf("%v %v: inputs modified", test.name, precision)
+			}
+		}
+	}
+}
+
+// The inputs have very different ranges, so the scaling of the inputs has very
+// different factors. The int8 weights must not be quantized with them.
+func TestCompileInputRange(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	ranges := []float64{1e-3, 1, 1e4}
+	inputs := RandomSliceOfSlice(100, nInputs)
+	for i := range inputs {
+		for j := range inputs[i] {
+			inputs[i][j] *= ranges[j]
+		}
+	}
+	net := newTestNet(nInputs, defaultRegressionLayers(nInputs, nOutputs, 2, 8), &scale.Normal{}, &scale.Normal{})
+	net.InputScaler.SetScale(inputs)
+	net.OutputScaler.SetScale(RandomData(nOutputs, 10))
+	net.layers[0].BatchNorm = NewBatchNorm()
+	net.new()
+	if err := net.Initialize(nil, rand.NewSource(1)); err != nil {
+		t.Fatal(err)
+	}
+	for j := range net.layers[0].BatchNorm.RunningVar {
+		net.layers[0].BatchNorm.RunningVar[j] = math.Pow(10, float64(j%4)-2)
+	}
+
+	c, err := Compile(net, Int8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxErr, _, err := c.MaxError(net, inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxErr > 0.1 {
+		t.Errorf("Error too large for inputs with different ranges. Want less than 0.1, got %v", maxErr)
+	}
+}
+
+func TestCompiledPredictAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items with the race detector")
+	}
+	net := newBatchNormNet(3, 2)
+	c, err := Compile(net, Int8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := RandomSliceOfSlice(1, 3)[0]
+	pred := make([]float64, 2)
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := c.PredictInto(input, pred); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("PredictInto allocates %v times per call", allocs)
+	}
+	want, _ := c.Predict(input)
+	if !floats.Equal(pred, want) {
+		t.Errorf("PredictInto does not match Predict")
+	}
+	// Predict only allocates the prediction
+	allocs = testing.AllocsPerRun(100, func() {
+		if _, err := c.Predict(input); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 1 {
+		t.Errorf("Predict allocates %v times per call", allocs)
+	}
+	if err := c.PredictInto(input, make([]float64, 3)); err == nil {
+		t.Errorf("No error from PredictInto for a prediction of the wrong length")
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	nInputs := 3
+	net := newPruneNet(nInputs, 2)
+	if _, err := Compile(net, Precision(5)); err == nil {
+		t.Errorf("No error for unknown precision")
+	}
+	c, err := Compile(net, Float32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Predict(make([]float64, nInputs+1)); err == nil {
+		t.Errorf("No error for input of the wrong length")
+	}
+	if _, _, err := c.MaxError(newPruneNet(nInputs, 3), nil); err == nil {
+		t.Errorf("No error for a different net")
+	}
+
+	rbf := newPruneNet(nInputs, 2)
+	rbf.layers[0].Neurons[0] = &RBFNeuron{}
+	rbf.new()
+	if _, err := Compile(rbf, Float32); err == nil {
+		t.Errorf("No error for a net with a neuron which is not a SumNeuron")
+	}
+	if _, err := Compile(newMixtureNet(nInputs, 2, 3), Int8); err == nil {
+		t.Errorf("No error for a mixture density net")
+	}
+	prob := newPruneNet(nInputs, 2)
+	prob.OutputScaler = &scale.Probability{}
+	if _, err := Compile(prob, Float32); err == nil {
+		t.Errorf("No error for an output scaler which is not set")
+	}
+}
@@ -0,0 +1,240 @@
+package nnet
+
+import (
+	"github.com/gonum/blas"
+	"github.com/gonum/blas/blas64"
+)
+
+// denseBatchSize is the number of samples processed at once by the matrix-matrix
+// path in SeqLossDeriv
+const denseBatchSize = 32
+
+// isSumLayer returns true if the layer has neurons and every neuron in the layer
+// is a SumNeuron
+func (l *Layer) isSumLayer() bool {
+	for _, neuron := range l.Neurons {
+		if _, ok := neuron.(*SumNeuron); !ok {
+			return false
+		}
+	}
+	return len(l.Neurons) != 0
+}
+
+// isDenseLayer returns true if the layer is a layer of SumNeurons, in which case
+// it can be computed with matrix products. Layers with batch normalization are
+// never dense layers.
+func (l *Layer) isDenseLayer() bool {
+	return l.BatchNorm == nil && l.isSumLayer()
+}
+
+// layerMatrix returns the weights of the layer as a matrix, with one row per
+// neuron and one column per input. The bias of each neuron is the element just
+// past the end of its row. The matrix is a view of the parameters, and so ok is
+// false if the parameters of the neurons are not stored contiguously.
+func layerMatrix(parameters [][]float64, nInputs int) (w blas64.General, ok bool) {
+	nNeurons := len(parameters)
+	stride := nInputs + 1
+	if nNeurons == 0 || cap(parameters[0]) < nNeurons*stride {
+		return w, false
+	}
+	block := parameters[0][:nNeurons*stride]
+	for j, p := range parameters {
+		if len(p) != stride || &p[0] != &block[j*stride] {
+			return w, false
+		}
+	}
+	return blas64.General{Rows: nNeurons, Cols: nInputs, Stride: stride, Data: block}, true
+}
+
+// ProcessSumLayer is the same as ProcessLayer for a layer of SumNeurons, but the
+// combinations are computed with a single matrix-vector product. Returns false
+// if the fast path cannot be used, in which case nothing is computed
+func ProcessSumLayer(layer *Layer, parameters [][]float64, inputs []float64, combinations, outputs []float64) bool {
+	if !layer.isDenseLayer() {
+		return false
+	}
+	w, ok := layerMatrix(parameters, len(inputs))
+	if !ok {
+		return false
+	}
+	for i := range combinations {
+		combinations[i] = w.Data[i*w.Stride+w.Cols]
+	}
+	blas64.Gemv(blas.NoTrans, 1, w, blas64.Vector{Inc: 1, Data: inputs}, 1, blas64.Vector{Inc: 1, Data: combinations})
+	layer.activate(combinations, outputs)
+	return true
+}
+
+// DerivativesSumLayer is the dense version of DerivativesLayer. Instead of storing
+// the derivative of the loss with respect to the inputs of every neuron, it stores the
+// derivative of the loss with respect to the layer inputs (the summed version) in
+// dLossDLayerInput. dLossDOutput is overwritten with the derivative of the
+// loss with respect to the combinations. Returns false if the fast path cannot be used,
+// in which case nothing is computed.
+func DerivativesSumLayer(l Layer, parameters [][]float64, inputs []float64, combinations, outputs, dLossDOutput []float64, dLossDParam [][]float64, dLossDLayerInput []float64) bool {
+	if !l.isDenseLayer() {
+		return false
+	}
+	w, ok := layerMatrix(parameters, len(inputs))
+	if !ok {
+		return false
+	}
+	l.dLossDCombination(combinations, outputs, dLossDOutput, dLossDOutput)
+	for i, dLossDCombination := range dLossDOutput {
+		dp := dLossDParam[i]
+		for k, val := range inputs {
+			dp[k] = dLossDCombination * val
+		}
+		dp[len(inputs)] = dLossDCombination
+	}
+	if dLossDLayerInput != nil {
+		blas64.Gemv(blas.Trans, 1, w, blas64.Vector{Inc: 1, Data: dLossDOutput}, 0, blas64.Vector{Inc: 1, Data: dLossDLayerInput})
+	}
+	return true
+}
+
+// isDenseNet returns true if every layer in the net is a layer of SumNeurons
+// with contiguous parameters. Nets with shared parameters are not dense, as the
+// derivatives are found for each neuron and then summed, and neither are graph nets.
+func (net *Net) isDenseNet() bool {
+	if net.aliased != nil || !net.isSequential() {
+		return false
+	}
+	nInputs := net.nInputs
+	for i := range net.layers {
+		if !net.layers[i].isDenseLayer() {
+			return false
+		}
+		if _, ok := layerMatrix(net.parameters[i], nInputs); !ok {
+			return false
+		}
+		nInputs = len(net.layers[i].Neurons)
+	}
+	return true
+}
+
+// denseBatchMemory is the temporary memory for computing the loss and derivative
+// of a batch of samples using matrix-matrix products. All of the matrices have
+// one row per sample.
+type denseBatchMemory struct {
+	input        blas64.General
+	combinations []blas64.General
+	outputs      []blas64.General
+	dLossDOutput []blas64.General
+}
+
+func newGeneral(rows, cols int) blas64.General {
+	return blas64.General{Rows: rows, Cols: cols, Stride: cols, Data: make([]float64, rows*cols)}
+}
+
+// rowsOf returns a view of the first n rows of the matrix
+func rowsOf(a blas64.General, n int) blas64.General {
+	a.Rows = n
+	a.Data = a.Data[:n*a.Stride]
+	return a
+}
+
+func (net *Net) newDenseBatchMemory() *denseBatchMemory {
+	m := &denseBatchMemory{
+		input:        newGeneral(denseBatchSize, net.nInputs),
+		combinations: make([]blas64.General, len(net.layers)),
+		outputs:      make([]blas64.General, len(net.layers)),
+		dLossDOutput: make([]blas64.General, len(net.layers)),
+	}
+	for i, layer := range net.layers {
+		m.combinations[i] = newGeneral(denseBatchSize, len(layer.Neurons))
+		m.outputs[i] = newGeneral(denseBatchSize, len(layer.Neurons))
+		m.dLossDOutput[i] = newGeneral(denseBatchSize, len(layer.Neurons))
+	}
+	return m
+}
+
+// denseBatchLossDeriv computes the loss of a batch of samples (at most denseBatchSize) and adds
+// the derivative of the loss with respect to the parameters into dLossDParamFlat, which
+// must have the layout of the flat memory from NewPerParameterMemory. The net must be dense.
+func denseBatchLossDeriv(inputs, truths [][]float64, weights []float64, net *Net, m *denseBatchMemory, dLossDPred []float64, dLossDParamFlat []float64) (loss float64) {
+	nSamples := len(inputs)
+	nLayers := len(net.layers)
+
+	x := rowsOf(m.input, nSamples)
+	for i, input := range inputs {
+		copy(x.Data[i*x.Stride:i*x.Stride+x.Cols], input)
+	}
+
+	// Forward pass. Each layer is combinations = inputs * W^T + bias
+	layerInput := x
+	for l := 0; l < nLayers; l++ {
+		w, _ := layerMatrix(net.parameters[l], layerInput.Cols)
+		comb := rowsOf(m.combinations[l], nSamples)
+		out := rowsOf(m.outputs[l], nSamples)
+		for i := 0; i < nSamples; i++ {
+			row := comb.Data[i*comb.Stride : i*comb.Stride+comb.Cols]
+			for j := range row {
+				row[j] = w.Data[j*w.Stride+w.Cols]
+			}
+		}
+		blas64.Gemm(blas.NoTrans, blas.Trans, 1, layerInput, w, 1, comb)
+		for i := 0; i < nSamples; i++ {
+			net.layers[l].activate(comb.Data[i*comb.Stride:i*comb.Stride+comb.Cols], out.Data[i*out.Stride:i*out.Stride+out.Cols])
+		}
+		layerInput = out
+	}
+
+	// Compute the loss and the derivative with respect to the predictions
+	pred := rowsOf(m.outputs[nLayers-1], nSamples)
+	dLossDOut := rowsOf(m.dLossDOutput[nLayers-1], nSamples)
+	for i := 0; i < nSamples; i++ {
+		prediction := pred.Data[i*pred.Stride : i*pred.Stride+pred.Cols]
+		loss += weights[i] * net.Losser.LossAndDeriv(prediction, truths[i], dLossDPred)
+		row := dLossDOut.Data[i*dLossDOut.Stride : i*dLossDOut.Stride+dLossDOut.Cols]
+		for j, val := range dLossDPred {
+			row[j] = weights[i] * val
+		}
+	}
+
+	// Backward pass. The layers below the lowest trainable layer are not needed
+	lowest := net.lowestTrainableLayer()
+	for l := nLayers - 1; l >= lowest; l-- {
+		layerInput := x
+		if l > 0 {
+			layerInput = rowsOf(m.outputs[l-1], nSamples)
+		}
+		w, _ := layerMatrix(net.parameters[l], layerInput.Cols)
+		comb := rowsOf(m.combinations[l], nSamples)
+		out := rowsOf(m.outputs[l], nSamples)
+		dLossDComb := rowsOf(m.dLossDOutput[l], nSamples)
+
+		// Turn the derivative with respect to the output into the derivative with
+		// respect to the combination
+		for i := 0; i < nSamples; i++ {
+			row := dLossDComb.Data[i*dLossDComb.Stride : i*dLossDComb.Stride+dLossDComb.Cols]
+			net.layers[l].dLossDCombination(comb.Data[i*comb.Stride:i*comb.Stride+comb.Cols], out.Data[i*out.Stride:i*out.Stride+out.Cols], row, row)
+		}
+
+		// The derivative with respect to the weights is dLossDComb^T * inputs,
+		// and with respect to the bias is the sum over the samples
+		dW := net.flatLayerMatrix(l, layerInput.Cols, dLossDParamFlat)
+		blas64.Gemm(blas.Trans, blas.NoTrans, 1, dLossDComb, layerInput, 1, dW)
+		for i := 0; i < nSamples; i++ {
+			for j := 0; j < dLossDComb.Cols; j++ {
+				dW.Data[j*dW.Stride+dW.Cols] += dLossDComb.Data[i*dLossDComb.Stride+j]
+			}
+		}
+
+		// The derivative with respect to the outputs of the previous layer
+		// is dLossDComb * W
+		if l > lowest {
+			blas64.Gemm(blas.NoTrans, blas.NoTrans, 1, dLossDComb, w, 0, rowsOf(m.dLossDOutput[l-1], nSamples))
+		}
+	}
+	return loss
+}
+
+// flatLayerMatrix returns the matrix view of layer l (as in layerMatrix) for flat
+// memory with the layout of the flat memory from NewPerParameterMemory
+func (net *Net) flatLayerMatrix(l, nInputs int, flat []float64) blas64.General {
+	start := net.parameterIdx[l][0]
+	rows := len(net.layers[l].Neurons)
+	stride := nInputs + 1
+	return blas64.General{Rows: rows, Cols: nInputs, Stride: stride, Data: flat[start : start+rows*stride]}
+}
@@ -0,0 +1,120 @@
+package nnet
+
+import (
+	"testing"
+
+	"github.com/btracey/nnet/loss"
+	"github.com/gonum/floats"
+)
+
+const denseTol = 1e-12
+
+// perNeuronSumNeuron wraps a SumNeuron so that the layer uses the per-neuron path
+type perNeuronSumNeuron struct {
+	*SumNeuron
+}
+
+// newPerNeuronNet returns a copy of the net which uses the per-neuron code path
+func newPerNeuronNet(net *Net) *Net {
+	layers := make([]Layer, len(net.layers))
+	for i, layer := range net.layers {
+		layers[i].Neurons = make([]Neuron, len(layer.Neurons))
+		for j, neuron := range layer.Neurons {
+			layers[i].Neurons[j] = perNeuronSumNeuron{neuron.(*SumNeuron)}
+		}
+	}
+	net2 := NewNet(net.nInputs, layers)
+	net2.Losser = net.Losser
+	net2.SetParametersSlice(net.parametersSlice)
+	return net2
+}
+
+func TestDenseMatchPerNeuron(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	net := DefaultRegression(nInputs, nOutputs, 2, 10)
+	net.Losser = loss.SquaredDistance{}
+	slow := newPerNeuronNet(net)
+	if !net.isDenseNet() {
+		t.Fatalf("DefaultRegression net should be dense")
+	}
+	if slow.isDenseNet() {
+		t.Fatalf("Wrapped net should not be dense")
+	}
+
+	nSamples := 101
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := RandomSliceOfSlice(nSamples, nOutputs)
+	weights := RandomWeights(nSamples)
+
+	// Check the predictions
+	pred1 := make([]float64, nOutputs)
+	pred2 := make([]float64, nOutputs)
+	p1 := net.NewPredictTmpMemory()
+	p2 := slow.NewPredictTmpMemory()
+	for _, input := range inputs {
+		Predict(input, net, pred1, p1.combinations, p1.outputs)
+		Predict(input, slow, pred2, p2.combinations, p2.outputs)
+		if !floats.EqualApprox(pred1, pred2, denseTol) {
+			t.Errorf("Predictions don't match. Dense: %v, per neuron: %v", pred1, pred2)
+			return
+		}
+	}
+
+	// Check the derivative of a single sample
+	tmp1 := net.NewPredLossDerivTmpMemory()
+	tmp2 := slow.NewPredLossDerivTmpMemory()
+	dLossDParam1, flat1 := net.NewPerParameterMemory()
+	dLossDParam2, flat2 := slow.NewPerParameterMemory()
+	loss1 := PredLossDeriv(inputs[0], truths[0], weights[0], net, tmp1, pred1, dLossDParam1)
+	loss2 := PredLossDeriv(inputs[0], truths[0], weights[0], slow, tmp2, pred2, dLossDParam2)
+	if !floats.EqualWithinAbsOrRel(loss1, loss2, denseTol, denseTol) {
+		t.Errorf("PredLossDeriv loss doesn't match. Dense: %v, per neuron: %v", loss1, loss2)
+	}
+	if !floats.EqualApprox(flat1, flat2, denseTol) {
+		t.Errorf("PredLossDeriv derivative doesn't match")
+	}
+
+	// Check the batched version
+	loss1 = SeqLossDeriv(inputs, truths, weights, net, dLossDParam1, NewParLossDerivMemory(net))
+	loss2 = SeqLossDeriv(inputs, truths, weights, slow, dLossDParam2, NewParLossDerivMemory(slow))
+	if !floats.EqualWithinAbsOrRel(loss1, loss2, denseTol, denseTol) {
+		t.Errorf("SeqLossDeriv loss doesn't match. Dense: %v, per neuron: %v", loss1, loss2)
+	}
+	if !floats.EqualApprox(flat1, flat2, denseTol) {
+		t.Errorf("SeqLossDeriv derivative doesn't match")
+	}
+
+	loss1 = ParLossDeriv(inputs, truths, weights, net, dLossDParam1, 7)
+	loss2 = ParLossDeriv(inputs, truths, weights, slow, dLossDParam2, 7)
+	if !floats.EqualWithinAbsOrRel(loss1, loss2, denseTol, denseTol) {
+		t.Errorf("ParLossDeriv loss doesn't match. Dense: %v, per neuron: %v", loss1, loss2)
+	}
+	if !floats.EqualApprox(flat1, flat2, denseTol) {
+		t.Errorf("ParLossDeriv derivative doesn't match")
+	}
+}
+
+func BenchmarkSeqLossDerivDense(b *testing.B) {
+	net := DefaultRegression(10, 3, 2, 50)
+	benchmarkSeqLossDeriv(b, net)
+}
+
+func BenchmarkSeqLossDerivPerNeuron(b *testing.B) {
+	net := newPerNeuronNet(DefaultRegression(10, 3, 2, 50))
+	benchmarkSeqLossDeriv(b, net)
+}
+
+func benchmarkSeqLossDeriv(b *testing.B, net *Net) {
+	net.Losser = loss.SquaredDistance{}
+	nSamples := 1000
+	inputs := RandomSliceOfSlice(nSamples, net.Inputs())
+	truths := RandomSliceOfSlice(nSamples, net.Outputs())
+	weights := RandomWeights(nSamples)
+	dLossDParam, _ := net.NewPerParameterMemory()
+	p := NewParLossDerivMemory(net)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		SeqLossDeriv(inputs, truths, weights, net, dLossDParam, p)
+	}
+}
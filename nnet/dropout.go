@@ -0,0 +1,197 @@
+package nnet
+
+import (
+	"errors"
+	"math/rand"
+)
+
+// hasDropout returns true if any of the layers of the net have dropout
+func (net *Net) hasDropout() bool {
+	for i := range net.layers {
+		if net.layers[i].Dropout != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// dropoutSeed returns a seed for the dropout masks from the DropoutSource
+// of the net
+func (net *Net) dropoutSeed() int64 {
+	if net.DropoutSource == nil {
+		return rand.Int63()
+	}
+	return net.DropoutSource.Int63()
+}
+
+// dropoutMemory is the temporary memory for the dropout masks. masks[l] is nil
+// if layer l does not have dropout, and otherwise contains the factor by which each
+// output of the layer is multiplied (either zero or 1/(1-Dropout)). dropped[l] is the
+// output of the layer after the mask is applied. visible[l] is dropped[l] for the
+// layers with dropout and the output of the layer otherwise (see maskedOutputs).
+type dropoutMemory struct {
+	masks   [][]float64
+	dropped [][]float64
+	visible [][]float64
+}
+
+func (net *Net) newDropoutMemory() *dropoutMemory {
+	m := &dropoutMemory{
+		masks:   make([][]float64, len(net.layers)),
+		dropped: make([][]float64, len(net.layers)),
+		visible: make([][]float64, len(net.layers)),
+	}
+	for i, layer := range net.layers {
+		if layer.Dropout == 0 {
+			continue
+		}
+		m.masks[i] = make([]float64, len(layer.Neurons))
+		m.dropped[i] = make([]float64, len(layer.Neurons))
+	}
+	return m
+}
+
+// sample draws new dropout masks for all of the layers
+func (m *dropoutMemory) sample(layers []Layer, rnd *rand.Rand) {
+	for l, mask := range m.masks {
+		if mask == nil {
+			continue
+		}
+		p := layers[l].Dropout
+		if p < 0 || p >= 1 {
+			panic("nnet: dropout must be at least zero and less than one")
+		}
+		keep := 1 / (1 - p)
+		for j := range mask {
+			mask[j] = keep
+			if rnd.Float64() < p {
+				mask[j] = 0
+			}
+		}
+	}
+}
+
+// maskedOutputs returns the outputs of the layers after the dropout masks are
+// applied, which are the inputs seen by the later layers. The returned memory is
+// that of m and outputs, so it only needs to be found once for each outputs.
+func (m *dropoutMemory) maskedOutputs(outputs [][]float64) [][]float64 {
+	for l := range m.visible {
+		if m.masks[l] == nil {
+			m.visible[l] = outputs[l]
+		} else {
+			m.visible[l] = m.dropped[l]
+		}
+	}
+	return m.visible
+}
+
+// predictDropout is the same as Predict, but the outputs of every layer are
+// multiplied by the current dropout masks
+func predictDropout(input []float64, net *Net, predOutput []float64, combinations, outputs, layerInputs [][]float64, m *dropoutMemory) {
+	layers := net.layers
+	parameters := net.parameters
+	visible := m.maskedOutputs(outputs)
+	for l := range layers {
+		layerInput := net.layerInput(l, input, visible, layerInputs)
+		if !ProcessSumLayer(&layers[l], parameters[l], layerInput, combinations[l], outputs[l]) {
+			ProcessLayer(&layers[l], parameters[l], layerInput, combinations[l], outputs[l])
+		}
+		if mask := m.masks[l]; mask != nil {
+			for j, val := range outputs[l] {
+				m.dropped[l][j] = val * mask[j]
+			}
+		}
+	}
+	copy(predOutput, visible[len(layers)-1])
+}
+
+// derivativeDropout is the same as derivative, but for the forward pass of predictDropout.
+// Each layer sees the masked outputs of its sources as inputs, so the derivative
+// with respect to the outputs of a layer is multiplied by the mask.
+func derivativeDropout(input []float64, net *Net, dLossDPred []float64, tmp *PredLossDerivTmpMemory, dLossDParam [][][]float64, m *dropoutMemory) {
+	dLossDOutput := tmp.dLossDOutput
+	nLayers := len(net.layers)
+	lowest := net.lowestTrainableLayer()
+	if lowest >= nLayers {
+		return
+	}
+	visible := m.maskedOutputs(tmp.outputs)
+	net.zeroDLossDOutput(lowest, dLossDOutput)
+	copy(dLossDOutput[nLayers-1], dLossDPred)
+	for l := nLayers - 1; l >= lowest; l-- {
+		if mask := m.masks[l]; mask != nil {
+			for j := range dLossDOutput[l] {
+				dLossDOutput[l][j] *= mask[j]
+			}
+		}
+		derivativeLayer(l, lowest, input, visible, net, tmp, dLossDParam, nil)
+	}
+}
+
+// predLossDerivDropout is PredLossDeriv with the dropout masks sampled from rnd
+func predLossDerivDropout(input []float64, truth []float64, weight float64, net *Net, tmp *PredLossDerivTmpMemory, m *dropoutMemory, rnd *rand.Rand, prediction []float64, dLossDParam [][][]float64) (loss float64) {
+	m.sample(net.layers, rnd)
+	predictDropout(input, net, prediction, tmp.combinations, tmp.outputs, tmp.layerInputs, m)
+	loss = weight * net.Losser.LossAndDeriv(prediction, truth, tmp.dLossDPred)
+	for i := range tmp.dLossDPred {
+		tmp.dLossDPred[i] *= weight
+	}
+	derivativeDropout(input, net, tmp.dLossDPred, tmp, dLossDParam, m)
+	return loss
+}
+
+// PredictWithUncertainty estimates the uncertainty of the prediction at the input
+// with Monte Carlo dropout. nSamples predictions are made with dropout masks sampled
+// from src, or from a source seeded by the global source in math/rand if src is nil,
+// and the mean and variance of each (unscaled) output over the samples is returned.
+// The input is not modified. If the net has no dropout all of the samples are the
+// same and the variance is zero. The DropoutSource of the net is not used, so
+// PredictWithUncertainty may be called concurrently as long as src is not shared.
+func (net *Net) PredictWithUncertainty(input []float64, nSamples int, src rand.Source) (mean, variance []float64, err error) {
+	if len(input) != net.nInputs {
+		return nil, nil, InputMismatch{Provided: len(input), Expected: net.nInputs}
+	}
+	if nSamples < 1 {
+		return nil, nil, errors.New("nnet: number of samples must be at least one")
+	}
+	if !net.InputScaler.IsScaled() {
+		return nil, nil, errors.New("Scale must be set before calling predict")
+	}
+	if !net.OutputScaler.IsScaled() {
+		return nil, nil, errors.New("Scale must be set before calling predict")
+	}
+	scaledInput := make([]float64, len(input))
+	copy(scaledInput, input)
+	err = net.InputScaler.Scale(scaledInput)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmp := net.NewPredictTmpMemory()
+	m := net.newDropoutMemory()
+	if src == nil {
+		src = rand.NewSource(rand.Int63())
+	}
+	rnd := rand.New(src)
+	pred := make([]float64, net.nOutputs)
+	mean = make([]float64, net.nOutputs)
+	variance = make([]float64, net.nOutputs)
+	// Welford's algorithm for the running mean and variance
+	for s := 0; s < nSamples; s++ {
+		m.sample(net.layers, rnd)
+		predictDropout(scaledInput, net, pred, tmp.combinations, tmp.outputs, tmp.layerInputs, m)
+		err = net.OutputScaler.Unscale(pred)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, val := range pred {
+			diff := val - mean[i]
+			mean[i] += diff / float64(s+1)
+			variance[i] += diff * (val - mean[i])
+		}
+	}
+	for i := range variance {
+		variance[i] /= float64(nSamples)
+	}
+	return mean, variance, nil
+}
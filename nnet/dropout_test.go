@@ -0,0 +1,240 @@
+package nnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/btracey/nnet/scale"
+	"github.com/gonum/floats"
+)
+
+func newDropoutNet(nInputs, nOutputs int) *Net {
+	layers := make([]Layer, 3)
+	layers[0].Neurons = []Neuron{&TanhNeuron, &TanhNeuron, &SigmoidNeuron, &TanhNeuron, &TanhNeuron}
+	layers[0].Dropout = 0.3
+	layers[1].Neurons = []Neuron{&TanhNeuron, perNeuronSumNeuron{&TanhNeuron}, &TanhNeuron, &TanhNeuron}
+	layers[1].Dropout = 0.5
+	layers[2].Neurons = make([]Neuron, nOutputs)
+	for j := range layers[2].Neurons {
+		layers[2].Neurons[j] = &LinearNeuron
+	}
+	return newTestNet(nInputs, layers, &scale.None{}, &scale.None{})
+}
+
+func TestDropoutDeriv(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	nSamples := 20
+	net := newDropoutNet(nInputs, nOutputs)
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := RandomSliceOfSlice(nSamples, nOutputs)
+	weights := RandomWeights(nSamples)
+
+	// Reseeding the memory gives the same masks, so the loss can be finite differenced
+	seqLossDeriv := func(dLossDParam [][][]float64) float64 {
+		p := NewParLossDerivMemory(net)
+		p.rand = rand.New(rand.NewSource(1))
+		return SeqLossDeriv(inputs, truths, weights, net, dLossDParam, p)
+	}
+	dLossDParam, dLossFlat := net.NewPerParameterMemory()
+	seqLossDeriv(dLossDParam)
+
+	params := make([]float64, net.TotalNumParameters())
+	net.ParametersSlice(params)
+	fdDLossFlat := make([]float64, len(params))
+	d, _ := net.NewPerParameterMemory()
+	for i := range params {
+		params[i] += netFDStep
+		net.SetParametersSlice(params)
+		loss1 := seqLossDeriv(d)
+		params[i] -= 2 * netFDStep
+		net.SetParametersSlice(params)
+		loss2 := seqLossDeriv(d)
+		params[i] += netFDStep
+		net.SetParametersSlice(params)
+		fdDLossFlat[i] = (loss1 - loss2) / (2 * netFDStep)
+	}
+	for i := range params {
+		if !floats.EqualWithinAbsOrRel(dLossFlat[i], fdDLossFlat[i], 1e-5, 1e-5) {
+			t.Errorf("Finite difference doesn't match derivative with dropout")
+			for i := range dLossFlat {
+				fmt.Println(i, dLossFlat[i], fdDLossFlat[i], dLossFlat[i]-fdDLossFlat[i])
+			}
+			break
+		}
+	}
+
+	// The masks must actually change the loss
+	noDropout := newDropoutNet(nInputs, nOutputs)
+	noDropout.layers[0].Dropout = 0
+	noDropout.layers[1].Dropout = 0
+	noDropout.SetParametersSlice(params)
+	d2, _ := noDropout.NewPerParameterMemory()
+	if SeqLossDeriv(inputs, truths, weights, noDropout, d2, NewParLossDerivMemory(noDropout)) == seqLossDeriv(d) {
+		t.Errorf("Dropout does not change the loss")
+	}
+}
+
+func TestDropoutReproducible(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	nSamples := 50
+	net := newDropoutNet(nInputs, nOutputs)
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := RandomSliceOfSlice(nSamples, nOutputs)
+	weights := RandomWeights(nSamples)
+
+	net.DropoutSource = rand.NewSource(2)
+	tiered1, _ := net.NewPerParameterMemory()
+	loss1 := ParLossDeriv(inputs, truths, weights, net, tiered1, 7)
+
+	net.DropoutSource = rand.NewSource(2)
+	tiered2, _ := net.NewPerParameterMemory()
+	loss2 := ParLossDeriv(inputs, truths, weights, net, tiered2, 7)
+
+	if !floats.EqualWithinAbsOrRel(loss1, loss2, 1e-12, 1e-12) {
+		t.Errorf("Loss not reproducible with the same DropoutSource: %v, %v", loss1, loss2)
+	}
+	for i, lay := range tiered1 {
+		for j, neur := range lay {
+			if !floats.EqualApprox(neur, tiered2[i][j], 1e-12) {
+				t.Errorf("Derivative not reproducible with the same DropoutSource")
+				return
+			}
+		}
+	}
+}
+
+func TestPredictWithUncertainty(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	net := newDropoutNet(nInputs, nOutputs)
+	data := RandomData(nOutputs, 100)
+	net.OutputScaler = &scale.Normal{}
+	net.OutputScaler.SetScale(data)
+	input := []float64{0.1, -0.4, 0.7}
+	inputCopy := make([]float64, len(input))
+	copy(inputCopy, input)
+
+	// Predict does not use dropout
+	pred1, err := net.Predict(input)
+	if err != nil {
+		t.Fatalf("Error predicting: %v", err)
+	}
+	pred2, _ := net.Predict(input)
+	if !floats.Equal(pred1, pred2) {
+		t.Errorf("Predict is not deterministic with dropout")
+	}
+
+	mean, variance, err := net.PredictWithUncertainty(input, 200, rand.NewSource(3))
+	if err != nil {
+		t.Fatalf("Error predicting with uncertainty: %v", err)
+	}
+	if !floats.Equal(input, inputCopy) {
+		t.Errorf("PredictWithUncertainty modified the input")
+	}
+	for i, v := range variance {
+		if v <= 0 {
+			t.Errorf("Variance of output %v is not positive with dropout: %v", i, v)
+		}
+	}
+	if len(mean) != nOutputs {
+		t.Errorf("Wrong length of the mean")
+	}
+
+	// Without dropout every sample is the prediction
+	net.layers[0].Dropout = 0
+	net.layers[1].Dropout = 0
+	mean, variance, err = net.PredictWithUncertainty(input, 10, nil)
+	if err != nil {
+		t.Fatalf("Error predicting with uncertainty: %v", err)
+	}
+	if !floats.EqualApprox(mean, pred1, 1e-14) {
+		t.Errorf("Mean does not match prediction without dropout. Mean: %v, Pred: %v", mean, pred1)
+	}
+	for i, v := range variance {
+		if v > 1e-20 {
+			t.Errorf("Variance of output %v is not zero without dropout: %v", i, v)
+		}
+	}
+
+	if _, _, err := net.PredictWithUncertainty(input, 0, nil); err == nil {
+		t.Errorf("No error with zero samples")
+	}
+
+	// Errors from the scalers are returned
+	outputScaler := net.OutputScaler
+	net.OutputScaler = &failingScaler{}
+	if _, _, err := net.PredictWithUncertainty(input, 10, nil); err == nil {
+		t.Errorf("No error when unscaling fails")
+	}
+	net.OutputScaler = outputScaler
+	net.InputScaler = &failingScaler{}
+	if _, _, err := net.PredictWithUncertainty(input, 10, nil); err == nil {
+		t.Errorf("No error when scaling fails")
+	}
+}
+
+// Concurrent callers with their own sources get the same results as sequential ones
+func TestPredictWithUncertaintyConcurrent(t *testing.T) {
+	net := newDropoutNet(3, 2)
+	// The DropoutSource is not safe for concurrent use, so must not be used
+	net.DropoutSource = rand.NewSource(1)
+	input := []float64{0.1, -0.4, 0.7}
+	nCallers := 8
+	wantMean := make([][]float64, nCallers)
+	wantVar := make([][]float64, nCallers)
+	for i := range wantMean {
+		var err error
+		wantMean[i], wantVar[i], err = net.PredictWithUncertainty(input, 50, rand.NewSource(int64(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mean := make([][]float64, nCallers)
+	variance := make([][]float64, nCallers)
+	errs := make([]error, nCallers)
+	var wg sync.WaitGroup
+	for i := 0; i < nCallers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mean[i], variance[i], errs[i] = net.PredictWithUncertainty(input, 50, rand.NewSource(int64(i)))
+			// A nil source is also safe for concurrent use
+			if _, _, err := net.PredictWithUncertainty(input, 5, nil); err != nil {
+				errs[i] = err
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := range mean {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if !floats.Equal(mean[i], wantMean[i]) || !floats.Equal(variance[i], wantVar[i]) {
+			t.Errorf("Concurrent caller %v does not match the sequential result", i)
+		}
+	}
+}
+
+func TestDropoutJSON(t *testing.T) {
+	net := newDropoutNet(3, 2)
+	net.layers[1].Neurons[1] = &TanhNeuron
+	b, err := json.Marshal(net)
+	if err != nil {
+		t.Fatalf("Error marshaling: %v", err)
+	}
+	net2 := &Net{}
+	if err := json.Unmarshal(b, net2); err != nil {
+		t.Fatalf("Error unmarshaling: %v", err)
+	}
+	for i := range net.layers {
+		if net.layers[i].Dropout != net2.layers[i].Dropout {
+			t.Errorf("Dropout of layer %v not preserved: %v, %v", i, net.layers[i].Dropout, net2.layers[i].Dropout)
+		}
+	}
+}
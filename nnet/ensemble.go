@@ -0,0 +1,220 @@
+package nnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// Ensemble is a collection of nets with the same number of inputs and outputs whose
+// predictions are averaged, for example nets trained from different random seeds.
+// Weights are the weights of the nets in the average. If Weights is nil, all of
+// the nets have the same weight. An Ensemble is saved as a single JSON document
+// containing the JSON of each of the nets.
+type Ensemble struct {
+	Nets    []*Net
+	Weights []float64
+}
+
+// NewEnsemble returns an ensemble of the nets. weights may be nil, in which case
+// all of the nets have the same weight.
+func NewEnsemble(nets []*Net, weights []float64) (*Ensemble, error) {
+	e := &Ensemble{
+		Nets:    nets,
+		Weights: weights,
+	}
+	if err := e.check(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// check returns an error if the nets do not match or if the weights are not valid
+func (e *Ensemble) check() error {
+	if len(e.Nets) == 0 {
+		return errors.New("nnet: ensemble has no nets")
+	}
+	for i, net := range e.Nets {
+		if net.Inputs() != e.Nets[0].Inputs() || net.Outputs() != e.Nets[0].Outputs() {
+			return fmt.Errorf("nnet: net %v of the ensemble has %v inputs and %v outputs, but net 0 has %v inputs and %v outputs",
+				i, net.Inputs(), net.Outputs(), e.Nets[0].Inputs(), e.Nets[0].Outputs())
+		}
+	}
+	if e.Weights == nil {
+		return nil
+	}
+	if len(e.Weights) != len(e.Nets) {
+		return fmt.Errorf("nnet: ensemble has %v nets but %v weights", len(e.Nets), len(e.Weights))
+	}
+	var sum float64
+	for _, w := range e.Weights {
+		if w < 0 {
+			return errors.New("nnet: negative ensemble weight")
+		}
+		sum += w
+	}
+	if sum == 0 {
+		return errors.New("nnet: ensemble weights sum to zero")
+	}
+	return nil
+}
+
+// Inputs returns the number of inputs of the nets
+func (e *Ensemble) Inputs() int {
+	return e.Nets[0].Inputs()
+}
+
+// Outputs returns the number of outputs of the nets
+func (e *Ensemble) Outputs() int {
+	return e.Nets[0].Outputs()
+}
+
+// normalizedWeights returns the weights of the nets, which sum to one
+func (e *Ensemble) normalizedWeights() []float64 {
+	weights := make([]float64, len(e.Nets))
+	if e.Weights == nil {
+		for i := range weights {
+			weights[i] = 1 / float64(len(weights))
+		}
+		return weights
+	}
+	var sum float64
+	for _, w := range e.Weights {
+		sum += w
+	}
+	for i, w := range e.Weights {
+		weights[i] = w / sum
+	}
+	return weights
+}
+
+// meanVariance sets the weighted mean and variance of the predictions of the nets
+func meanVariance(weights []float64, preds [][]float64, mean, variance []float64) {
+	for j := range mean {
+		mean[j] = 0
+		variance[j] = 0
+	}
+	for i, pred := range preds {
+		for j, val := range pred {
+			mean[j] += weights[i] * val
+		}
+	}
+	for i, pred := range preds {
+		for j, val := range pred {
+			diff := val - mean[j]
+			variance[j] += weights[i] * diff * diff
+		}
+	}
+}
+
+// Predict predicts the value at the input with all of the nets in parallel, and
+// returns the weighted mean and variance of the (unscaled) predictions of each output.
+func (e *Ensemble) Predict(input []float64) (mean, variance []float64, err error) {
+	if err := e.check(); err != nil {
+		return nil, nil, err
+	}
+	preds := make([][]float64, len(e.Nets))
+	errs := make([]error, len(e.Nets))
+	w := sync.WaitGroup{}
+	for i, net := range e.Nets {
+		w.Add(1)
+		go func(i int, net *Net) {
+			defer w.Done()
+			preds[i], errs[i] = net.Predict(input)
+		}(i, net)
+	}
+	w.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, nil, fmt.Errorf("nnet: error predicting with net %v: %v", i, err)
+		}
+	}
+	mean = make([]float64, e.Outputs())
+	variance = make([]float64, e.Outputs())
+	meanVariance(e.normalizedWeights(), preds, mean, variance)
+	return mean, variance, nil
+}
+
+// PredictSlice is the same as Predict for each of the inputs. The nets predict in
+// parallel, and each net predicts the inputs in parallel as in Net.PredictSlice.
+func (e *Ensemble) PredictSlice(inputs [][]float64) (means, variances [][]float64, err error) {
+	if err := e.check(); err != nil {
+		return nil, nil, err
+	}
+	preds := make([][][]float64, len(e.Nets))
+	errs := make([]error, len(e.Nets))
+	w := sync.WaitGroup{}
+	for i, net := range e.Nets {
+		w.Add(1)
+		go func(i int, net *Net) {
+			defer w.Done()
+			preds[i], errs[i] = net.PredictSlice(inputs)
+		}(i, net)
+	}
+	w.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, nil, fmt.Errorf("nnet: error predicting with net %v: %v", i, err)
+		}
+	}
+	weights := e.normalizedWeights()
+	means = make([][]float64, len(inputs))
+	variances = make([][]float64, len(inputs))
+	samplePreds := make([][]float64, len(e.Nets))
+	for j := range inputs {
+		for i := range preds {
+			samplePreds[i] = preds[i][j]
+		}
+		means[j] = make([]float64, e.Outputs())
+		variances[j] = make([]float64, e.Outputs())
+		meanVariance(weights, samplePreds, means[j], variances[j])
+	}
+	return means, variances, nil
+}
+
+type ensembleMarshaler struct {
+	Weights []float64 `json:",omitempty"`
+	Nets    []*Net
+}
+
+// MarshalJSON marshals the ensemble with the JSON of each of the nets
+func (e *Ensemble) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&ensembleMarshaler{Weights: e.Weights, Nets: e.Nets})
+}
+
+// UnmarshalJSON unmarshals the ensemble, and returns an error if the nets do not match
+func (e *Ensemble) UnmarshalJSON(data []byte) error {
+	v := &ensembleMarshaler{}
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("nnet/ensemble/unmarshaljson: error unmarshaling data: %v", err)
+	}
+	e.Nets = v.Nets
+	e.Weights = v.Weights
+	return e.check()
+}
+
+// Save saves the ensemble to a JSON file
+func (e *Ensemble) Save(filename string) error {
+	b, err := json.MarshalIndent(e, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0700)
+}
+
+// LoadEnsemble loads an ensemble from a JSON file saved with Save
+func LoadEnsemble(filename string) (*Ensemble, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	e := &Ensemble{}
+	err = json.Unmarshal(b, e)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
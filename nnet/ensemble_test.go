@@ -0,0 +1,143 @@
+package nnet
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btracey/nnet/scale"
+	"github.com/gonum/floats"
+)
+
+func newTestEnsemble(nInputs, nOutputs, nNets int) []*Net {
+	nets := make([]*Net, nNets)
+	for i := range nets {
+		nets[i] = DefaultRegression(nInputs, nOutputs, 1, 5)
+		if err := nets[i].Initialize(nil, rand.NewSource(int64(i))); err != nil {
+			panic(err)
+		}
+		nets[i].InputScaler.SetScale(RandomData(nInputs, 20))
+		nets[i].OutputScaler = &scale.Linear{}
+		nets[i].OutputScaler.SetScale(RandomData(nOutputs, 20))
+	}
+	return nets
+}
+
+func TestEnsemblePredict(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	nets := newTestEnsemble(nInputs, nOutputs, 4)
+	inputs := RandomSliceOfSlice(20, nInputs)
+	for _, weights := range [][]float64{nil, {1, 2, 0, 3}} {
+		e, err := NewEnsemble(nets, weights)
+		if err != nil {
+			t.Fatalf("Error making ensemble: %v", err)
+		}
+		means, variances, err := e.PredictSlice(inputs)
+		if err != nil {
+			t.Fatalf("Error predicting: %v", err)
+		}
+		for i, input := range inputs {
+			orig := append([]float64(nil), input...)
+			mean, variance, err := e.Predict(input)
+			if err != nil {
+				t.Fatalf("Error predicting: %v", err)
+			}
+			if !floats.Equal(input, orig) {
+				t.Errorf("Input changed by Predict")
+			}
+			// Compare with the weighted mean and variance of the nets predicting in turn
+			w := weights
+			if w == nil {
+				w = []float64{1, 1, 1, 1}
+			}
+			sumWeights := floats.Sum(w)
+			wantMean := make([]float64, nOutputs)
+			var preds [][]float64
+			for k, net := range nets {
+				pred, err := net.Predict(input)
+				if err != nil {
+					t.Fatalf("Error predicting: %v", err)
+				}
+				preds = append(preds, pred)
+				floats.AddScaled(wantMean, w[k]/sumWeights, pred)
+			}
+			wantVariance := make([]float64, nOutputs)
+			for k, pred := range preds {
+				for j := range pred {
+					d := pred[j] - wantMean[j]
+					wantVariance[j] += w[k] / sumWeights * d * d
+				}
+			}
+			if !floats.EqualApprox(mean, wantMean, 1e-12) || !floats.EqualApprox(variance, wantVariance, 1e-12) {
+				t.Errorf("Wrong mean or variance. Want %v and %v, got %v and %v", wantMean, wantVariance, mean, variance)
+			}
+			if !floats.EqualApprox(means[i], mean, 1e-12) || !floats.EqualApprox(variances[i], variance, 1e-12) {
+				t.Errorf("PredictSlice does not match Predict")
+			}
+		}
+	}
+
+	if _, err := NewEnsemble(nets, []float64{1, 2}); err == nil {
+		t.Errorf("No error for the wrong number of weights")
+	}
+	if _, err := NewEnsemble(nets, []float64{1, -2, 1, 1}); err == nil {
+		t.Errorf("No error for a negative weight")
+	}
+	if _, err := NewEnsemble(append(nets, newTestEnsemble(nInputs, nOutputs+1, 1)...), nil); err == nil {
+		t.Errorf("No error for nets which do not match")
+	}
+}
+
+func TestEnsembleJSON(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	e, err := NewEnsemble(newTestEnsemble(nInputs, nOutputs, 3), []float64{1, 2, 3})
+	if err != nil {
+		t.Fatalf("Error making ensemble: %v", err)
+	}
+	inputs := RandomSliceOfSlice(10, nInputs)
+	means, variances, err := e.PredictSlice(inputs)
+	if err != nil {
+		t.Fatalf("Error predicting: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "nnet")
+	if err != nil {
+		t.Fatalf("Error making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "ensemble.json")
+	if err := e.Save(filename); err != nil {
+		t.Fatalf("Error saving: %v", err)
+	}
+	e2, err := LoadEnsemble(filename)
+	if err != nil {
+		t.Fatalf("Error loading: %v", err)
+	}
+	if !floats.Equal(e.Weights, e2.Weights) || len(e2.Nets) != len(e.Nets) {
+		t.Errorf("Ensemble does not match after loading")
+	}
+	means2, variances2, err := e2.PredictSlice(inputs)
+	if err != nil {
+		t.Fatalf("Error predicting: %v", err)
+	}
+	for i := range means {
+		if !floats.EqualApprox(means[i], means2[i], 1e-14) || !floats.EqualApprox(variances[i], variances2[i], 1e-14) {
+			t.Errorf("Predictions don't match after loading")
+			break
+		}
+	}
+
+	// The nets must match when unmarshaling
+	b, err := json.Marshal(&Ensemble{Nets: append(e.Nets, newTestEnsemble(nInputs+1, nOutputs, 1)...)})
+	if err != nil {
+		t.Fatalf("Error marshaling: %v", err)
+	}
+	if err := json.Unmarshal(b, &Ensemble{}); err == nil {
+		t.Errorf("No error unmarshaling nets which do not match")
+	}
+}
@@ -0,0 +1,274 @@
+package nnet
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Evaluator computes the loss and derivative of a net (as ParLossDeriv) and predicts
+// (as PredictSlice) with a fixed number of workers. The memory of the workers is
+// allocated by NewEvaluator and reused by every call. The samples are split into chunks
+// which the workers take in turn, and the context is checked before each chunk, so
+// cancelling it stops the evaluation after the chunks in progress.
+//
+// The results of the chunks are summed as set by net.Reduction. With Ordered, the
+// derivative memory of the pending sums of the tree (see Ordered) is allocated the
+// first time it is needed and kept by the Evaluator.
+//
+// The structure of the net must not change while the Evaluator is in use. An
+// Evaluator may not be used by multiple goroutines at once.
+type Evaluator struct {
+	net       *Net
+	chunkSize int
+	workers   []*evalWorker
+
+	nInputs            int // The size of the net when the memory was allocated
+	totalNumParameters int
+
+	seeds   []int64            // The seeds of the dropout masks of each chunk
+	batches []*BatchStatistics // The batch statistics of each chunk
+	pooled  *BatchStatistics   // The memory of the batch statistics of all of the chunks
+	stats   *BatchStatistics   // The batch statistics of the last call to LossDeriv. nil if none
+
+	tree chunkTree // The sum of the chunks for Ordered reduction
+}
+
+// evalWorker is the memory of one worker of an Evaluator
+type evalWorker struct {
+	loss        float64
+	dLossDParam [][][]float64 // The sum of the derivatives of the chunks of the worker
+	chunk       [][][]float64 // The derivative of one chunk
+	p           *ParLossDerivMemory
+	predict     *predictScratch
+	err         error
+}
+
+// NewEvaluator returns an Evaluator for the net with nWorkers workers which each
+// process chunkSize samples at a time. Panics if nWorkers or chunkSize is less than one.
+func NewEvaluator(net *Net, nWorkers, chunkSize int) *Evaluator {
+	if nWorkers < 1 {
+		panic("nnet: number of workers must be at least one")
+	}
+	if chunkSize < 1 {
+		panic("nnet: chunk size must be at least one")
+	}
+	e := &Evaluator{
+		net:                net,
+		chunkSize:          chunkSize,
+		workers:            make([]*evalWorker, nWorkers),
+		nInputs:            net.nInputs,
+		totalNumParameters: net.totalNumParameters,
+		tree:               chunkTree{net: net},
+	}
+	for i := range e.workers {
+		w := &evalWorker{
+			p: NewParLossDerivMemory(net),
+			predict: &predictScratch{
+				input: make([]float64, net.nInputs),
+				tmp:   *net.NewPredictTmpMemory(),
+			},
+		}
+		w.dLossDParam, _ = net.NewPerParameterMemory()
+		w.chunk, _ = net.NewPerParameterMemory()
+		e.workers[i] = w
+	}
+	return e
+}
+
+// Workers returns the number of workers of the Evaluator
+func (e *Evaluator) Workers() int {
+	return len(e.workers)
+}
+
+// ChunkSize returns the number of samples processed by a worker at a time
+func (e *Evaluator) ChunkSize() int {
+	return e.chunkSize
+}
+
+// LossDeriv computes the loss and the derivative of the loss with respect to the
+// parameters over all of the samples as ParLossDeriv does, and stores the derivative
+// into dLossDParam. The batch statistics of batch normalization are kept for
+// BatchStatistics. If the context is cancelled before all of the chunks are processed,
+// the error of the context is returned, dLossDParam is not valid, and there are no
+// batch statistics.
+func (e *Evaluator) LossDeriv(ctx context.Context, inputs, truths [][]float64, weights []float64, dLossDParam [][][]float64) (loss float64, err error) {
+	if len(truths) != len(inputs) || len(weights) != len(inputs) {
+		return 0, errors.New("nnet: number of inputs, truths and weights must match")
+	}
+	if err := e.checkNet(); err != nil {
+		return 0, err
+	}
+	net := e.net
+	e.stats = nil
+	nChunks := e.numChunks(len(inputs))
+	if nChunks == 0 {
+		zeroParameterMemory(dLossDParam)
+		return 0, nil
+	}
+
+	// The seeds of the dropout masks are drawn in order so that the result does not
+	// depend on which worker processes which chunk
+	dropout := net.Mode == Train && net.hasDropout()
+	batchNorm := net.Mode == Train && hasBatchNorm(net.layers)
+	if dropout {
+		e.seeds = e.seeds[:0]
+		for c := 0; c < nChunks; c++ {
+			e.seeds = append(e.seeds, net.dropoutSeed())
+		}
+	}
+	if batchNorm {
+		for len(e.batches) < nChunks {
+			e.batches = append(e.batches, net.newBatchStatistics())
+		}
+	}
+	ordered := net.Reduction == Ordered
+	if ordered {
+		e.tree.reset(nChunks)
+	}
+
+	for _, w := range e.workers {
+		w.loss = 0
+		zeroParameterMemory(w.dLossDParam)
+	}
+	err = e.run(ctx, nChunks, func(w *evalWorker, c int) error {
+		start, end := e.chunkBounds(c, len(inputs))
+		if dropout {
+			w.p.seed(e.seeds[c])
+		}
+		if ordered {
+			d := e.tree.memory()
+			e.tree.add(c, SeqLossDeriv(inputs[start:end], truths[start:end], weights[start:end], net, d, w.p), d)
+		} else {
+			w.loss += SeqLossDeriv(inputs[start:end], truths[start:end], weights[start:end], net, w.chunk, w.p)
+			net.addParameterMemory(w.dLossDParam, w.chunk)
+		}
+		if batchNorm {
+			e.batches[c].copyStatistics(w.p.batch.BatchStatistics)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if ordered {
+		loss = e.tree.sum(dLossDParam)
+	} else {
+		zeroParameterMemory(dLossDParam)
+		for _, w := range e.workers {
+			loss += w.loss
+			net.addParameterMemory(dLossDParam, w.dLossDParam)
+		}
+	}
+	if batchNorm {
+		if e.pooled == nil {
+			e.pooled = net.newBatchStatistics()
+		}
+		e.stats = net.poolBatchStatistics(e.pooled, e.batches[:nChunks])
+	}
+	return loss, nil
+}
+
+// BatchStatistics returns the batch statistics of batch normalization of the last
+// call to LossDeriv for Net.UpdateRunningStatistics, or nil if there are none. The
+// memory is reused by the next call to LossDeriv.
+func (e *Evaluator) BatchStatistics() *BatchStatistics {
+	return e.stats
+}
+
+// Predict predicts the values at all of the (unscaled) inputs as PredictSlice does,
+// and stores them into predictions, which must have the same length as inputs and
+// elements of length net.Outputs(). The inputs are not modified. If the context is
+// cancelled before all of the chunks are processed, the error of the context is returned.
+func (e *Evaluator) Predict(ctx context.Context, inputs, predictions [][]float64) error {
+	if len(predictions) != len(inputs) {
+		return errors.New("nnet: number of inputs and predictions must match")
+	}
+	if err := e.checkNet(); err != nil {
+		return err
+	}
+	net := e.net
+	if err := net.checkPredict(nil, nil); err != nil {
+		return err
+	}
+	return e.run(ctx, e.numChunks(len(inputs)), func(w *evalWorker, c int) error {
+		start, end := e.chunkBounds(c, len(inputs))
+		for i := start; i < end; i++ {
+			if err := net.checkPredict(inputs[i], predictions[i]); err != nil {
+				return err
+			}
+			if err := net.predict(inputs[i], predictions[i], w.predict); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// run processes the chunks with the workers. If processing a chunk returns an error,
+// the other workers stop and the error is returned.
+func (e *Evaluator) run(ctx context.Context, nChunks int, process func(w *evalWorker, c int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var next, done int64
+	var wg sync.WaitGroup
+	for _, w := range e.workers {
+		w.err = nil
+		wg.Add(1)
+		go func(w *evalWorker) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				c := int(atomic.AddInt64(&next, 1) - 1)
+				if c >= nChunks {
+					return
+				}
+				if err := process(w, c); err != nil {
+					w.err = err
+					cancel()
+					return
+				}
+				atomic.AddInt64(&done, 1)
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, w := range e.workers {
+		if w.err != nil {
+			return w.err
+		}
+	}
+	if int(done) < nChunks {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// checkNet checks that the size of the net has not changed since the memory was allocated
+func (e *Evaluator) checkNet() error {
+	if e.net.nInputs != e.nInputs || e.net.totalNumParameters != e.totalNumParameters {
+		return errors.New("nnet: net changed since the Evaluator was created")
+	}
+	return nil
+}
+
+func (e *Evaluator) numChunks(nSamples int) int {
+	return numChunks(nSamples, e.chunkSize)
+}
+
+// chunkBounds returns the range of samples in chunk c
+func (e *Evaluator) chunkBounds(c, nSamples int) (start, end int) {
+	return chunkBounds(c, e.chunkSize, nSamples)
+}
+
+// zeroParameterMemory sets all of the elements of the memory to zero
+func zeroParameterMemory(mem [][][]float64) {
+	for i := range mem {
+		for j := range mem[i] {
+			for k := range mem[i][j] {
+				mem[i][j][k] = 0
+			}
+		}
+	}
+}
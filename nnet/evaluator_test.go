@@ -0,0 +1,196 @@
+package nnet
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gonum/floats"
+)
+
+// runningStatistics returns a copy of the running statistics of the layers
+func runningStatistics(net *Net) [][]float64 {
+	var stats [][]float64
+	for _, layer := range net.layers {
+		if b := layer.BatchNorm; b != nil {
+			stats = append(stats, append([]float64(nil), b.RunningMean...), append([]float64(nil), b.RunningVar...))
+		}
+	}
+	return stats
+}
+
+func setRunningStatistics(net *Net, stats [][]float64) {
+	for _, layer := range net.layers {
+		if b := layer.BatchNorm; b != nil {
+			copy(b.RunningMean, stats[0])
+			copy(b.RunningVar, stats[1])
+			stats = stats[2:]
+		}
+	}
+}
+
+func TestEvaluatorLossDeriv(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	nSamples := 53
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := RandomSliceOfSlice(nSamples, nOutputs)
+	weights := RandomWeights(nSamples)
+	for _, test := range []struct {
+		name string
+		net  *Net
+	}{
+		{"dense", newPruneNet(nInputs, nOutputs)},
+		{"dropout", newDropoutNet(nInputs, nOutputs)},
+		{"batch norm", newBatchNormNet(nInputs, nOutputs)},
+		{"shared", newSharedNet(t)},
+	} {
+		net := test.net
+		for _, chunkSize := range []int{7, 100} {
+			stats := runningStatistics(net)
+			net.DropoutSource = rand.NewSource(1)
+			want, wantFlat := net.NewPerParameterMemory()
+			wantLoss, batch := ParLossDerivStatistics(inputs, truths, weights, net, want, chunkSize)
+			net.UpdateRunningStatistics(batch)
+			wantStats := runningStatistics(net)
+
+			e := NewEvaluator(net, 3, chunkSize)
+			// The memory is reused, so the second evaluation must be the same
+			for rep := 0; rep < 2; rep++ {
+				setRunningStatistics(net, stats)
+				net.DropoutSource = rand.NewSource(1)
+				got, gotFlat := net.NewPerParameterMemory()
+				loss, err := e.LossDeriv(context.Background(), inputs, truths, weights, got)
+				if err != nil {
+					t.Fatalf("%v: error evaluating: %v", test.name, err)
+				}
+				net.UpdateRunningStatistics(e.BatchStatistics())
+				if math.Abs(loss-wantLoss) > 1e-12 {
+					t.Errorf("%v, chunk size %v: loss mismatch. Want %v, got %v", test.name, chunkSize, wantLoss, loss)
+				}
+				if !floats.EqualApprox(gotFlat, wantFlat, 1e-12) {
+					t.Errorf("%v, chunk size %v: derivative mismatch", test.name, chunkSize)
+				}
+				if !predictionsMatch(runningStatistics(net), wantStats, 1e-12) {
+					t.Errorf("%v, chunk size %v: running statistics mismatch", test.name, chunkSize)
+				}
+			}
+		}
+	}
+}
+
+func TestEvaluatorNoSamples(t *testing.T) {
+	net := newBatchNormNet(3, 2)
+	stats := runningStatistics(net)
+	for _, reduction := range []Reduction{Unordered, Ordered} {
+		net.Reduction = reduction
+		e := NewEvaluator(net, 2, 5)
+		d, flat := net.NewPerParameterMemory()
+		for i := range flat {
+			flat[i] = 1
+		}
+		loss, err := e.LossDeriv(context.Background(), nil, nil, nil, d)
+		if e.BatchStatistics() != nil {
+			t.Errorf("Reduction %v: batch statistics with no samples", reduction)
+		}
+		net.UpdateRunningStatistics(e.BatchStatistics())
+		if err != nil {
+			t.Errorf("Reduction %v: error with no samples: %v", reduction, err)
+		}
+		if loss != 0 {
+			t.Errorf("Reduction %v: nonzero loss with no samples: %v", reduction, loss)
+		}
+		for _, v := range flat {
+			if v != 0 {
+				t.Errorf("Reduction %v: nonzero derivative with no samples", reduction)
+				break
+			}
+		}
+	}
+	if !predictionsMatch(runningStatistics(net), stats, 0) {
+		t.Errorf("Running statistics changed with no samples")
+	}
+}
+
+func TestEvaluatorPredict(t *testing.T) {
+	net := newPruneNet(3, 2)
+	inputs := RandomSliceOfSlice(250, 3)
+	want, err := net.PredictSlice(inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEvaluator(net, 4, 16)
+	predictions := make([][]float64, len(inputs))
+	for i := range predictions {
+		predictions[i] = make([]float64, net.Outputs())
+	}
+	if err := e.Predict(context.Background(), inputs, predictions); err != nil {
+		t.Fatal(err)
+	}
+	if !predictionsMatch(predictions, want, 0) {
+		t.Errorf("Predictions do not match PredictSlice")
+	}
+
+	inputs[100] = inputs[100][:2]
+	if err := e.Predict(context.Background(), inputs, predictions); err == nil {
+		t.Errorf("No error for an input of the wrong length")
+	}
+}
+
+func TestEvaluatorCancel(t *testing.T) {
+	nSamples := 100
+	net := newBatchNormNet(3, 2)
+	inputs := RandomSliceOfSlice(nSamples, 3)
+	truths := RandomSliceOfSlice(nSamples, 2)
+	weights := RandomWeights(nSamples)
+	predictions := RandomSliceOfSlice(nSamples, 2)
+	e := NewEvaluator(net, 2, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stats := runningStatistics(net)
+	dLossDParam, _ := net.NewPerParameterMemory()
+	if _, err := e.LossDeriv(ctx, inputs, truths, weights, dLossDParam); err != context.Canceled {
+		t.Errorf("LossDeriv with a cancelled context returned %v", err)
+	}
+	if e.BatchStatistics() != nil {
+		t.Errorf("Batch statistics from a cancelled evaluation")
+	}
+	net.UpdateRunningStatistics(e.BatchStatistics())
+	if !predictionsMatch(runningStatistics(net), stats, 0) {
+		t.Errorf("Running statistics updated by a cancelled evaluation")
+	}
+	if err := e.Predict(ctx, inputs, predictions); err != context.Canceled {
+		t.Errorf("Predict with a cancelled context returned %v", err)
+	}
+
+	// Cancel while the workers are running
+	ctx, cancel = context.WithCancel(context.Background())
+	var processed int64
+	err := e.run(ctx, 1000, func(w *evalWorker, c int) error {
+		if c == 10 {
+			cancel()
+		}
+		atomic.AddInt64(&processed, 1)
+		return nil
+	})
+	if err != context.Canceled {
+		t.Errorf("Cancelling while running returned %v", err)
+	}
+	if processed == 1000 {
+		t.Errorf("All of the chunks processed after cancelling")
+	}
+
+	// The Evaluator still works after being cancelled
+	if _, err := e.LossDeriv(context.Background(), inputs, truths, weights, dLossDParam); err != nil {
+		t.Errorf("Error after cancelling: %v", err)
+	}
+	if err := net.AddNeurons(0, nil, &TanhNeuron); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.LossDeriv(context.Background(), inputs, truths, weights, dLossDParam); err == nil {
+		t.Errorf("No error for a net which changed")
+	}
+}
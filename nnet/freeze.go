@@ -0,0 +1,172 @@
+package nnet
+
+// Parameters can be frozen at the level of layers or neurons, for example to retrain
+// only the last layers of a net. Frozen parameters are not changed by training: their
+// derivatives from PredLossDeriv, SeqLossDeriv and ParLossDeriv are zero, and they
+// are not part of the trainable parameters. The derivatives of layers below the
+// lowest layer with a trainable parameter are not computed at all. Freezing is part
+// of the training setup and is not saved with the net.
+
+// SetLayerFrozen freezes or unfreezes all of the parameters of a layer, including
+// the gammas and betas of batch normalization
+func (net *Net) SetLayerFrozen(layer int, frozen bool) {
+	net.initFrozen()
+	for j := range net.frozen[layer] {
+		net.frozen[layer][j] = frozen
+	}
+}
+
+// SetNeuronFrozen freezes or unfreezes the parameters of one neuron
+func (net *Net) SetNeuronFrozen(layer, neuron int, frozen bool) {
+	if neuron < 0 || neuron >= len(net.layers[layer].Neurons) {
+		panic("nnet: neuron index out of range")
+	}
+	net.initFrozen()
+	net.frozen[layer][neuron] = frozen
+}
+
+// NeuronFrozen returns true if the parameters of the neuron are frozen
+func (net *Net) NeuronFrozen(layer, neuron int) bool {
+	if net.frozen == nil {
+		return false
+	}
+	return net.frozen[layer][neuron]
+}
+
+// initFrozen allocates the freeze mask, which has one entry per entry of nParameters
+func (net *Net) initFrozen() {
+	if net.frozen != nil {
+		return
+	}
+	net.frozen = make([][]bool, len(net.nParameters))
+	for i := range net.frozen {
+		net.frozen[i] = make([]bool, len(net.nParameters[i]))
+	}
+}
+
+// lowestTrainableLayer returns the index of the lowest layer with a trainable
+// parameter, or the number of layers if all of the parameters are frozen
+func (net *Net) lowestTrainableLayer() int {
+	if net.frozen == nil {
+		return 0
+	}
+	for i, layer := range net.frozen {
+		for _, frozen := range layer {
+			if !frozen {
+				return i
+			}
+		}
+	}
+	return len(net.frozen)
+}
+
+// zeroFrozen sets the derivatives of the frozen (and pruned) parameters to zero
+func (net *Net) zeroFrozen(dLossDParam [][][]float64) {
+	net.zeroPruned(dLossDParam)
+	if net.frozen == nil {
+		return
+	}
+	for i, layer := range net.frozen {
+		for j, frozen := range layer {
+			if !frozen {
+				continue
+			}
+			for k := range dLossDParam[i][j] {
+				dLossDParam[i][j][k] = 0
+			}
+		}
+	}
+}
+
+// trainable returns which entries of parameters are trainable. Shared parameters
+// are only trainable in their first entry, and only if none of the neurons which
+// share them are frozen
+func (net *Net) trainable() [][]bool {
+	frozenBlock := make(map[int]bool)
+	for i, layer := range net.frozen {
+		for j, frozen := range layer {
+			if frozen {
+				frozenBlock[net.parameterIdx[i][j]] = true
+			}
+		}
+	}
+	trainable := make([][]bool, len(net.frozen))
+	for i, layer := range net.frozen {
+		trainable[i] = make([]bool, len(layer))
+		for j := range layer {
+			aliased := net.aliased != nil && net.aliased[i][j]
+			trainable[i][j] = !aliased && !frozenBlock[net.parameterIdx[i][j]]
+		}
+	}
+	return trainable
+}
+
+// NumTrainableParameters returns the number of parameters which are not frozen
+func (net *Net) NumTrainableParameters() int {
+	if net.frozen == nil {
+		return net.totalNumParameters
+	}
+	var n int
+	for i, layer := range net.trainable() {
+		for j, trainable := range layer {
+			if trainable {
+				n += net.nParameters[i][j]
+			}
+		}
+	}
+	return n
+}
+
+// TrainableSlice copies the entries of src for the trainable parameters into dst.
+// src has one entry per parameter (like the flat memory from NewPerParameterMemory)
+// and dst has one entry per trainable parameter. This gives the derivative with
+// respect to the trainable parameters from the derivative with respect to all of them.
+func (net *Net) TrainableSlice(src, dst []float64) {
+	if len(src) != net.totalNumParameters {
+		panic("length of src does not match the number of parameters")
+	}
+	if len(dst) != net.NumTrainableParameters() {
+		panic("length of dst does not match the number of trainable parameters")
+	}
+	if net.frozen == nil {
+		copy(dst, src)
+		return
+	}
+	var count int
+	for i, layer := range net.trainable() {
+		for j, trainable := range layer {
+			if !trainable {
+				continue
+			}
+			start := net.parameterIdx[i][j]
+			count += copy(dst[count:], src[start:start+net.nParameters[i][j]])
+		}
+	}
+}
+
+// TrainableParametersSlice copies the trainable parameters into dst
+func (net *Net) TrainableParametersSlice(dst []float64) {
+	net.TrainableSlice(net.parametersSlice, dst)
+}
+
+// SetTrainableParametersSlice sets the trainable parameters to the values in src.
+// The frozen parameters are not changed
+func (net *Net) SetTrainableParametersSlice(src []float64) {
+	if len(src) != net.NumTrainableParameters() {
+		panic("length of src does not match the number of trainable parameters")
+	}
+	defer net.zeroPrunedParameters()
+	if net.frozen == nil {
+		copy(net.parametersSlice, src)
+		return
+	}
+	var count int
+	for i, layer := range net.trainable() {
+		for j, trainable := range layer {
+			if !trainable {
+				continue
+			}
+			count += copy(net.parameters[i][j], src[count:])
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package nnet
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/btracey/nnet/loss"
+	"github.com/gonum/floats"
+)
+
+func TestFreezeDeriv(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	nSamples := 20
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := RandomSliceOfSlice(nSamples, nOutputs)
+	weights := RandomWeights(nSamples)
+
+	dense := DefaultRegression(nInputs, nOutputs, 2, 5)
+	dense.Losser = loss.SquaredDistance{}
+	for _, test := range []struct {
+		name string
+		net  *Net
+	}{
+		{"dense", dense},
+		{"per neuron", newPerNeuronNet(dense)},
+		{"dropout", newDropoutNet(nInputs, nOutputs)},
+		{"batch norm", newBatchNormNet(nInputs, nOutputs)},
+	} {
+		net := test.net
+		seqLossDeriv := func(dLossDParam [][][]float64) float64 {
+			p := NewParLossDerivMemory(net)
+			p.rand = rand.New(rand.NewSource(1))
+			return SeqLossDeriv(inputs, truths, weights, net, dLossDParam, p)
+		}
+		dLossDParam, _ := net.NewPerParameterMemory()
+		loss := seqLossDeriv(dLossDParam)
+
+		net.SetLayerFrozen(0, true)
+		net.SetNeuronFrozen(1, 0, true)
+		if !net.NeuronFrozen(0, 1) || !net.NeuronFrozen(1, 0) || net.NeuronFrozen(1, 1) {
+			t.Errorf("Wrong frozen neurons for %v", test.name)
+		}
+		if net.lowestTrainableLayer() != 1 {
+			t.Errorf("Wrong lowest trainable layer for %v", test.name)
+		}
+		frozenDLossDParam, frozenDLossFlat := net.NewPerParameterMemory()
+		// Set the memory to make sure that the frozen derivatives are overwritten
+		for i := range frozenDLossFlat {
+			frozenDLossFlat[i] = 1
+		}
+		frozenLoss := seqLossDeriv(frozenDLossDParam)
+		if frozenLoss != loss {
+			t.Errorf("Loss changed by freezing for %v", test.name)
+		}
+		for l := range frozenDLossDParam {
+			for n := range frozenDLossDParam[l] {
+				frozen := l == 0 || (l == 1 && n == 0)
+				for k, val := range frozenDLossDParam[l][n] {
+					want := dLossDParam[l][n][k]
+					if frozen {
+						want = 0
+					}
+					if !floats.EqualWithinAbsOrRel(val, want, 1e-12, 1e-12) {
+						t.Errorf("Wrong derivative for %v at %v, %v, %v. Want %v, got %v", test.name, l, n, k, want, val)
+					}
+				}
+			}
+		}
+
+		// The trainable derivative is the subset of the full derivative
+		nTrainable := net.NumTrainableParameters()
+		var want int
+		for l := range net.nParameters {
+			for n, nParam := range net.nParameters[l] {
+				if !net.NeuronFrozen(l, n) {
+					want += nParam
+				}
+			}
+		}
+		if nTrainable != want {
+			t.Errorf("Wrong number of trainable parameters for %v. Want %v, got %v", test.name, want, nTrainable)
+		}
+		trainable := make([]float64, nTrainable)
+		net.TrainableSlice(frozenDLossFlat, trainable)
+		if floats.Sum(trainable) != floats.Sum(frozenDLossFlat) {
+			t.Errorf("Trainable derivative does not contain all of the non-zero derivatives for %v", test.name)
+			fmt.Println(trainable)
+			fmt.Println(frozenDLossFlat)
+		}
+
+		net.SetLayerFrozen(0, false)
+		net.SetNeuronFrozen(1, 0, false)
+		if net.NumTrainableParameters() != net.TotalNumParameters() {
+			t.Errorf("Not all parameters trainable after unfreezing for %v", test.name)
+		}
+	}
+}
+
+func TestFreezeAll(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	nSamples := 10
+	net := DefaultRegression(nInputs, nOutputs, 2, 5)
+	net.Losser = loss.SquaredDistance{}
+	for l := range net.layers {
+		net.SetLayerFrozen(l, true)
+	}
+	if net.NumTrainableParameters() != 0 {
+		t.Errorf("Trainable parameters with all layers frozen")
+	}
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := RandomSliceOfSlice(nSamples, nOutputs)
+	weights := RandomWeights(nSamples)
+	dLossDParam, dLossFlat := net.NewPerParameterMemory()
+	loss := ParLossDeriv(inputs, truths, weights, net, dLossDParam, 3)
+	if loss == 0 {
+		t.Errorf("Zero loss with all layers frozen")
+	}
+	for _, val := range dLossFlat {
+		if val != 0 {
+			t.Errorf("Non-zero derivative with all layers frozen")
+			break
+		}
+	}
+}
+
+func TestTrainableParametersSlice(t *testing.T) {
+	net := DefaultRegression(3, 2, 2, 5)
+	net.SetLayerFrozen(1, true)
+	net.SetNeuronFrozen(2, 1, true)
+
+	all := make([]float64, net.TotalNumParameters())
+	net.ParametersSlice(all)
+	trainable := make([]float64, net.NumTrainableParameters())
+	net.TrainableParametersSlice(trainable)
+
+	newTrainable := RandomSliceOfSlice(1, len(trainable))[0]
+	net.SetTrainableParametersSlice(newTrainable)
+	got := make([]float64, len(trainable))
+	net.TrainableParametersSlice(got)
+	if !floats.Equal(got, newTrainable) {
+		t.Errorf("Trainable parameters not set")
+	}
+	var count int
+	for l := range net.parameters {
+		for n := range net.parameters[l] {
+			for k, val := range net.parameters[l][n] {
+				if net.NeuronFrozen(l, n) {
+					if val != all[net.parameterIdx[l][n]+k] {
+						t.Errorf("Frozen parameter changed at %v, %v, %v", l, n, k)
+					}
+					continue
+				}
+				if val != newTrainable[count] {
+					t.Errorf("Wrong trainable parameter at %v, %v, %v", l, n, k)
+				}
+				count++
+			}
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package nnet
 
 import (
+	"github.com/gonum/blas"
+	"github.com/gonum/blas/blas64"
 	"github.com/gonum/floats"
 )
 
@@ -14,7 +16,12 @@ func ProcessNeuron(neuron Neuron, parameters, inputs []float64) (combination, ou
 func DLossNeuron(n Neuron, parameters []float64, inputs []float64, combination, output, dLossDOutput float64, dLossDParam, dLossDInput []float64) {
 	dOutputDCombination := n.DActivateDCombination(combination, output)
 	dLossDCombination := dLossDOutput * dOutputDCombination
+	dLossNeuronCombination(n, parameters, inputs, combination, dLossDCombination, dLossDParam, dLossDInput)
+}
 
+// dLossNeuronCombination is DLossNeuron given the derivative of the loss with respect to
+// the combination rather than with respect to the output
+func dLossNeuronCombination(n Neuron, parameters []float64, inputs []float64, combination, dLossDCombination float64, dLossDParam, dLossDInput []float64) {
 	// Store DCombineDParameters into dLossDParam
 	n.DCombineDParameters(parameters, inputs, combination, dLossDParam)
 	// Actual dLossDParam is dLossDCombination * dLossDParam
@@ -35,6 +42,14 @@ func DLossNeuron(n Neuron, parameters []float64, inputs []float64, combination,
 // inputs are the inputs to that layer (the outputs of the previous layer)
 // Stores in place the combinations of the neurons and the outputs of the neurons (as set by neuron.Process)
 func ProcessLayer(layer *Layer, parameters [][]float64, inputs []float64, combinations, outputs []float64) {
+	if layer.Activation != nil || layer.BatchNorm != nil {
+		for i, neuron := range layer.Neurons {
+			combinations[i] = neuron.Combine(parameters[i], inputs)
+		}
+		layer.normalize(parameters, combinations)
+		layer.activate(combinations, outputs)
+		return
+	}
 	for i, neuron := range layer.Neurons {
 		combinations[i], outputs[i] = ProcessNeuron(neuron, parameters[i], inputs)
 	}
@@ -42,19 +57,28 @@ func ProcessLayer(layer *Layer, parameters [][]float64, inputs []float64, combin
 
 // Predict feeds the input through the network and stores the prediction into predOutput.
 // It caches the weighted sums and outputs (for example, for use with PredictWithDerivative)
-// Assumes the input is appropriately scaled
+// Assumes the input is appropriately scaled. For a graph net, Predict allocates
+// the memory for the concatenated inputs of the layers.
 func Predict(input []float64, net *Net, predOutput []float64, combinations, outputs [][]float64) {
+	forward(input, net, predOutput, combinations, outputs, net.newLayerInputMemory())
+}
+
+// forward is Predict with the memory for the inputs of the layers from newLayerInputMemory
+func forward(input []float64, net *Net, predOutput []float64, combinations, outputs, layerInputs [][]float64) {
 	nLayers := len(net.layers)
 
 	parameters := net.parameters
 	layers := net.layers
 
-	// Process the first layer (which uses the input as an input).
-	ProcessLayer(&layers[0], parameters[0], input, combinations[0], outputs[0])
-
-	// Process all of the rest of the layers by using the ouptus of the previous layer as inputs
-	for i := 1; i < nLayers; i++ {
-		ProcessLayer(&layers[i], parameters[i], outputs[i-1], combinations[i], outputs[i])
+	// Process all of the layers, each of which uses the outputs of its sources
+	// as inputs. Layers of SumNeurons are computed with a matrix-vector product
+	for i := 0; i < nLayers; i++ {
+		layerInput := net.layerInput(i, input, outputs, layerInputs)
+		if net.sparseIdx != nil && net.sparseIdx[i] != nil {
+			processSparseLayer(&layers[i], parameters[i], net.sparseIdx[i], layerInput, combinations[i], outputs[i])
+		} else if !ProcessSumLayer(&layers[i], parameters[i], layerInput, combinations[i], outputs[i]) {
+			ProcessLayer(&layers[i], parameters[i], layerInput, combinations[i], outputs[i])
+		}
 	}
 
 	// The predicted output is the outputs from the last layer
@@ -64,23 +88,52 @@ func Predict(input []float64, net *Net, predOutput []float64, combinations, outp
 
 // DerivPredLossTmpMemory is the temporary memory needed for computing the derivative
 type PredLossDerivTmpMemory struct {
-	combinations [][]float64
-	outputs      [][]float64
-	dLossDPred   []float64
-	dLossDOutput [][]float64
-	dLossDInput  [][][]float64
+	combinations     [][]float64
+	outputs          [][]float64
+	dLossDPred       []float64
+	dLossDOutput     [][]float64
+	dLossDInput      [][][]float64
+	layerInputs      [][]float64   // The concatenated inputs of the layers of a graph net
+	dLossDLayerInput [][]float64   // The derivatives with respect to the inputs of the layers of a graph net
+	unnormalized     [][]float64   // The combinations of the layers with batch normalization before the normalization
+	untied           [][][]float64 // Derivatives of neurons which share parameters. Allocated the first time it is needed
+}
+
+// unnormalizedLayer returns the memory for the unnormalized combinations of layer l,
+// or nil if there is none
+func (tmp *PredLossDerivTmpMemory) unnormalizedLayer(l int) []float64 {
+	if tmp.unnormalized == nil {
+		return nil
+	}
+	return tmp.unnormalized[l]
 }
 
 // DerivPredLoss predicts the value at the input, compute the value of the loss,
 // and computes the derivative of the loss with respect to the parameters
 func PredLossDeriv(input []float64, truth []float64, weight float64, net *Net, tmp *PredLossDerivTmpMemory, prediction []float64, dLossDParam [][][]float64) (loss float64) {
-	Predict(input, net, prediction, tmp.combinations, tmp.outputs)
+	if net.aliased == nil {
+		return predLossDeriv(input, truth, weight, net, tmp, prediction, dLossDParam)
+	}
+	if tmp.untied == nil {
+		tmp.untied, _ = net.newUntiedParameterMemory()
+	}
+	loss = predLossDeriv(input, truth, weight, net, tmp, prediction, tmp.untied)
+	net.sumShared(tmp.untied, dLossDParam)
+	net.zeroFrozen(dLossDParam)
+	return loss
+}
+
+// predLossDeriv is PredLossDeriv, but dLossDParam has a separate entry for every
+// neuron as in newUntiedParameterMemory
+func predLossDeriv(input []float64, truth []float64, weight float64, net *Net, tmp *PredLossDerivTmpMemory, prediction []float64, dLossDParam [][][]float64) (loss float64) {
+	forward(input, net, prediction, tmp.combinations, tmp.outputs, tmp.layerInputs)
 	loss = net.Losser.LossAndDeriv(prediction, truth, tmp.dLossDPred)
 
 	// scale the loss and derivative by the weight
 	loss *= weight
 	floats.Scale(weight, tmp.dLossDPred)
-	Derivative(input, net.layers, net.parameters, tmp.dLossDPred, tmp.combinations, tmp.outputs, tmp.dLossDOutput, tmp.dLossDInput, dLossDParam)
+	derivative(input, net, tmp.dLossDPred, tmp, dLossDParam, net.lowestTrainableLayer())
+	net.zeroFrozen(dLossDParam)
 	return loss
 }
 
@@ -91,11 +144,45 @@ func PredLossDeriv(input []float64, truth []float64, weight float64, net *Net, t
 // dLossDOutput is the derivative of the loss with respect to the outputs of that layer
 // dLossDParam and dLossDInput are stored in place
 func DerivativesLayer(l Layer, parameters [][]float64, inputs []float64, combinations, outputs, dLossDOutput []float64, dLossDParam, dLossDInput [][]float64) {
+	if l.Activation != nil || l.BatchNorm != nil {
+		dLossDOutput = append([]float64(nil), dLossDOutput...)
+	}
+	derivativesLayer(l, parameters, inputs, combinations, outputs, dLossDOutput, dLossDParam, dLossDInput, nil)
+}
+
+// derivativesLayer is DerivativesLayer, but if the layer has an Activation or BatchNorm,
+// dLossDOutput is overwritten with the derivative of the loss with respect to the
+// combinations. unnormalized is storage for the combinations of a layer with batch
+// normalization, and is allocated if it is nil.
+func derivativesLayer(l Layer, parameters [][]float64, inputs []float64, combinations, outputs, dLossDOutput []float64, dLossDParam, dLossDInput [][]float64, unnormalized []float64) {
+	if l.Activation != nil || l.BatchNorm != nil {
+		dLossDCombination := dLossDOutput
+		l.dLossDCombination(combinations, outputs, dLossDOutput, dLossDCombination)
+		if l.BatchNorm != nil {
+			// The stored combinations are normalized, so find the combinations of the neurons
+			combinations = l.unnormalized(parameters, inputs, unnormalized)
+			l.dLossDUnnormalized(parameters, combinations, dLossDCombination, dLossDParam[len(l.Neurons)])
+		}
+		for i, neuron := range l.Neurons {
+			dLossNeuronCombination(neuron, parameters[i], inputs, combinations[i], dLossDCombination[i], dLossDParam[i], dLossDInput[i])
+		}
+		return
+	}
 	for i, neuron := range l.Neurons {
 		DLossNeuron(neuron, parameters[i], inputs, combinations[i], outputs[i], dLossDOutput[i], dLossDParam[i], dLossDInput[i])
 	}
 }
 
+// unnormalized returns the combinations of the neurons of a layer with batch
+// normalization stored into dst, which is allocated if it is nil
+func (l *Layer) unnormalized(parameters [][]float64, inputs, dst []float64) []float64 {
+	if dst == nil {
+		dst = make([]float64, len(l.Neurons))
+	}
+	l.combine(parameters, inputs, dst)
+	return dst
+}
+
 // DInputToDOutput changes the derivative of the loss wrt the inputs of the layer to
 // next layer wrt the input and changes it to the derivative of the loss wrt the inputs
 // of the previous layer
@@ -116,7 +203,17 @@ func DInputToDOutput(nextLayerDLossDInput [][]float64, previousLayerDLossDOutput
 // input, layers, parameters, dLossDPred, combinations, and outputs are all true inputs to the method.
 // dLossDParam is the output of the method
 // dLossDOutput and dLossDInput are storage for temporary variables
+// The layers are sequential, as in a net made by NewNet.
 func Derivative(input []float64, layers []Layer, parameters [][][]float64, dLossDPred []float64, combinations, outputs, dLossDOutput [][]float64, dLossDInput, dLossDParam [][][]float64) {
+	net := &Net{layers: layers, parameters: parameters}
+	tmp := &PredLossDerivTmpMemory{combinations: combinations, outputs: outputs, dLossDOutput: dLossDOutput, dLossDInput: dLossDInput}
+	derivative(input, net, dLossDPred, tmp, dLossDParam, 0)
+}
+
+// derivative is Derivative for the net with the memory in tmp, but the derivatives are
+// only computed for the layers starting at lowest. The derivatives for the layers
+// below are not changed.
+func derivative(input []float64, net *Net, dLossDPred []float64, tmp *PredLossDerivTmpMemory, dLossDParam [][][]float64, lowest int) {
 	// For each layer, the following holds
 	// dL/dp_{k,i,L} = dL/dout_{i,L} * dout_{i,L}/dcomb_{i,L} * dcomb_{i,L}/dp_{k,i,L}
 	// where
@@ -142,18 +239,113 @@ func Derivative(input []float64, layers []Layer, parameters [][][]float64, dLoss
 	// The derivative of the loss with respect to the ouputs of the last layer
 	// is the same as the derivative of the loss function with respect to the
 	// predictions (because the outputs of the last layer are the predictions)
-	nLayers := len(layers)
-	copy(dLossDOutput[nLayers-1], dLossDPred)
-
-	for l := nLayers - 1; l > 0; l-- {
-		// Compute dLossDParam and dLossDInput. Inputs to the layer are the outputs of the previous layer
-		DerivativesLayer(layers[l], parameters[l], outputs[l-1], combinations[l], outputs[l], dLossDOutput[l], dLossDParam[l], dLossDInput[l])
-		for j := range dLossDOutput[l-1] {
-			dLossDOutput[l-1][j] = 0
+	// For a graph net, the derivative with respect to the outputs of a layer is summed
+	// over all of the layers which read from it. The layers are in topological order,
+	// so when layer l is reached all of those layers have added their contributions.
+	nLayers := len(net.layers)
+	if lowest >= nLayers {
+		return
+	}
+	net.zeroDLossDOutput(lowest, tmp.dLossDOutput)
+	copy(tmp.dLossDOutput[nLayers-1], dLossDPred)
+
+	for l := nLayers - 1; l >= lowest; l-- {
+		derivativeLayer(l, lowest, input, tmp.outputs, net, tmp, dLossDParam, nil)
+	}
+}
+
+// derivativeLayer computes the derivatives of the loss with respect to the parameters
+// of layer l given the derivative with respect to its outputs in tmp.dLossDOutput[l],
+// which is overwritten. The derivative with respect to the inputs of the layer is added
+// to the derivatives with respect to the outputs of its sources starting at lowest
+// (or stored into them for a sequential net). sourceOutputs are the outputs of the
+// layers as seen by the layers which read them. If dLossDNetInput is not nil, the
+// derivative with respect to the inputs of the net is also found in the same way.
+func derivativeLayer(l, lowest int, input []float64, sourceOutputs [][]float64, net *Net, tmp *PredLossDerivTmpMemory, dLossDParam [][][]float64, dLossDNetInput []float64) {
+	layer := net.layers[l]
+	parameters := net.parameters[l]
+	combinations := tmp.combinations[l]
+	outputs := tmp.outputs[l]
+	dLossDOutput := tmp.dLossDOutput[l]
+
+	layerInput := net.layerInput(l, input, sourceOutputs, tmp.layerInputs)
+	dLossDLayerInput := net.dLossDLayerInput(l, lowest, dLossDNetInput != nil, tmp.dLossDOutput, tmp.dLossDLayerInput)
+	if dLossDLayerInput == nil && l == 0 {
+		// The first layer of a sequential net
+		dLossDLayerInput = dLossDNetInput
+	}
+	// Layers of SumNeurons find the derivatives with respect to the inputs
+	// directly with a matrix-vector product
+	if !DerivativesSumLayer(layer, parameters, layerInput, combinations, outputs, dLossDOutput, dLossDParam[l], dLossDLayerInput) {
+		// Compute dLossDParam and dLossDInput
+		derivativesLayer(layer, parameters, layerInput, combinations, outputs, dLossDOutput, dLossDParam[l], tmp.dLossDInput[l], tmp.unnormalizedLayer(l))
+		// Find the derivatives with respect to the inputs
+		if dLossDLayerInput != nil {
+			DInputToDOutput(tmp.dLossDInput[l], dLossDLayerInput)
+		}
+	}
+	net.scatter(l, lowest, dLossDLayerInput, tmp.dLossDOutput, dLossDNetInput)
+}
+
+// DerivativesInputLayer computes the derivative of the loss with respect to the inputs
+// of the layer (summed over all of the neurons) and stores it in place into
+// dLossDLayerInput. dLossDOutput is the derivative of the loss with respect to the
+// outputs of the layer, and is overwritten with the derivative of the loss with respect
+// to the combinations. dLossDInput is storage for the per-neuron derivatives
+func DerivativesInputLayer(l Layer, parameters [][]float64, inputs []float64, combinations, outputs, dLossDOutput []float64, dLossDInput [][]float64, dLossDLayerInput []float64) {
+	derivativesInputLayer(l, parameters, inputs, combinations, outputs, dLossDOutput, dLossDInput, dLossDLayerInput, nil)
+}
+
+// derivativesInputLayer is DerivativesInputLayer with unnormalized as in derivativesLayer
+func derivativesInputLayer(l Layer, parameters [][]float64, inputs []float64, combinations, outputs, dLossDOutput []float64, dLossDInput [][]float64, dLossDLayerInput, unnormalized []float64) {
+	l.dLossDCombination(combinations, outputs, dLossDOutput, dLossDOutput)
+	if l.BatchNorm != nil {
+		combinations = l.unnormalized(parameters, inputs, unnormalized)
+		l.dLossDUnnormalized(parameters, combinations, dLossDOutput, nil)
+	}
+	if l.isDenseLayer() {
+		if w, ok := layerMatrix(parameters, len(inputs)); ok {
+			blas64.Gemv(blas.Trans, 1, w, blas64.Vector{Inc: 1, Data: dLossDOutput}, 0, blas64.Vector{Inc: 1, Data: dLossDLayerInput})
+			return
+		}
+	}
+	for i, neuron := range l.Neurons {
+		neuron.DCombineDInput(parameters[i], inputs, combinations[i], dLossDInput[i])
+		for j := range dLossDInput[i] {
+			dLossDInput[i][j] *= dLossDOutput[i]
+		}
+	}
+	DInputToDOutput(dLossDInput, dLossDLayerInput)
+}
+
+// InputDerivative computes the derivative of the loss function with respect to the
+// input of the net, and stores it in place into dLossDNetInput. The inputs are the
+// same as for Derivative, but the derivatives with respect to the parameters are not
+// computed. dLossDOutput and dLossDInput are storage for temporary variables
+func InputDerivative(input []float64, layers []Layer, parameters [][][]float64, dLossDPred []float64, combinations, outputs, dLossDOutput [][]float64, dLossDInput [][][]float64, dLossDNetInput []float64) {
+	net := &Net{layers: layers, parameters: parameters}
+	tmp := &PredLossDerivTmpMemory{combinations: combinations, outputs: outputs, dLossDOutput: dLossDOutput, dLossDInput: dLossDInput}
+	inputDerivative(input, net, dLossDPred, tmp, dLossDNetInput)
+}
+
+// inputDerivative is InputDerivative for the net with the memory in tmp
+func inputDerivative(input []float64, net *Net, dLossDPred []float64, tmp *PredLossDerivTmpMemory, dLossDNetInput []float64) {
+	nLayers := len(net.layers)
+	net.zeroDLossDOutput(0, tmp.dLossDOutput)
+	if !net.isSequential() {
+		for i := range dLossDNetInput {
+			dLossDNetInput[i] = 0
+		}
+	}
+	copy(tmp.dLossDOutput[nLayers-1], dLossDPred)
+	for l := nLayers - 1; l >= 0; l-- {
+		layerInput := net.layerInput(l, input, tmp.outputs, tmp.layerInputs)
+		dLossDLayerInput := net.dLossDLayerInput(l, 0, true, tmp.dLossDOutput, tmp.dLossDLayerInput)
+		if dLossDLayerInput == nil {
+			// The first layer of a sequential net
+			dLossDLayerInput = dLossDNetInput
 		}
-		// Find the derivatives of the outputs for the previous layer
-		DInputToDOutput(dLossDInput[l], dLossDOutput[l-1])
+		derivativesInputLayer(net.layers[l], net.parameters[l], layerInput, tmp.combinations[l], tmp.outputs[l], tmp.dLossDOutput[l], tmp.dLossDInput[l], dLossDLayerInput, tmp.unnormalizedLayer(l))
+		net.scatter(l, 0, dLossDLayerInput, tmp.dLossDOutput, dLossDNetInput)
 	}
-	// For the last layer, just need to find the derivative
-	DerivativesLayer(layers[0], parameters[0], input, combinations[0], outputs[0], dLossDOutput[0], dLossDParam[0], dLossDInput[0])
 }
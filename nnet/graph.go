@@ -0,0 +1,243 @@
+package nnet
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gonum/floats"
+)
+
+// NetInput is the source used in the sources of a graph net to specify that
+// a layer reads the inputs of the net
+const NetInput = -1
+
+// The layers of a Net form a directed acyclic graph. Every layer reads from a list
+// of sources, each of which is either the inputs to the net (NetInput) or the outputs
+// of an earlier layer. The input to the layer is the concatenation of the sources in
+// the order given. This allows skip connections from the raw inputs to deeper layers,
+// and residual blocks (a layer reading both the input and the output of a block). The
+// outputs of the net are the outputs of the last layer.
+//
+// A net made by NewNet is the special case where the first layer reads the inputs and
+// every other layer reads the layer before it (see SequentialSources). Such sequential
+// nets are stored without explicit sources. Hessian-vector products, surgery and
+// Compile are only supported for sequential nets.
+
+// SequentialSources returns the sources of a sequential net with nLayers layers
+func SequentialSources(nLayers int) [][]int {
+	sources := make([][]int, nLayers)
+	sources[0] = []int{NetInput}
+	for i := 1; i < nLayers; i++ {
+		sources[i] = []int{i - 1}
+	}
+	return sources
+}
+
+// NewGraphNet creates a new net where layer i reads from sources[i], with every
+// neuron randomized on its own as in RandomizeParameters. The sources are copied.
+// Returns an error if the sources do not form a valid graph. If the sources are
+// those of a sequential net, the net is the same as one made by NewNet.
+func NewGraphNet(nInputs int, layers []Layer, sources [][]int) (*Net, error) {
+	if err := checkSources(layers, sources); err != nil {
+		return nil, err
+	}
+	net := &Net{
+		layers:  layers,
+		nInputs: nInputs,
+		sources: copySources(sources),
+	}
+	net.new()
+	net.RandomizeParameters()
+	return net, nil
+}
+
+// checkSources returns an error if the sources are not valid for the layers
+func checkSources(layers []Layer, sources [][]int) error {
+	if len(layers) == 0 {
+		return errors.New("nnet: net must have at least one layer")
+	}
+	if len(sources) != len(layers) {
+		return errors.New("nnet: must have one set of sources per layer")
+	}
+	for i, srcs := range sources {
+		if len(srcs) == 0 {
+			return fmt.Errorf("nnet: layer %v has no sources", i)
+		}
+		for _, src := range srcs {
+			if src != NetInput && (src < 0 || src >= i) {
+				return fmt.Errorf("nnet: layer %v has invalid source %v. Sources must be NetInput or an earlier layer", i, src)
+			}
+		}
+	}
+	return nil
+}
+
+// copySources returns a copy of the sources, or nil if they are those of a
+// sequential net
+func copySources(sources [][]int) [][]int {
+	sequential := true
+	c := make([][]int, len(sources))
+	for i, srcs := range sources {
+		c[i] = make([]int, len(srcs))
+		copy(c[i], srcs)
+		if len(srcs) != 1 || srcs[0] != i-1 {
+			sequential = false
+		}
+	}
+	if sequential {
+		return nil
+	}
+	return c
+}
+
+// Sources returns a copy of the sources of layer i
+func (net *Net) Sources(i int) []int {
+	if net.sources == nil {
+		return []int{i - 1}
+	}
+	s := make([]int, len(net.sources[i]))
+	copy(s, net.sources[i])
+	return s
+}
+
+// isSequential returns true if every layer reads the layer before it
+func (net *Net) isSequential() bool {
+	return net.sources == nil
+}
+
+// sourceLen returns the length of the source
+func (net *Net) sourceLen(src int) int {
+	if src == NetInput {
+		return net.nInputs
+	}
+	return len(net.layers[src].Neurons)
+}
+
+// concatLen returns the length of the concatenated input of layer l, which is
+// zero if the layer has a single source
+func (net *Net) concatLen(l int) int {
+	if net.isSequential() || len(net.sources[l]) == 1 {
+		return 0
+	}
+	var n int
+	for _, src := range net.sources[l] {
+		n += net.sourceLen(src)
+	}
+	return n
+}
+
+// newLayerInputMemory makes memory for the concatenated inputs of the layers
+// of a graph net. It is nil for a sequential net, and nil for the layers with
+// a single source.
+func (net *Net) newLayerInputMemory() [][]float64 {
+	if net.isSequential() {
+		return nil
+	}
+	mem := make([][]float64, len(net.layers))
+	for i := range mem {
+		if n := net.concatLen(i); n > 0 {
+			mem[i] = make([]float64, n)
+		}
+	}
+	return mem
+}
+
+// newDLossDLayerInputMemory makes memory for the derivative of the loss with
+// respect to the inputs of each layer of a graph net. It is nil for a sequential net.
+func (net *Net) newDLossDLayerInputMemory() [][]float64 {
+	if net.isSequential() {
+		return nil
+	}
+	layerInputs := net.layerInputs()
+	mem := make([][]float64, len(net.layers))
+	for i := range mem {
+		mem[i] = make([]float64, layerInputs[i])
+	}
+	return mem
+}
+
+// layerInput returns the input of layer l given the input of the net and the
+// outputs of the layers. The sources of a layer with more than one source are
+// concatenated into buf[l], where buf is from newLayerInputMemory.
+func (net *Net) layerInput(l int, input []float64, outputs, buf [][]float64) []float64 {
+	if net.isSequential() {
+		if l == 0 {
+			return input
+		}
+		return outputs[l-1]
+	}
+	srcs := net.sources[l]
+	if len(srcs) == 1 {
+		if srcs[0] == NetInput {
+			return input
+		}
+		return outputs[srcs[0]]
+	}
+	count := 0
+	for _, src := range srcs {
+		if src == NetInput {
+			count += copy(buf[l][count:], input)
+		} else {
+			count += copy(buf[l][count:], outputs[src])
+		}
+	}
+	return buf[l]
+}
+
+// dLossDLayerInput returns the memory for the derivative of the loss with respect
+// to the input of layer l when the derivatives are needed for the layers starting
+// at lowest, or nil if they are not needed. For a sequential net this is the
+// derivative with respect to the outputs of the previous layer, and otherwise it
+// is buf[l] where buf is from newDLossDLayerInputMemory, and must be added to the
+// sources with scatter. If netInput is true, the derivative is also needed for the
+// inputs of the net.
+func (net *Net) dLossDLayerInput(l, lowest int, netInput bool, dLossDOutput, buf [][]float64) []float64 {
+	if net.isSequential() {
+		if l > lowest {
+			return dLossDOutput[l-1]
+		}
+		return nil
+	}
+	for _, src := range net.sources[l] {
+		if src >= lowest || (netInput && src == NetInput) {
+			return buf[l]
+		}
+	}
+	return nil
+}
+
+// scatter adds the derivative of the loss with respect to the input of layer l of
+// a graph net to the derivatives with respect to the outputs of its sources starting
+// at lowest, and to dLossDNetInput if it is not nil. Does nothing for a sequential net.
+func (net *Net) scatter(l, lowest int, dLossDLayerInput []float64, dLossDOutput [][]float64, dLossDNetInput []float64) {
+	if net.isSequential() || dLossDLayerInput == nil {
+		return
+	}
+	count := 0
+	for _, src := range net.sources[l] {
+		n := net.sourceLen(src)
+		d := dLossDLayerInput[count : count+n]
+		if src == NetInput {
+			if dLossDNetInput != nil {
+				floats.Add(dLossDNetInput, d)
+			}
+		} else if src >= lowest {
+			floats.Add(dLossDOutput[src], d)
+		}
+		count += n
+	}
+}
+
+// zeroDLossDOutput zeroes the derivatives with respect to the outputs of the
+// layers of a graph net starting at lowest, except for the last layer, so that
+// scatter can add to them. Does nothing for a sequential net.
+func (net *Net) zeroDLossDOutput(lowest int, dLossDOutput [][]float64) {
+	if net.isSequential() {
+		return
+	}
+	for l := lowest; l < len(net.layers)-1; l++ {
+		for j := range dLossDOutput[l] {
+			dLossDOutput[l][j] = 0
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package nnet
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/scale"
+	"github.com/gonum/floats"
+)
+
+// newSkipGraphNet returns a graph net with a skip connection from the input and
+// a residual connection around layer 1
+func newSkipGraphNet(t *testing.T, nInputs, nOutputs int) *Net {
+	layers := make([]Layer, 4)
+	for i, n := range []int{5, 5, 4} {
+		layers[i].Neurons = make([]Neuron, n)
+		for j := range layers[i].Neurons {
+			layers[i].Neurons[j] = &TanhNeuron
+		}
+	}
+	// Make one layer use the per-neuron path
+	layers[1].Neurons[2] = &SigmoidNeuron
+	layers[1].Neurons[3] = perNeuronSumNeuron{&TanhNeuron}
+	layers[3].Neurons = make([]Neuron, nOutputs)
+	for j := range layers[3].Neurons {
+		layers[3].Neurons[j] = &LinearNeuron
+	}
+	sources := [][]int{
+		{NetInput},
+		{0},
+		{NetInput, 0, 1},
+		{2, NetInput},
+	}
+	net, err := NewGraphNet(nInputs, layers, sources)
+	if err != nil {
+		t.Fatalf("Error creating graph net: %v", err)
+	}
+	net.Losser = loss.SquaredDistance{}
+	net.InputScaler = &scale.Linear{}
+	net.InputScaler.SetScale(RandomData(nInputs, 10))
+	net.OutputScaler = &scale.Normal{}
+	net.OutputScaler.SetScale(RandomData(nOutputs, 10))
+	return net
+}
+
+func TestGraphNetSequential(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	net := newRegressionTestNet(nInputs, nOutputs, 6)
+	g, err := NewGraphNet(nInputs, net.layers, SequentialSources(len(net.layers)))
+	if err != nil {
+		t.Fatalf("Error creating graph net: %v", err)
+	}
+	if !g.isSequential() {
+		t.Errorf("Graph net with sequential sources is not sequential")
+	}
+	if !reflect.DeepEqual(g.parameterIdx, net.parameterIdx) {
+		t.Errorf("Parameter layout doesn't match")
+	}
+	for i := range net.layers {
+		if !reflect.DeepEqual(g.Sources(i), []int{i - 1}) {
+			t.Errorf("Wrong sources for layer %v: %v", i, g.Sources(i))
+		}
+	}
+}
+
+func TestGraphNetSources(t *testing.T) {
+	layers := []Layer{
+		{Neurons: []Neuron{&TanhNeuron}},
+		{Neurons: []Neuron{&LinearNeuron}},
+	}
+	for _, sources := range [][][]int{
+		{{NetInput}},
+		{{NetInput}, {1}},
+		{{0}, {NetInput}},
+		{{NetInput}, {}},
+		{{NetInput}, {-2}},
+	} {
+		_, err := NewGraphNet(2, layers, sources)
+		if err == nil {
+			t.Errorf("No error for invalid sources %v", sources)
+		}
+	}
+
+	sources := [][]int{{NetInput}, {0, NetInput}}
+	net, err := NewGraphNet(2, layers, sources)
+	if err != nil {
+		t.Fatalf("Error creating graph net: %v", err)
+	}
+	sources[1][0] = NetInput
+	if !reflect.DeepEqual(net.Sources(1), []int{0, NetInput}) {
+		t.Errorf("Sources not copied")
+	}
+	if net.TotalNumParameters() != 3+4 {
+		t.Errorf("Wrong number of parameters: %v", net.TotalNumParameters())
+	}
+}
+
+func TestGraphNetPredict(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	net := newSkipGraphNet(t, nInputs, nOutputs)
+	input := []float64{0.2, -0.7, 1.1}
+
+	// Compute the prediction by hand from the layers
+	scaled := make([]float64, nInputs)
+	copy(scaled, input)
+	net.InputScaler.Scale(scaled)
+	layerOutput := func(l int, in []float64) []float64 {
+		out := make([]float64, len(net.layers[l].Neurons))
+		for j, neuron := range net.layers[l].Neurons {
+			_, out[j] = ProcessNeuron(neuron, net.parameters[l][j], in)
+		}
+		return out
+	}
+	out0 := layerOutput(0, scaled)
+	out1 := layerOutput(1, out0)
+	in2 := append(append(append([]float64{}, scaled...), out0...), out1...)
+	out2 := layerOutput(2, in2)
+	want := layerOutput(3, append(append([]float64{}, out2...), scaled...))
+	net.OutputScaler.Unscale(want)
+
+	pred, err := net.Predict(input)
+	if err != nil {
+		t.Fatalf("Error predicting: %v", err)
+	}
+	if !floats.EqualApprox(pred, want, 1e-14) {
+		t.Errorf("Prediction mismatch. Want %v, got %v", want, pred)
+	}
+	preds, err := net.PredictSlice([][]float64{input})
+	if err != nil {
+		t.Fatalf("Error predicting: %v", err)
+	}
+	if !floats.EqualApprox(preds[0], want, 1e-14) {
+		t.Errorf("PredictSlice mismatch. Want %v, got %v", want, preds[0])
+	}
+}
+
+func TestGraphNetDeriv(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	nSamples := 6
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := RandomSliceOfSlice(nSamples, nOutputs)
+	weights := RandomWeights(nSamples)
+
+	plain := newSkipGraphNet(t, nInputs, nOutputs)
+	batch := newSkipGraphNet(t, nInputs, nOutputs)
+	batch.layers[1].BatchNorm = NewBatchNorm()
+	batch.new()
+	batch.RandomizeParameters()
+	dropout := newSkipGraphNet(t, nInputs, nOutputs)
+	dropout.layers[0].Dropout = 0.3
+	dropout.layers[2].Dropout = 0.5
+	shared := newSkipGraphNet(t, nInputs, nOutputs)
+	err := shared.ShareParameters(NeuronIndex{Layer: 0, Neuron: 0}, NeuronIndex{Layer: 0, Neuron: 3})
+	if err != nil {
+		t.Fatalf("Error sharing parameters: %v", err)
+	}
+	for _, test := range []struct {
+		name string
+		net  *Net
+	}{
+		{"plain", plain},
+		{"batch norm", batch},
+		{"dropout", dropout},
+		{"shared", shared},
+	} {
+		batchNormFD(t, test.net, inputs, truths, weights, test.name)
+	}
+
+	// Freezing the first layer only zeroes its derivatives. The derivatives of the
+	// later layers do not depend on those of the first layer, which reads only the
+	// inputs of the net
+	dLossDParam, flat := plain.NewPerParameterMemory()
+	SeqLossDeriv(inputs, truths, weights, plain, dLossDParam, NewParLossDerivMemory(plain))
+	plain.SetLayerFrozen(0, true)
+	frozenDLossDParam, frozenFlat := plain.NewPerParameterMemory()
+	SeqLossDeriv(inputs, truths, weights, plain, frozenDLossDParam, NewParLossDerivMemory(plain))
+	for _, d := range dLossDParam[0] {
+		for k := range d {
+			d[k] = 0
+		}
+	}
+	if !floats.Equal(flat, frozenFlat) {
+		t.Errorf("Frozen derivative mismatch")
+	}
+}
+
+func TestGraphNetParLossDeriv(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	nSamples := 25
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := RandomSliceOfSlice(nSamples, nOutputs)
+	weights := RandomWeights(nSamples)
+	net := newSkipGraphNet(t, nInputs, nOutputs)
+
+	dSeq, flatSeq := net.NewPerParameterMemory()
+	lossSeq := SeqLossDeriv(inputs, truths, weights, net, dSeq, NewParLossDerivMemory(net))
+	dPar, flatPar := net.NewPerParameterMemory()
+	lossPar := ParLossDeriv(inputs, truths, weights, net, dPar, 4)
+	if !floats.EqualWithinAbsOrRel(lossSeq, lossPar, 1e-12, 1e-12) {
+		t.Errorf("Loss mismatch. Seq %v, par %v", lossSeq, lossPar)
+	}
+	if !floats.EqualApprox(flatSeq, flatPar, 1e-12) {
+		t.Errorf("Derivative mismatch")
+	}
+}
+
+func TestGraphNetInputJacobian(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	net := newSkipGraphNet(t, nInputs, nOutputs)
+	input := []float64{0.3, -0.4, 0.8}
+	jac := make([][]float64, nOutputs)
+	for i := range jac {
+		jac[i] = make([]float64, nInputs)
+	}
+	err := net.InputJacobian(input, jac)
+	if err != nil {
+		t.Fatalf("Error computing Jacobian: %v", err)
+	}
+	for j := range input {
+		input[j] += netFDStep
+		pred1, _ := net.Predict(input)
+		input[j] -= 2 * netFDStep
+		pred2, _ := net.Predict(input)
+		input[j] += netFDStep
+		for i := range pred1 {
+			fd := (pred1[i] - pred2[i]) / (2 * netFDStep)
+			if !floats.EqualWithinAbsOrRel(jac[i][j], fd, 1e-6, 1e-6) {
+				t.Errorf("Jacobian mismatch at %v, %v. Got %v, fd %v", i, j, jac[i][j], fd)
+			}
+		}
+	}
+}
+
+func TestGraphNetSerialize(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	net := newSkipGraphNet(t, nInputs, nOutputs)
+	// The per-neuron wrapper isn't registered, so replace it
+	net.layers[1].Neurons[3] = &LinearTanhNeuron
+
+	data, err := json.Marshal(net)
+	if err != nil {
+		t.Fatalf("Error marshaling graph net: %v", err)
+	}
+	net2 := &Net{}
+	err = json.Unmarshal(data, net2)
+	if err != nil {
+		t.Fatalf("Error unmarshaling graph net: %v", err)
+	}
+	if !reflect.DeepEqual(net, net2) {
+		t.Errorf("Graph net not equal after encoding and decoding JSON")
+	}
+
+	b, err := net.GobEncode()
+	if err != nil {
+		t.Fatalf("Error gob encoding: %v", err)
+	}
+	net3 := &Net{}
+	err = net3.GobDecode(b)
+	if err != nil {
+		t.Fatalf("Error gob decoding: %v", err)
+	}
+	if !reflect.DeepEqual(net.sources, net3.sources) {
+		t.Errorf("Sources don't match after gob")
+	}
+	if !floats.Equal(net.parametersSlice, net3.parametersSlice) {
+		t.Errorf("Parameters don't match after gob")
+	}
+
+	// Changing a parameter should cause the prediction check to fail
+	v := &netMarshal{}
+	json.Unmarshal(data, v)
+	v.Parameters[0] += 1
+	data, _ = json.Marshal(v)
+	if json.Unmarshal(data, &Net{}) == nil {
+		t.Errorf("Prediction check should fail for modified parameters")
+	}
+}
+
+func TestGraphNetUnsupported(t *testing.T) {
+	net := newSkipGraphNet(t, 3, 2)
+	if net.HessVecSupported() == nil {
+		t.Errorf("No error for Hessian-vector products of a graph net")
+	}
+	if net.InsertLayer(1, Layer{Neurons: []Neuron{&LinearNeuron}}) == nil {
+		t.Errorf("No error for surgery on a graph net")
+	}
+	if _, err := Compile(net, Float32); err == nil {
+		t.Errorf("No error compiling a graph net")
+	}
+}
@@ -0,0 +1,227 @@
+package nnet
+
+import (
+	"errors"
+
+	"github.com/btracey/nnet/activator"
+	"github.com/btracey/nnet/loss"
+)
+
+// Hessian-vector products are computed with the R-operator of Pearlmutter,
+// "Fast exact multiplication by the Hessian", Neural Computation, 1994.
+// R{x} is the directional derivative of x with respect to the parameters in the
+// direction v. Applying R to the forward and backward passes gives R{dLoss/dParam},
+// which is the Hessian of the loss with respect to the parameters times v.
+
+// HessVecSupported returns an error if Hessian-vector products cannot be computed
+// for the net. Every neuron must be a SumNeuron whose Activator implements
+// activator.SecondDerivActivator, no layer may have an Activation or BatchNorm, no neurons may
+// share parameters, and the Losser must implement loss.HessVecLosser
+func (net *Net) HessVecSupported() error {
+	if _, ok := net.Losser.(loss.HessVecLosser); !ok {
+		return errors.New("nnet: Losser does not implement loss.HessVecLosser")
+	}
+	if net.aliased != nil {
+		return errors.New("nnet: Hessian-vector products not supported for shared parameters")
+	}
+	if !net.isSequential() {
+		return errors.New("nnet: Hessian-vector products not supported for graph nets")
+	}
+	for _, layer := range net.layers {
+		if layer.Activation != nil {
+			return errors.New("nnet: Hessian-vector products not supported for layer activations")
+		}
+		if layer.BatchNorm != nil {
+			return errors.New("nnet: Hessian-vector products not supported for batch normalization")
+		}
+		for _, neuron := range layer.Neurons {
+			s, ok := neuron.(*SumNeuron)
+			if !ok {
+				return errors.New("nnet: Hessian-vector products only supported for SumNeurons")
+			}
+			if _, ok := s.Activator.(activator.SecondDerivActivator); !ok {
+				return errors.New("nnet: Activator does not implement activator.SecondDerivActivator")
+			}
+		}
+	}
+	return nil
+}
+
+func (net *Net) hessVecLosser() loss.HessVecLosser {
+	return net.Losser.(loss.HessVecLosser)
+}
+
+// PredLossHessVecTmpMemory is the temporary memory needed for computing
+// Hessian-vector products
+type PredLossHessVecTmpMemory struct {
+	combinations  [][]float64
+	outputs       [][]float64
+	rCombinations [][]float64
+	rOutputs      [][]float64
+	dLossDPred    []float64
+	rDLossDPred   []float64
+	dLossDOutput  [][]float64
+	rDLossDOutput [][]float64
+	prediction    []float64
+	hessVecTmp    [][][]float64 // For summing over samples in SeqLossHessVec
+}
+
+func (net *Net) NewPredLossHessVecTmpMemory() *PredLossHessVecTmpMemory {
+	hessVecTmp, _ := net.NewPerParameterMemory()
+	return &PredLossHessVecTmpMemory{
+		prediction:    make([]float64, net.nOutputs),
+		hessVecTmp:    hessVecTmp,
+		combinations:  net.NewPerNeuronMemory(),
+		outputs:       net.NewPerNeuronMemory(),
+		rCombinations: net.NewPerNeuronMemory(),
+		rOutputs:      net.NewPerNeuronMemory(),
+		dLossDPred:    make([]float64, net.nOutputs),
+		rDLossDPred:   make([]float64, net.nOutputs),
+		dLossDOutput:  net.NewPerNeuronMemory(),
+		rDLossDOutput: net.NewPerNeuronMemory(),
+	}
+}
+
+// PredLossHessVec predicts the value at the input, computes the value of the loss,
+// and computes the product of the Hessian of the loss with respect to the parameters
+// and the direction v. v and hessVec are indexed like the memory from
+// NewPerParameterMemory. As for the derivative, the entries of hessVec of frozen
+// and pruned parameters are zero. The net must satisfy HessVecSupported
+func PredLossHessVec(input []float64, truth []float64, weight float64, net *Net, v [][][]float64, tmp *PredLossHessVecTmpMemory, prediction []float64, hessVec [][][]float64) (loss float64) {
+	layers := net.layers
+	parameters := net.parameters
+	nLayers := len(layers)
+
+	// Forward pass
+	// comb = W * in + b
+	// R{comb} = V * in + W * R{in} + R{b}
+	// out = f(comb), R{out} = f'(comb) R{comb}
+	layerInput := input
+	var rLayerInput []float64 // R{input} is zero for the first layer
+	for l := 0; l < nLayers; l++ {
+		for j, neuron := range layers[l].Neurons {
+			p := parameters[l][j]
+			vp := v[l][j]
+			nIn := len(layerInput)
+			comb := p[nIn]
+			rComb := vp[nIn]
+			for k, val := range layerInput {
+				comb += p[k] * val
+				rComb += vp[k] * val
+			}
+			for k, val := range rLayerInput {
+				rComb += p[k] * val
+			}
+			out := neuron.Activate(comb)
+			tmp.combinations[l][j] = comb
+			tmp.outputs[l][j] = out
+			tmp.rCombinations[l][j] = rComb
+			tmp.rOutputs[l][j] = neuron.DActivateDCombination(comb, out) * rComb
+		}
+		layerInput = tmp.outputs[l]
+		rLayerInput = tmp.rOutputs[l]
+	}
+	copy(prediction, tmp.outputs[nLayers-1])
+
+	losser := net.hessVecLosser()
+	loss = weight * losser.LossAndDeriv(prediction, truth, tmp.dLossDPred)
+	losser.HessVec(prediction, truth, tmp.rOutputs[nLayers-1], tmp.rDLossDPred)
+	for i := range tmp.dLossDPred {
+		tmp.dLossDOutput[nLayers-1][i] = weight * tmp.dLossDPred[i]
+		tmp.rDLossDOutput[nLayers-1][i] = weight * tmp.rDLossDPred[i]
+	}
+
+	// Backward pass
+	// dLossDComb = f'(comb) dLossDOut
+	// R{dLossDComb} = f''(comb) R{comb} dLossDOut + f'(comb) R{dLossDOut}
+	// R{dLossDW} = R{dLossDComb} in + dLossDComb R{in}
+	// R{dLossDIn} = V^T dLossDComb + W^T R{dLossDComb}
+	for l := nLayers - 1; l >= 0; l-- {
+		layerInput = input
+		rLayerInput = nil
+		if l > 0 {
+			layerInput = tmp.outputs[l-1]
+			rLayerInput = tmp.rOutputs[l-1]
+			for k := range tmp.dLossDOutput[l-1] {
+				tmp.dLossDOutput[l-1][k] = 0
+				tmp.rDLossDOutput[l-1][k] = 0
+			}
+		}
+		nIn := len(layerInput)
+		for j, neuron := range layers[l].Neurons {
+			act := neuron.(*SumNeuron).Activator.(activator.SecondDerivActivator)
+			comb := tmp.combinations[l][j]
+			out := tmp.outputs[l][j]
+			dOutDComb := act.DActivateDCombination(comb, out)
+			d2OutDComb2 := act.D2ActivateDCombination2(comb, out)
+
+			dLossDComb := dOutDComb * tmp.dLossDOutput[l][j]
+			rDLossDComb := d2OutDComb2*tmp.rCombinations[l][j]*tmp.dLossDOutput[l][j] + dOutDComb*tmp.rDLossDOutput[l][j]
+
+			hv := hessVec[l][j]
+			for k, val := range layerInput {
+				hv[k] = rDLossDComb * val
+			}
+			for k, val := range rLayerInput {
+				hv[k] += dLossDComb * val
+			}
+			hv[nIn] = rDLossDComb
+
+			if l > 0 {
+				p := parameters[l][j]
+				vp := v[l][j]
+				for k := 0; k < nIn; k++ {
+					tmp.dLossDOutput[l-1][k] += p[k] * dLossDComb
+					tmp.rDLossDOutput[l-1][k] += vp[k]*dLossDComb + p[k]*rDLossDComb
+				}
+			}
+		}
+	}
+	net.zeroFrozen(hessVec)
+	return loss
+}
+
+// SeqLossHessVec computes the sum of the loss and the Hessian-vector products
+// over all of the samples, and stores the product into hessVec
+func SeqLossHessVec(inputs, truths [][]float64, weights []float64, net *Net, v [][][]float64, hessVec [][][]float64, tmp *PredLossHessVecTmpMemory) (loss float64) {
+	loss = PredLossHessVec(inputs[0], truths[0], weights[0], net, v, tmp, tmp.prediction, hessVec)
+	for i := 1; i < len(inputs); i++ {
+		loss += PredLossHessVec(inputs[i], truths[i], weights[i], net, v, tmp, tmp.prediction, tmp.hessVecTmp)
+		for i, lay := range tmp.hessVecTmp {
+			for j, neur := range lay {
+				for k, val := range neur {
+					hessVec[i][j][k] += val
+				}
+			}
+		}
+	}
+	return loss
+}
+
+// ParLossHessVec computes the product of the Hessian of the total loss with respect
+// to the parameters and the direction v in parallel, and stores it into hessVec.
+// v has one entry per parameter (as in ParametersSlice). The Hessian is with respect
+// to the parameters which are not frozen or pruned, so their entries of v are taken
+// to be zero, and their entries of hessVec are zero. The chunks are summed as set
+// by net.Reduction, as in ParLossDeriv. Returns an error if Hessian-vector products
+// are not supported by the net
+func ParLossHessVec(inputs, truths [][]float64, weights []float64, net *Net, v []float64, hessVec [][][]float64, chunkSize int) (loss float64, err error) {
+	if err := net.HessVecSupported(); err != nil {
+		return 0, err
+	}
+	if len(v) != net.totalNumParameters {
+		return 0, errors.New("nnet: length of v does not match the number of parameters")
+	}
+	tieredV, flatV := net.NewPerParameterMemory()
+	copy(flatV, v)
+	net.zeroFrozen(tieredV)
+
+	loss = net.parChunks(numChunks(len(inputs), chunkSize), net.Reduction, hessVec, func() func(c int, hessVec [][][]float64) float64 {
+		tmp := net.NewPredLossHessVecTmpMemory()
+		return func(c int, hessVec [][][]float64) float64 {
+			start, end := chunkBounds(c, chunkSize, len(inputs))
+			return SeqLossHessVec(inputs[start:end], truths[start:end], weights[start:end], net, tieredV, hessVec, tmp)
+		}
+	})
+	return loss, nil
+}
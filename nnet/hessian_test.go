@@ -0,0 +1,121 @@
+package nnet
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/btracey/nnet/loss"
+	"github.com/gonum/floats"
+)
+
+func TestParLossHessVec(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	nSamples := 23
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := RandomSliceOfSlice(nSamples, nOutputs)
+	weights := RandomWeights(nSamples)
+	for _, test := range []struct {
+		name   string
+		frozen bool
+		prune  float64
+	}{
+		{"all", false, 0},
+		{"frozen", true, 0},
+		{"pruned", false, 0.4},
+	} {
+		net := DefaultRegression(nInputs, nOutputs, 2, 6)
+		net.Losser = loss.LogSquared{}
+		if err := net.HessVecSupported(); err != nil {
+			t.Fatalf("Hessian-vector products should be supported: %v", err)
+		}
+		net.SetLayerFrozen(1, test.frozen)
+		if test.prune != 0 {
+			if err := net.PruneFraction(test.prune); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		params := make([]float64, net.TotalNumParameters())
+		net.ParametersSlice(params)
+		v := RandomWeights(net.TotalNumParameters())
+		floats.Scale(0.1, v)
+
+		hessVec, hessVecFlat := net.NewPerParameterMemory()
+		_, err := ParLossHessVec(inputs, truths, weights, net, v, hessVec, 5)
+		if err != nil {
+			t.Fatalf("Error computing the Hessian-vector product: %v", err)
+		}
+
+		// Compare with the finite difference of the gradient in the direction v. The
+		// frozen and pruned parameters are not moved, and their derivatives are zero.
+		vTiered, vFlat := net.NewPerParameterMemory()
+		copy(vFlat, v)
+		net.zeroFrozen(vTiered)
+		v = vFlat
+		dLossDParam, dLossDParamFlat := net.NewPerParameterMemory()
+		p := NewParLossDerivMemory(net)
+		fd := make([]float64, len(params))
+		floats.AddScaled(params, netFDStep, v)
+		net.SetParametersSlice(params)
+		SeqLossDeriv(inputs, truths, weights, net, dLossDParam, p)
+		copy(fd, dLossDParamFlat)
+		floats.AddScaled(params, -2*netFDStep, v)
+		net.SetParametersSlice(params)
+		SeqLossDeriv(inputs, truths, weights, net, dLossDParam, p)
+		floats.Sub(fd, dLossDParamFlat)
+		floats.Scale(1/(2*netFDStep), fd)
+		floats.AddScaled(params, netFDStep, v)
+		net.SetParametersSlice(params)
+
+		for i := range fd {
+			if !floats.EqualWithinAbsOrRel(fd[i], hessVecFlat[i], 1e-5, 1e-5) {
+				t.Errorf("%v: Finite difference doesn't match Hessian-vector product", test.name)
+				for i := range fd {
+					fmt.Println(i, hessVecFlat[i], fd[i], hessVecFlat[i]-fd[i])
+				}
+				break
+			}
+		}
+		for i, lay := range hessVec {
+			for j, neur := range lay {
+				for k, val := range neur {
+					if (test.frozen && i == 1 || net.IsPruned(i, j, k)) && val != 0 {
+						t.Errorf("%v: nonzero product for parameter %v of neuron %v of layer %v", test.name, k, j, i)
+					}
+				}
+			}
+		}
+
+		// The ordered sum does not depend on GOMAXPROCS
+		net.Reduction = Ordered
+		var want []float64
+		for _, procs := range []int{1, 3, 8} {
+			old := runtime.GOMAXPROCS(procs)
+			_, err := ParLossHessVec(inputs, truths, weights, net, v, hessVec, 2)
+			runtime.GOMAXPROCS(old)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want == nil {
+				want = append([]float64(nil), hessVecFlat...)
+			} else if !floats.Equal(hessVecFlat, want) {
+				t.Errorf("%v: ordered product changes with GOMAXPROCS = %v", test.name, procs)
+			}
+		}
+	}
+}
+
+func TestHessVecSupported(t *testing.T) {
+	net := DefaultRegression(3, 2, 1, 4)
+	net.Losser = loss.RelativeLog(0)
+	if net.HessVecSupported() == nil {
+		t.Errorf("Losser without HessVec should not be supported")
+	}
+	net.Losser = loss.SquaredDistance{}
+	net.layers[0].Neurons[0] = perNeuronSumNeuron{&TanhNeuron}
+	if net.HessVecSupported() == nil {
+		t.Errorf("Non SumNeuron should not be supported")
+	}
+}
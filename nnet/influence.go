@@ -0,0 +1,112 @@
+package nnet
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/gonum/floats"
+)
+
+// The functions below compute the derivative of the loss of each sample separately,
+// which shows which samples dominate the derivative of the total loss. They are
+// parallel over chunks of samples like ParLossDeriv. The derivatives are as for
+// PredLossDeriv, so they are computed as in Inference mode (without dropout, and with
+// the running statistics of batch normalization), and the derivatives of frozen and
+// pruned parameters are zero. The inputs and truths must already be scaled.
+
+// PerSampleLossDeriv computes the loss of each sample and the derivative of the loss
+// of each sample with respect to the parameters. The loss of sample i is stored into
+// losses[i] and the derivative into dLossDParam[i], which has one element per
+// parameter in the order of the flat memory from NewPerParameterMemory.
+func PerSampleLossDeriv(inputs, truths [][]float64, weights []float64, net *Net, losses []float64, dLossDParam [][]float64, chunkSize int) error {
+	if len(losses) != len(inputs) || len(dLossDParam) != len(inputs) {
+		return errors.New("nnet: number of losses and derivatives must match the number of inputs")
+	}
+	for _, d := range dLossDParam {
+		if len(d) != net.totalNumParameters {
+			return errors.New("nnet: length of derivative does not match the number of parameters")
+		}
+	}
+	return perSampleLossDeriv(inputs, truths, weights, net, chunkSize, func(i int, loss float64, deriv []float64) {
+		losses[i] = loss
+		copy(dLossDParam[i], deriv)
+	})
+}
+
+// GradientNorms computes the loss of each sample and the Euclidean norm of the
+// derivative of the loss of each sample with respect to the parameters, without
+// storing the derivatives. Large norms are samples which dominate the derivative,
+// which are often outliers or mislabeled.
+func GradientNorms(inputs, truths [][]float64, weights []float64, net *Net, losses, norms []float64, chunkSize int) error {
+	if len(losses) != len(inputs) || len(norms) != len(inputs) {
+		return errors.New("nnet: number of losses and norms must match the number of inputs")
+	}
+	return perSampleLossDeriv(inputs, truths, weights, net, chunkSize, func(i int, loss float64, deriv []float64) {
+		losses[i] = loss
+		norms[i] = floats.Norm(deriv, 2)
+	})
+}
+
+// InfluenceScores computes the influence of each training sample on the loss at a
+// test sample (with weight one), which is the dot product of the derivative of the
+// loss of the training sample with the derivative of the loss of the test sample. A
+// gradient step on a training sample with a positive score decreases the test loss to
+// first order, and a step on a sample with a negative score increases it. The score of
+// training sample i is stored into scores[i].
+func InfluenceScores(inputs, truths [][]float64, weights []float64, net *Net, testInput, testTruth []float64, scores []float64, chunkSize int) error {
+	if len(scores) != len(inputs) {
+		return errors.New("nnet: number of scores must match the number of inputs")
+	}
+	if len(testInput) != net.nInputs {
+		return InputMismatch{Provided: len(testInput), Expected: net.nInputs}
+	}
+	if len(testTruth) != net.nOutputs {
+		return errors.New("nnet: length of the test truth must match the number of outputs")
+	}
+	testDeriv, testFlat := net.NewPerParameterMemory()
+	PredLossDeriv(testInput, testTruth, 1, net, net.NewPredLossDerivTmpMemory(), make([]float64, net.nOutputs), testDeriv)
+	return perSampleLossDeriv(inputs, truths, weights, net, chunkSize, func(i int, loss float64, deriv []float64) {
+		scores[i] = floats.Dot(deriv, testFlat)
+	})
+}
+
+// perSampleLossDeriv calls f with the loss of each sample and its derivative with
+// respect to the parameters in the flat layout. The chunks are processed in parallel,
+// so f is called concurrently for samples in different chunks. The derivative is only
+// valid during the call.
+func perSampleLossDeriv(inputs, truths [][]float64, weights []float64, net *Net, chunkSize int, f func(i int, loss float64, dLossDParam []float64)) error {
+	if len(truths) != len(inputs) || len(weights) != len(inputs) {
+		return errors.New("nnet: number of inputs, truths and weights must match")
+	}
+	if chunkSize < 1 {
+		return errors.New("nnet: chunk size must be at least one")
+	}
+	for i := range inputs {
+		if len(inputs[i]) != net.nInputs {
+			return InputMismatch{Provided: len(inputs[i]), Expected: net.nInputs}
+		}
+		if len(truths[i]) != net.nOutputs {
+			return errors.New("nnet: length of truth must match the number of outputs")
+		}
+	}
+	var wg sync.WaitGroup
+	for start := 0; start < len(inputs); start += chunkSize {
+		end := start + chunkSize
+		if end > len(inputs) {
+			end = len(inputs)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			tmp := net.NewPredLossDerivTmpMemory()
+			prediction := make([]float64, net.nOutputs)
+			dLossDParam, flat := net.NewPerParameterMemory()
+			for i := start; i < end; i++ {
+				loss := PredLossDeriv(inputs[i], truths[i], weights[i], net, tmp, prediction, dLossDParam)
+				f(i, loss, flat)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,126 @@
+package nnet
+
+import (
+	"math"
+	"testing"
+
+	"github.com/gonum/floats"
+)
+
+func TestPerSampleLossDeriv(t *testing.T) {
+	nSamples := 23
+	for _, test := range []struct {
+		name string
+		net  *Net
+	}{
+		{"dense", newPruneNet(3, 2)},
+		{"shared", newSharedNet(t)},
+	} {
+		net := test.net
+		nOutputs := net.Outputs()
+		inputs := RandomSliceOfSlice(nSamples, net.Inputs())
+		truths := RandomSliceOfSlice(nSamples, nOutputs)
+		weights := RandomWeights(nSamples)
+		net.Mode = Inference
+		net.PruneThreshold(0.2)
+		net.SetLayerFrozen(0, true)
+
+		losses := make([]float64, nSamples)
+		derivs := RandomSliceOfSlice(nSamples, net.TotalNumParameters())
+		if err := PerSampleLossDeriv(inputs, truths, weights, net, losses, derivs, 4); err != nil {
+			t.Fatal(err)
+		}
+
+		// The sum over the samples is the derivative of the total loss
+		want, wantFlat := net.NewPerParameterMemory()
+		wantLoss := SeqLossDeriv(inputs, truths, weights, net, want, NewParLossDerivMemory(net))
+		sum := make([]float64, net.TotalNumParameters())
+		for _, d := range derivs {
+			floats.Add(sum, d)
+		}
+		if !floats.EqualWithinAbsOrRel(floats.Sum(losses), wantLoss, 1e-12, 1e-12) {
+			t.Errorf("%v: losses do not sum to the total loss", test.name)
+		}
+		if !floats.EqualApprox(sum, wantFlat, 1e-12) {
+			t.Errorf("%v: derivatives do not sum to the total derivative", test.name)
+		}
+
+		// Each is the derivative of one sample
+		for _, i := range []int{0, 7, nSamples - 1} {
+			d, flat := net.NewPerParameterMemory()
+			loss := PredLossDeriv(inputs[i], truths[i], weights[i], net, net.NewPredLossDerivTmpMemory(), make([]float64, nOutputs), d)
+			if loss != losses[i] || !floats.Equal(flat, derivs[i]) {
+				t.Errorf("%v: derivative of sample %v does not match PredLossDeriv", test.name, i)
+			}
+		}
+
+		norms := make([]float64, nSamples)
+		if err := GradientNorms(inputs, truths, weights, net, make([]float64, nSamples), norms, 5); err != nil {
+			t.Fatal(err)
+		}
+		for i, n := range norms {
+			if math.Abs(n-floats.Norm(derivs[i], 2)) > 1e-14 {
+				t.Errorf("%v: wrong norm of sample %v", test.name, i)
+			}
+		}
+
+		// The influence is the dot product with the derivative at the test point
+		testInput := inputs[3]
+		testTruth := truths[3]
+		scores := make([]float64, nSamples)
+		ones := make([]float64, nSamples)
+		for i := range ones {
+			ones[i] = 1
+		}
+		if err := InfluenceScores(inputs, truths, ones, net, testInput, testTruth, scores, 6); err != nil {
+			t.Fatal(err)
+		}
+		unit := make([][]float64, nSamples)
+		for i := range unit {
+			unit[i] = make([]float64, net.TotalNumParameters())
+		}
+		PerSampleLossDeriv(inputs, truths, ones, net, losses, unit, 6)
+		for i, s := range scores {
+			want := floats.Dot(unit[i], unit[3])
+			if math.Abs(s-want) > 1e-12*math.Max(1, math.Abs(want)) {
+				t.Errorf("%v: wrong influence score of sample %v. Want %v, got %v", test.name, i, want, s)
+			}
+		}
+
+		// A mislabeled sample has the largest norm
+		truths[11] = make([]float64, nOutputs)
+		for j := range truths[11] {
+			truths[11][j] = 100
+		}
+		if err := GradientNorms(inputs, truths, ones, net, make([]float64, nSamples), norms, 5); err != nil {
+			t.Fatal(err)
+		}
+		if floats.MaxIdx(norms) != 11 {
+			t.Errorf("%v: mislabeled sample does not have the largest norm", test.name)
+		}
+	}
+}
+
+func TestPerSampleErrors(t *testing.T) {
+	net := newPruneNet(3, 2)
+	inputs := RandomSliceOfSlice(5, 3)
+	truths := RandomSliceOfSlice(5, 2)
+	weights := RandomWeights(5)
+	derivs := RandomSliceOfSlice(5, net.TotalNumParameters())
+	if err := PerSampleLossDeriv(inputs, truths, weights, net, make([]float64, 4), derivs, 2); err == nil {
+		t.Errorf("No error for the wrong number of losses")
+	}
+	if err := PerSampleLossDeriv(inputs, truths[:4], weights, net, make([]float64, 5), derivs, 2); err == nil {
+		t.Errorf("No error for the wrong number of truths")
+	}
+	derivs[2] = derivs[2][1:]
+	if err := PerSampleLossDeriv(inputs, truths, weights, net, make([]float64, 5), derivs, 2); err == nil {
+		t.Errorf("No error for a derivative of the wrong length")
+	}
+	if err := GradientNorms(inputs, truths, weights, net, make([]float64, 5), make([]float64, 5), 0); err == nil {
+		t.Errorf("No error for a chunk size of zero")
+	}
+	if err := InfluenceScores(inputs, truths, weights, net, inputs[0][:2], truths[0], make([]float64, 5), 2); err == nil {
+		t.Errorf("No error for a test input of the wrong length")
+	}
+}
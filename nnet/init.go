@@ -0,0 +1,322 @@
+package nnet
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Initializer sets the initial values of the parameters of a net. All of the
+// randomness must come from rnd so that the same seed gives the same net.
+type Initializer interface {
+	Initialize(net *Net, rnd *rand.Rand) error
+}
+
+// SeededRandomizer is a Neuron which can randomize its parameters from a given
+// source rather than from the global source in math/rand. Initializers use it
+// for the neurons they do not know how to initialize, and return an error for
+// such neurons which are not SeededRandomizers, as Randomize would make the
+// initialization depend on the global source.
+type SeededRandomizer interface {
+	RandomizeFrom(parameters []float64, rnd *rand.Rand)
+}
+
+// randSource is the part of rand.Rand used to randomize parameters
+type randSource interface {
+	Float64() float64
+	NormFloat64() float64
+}
+
+// globalRand is a randSource using the global source in math/rand
+type globalRand struct{}
+
+func (globalRand) Float64() float64     { return rand.Float64() }
+func (globalRand) NormFloat64() float64 { return rand.NormFloat64() }
+
+// Initialize sets the parameters of the net with the initializer. If init is nil,
+// every neuron is randomized on its own with RandomizeFrom (see NeuronInitializer).
+// If src is nil, a seed is drawn from the global source in math/rand.
+func (net *Net) Initialize(init Initializer, src rand.Source) error {
+	if src == nil {
+		src = rand.NewSource(rand.Int63())
+	}
+	if init == nil {
+		init = NeuronInitializer{}
+	}
+	return init.Initialize(net, rand.New(src))
+}
+
+// layerInputs returns the number of inputs to each layer
+func (net *Net) layerInputs() []int {
+	layerInputs := make([]int, len(net.layers))
+	if net.isSequential() {
+		// The first layer has the inputs of the net as inputs, and the rest
+		// have the outputs of the previous layer
+		layerInputs[0] = net.nInputs
+		for i := 1; i < len(net.layers); i++ {
+			layerInputs[i] = len(net.layers[i-1].Neurons)
+		}
+		return layerInputs
+	}
+	for i, srcs := range net.sources {
+		for _, src := range srcs {
+			layerInputs[i] += net.sourceLen(src)
+		}
+	}
+	return layerInputs
+}
+
+// randomizeNeuron randomizes the parameters of a neuron from rnd. Returns an
+// error if the neuron is not a SeededRandomizer
+func randomizeNeuron(neuron Neuron, parameters []float64, rnd *rand.Rand) error {
+	s, ok := neuron.(SeededRandomizer)
+	if !ok {
+		return fmt.Errorf("nnet: neuron of type %T does not implement SeededRandomizer", neuron)
+	}
+	s.RandomizeFrom(parameters, rnd)
+	return nil
+}
+
+// resetBatchNorm sets the gammas of batch normalization to one and the betas to zero
+func (net *Net) resetBatchNorm() {
+	for i, layer := range net.layers {
+		if layer.BatchNorm == nil {
+			continue
+		}
+		gamma, beta := layer.batchNormParameters(net.parameters[i])
+		for j := range gamma {
+			gamma[j] = 1
+			beta[j] = 0
+		}
+	}
+}
+
+// initializeWeights sets the weights of all of the layers of SumNeurons with
+// setLayer, which is given the parameters of the neurons and the number of inputs
+// to the layer. The biases are set to zero, and all other neurons are randomized
+// with randomizeNeuron.
+func (net *Net) initializeWeights(rnd *rand.Rand, setLayer func(parameters [][]float64, nInputs int)) error {
+	layerInputs := net.layerInputs()
+	for i := range net.layers {
+		layer := &net.layers[i]
+		if !layer.isSumLayer() {
+			for j, neuron := range layer.Neurons {
+				if err := randomizeNeuron(neuron, net.parameters[i][j], rnd); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		params := net.parameters[i][:len(layer.Neurons)]
+		setLayer(params, layerInputs[i])
+		for _, p := range params {
+			p[layerInputs[i]] = 0
+		}
+	}
+	net.resetBatchNorm()
+	return nil
+}
+
+// NeuronInitializer randomizes every neuron on its own (for SumNeurons, normally
+// distributed with a variance of one over the number of parameters). This is the
+// default initializer. All of the neurons must be SeededRandomizers.
+type NeuronInitializer struct{}
+
+// Initialize initializes the net
+func (NeuronInitializer) Initialize(net *Net, rnd *rand.Rand) error {
+	for i, layer := range net.layers {
+		for j, neuron := range layer.Neurons {
+			if err := randomizeNeuron(neuron, net.parameters[i][j], rnd); err != nil {
+				return err
+			}
+		}
+	}
+	net.resetBatchNorm()
+	return nil
+}
+
+// Xavier is the initialization of Glorot and Bengio, "Understanding the difficulty
+// of training deep feedforward neural networks", 2010. The weights of the SumNeurons
+// are normally distributed with variance 2 / (fanIn + fanOut), and the biases are zero.
+type Xavier struct{}
+
+// Initialize initializes the net
+func (Xavier) Initialize(net *Net, rnd *rand.Rand) error {
+	return net.initializeWeights(rnd, func(parameters [][]float64, nInputs int) {
+		std := math.Sqrt(2 / float64(nInputs+len(parameters)))
+		for _, p := range parameters {
+			for k := 0; k < nInputs; k++ {
+				p[k] = std * rnd.NormFloat64()
+			}
+		}
+	})
+}
+
+// He is the initialization of He et al., "Delving deep into rectifiers", 2015. The
+// weights of the SumNeurons are normally distributed with variance 2 / fanIn, and the
+// biases are zero.
+type He struct{}
+
+// Initialize initializes the net
+func (He) Initialize(net *Net, rnd *rand.Rand) error {
+	return net.initializeWeights(rnd, func(parameters [][]float64, nInputs int) {
+		std := math.Sqrt(2 / float64(nInputs))
+		for _, p := range parameters {
+			for k := 0; k < nInputs; k++ {
+				p[k] = std * rnd.NormFloat64()
+			}
+		}
+	})
+}
+
+// Orthogonal is the initialization of Saxe et al., "Exact solutions to the nonlinear
+// dynamics of learning in deep linear neural networks", 2013. The weight matrix of each
+// layer of SumNeurons is a random orthogonal matrix times Gain (the rows are orthonormal
+// if there are fewer neurons than inputs, and otherwise the columns are). If Gain
+// is zero, a gain of one is used. The biases are zero.
+type Orthogonal struct {
+	Gain float64
+}
+
+// Initialize initializes the net
+func (o Orthogonal) Initialize(net *Net, rnd *rand.Rand) error {
+	gain := o.Gain
+	if gain == 0 {
+		gain = 1
+	}
+	return net.initializeWeights(rnd, func(parameters [][]float64, nInputs int) {
+		randomOrthogonal(parameters, nInputs, rnd)
+		for _, p := range parameters {
+			for k := 0; k < nInputs; k++ {
+				p[k] *= gain
+			}
+		}
+	})
+}
+
+// randomOrthogonal sets the first nInputs elements of the rows to a random matrix
+// with orthonormal rows or columns (whichever there are fewer of). The vectors are
+// orthonormalized with the modified Gram-Schmidt process.
+func randomOrthogonal(rows [][]float64, nInputs int, rnd *rand.Rand) {
+	nRows := len(rows)
+	for _, row := range rows {
+		for k := 0; k < nInputs; k++ {
+			row[k] = rnd.NormFloat64()
+		}
+	}
+	// Work with the vectors which are orthonormalized
+	var vecs [][]float64
+	if nRows <= nInputs {
+		vecs = make([][]float64, nRows)
+		for i, row := range rows {
+			vecs[i] = row[:nInputs]
+		}
+	} else {
+		vecs = make([][]float64, nInputs)
+		for k := range vecs {
+			vecs[k] = make([]float64, nRows)
+			for i, row := range rows {
+				vecs[k][i] = row[k]
+			}
+		}
+	}
+	for i, v := range vecs {
+		for _, u := range vecs[:i] {
+			var dot float64
+			for k := range v {
+				dot += u[k] * v[k]
+			}
+			for k := range v {
+				v[k] -= dot * u[k]
+			}
+		}
+		var norm float64
+		for _, val := range v {
+			norm += val * val
+		}
+		norm = math.Sqrt(norm)
+		for k := range v {
+			v[k] /= norm
+		}
+	}
+	if nRows > nInputs {
+		for k, v := range vecs {
+			for i, row := range rows {
+				row[k] = v[i]
+			}
+		}
+	}
+}
+
+// LSUV is the layer-sequential unit-variance initialization of Mishkin and Matas,
+// "All you need is a good init", 2015. The net is first initialized with Orthogonal,
+// and then the weights of each layer of SumNeurons are scaled in turn until the
+// variance of the combinations of the layer over the inputs is within Tol of one.
+// Inputs are the inputs to the net after scaling. If Tol is zero, 0.1 is used, and if
+// MaxIter is zero, at most 10 scalings are done per layer.
+type LSUV struct {
+	Inputs  [][]float64
+	Tol     float64
+	MaxIter int
+}
+
+// Initialize initializes the net. Returns an error if there are no inputs or if
+// the inputs do not match the net
+func (l LSUV) Initialize(net *Net, rnd *rand.Rand) error {
+	if len(l.Inputs) == 0 {
+		return errors.New("nnet: LSUV needs inputs")
+	}
+	for i, input := range l.Inputs {
+		if len(input) != net.nInputs {
+			return fmt.Errorf("nnet: LSUV input %v has length %v, but the net has %v inputs", i, len(input), net.nInputs)
+		}
+	}
+	tol := l.Tol
+	if tol == 0 {
+		tol = 0.1
+	}
+	maxIter := l.MaxIter
+	if maxIter == 0 {
+		maxIter = 10
+	}
+	err := Orthogonal{}.Initialize(net, rnd)
+	if err != nil {
+		return err
+	}
+
+	tmp := net.NewPredictTmpMemory()
+	pred := make([]float64, net.nOutputs)
+	layerInputs := net.layerInputs()
+	for layer := range net.layers {
+		if !net.layers[layer].isSumLayer() {
+			continue
+		}
+		for iter := 0; iter < maxIter; iter++ {
+			// The combinations of the later layers are not needed, but it is simpler to
+			// predict with the whole net
+			var sum, sumSq float64
+			var n int
+			for _, input := range l.Inputs {
+				forward(input, net, pred, tmp.combinations, tmp.outputs, tmp.layerInputs)
+				for _, comb := range tmp.combinations[layer] {
+					sum += comb
+					sumSq += comb * comb
+					n++
+				}
+			}
+			mean := sum / float64(n)
+			variance := sumSq/float64(n) - mean*mean
+			if math.Abs(variance-1) < tol || variance == 0 {
+				break
+			}
+			scale := 1 / math.Sqrt(variance)
+			for _, p := range net.parameters[layer][:len(net.layers[layer].Neurons)] {
+				for k := 0; k < layerInputs[layer]; k++ {
+					p[k] *= scale
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package nnet
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/gonum/floats"
+)
+
+func initTestLayers() []Layer {
+	layers := make([]Layer, 3)
+	layers[0].Neurons = make([]Neuron, 40)
+	for j := range layers[0].Neurons {
+		layers[0].Neurons[j] = &TanhNeuron
+	}
+	layers[1].Neurons = []Neuron{&RBFNeuron{}, &RBFNeuron{}, &RBFNeuron{PerDimensionWidth: true}}
+	layers[2].Neurons = []Neuron{&LinearNeuron, &LinearNeuron}
+	return layers
+}
+
+// newInitNet returns a net with initTestLayers initialized by init with the seed
+func newInitNet(t *testing.T, nInputs int, init Initializer, seed int64) *Net {
+	net, err := NewNetInit(nInputs, initTestLayers(), init, rand.NewSource(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return net
+}
+
+func TestInitializeReproducible(t *testing.T) {
+	inputs := RandomSliceOfSlice(50, 5)
+	for _, init := range []Initializer{nil, NeuronInitializer{}, Xavier{}, He{}, Orthogonal{Gain: 1.2}, LSUV{Inputs: inputs}} {
+		net1 := newInitNet(t, 5, init, 1)
+		net2 := newInitNet(t, 5, init, 1)
+		net3 := newInitNet(t, 5, init, 2)
+		if !floats.Equal(net1.parametersSlice, net2.parametersSlice) {
+			t.Errorf("Parameters not the same with the same seed for %T", init)
+		}
+		if floats.Equal(net1.parametersSlice, net3.parametersSlice) {
+			t.Errorf("Parameters the same with different seeds for %T", init)
+		}
+	}
+}
+
+// sumLayerWeights returns the weights of the first layer of the net
+func sumLayerWeights(net *Net) (weights [][]float64, biases []float64) {
+	nInputs := net.nInputs
+	for _, p := range net.parameters[0] {
+		weights = append(weights, p[:nInputs])
+		biases = append(biases, p[nInputs])
+	}
+	return weights, biases
+}
+
+func TestInitializeVariance(t *testing.T) {
+	nInputs := 60
+	for _, test := range []struct {
+		init     Initializer
+		variance float64
+	}{
+		{Xavier{}, 2.0 / (60 + 40)},
+		{He{}, 2.0 / 60},
+	} {
+		net := newInitNet(t, nInputs, test.init, 1)
+		weights, biases := sumLayerWeights(net)
+		var sumSq float64
+		var n int
+		for _, w := range weights {
+			for _, val := range w {
+				sumSq += val * val
+				n++
+			}
+		}
+		variance := sumSq / float64(n)
+		if math.Abs(variance-test.variance) > 0.1*test.variance {
+			t.Errorf("Wrong variance for %T. Want %v, got %v", test.init, test.variance, variance)
+		}
+		for _, b := range biases {
+			if b != 0 {
+				t.Errorf("Non-zero bias for %T", test.init)
+				break
+			}
+		}
+	}
+}
+
+func TestOrthogonal(t *testing.T) {
+	gain := 1.5
+	// Fewer neurons than inputs, so the rows are orthogonal, and more neurons than
+	// inputs so the columns are
+	for _, nInputs := range []int{60, 15} {
+		net := newInitNet(t, nInputs, Orthogonal{Gain: gain}, 1)
+		weights, _ := sumLayerWeights(net)
+		nNeurons := len(weights)
+		if nNeurons <= nInputs {
+			for i := range weights {
+				for j := range weights {
+					dot := floats.Dot(weights[i], weights[j])
+					want := 0.0
+					if i == j {
+						want = gain * gain
+					}
+					if math.Abs(dot-want) > 1e-12 {
+						t.Errorf("Rows %v and %v not orthogonal: %v", i, j, dot)
+					}
+				}
+			}
+			continue
+		}
+		for k := 0; k < nInputs; k++ {
+			for l := 0; l < nInputs; l++ {
+				var dot float64
+				for i := range weights {
+					dot += weights[i][k] * weights[i][l]
+				}
+				want := 0.0
+				if k == l {
+					want = gain * gain
+				}
+				if math.Abs(dot-want) > 1e-12 {
+					t.Errorf("Columns %v and %v not orthogonal: %v", k, l, dot)
+				}
+			}
+		}
+	}
+}
+
+func TestLSUV(t *testing.T) {
+	nInputs := 5
+	inputs := RandomSliceOfSlice(200, nInputs)
+	for i := range inputs {
+		floats.Scale(10, inputs[i])
+	}
+	tol := 0.05
+	net := newInitNet(t, nInputs, LSUV{Inputs: inputs, Tol: tol, MaxIter: 20}, 1)
+	tmp := net.NewPredictTmpMemory()
+	pred := make([]float64, net.Outputs())
+	// The first and last layers are sum layers
+	for _, l := range []int{0, 2} {
+		var sum, sumSq float64
+		var n int
+		for _, input := range inputs {
+			Predict(input, net, pred, tmp.combinations, tmp.outputs)
+			for _, comb := range tmp.combinations[l] {
+				sum += comb
+				sumSq += comb * comb
+				n++
+			}
+		}
+		mean := sum / float64(n)
+		variance := sumSq/float64(n) - mean*mean
+		if math.Abs(variance-1) > tol {
+			t.Errorf("Variance of layer %v is %v", l, variance)
+		}
+	}
+
+	err := net.Initialize(LSUV{}, nil)
+	if err == nil {
+		t.Errorf("No error for LSUV without inputs")
+	}
+	err = net.Initialize(LSUV{Inputs: RandomSliceOfSlice(10, nInputs+1)}, nil)
+	if err == nil {
+		t.Errorf("No error for LSUV with the wrong input size")
+	}
+}
+
+// unseededNeuron is a Neuron which is not a SeededRandomizer
+type unseededNeuron struct {
+	Neuron
+}
+
+func TestInitializeUnseeded(t *testing.T) {
+	layers := initTestLayers()
+	layers[1].Neurons[0] = unseededNeuron{&TanhNeuron}
+	for _, init := range []Initializer{nil, Xavier{}, He{}, Orthogonal{}} {
+		if _, err := NewNetInit(5, layers, init, rand.NewSource(1)); err == nil {
+			t.Errorf("No error for a neuron which is not a SeededRandomizer with %T", init)
+		}
+	}
+	// NewNet randomizes every neuron with Randomize
+	NewNet(5, layers)
+}
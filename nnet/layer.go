@@ -1,32 +1,103 @@
 package nnet
 
 import (
+	"bytes"
 	"encoding/json"
+	"github.com/btracey/nnet/activator"
 	"github.com/btracey/nnet/common"
 )
 
-// layer represents a layer of neurons
+// layer represents a layer of neurons. If Activation is not nil, the outputs of the layer are
+// computed from the combinations of all of the neurons by Activation, and the
+// activation functions of the neurons themselves are not used.
+//
+// Dropout is the probability that each output of the layer is set to zero during
+// training (in SeqLossDeriv and ParLossDeriv of a Net in the Train mode). The outputs which
+// are kept are scaled by 1/(1-Dropout) so that predictions do not need to be rescaled.
+//
+// If BatchNorm is not nil, the combinations of the neurons are normalized before they
+// are activated (see BatchNorm). The combinations stored by ProcessLayer and Predict are
+// the normalized combinations.
 type Layer struct {
-	Neurons []Neuron
+	Neurons    []Neuron
+	Activation activator.LayerActivator
+	Dropout    float64
+	BatchNorm  *BatchNorm
 }
 
+// activate computes the outputs of the layer from the combinations
+func (l *Layer) activate(combinations, outputs []float64) {
+	if l.Activation != nil {
+		l.Activation.Activate(combinations, outputs)
+		return
+	}
+	for i, neuron := range l.Neurons {
+		outputs[i] = neuron.Activate(combinations[i])
+	}
+}
+
+// dLossDCombination computes the derivative of the loss with respect to the combinations
+// of the layer given the derivative of the loss with respect to the outputs. dLossDOutput
+// and dLossDCombination may be the same slice.
+func (l *Layer) dLossDCombination(combinations, outputs, dLossDOutput, dLossDCombination []float64) {
+	if l.Activation == nil {
+		for i, neuron := range l.Neurons {
+			dLossDCombination[i] = dLossDOutput[i] * neuron.DActivateDCombination(combinations[i], outputs[i])
+		}
+		return
+	}
+	// dLoss/dcomb_j = sum_i dLoss/dout_i * dout_i/dcomb_j
+	l.Activation.VecDActivateDCombination(combinations, outputs, dLossDOutput, dLossDCombination)
+}
+
+type layerMarshaler struct {
+	Neurons    []*common.InterfaceMarshaler
+	Activation *common.InterfaceMarshaler `json:",omitempty"`
+	Dropout    float64                    `json:",omitempty"`
+	BatchNorm  *BatchNorm                 `json:",omitempty"`
+}
+
+// MarshalJSON marshals the layer as a list of neurons. If the layer has an
+// Activation, Dropout or BatchNorm, it is instead marshaled as an object with the neurons and the options
 func (l Layer) MarshalJSON() ([]byte, error) {
 	n := make([]*common.InterfaceMarshaler, len(l.Neurons))
 	for i := range l.Neurons {
 		n[i] = &common.InterfaceMarshaler{I: l.Neurons[i]}
 	}
-	return json.Marshal(n)
+	if l.Activation == nil && l.Dropout == 0 && l.BatchNorm == nil {
+		return json.Marshal(n)
+	}
+	v := &layerMarshaler{
+		Neurons:   n,
+		Dropout:   l.Dropout,
+		BatchNorm: l.BatchNorm,
+	}
+	if l.Activation != nil {
+		v.Activation = &common.InterfaceMarshaler{I: l.Activation}
+	}
+	return json.Marshal(v)
 }
 
 func (l *Layer) UnmarshalJSON(data []byte) error {
-	v := make([]*common.InterfaceMarshaler, 0)
-	err := json.Unmarshal(data, &v)
+	v := &layerMarshaler{}
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err = json.Unmarshal(data, &v.Neurons)
+	} else {
+		err = json.Unmarshal(data, v)
+	}
 	if err != nil {
 		return err
 	}
-	l.Neurons = make([]Neuron, len(v))
+	l.Neurons = make([]Neuron, len(v.Neurons))
 	for i := range l.Neurons {
-		l.Neurons[i] = v[i].I.(Neuron)
+		l.Neurons[i] = v.Neurons[i].I.(Neuron)
+	}
+	l.Dropout = v.Dropout
+	l.BatchNorm = v.BatchNorm
+	l.Activation = nil
+	if v.Activation != nil {
+		l.Activation = v.Activation.I.(activator.LayerActivator)
 	}
 	return nil
 }
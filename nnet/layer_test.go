@@ -0,0 +1,190 @@
+package nnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/btracey/nnet/activator"
+	"github.com/btracey/nnet/loss"
+	"github.com/gonum/floats"
+)
+
+// oneHot returns random one-hot class labels
+func oneHot(nSamples, nClasses int) [][]float64 {
+	truths := make([][]float64, nSamples)
+	for i := range truths {
+		truths[i] = make([]float64, nClasses)
+		truths[i][i%nClasses] = 1
+	}
+	return truths
+}
+
+func TestSoftmaxLayerDeriv(t *testing.T) {
+	nInputs := 3
+	nClasses := 4
+	net := DefaultClassification(nInputs, nClasses, 2, 5)
+	net.layers[len(net.layers)-1].Activation = activator.Softmax{}
+	net.Losser = loss.ProbabilityCrossEntropy{}
+	slow := newPerNeuronNet(net)
+	slow.layers[len(slow.layers)-1].Activation = net.layers[len(net.layers)-1].Activation
+
+	nSamples := 40
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := oneHot(nSamples, nClasses)
+	weights := RandomWeights(nSamples)
+
+	for _, n := range []*Net{net, slow} {
+		dLossDParam, dLossFlat := n.NewPerParameterMemory()
+		n.RandomizeParameters()
+		PredLossDeriv(inputs[0], truths[0], weights[0], n, n.NewPredLossDerivTmpMemory(), make([]float64, nClasses), dLossDParam)
+
+		params := make([]float64, n.TotalNumParameters())
+		n.ParametersSlice(params)
+		pred := make([]float64, nClasses)
+		dLossDPred := make([]float64, nClasses)
+		tmp := n.NewPredictTmpMemory()
+		fdDLossFlat := make([]float64, len(params))
+		for i := range params {
+			params[i] += netFDStep
+			n.SetParametersSlice(params)
+			Predict(inputs[0], n, pred, tmp.combinations, tmp.outputs)
+			loss1 := weights[0] * n.Losser.LossAndDeriv(pred, truths[0], dLossDPred)
+			params[i] -= 2 * netFDStep
+			n.SetParametersSlice(params)
+			Predict(inputs[0], n, pred, tmp.combinations, tmp.outputs)
+			loss2 := weights[0] * n.Losser.LossAndDeriv(pred, truths[0], dLossDPred)
+			params[i] += netFDStep
+			n.SetParametersSlice(params)
+			fdDLossFlat[i] = (loss1 - loss2) / (2 * netFDStep)
+		}
+		if sum := floats.Sum(pred); math.Abs(sum-1) > 1e-14 {
+			t.Errorf("Softmax predictions don't sum to one: %v", pred)
+		}
+		for i := range params {
+			if !floats.EqualWithinAbsOrRel(dLossFlat[i], fdDLossFlat[i], 1e-6, 1e-6) {
+				t.Errorf("Finite difference doesn't match derivative")
+				for i := range dLossFlat {
+					fmt.Println(i, dLossFlat[i], fdDLossFlat[i], dLossFlat[i]-fdDLossFlat[i])
+				}
+				return
+			}
+		}
+	}
+
+	// The batched path should match the per-neuron path
+	slow.SetParametersSlice(net.parametersSlice)
+	dLossDParam1, flat1 := net.NewPerParameterMemory()
+	dLossDParam2, flat2 := slow.NewPerParameterMemory()
+	loss1 := ParLossDeriv(inputs, truths, weights, net, dLossDParam1, 7)
+	loss2 := ParLossDeriv(inputs, truths, weights, slow, dLossDParam2, 7)
+	if !floats.EqualWithinAbsOrRel(loss1, loss2, denseTol, denseTol) {
+		t.Errorf("ParLossDeriv loss doesn't match. Dense: %v, per neuron: %v", loss1, loss2)
+	}
+	if !floats.EqualApprox(flat1, flat2, denseTol) {
+		t.Errorf("ParLossDeriv derivative doesn't match")
+	}
+}
+
+// A Softmax output layer with ProbabilityCrossEntropy is the same as an output layer
+// of logits with CrossEntropy
+func TestSoftmaxCrossEntropy(t *testing.T) {
+	nInputs := 3
+	nClasses := 4
+	nSamples := 30
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := oneHot(nSamples, nClasses)
+	weights := RandomWeights(nSamples)
+
+	logits, err := DefaultClassificationInit(nInputs, nClasses, 1, 5, nil, rand.NewSource(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	probs, err := DefaultClassificationInit(nInputs, nClasses, 1, 5, nil, rand.NewSource(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	probs.layers[len(probs.layers)-1].Activation = activator.Softmax{}
+	probs.Losser = loss.ProbabilityCrossEntropy{}
+
+	dLogits, flatLogits := logits.NewPerParameterMemory()
+	dProbs, flatProbs := probs.NewPerParameterMemory()
+	lossLogits := ParLossDeriv(inputs, truths, weights, logits, dLogits, 7)
+	lossProbs := ParLossDeriv(inputs, truths, weights, probs, dProbs, 7)
+	if math.Abs(lossLogits-lossProbs) > 1e-12 {
+		t.Errorf("Loss mismatch. Logits: %v, probabilities: %v", lossLogits, lossProbs)
+	}
+	if !floats.EqualApprox(flatLogits, flatProbs, 1e-12) {
+		t.Errorf("Derivative mismatch between the logits and the probabilities")
+	}
+}
+
+func TestClassificationDeriv(t *testing.T) {
+	nInputs := 3
+	nClasses := 4
+	nSamples := 10
+	net := DefaultClassification(nInputs, nClasses, 1, 5)
+	batchNormFD(t, net, RandomSliceOfSlice(nSamples, nInputs), oneHot(nSamples, nClasses), RandomWeights(nSamples), "classification")
+}
+
+func TestPredLossDerivAllocs(t *testing.T) {
+	nInputs := 3
+	softmax := DefaultClassification(nInputs, 4, 1, 5)
+	softmax.layers[len(softmax.layers)-1].Activation = activator.Softmax{}
+	softmax.Losser = loss.ProbabilityCrossEntropy{}
+	batch := newBatchNormNet(nInputs, 4)
+	input := RandomSliceOfSlice(1, nInputs)[0]
+	truth := RandomSliceOfSlice(1, 4)[0]
+	pred := make([]float64, 4)
+	for _, test := range []struct {
+		name string
+		net  *Net
+	}{
+		{"softmax", softmax},
+		{"batch norm", batch},
+	} {
+		net := test.net
+		tmp := net.NewPredLossDerivTmpMemory()
+		dLossDParam, _ := net.NewPerParameterMemory()
+		allocs := testing.AllocsPerRun(100, func() {
+			PredLossDeriv(input, truth, 1, net, tmp, pred, dLossDParam)
+		})
+		if allocs != 0 {
+			t.Errorf("%v: PredLossDeriv allocates %v times per call", test.name, allocs)
+		}
+	}
+}
+
+func TestLayerJSON(t *testing.T) {
+	nInputs := 3
+	nClasses := 3
+	net := DefaultClassification(nInputs, nClasses, 1, 4)
+	net.layers[len(net.layers)-1].Activation = activator.Softmax{}
+	net.InputScaler.SetScale(RandomData(nInputs, 100))
+	net.OutputScaler.SetScale(RandomData(nClasses, 100))
+
+	data, err := json.Marshal(net)
+	if err != nil {
+		t.Fatalf("Error marshaling net: %v", err)
+	}
+	net2 := &Net{}
+	err = net2.UnmarshalJSON(data)
+	if err != nil {
+		t.Fatalf("Error unmarshaling: %v", err)
+	}
+	if !reflect.DeepEqual(net, net2) {
+		t.Errorf("Net not equal after encoding and decoding")
+	}
+
+	// Layers without an activation are still marshaled as a list of neurons
+	data, err = json.Marshal(net.layers[0])
+	if err != nil {
+		t.Fatalf("Error marshaling layer: %v", err)
+	}
+	if data[0] != '[' {
+		t.Errorf("Layer without activation should marshal as a list")
+	}
+}
@@ -0,0 +1,145 @@
+package nnet
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/scale"
+)
+
+// A mixture density net predicts the distribution of the outputs as a mixture of
+// Gaussians rather than a single value. The outputs of the last layer are the
+// parameters of the mixture as described in loss.MixtureDensity, which must be the
+// Losser of the net. The OutputScaler scales the targets (which have fewer dimensions
+// than the outputs of the net), so Predict and PredictSlice should not be used.
+// Use PredictDistribution and SampleDistribution instead.
+
+// DefaultMixtureDensity returns the default network for predicting the distribution of
+// targets of dimension nDim as a mixture of nComponents Gaussians. The hidden layers
+// are as in DefaultRegression, and the output layer is linear.
+func DefaultMixtureDensity(nInputs, nDim, nComponents, nHiddenLayers, nNeuronsPerHiddenLayer int) *Net {
+	if nComponents < 1 {
+		panic("number of components must be at least 1")
+	}
+	if nDim < 1 {
+		panic("number of dimensions must be at least 1")
+	}
+	m := loss.MixtureDensity{Components: nComponents}
+	net := DefaultRegression(nInputs, m.NumOutputs(nDim), nHiddenLayers, nNeuronsPerHiddenLayer)
+	net.Losser = m
+	return net
+}
+
+// mixtureLosser returns the Losser of the net if it is a mixture density
+func (net *Net) mixtureLosser() (loss.MixtureDensity, error) {
+	m, ok := net.Losser.(loss.MixtureDensity)
+	if !ok {
+		return m, errors.New("nnet: Losser is not loss.MixtureDensity")
+	}
+	return m, nil
+}
+
+// predictMixture returns the mixture predicted at the input in scaled units
+func (net *Net) predictMixture(input []float64) (weights []float64, means, variances [][]float64, err error) {
+	if len(input) != net.nInputs {
+		return nil, nil, nil, InputMismatch{Provided: len(input), Expected: net.nInputs}
+	}
+	m, err := net.mixtureLosser()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !net.InputScaler.IsScaled() {
+		return nil, nil, nil, errors.New("Scale must be set before calling predict")
+	}
+	if !net.OutputScaler.IsScaled() {
+		return nil, nil, nil, errors.New("Scale must be set before calling predict")
+	}
+	s := net.getPredictScratch()
+	defer predictPool.Put(s)
+	copy(s.input, input)
+	err = net.InputScaler.Scale(s.input)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pred := make([]float64, net.nOutputs)
+	forward(s.input, net, pred, s.tmp.combinations, s.tmp.outputs, s.tmp.layerInputs)
+	weights, means, variances = m.Mixture(pred)
+	if len(means[0]) != net.OutputScaler.Dimensions() {
+		return nil, nil, nil, fmt.Errorf("nnet: mixture has dimension %v, but the OutputScaler has %v", len(means[0]), net.OutputScaler.Dimensions())
+	}
+	return weights, means, variances, nil
+}
+
+// PredictDistribution predicts the mixture distribution of the outputs at the input.
+// It returns the weight of each component, and the means and variances of the
+// component in each dimension. The means and variances are unscaled with the
+// OutputScaler, which must implement scale.Differentiable. The variances are scaled
+// by the square of the derivative of the unscaling at the mean, which is exact for
+// scalers which are linear in each dimension (like scale.Normal and scale.Linear).
+// The input is not modified.
+func (net *Net) PredictDistribution(input []float64) (weights []float64, means, variances [][]float64, err error) {
+	outputScaler, ok := net.OutputScaler.(scale.Differentiable)
+	if !ok {
+		return nil, nil, nil, errors.New("OutputScaler must implement scale.Differentiable")
+	}
+	weights, means, variances, err = net.predictMixture(input)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	deriv := make([]float64, len(means[0]))
+	for i := range means {
+		err = outputScaler.DUnscaleDPoint(means[i], deriv)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		err = outputScaler.Unscale(means[i])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for j, d := range deriv {
+			variances[i][j] *= d * d
+		}
+	}
+	return weights, means, variances, nil
+}
+
+// SampleDistribution draws nSamples samples from the mixture distribution of the
+// outputs at the input. The samples are drawn in scaled units and then unscaled with
+// the OutputScaler. If src is nil, the global source in math/rand is used. The input
+// is not modified.
+func (net *Net) SampleDistribution(input []float64, nSamples int, src rand.Source) ([][]float64, error) {
+	weights, means, variances, err := net.predictMixture(input)
+	if err != nil {
+		return nil, err
+	}
+	var rnd randSource = globalRand{}
+	if src != nil {
+		rnd = rand.New(src)
+	}
+	samples := make([][]float64, nSamples)
+	for s := range samples {
+		// Choose the component, and then sample from its Gaussian
+		u := rnd.Float64()
+		k := len(weights) - 1
+		var cum float64
+		for i, w := range weights {
+			cum += w
+			if u < cum {
+				k = i
+				break
+			}
+		}
+		samples[s] = make([]float64, len(means[k]))
+		for j := range samples[s] {
+			samples[s][j] = means[k][j] + math.Sqrt(variances[k][j])*rnd.NormFloat64()
+		}
+		err = net.OutputScaler.Unscale(samples[s])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
@@ -0,0 +1,172 @@
+package nnet
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/scale"
+	"github.com/gonum/floats"
+)
+
+func newMixtureNet(nInputs, nDim, nComponents int) *Net {
+	net := DefaultMixtureDensity(nInputs, nDim, nComponents, 1, 6)
+	net.InputScaler.SetScale(RandomData(nInputs, 20))
+	outputScaler := &scale.Normal{}
+	outputScaler.SetScale(RandomData(nDim, 20))
+	net.OutputScaler = outputScaler
+	return net
+}
+
+func TestMixtureDeriv(t *testing.T) {
+	nInputs := 3
+	nDim := 2
+	nSamples := 20
+	net := newMixtureNet(nInputs, nDim, 3)
+	if net.Outputs() != 3*(1+2*nDim) {
+		t.Errorf("Wrong number of outputs")
+	}
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := RandomSliceOfSlice(nSamples, nDim)
+	weights := RandomWeights(nSamples)
+	batchNormFD(t, net, inputs, truths, weights, "mixture density")
+}
+
+func TestMixtureSerialize(t *testing.T) {
+	nInputs := 3
+	nDim := 2
+	net := newMixtureNet(nInputs, nDim, 3)
+	input := RandomSliceOfSlice(1, nInputs)[0]
+	wantWeights, wantMeans, wantVariances, err := net.PredictDistribution(input)
+	if err != nil {
+		t.Fatalf("Error predicting distribution: %v", err)
+	}
+	checkDecoded := func(name string, net2 *Net) {
+		if !floats.Equal(net.parametersSlice, net2.parametersSlice) {
+			t.Errorf("%v: parameters don't match", name)
+		}
+		if net2.Losser != net.Losser {
+			t.Errorf("%v: Losser doesn't match", name)
+		}
+		weights, means, variances, err := net2.PredictDistribution(input)
+		if err != nil {
+			t.Errorf("%v: error predicting distribution: %v", name, err)
+			return
+		}
+		if !floats.Equal(weights, wantWeights) {
+			t.Errorf("%v: weights don't match", name)
+		}
+		for i := range means {
+			if !floats.Equal(means[i], wantMeans[i]) || !floats.Equal(variances[i], wantVariances[i]) {
+				t.Errorf("%v: distribution doesn't match", name)
+			}
+		}
+	}
+
+	data, err := json.Marshal(net)
+	if err != nil {
+		t.Fatalf("Error marshaling mixture net: %v", err)
+	}
+	net2 := &Net{}
+	err = json.Unmarshal(data, net2)
+	if err != nil {
+		t.Fatalf("Error unmarshaling mixture net: %v", err)
+	}
+	checkDecoded("JSON", net2)
+
+	b, err := net.GobEncode()
+	if err != nil {
+		t.Fatalf("Error gob encoding mixture net: %v", err)
+	}
+	net3 := &Net{}
+	err = net3.GobDecode(b)
+	if err != nil {
+		t.Fatalf("Error gob decoding mixture net: %v", err)
+	}
+	checkDecoded("gob", net3)
+
+	// Changing a parameter should cause the prediction check to fail
+	v := &netMarshal{}
+	json.Unmarshal(data, v)
+	v.Parameters[0] += 1
+	data, _ = json.Marshal(v)
+	if json.Unmarshal(data, &Net{}) == nil {
+		t.Errorf("Prediction check should fail for modified parameters")
+	}
+}
+
+func TestPredictDistribution(t *testing.T) {
+	nInputs := 3
+	nDim := 2
+	net := newMixtureNet(nInputs, nDim, 3)
+	outputScaler := net.OutputScaler.(*scale.Normal)
+	input := RandomSliceOfSlice(1, nInputs)[0]
+	orig := append([]float64(nil), input...)
+
+	weights, means, variances, err := net.PredictDistribution(input)
+	if err != nil {
+		t.Fatalf("Error predicting distribution: %v", err)
+	}
+	if !floats.Equal(input, orig) {
+		t.Errorf("Input changed by PredictDistribution")
+	}
+
+	scaled := append([]float64(nil), input...)
+	net.InputScaler.Scale(scaled)
+	pred := make([]float64, net.Outputs())
+	tmp := net.NewPredictTmpMemory()
+	Predict(scaled, net, pred, tmp.combinations, tmp.outputs)
+	wantWeights, wantMeans, wantVariances := loss.MixtureDensity{Components: 3}.Mixture(pred)
+	if !floats.EqualApprox(weights, wantWeights, 1e-14) {
+		t.Errorf("Weights don't match")
+	}
+	for k := range means {
+		for j := range means[k] {
+			sigma := outputScaler.Sigma[j]
+			mean := wantMeans[k][j]*sigma + outputScaler.Mu[j]
+			variance := wantVariances[k][j] * sigma * sigma
+			if math.Abs(means[k][j]-mean) > 1e-12 || math.Abs(variances[k][j]-variance) > 1e-12 {
+				t.Errorf("Unscaled distribution doesn't match")
+			}
+		}
+	}
+
+	// The moments of the samples match the moments of the mixture
+	nSamples := 100000
+	samples, err := net.SampleDistribution(input, nSamples, rand.NewSource(1))
+	if err != nil {
+		t.Fatalf("Error sampling: %v", err)
+	}
+	samples2, _ := net.SampleDistribution(input, nSamples, rand.NewSource(1))
+	for j := 0; j < nDim; j++ {
+		var mean, second float64
+		for k := range weights {
+			mean += weights[k] * means[k][j]
+			second += weights[k] * (variances[k][j] + means[k][j]*means[k][j])
+		}
+		variance := second - mean*mean
+		var sum, sumSq float64
+		for s := range samples {
+			sum += samples[s][j]
+			sumSq += samples[s][j] * samples[s][j]
+			if samples[s][j] != samples2[s][j] {
+				t.Fatalf("Samples not the same with the same seed")
+			}
+		}
+		sampleMean := sum / float64(nSamples)
+		sampleVariance := sumSq/float64(nSamples) - sampleMean*sampleMean
+		if math.Abs(sampleMean-mean) > 5*math.Sqrt(variance/float64(nSamples)) {
+			t.Errorf("Sample mean %v does not match mixture mean %v", sampleMean, mean)
+		}
+		if math.Abs(sampleVariance-variance) > 0.05*variance {
+			t.Errorf("Sample variance %v does not match mixture variance %v", sampleVariance, variance)
+		}
+	}
+
+	net.Losser = loss.SquaredDistance{}
+	if _, _, _, err := net.PredictDistribution(input); err == nil {
+		t.Errorf("No error for a net without a mixture density Losser")
+	}
+}
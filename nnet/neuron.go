@@ -17,6 +17,8 @@ import (
 func init() {
 	gob.Register(&SumNeuron{Activator: activator.LinearTanh{}})
 	common.Register(&SumNeuron{})
+	gob.Register(&RBFNeuron{})
+	common.Register(&RBFNeuron{})
 }
 
 var (
@@ -68,10 +70,29 @@ func (s *SumNeuron) Combine(parameters []float64, inputs []float64) (combination
 	return
 }
 
+// CombineSparse is Combine, but only the weights at the indices in idx are used.
+// It is used for sparse inference in nets with pruned weights.
+func (s *SumNeuron) CombineSparse(parameters []float64, inputs []float64, idx []int) (combination float64) {
+	for _, k := range idx {
+		combination += parameters[k] * inputs[k]
+	}
+	combination += parameters[len(parameters)-1]
+	return
+}
+
 // Randomize sets the parameters to a random initial condition
 func (s *SumNeuron) Randomize(parameters []float64) {
+	s.randomize(parameters, globalRand{})
+}
+
+// RandomizeFrom is the same as Randomize, but uses rnd as the source of randomness
+func (s *SumNeuron) RandomizeFrom(parameters []float64, rnd *rand.Rand) {
+	s.randomize(parameters, rnd)
+}
+
+func (s *SumNeuron) randomize(parameters []float64, rnd randSource) {
 	for i := range parameters {
-		parameters[i] = rand.NormFloat64() * math.Pow(float64(len(parameters)), -0.5)
+		parameters[i] = rnd.NormFloat64() * math.Pow(float64(len(parameters)), -0.5)
 	}
 }
 
@@ -95,6 +116,22 @@ func (s *SumNeuron) DCombineDInput(params []float64, inputs []float64, combinati
 	// This intentionally doesn't loop over all of the parameters, as the last parameter is the bias term
 }
 
+// InsertInput returns the parameters with a weight of zero for a new input at index i
+func (s *SumNeuron) InsertInput(parameters []float64, nInputs, i int) []float64 {
+	p := make([]float64, len(parameters)+1)
+	copy(p, parameters[:i])
+	copy(p[i+1:], parameters[i:])
+	return p
+}
+
+// RemoveInput returns the parameters without the weight for the input at index i
+func (s *SumNeuron) RemoveInput(parameters []float64, nInputs, i int) []float64 {
+	p := make([]float64, len(parameters)-1)
+	copy(p, parameters[:i])
+	copy(p[i:], parameters[i+1:])
+	return p
+}
+
 type activatorMarshaler struct {
 	Activator *common.InterfaceMarshaler
 }
@@ -113,3 +150,104 @@ func (s *SumNeuron) UnmarshalJSON(data []byte) error {
 	s.Activator = v.Activator.I.(activator.Activator)
 	return nil
 }
+
+// RBFNeuron is a radial basis function neuron. The parameters are the center of
+// the neuron (one per input) followed by the width. If PerDimensionWidth is true,
+// there is instead one width per input. The combination is the squared distance
+// from the center scaled by the width, sum_i (x_i - c_i)^2 / w_i^2, and the
+// output is a Gaussian of the distance, exp(-combination).
+type RBFNeuron struct {
+	PerDimensionWidth bool
+}
+
+// NumParameters returns the number of parameters
+func (r *RBFNeuron) NumParameters(nInputs int) int {
+	if r.PerDimensionWidth {
+		return 2 * nInputs
+	}
+	return nInputs + 1
+}
+
+// width returns the width of the ith dimension
+func (r *RBFNeuron) width(parameters []float64, nInputs, i int) float64 {
+	if r.PerDimensionWidth {
+		return parameters[nInputs+i]
+	}
+	return parameters[nInputs]
+}
+
+// Activate computes the Gaussian of the combination
+func (r *RBFNeuron) Activate(combination float64) float64 {
+	return math.Exp(-combination)
+}
+
+// DActivateDCombination returns the derivative of the Gaussian
+func (r *RBFNeuron) DActivateDCombination(combination, output float64) float64 {
+	return -output
+}
+
+// Combine computes the scaled squared distance between the inputs and the center
+func (r *RBFNeuron) Combine(parameters []float64, inputs []float64) (combination float64) {
+	nInputs := len(inputs)
+	for i, val := range inputs {
+		diff := (val - parameters[i]) / r.width(parameters, nInputs, i)
+		combination += diff * diff
+	}
+	return combination
+}
+
+// Randomize sets the centers to random values and sets the widths so that the
+// combination is of order one for inputs which are scaled to have unit variance
+func (r *RBFNeuron) Randomize(parameters []float64) {
+	r.randomize(parameters, globalRand{})
+}
+
+// RandomizeFrom is the same as Randomize, but uses rnd as the source of randomness
+func (r *RBFNeuron) RandomizeFrom(parameters []float64, rnd *rand.Rand) {
+	r.randomize(parameters, rnd)
+}
+
+func (r *RBFNeuron) randomize(parameters []float64, rnd randSource) {
+	nInputs := len(parameters) - 1
+	if r.PerDimensionWidth {
+		nInputs = len(parameters) / 2
+	}
+	width := math.Sqrt(float64(nInputs))
+	for i := 0; i < nInputs; i++ {
+		parameters[i] = rnd.NormFloat64()
+	}
+	for i := nInputs; i < len(parameters); i++ {
+		parameters[i] = width * (0.5 + rnd.Float64())
+	}
+}
+
+// DCombineDParameters finds the derivative of the combination with respect to the
+// centers and the widths
+func (r *RBFNeuron) DCombineDParameters(params []float64, inputs []float64, combination float64, deriv []float64) {
+	nInputs := len(inputs)
+	if !r.PerDimensionWidth {
+		deriv[nInputs] = 0
+	}
+	for i, val := range inputs {
+		w := r.width(params, nInputs, i)
+		diff := val - params[i]
+		// d/dc_i (x_i - c_i)^2 / w^2 = -2 (x_i - c_i) / w^2
+		deriv[i] = -2 * diff / (w * w)
+		// d/dw (x_i - c_i)^2 / w^2 = -2 (x_i - c_i)^2 / w^3
+		dw := -2 * diff * diff / (w * w * w)
+		if r.PerDimensionWidth {
+			deriv[nInputs+i] = dw
+		} else {
+			deriv[nInputs] += dw
+		}
+	}
+}
+
+// DCombineDInput finds the derivative of the combination with respect to the inputs
+func (r *RBFNeuron) DCombineDInput(params []float64, inputs []float64, combination float64, deriv []float64) {
+	nInputs := len(inputs)
+	for i, val := range inputs {
+		w := r.width(params, nInputs, i)
+		deriv[i] = 2 * (val - params[i]) / (w * w)
+	}
+}
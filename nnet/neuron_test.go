@@ -1,9 +1,14 @@
 package nnet
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/btracey/nnet/activator"
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/scale"
 	"github.com/gonum/floats"
 	"math"
+	"reflect"
 	"testing"
 )
 
@@ -101,3 +106,82 @@ func TestSumNeuron(t *testing.T) {
 	}
 	neuronTest(t, tanhLinear, answers, inputs, params)
 }
+
+func TestRBFNeuron(t *testing.T) {
+	inputs := []float64{1, 2, 3}
+	rbf := &RBFNeuron{}
+	params := []float64{0.5, 2.5, -1, 1.5}
+	trueCombination := (0.5/1.5)*(0.5/1.5) + (-0.5/1.5)*(-0.5/1.5) + (4/1.5)*(4/1.5)
+	answers := neuronTestAnswers{
+		combination: trueCombination,
+		activate:    math.Exp(-trueCombination),
+	}
+	neuronTest(t, rbf, answers, inputs, params)
+
+	rbf = &RBFNeuron{PerDimensionWidth: true}
+	params = []float64{0.5, 2.5, -1, 1.5, 0.8, 2}
+	trueCombination = (0.5/1.5)*(0.5/1.5) + (-0.5/0.8)*(-0.5/0.8) + (4.0/2)*(4.0/2)
+	answers = neuronTestAnswers{
+		combination: trueCombination,
+		activate:    math.Exp(-trueCombination),
+	}
+	neuronTest(t, rbf, answers, inputs, params)
+}
+
+func TestRBFNet(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	layers := make([]Layer, 3)
+	layers[0].Neurons = []Neuron{&RBFNeuron{}, &RBFNeuron{PerDimensionWidth: true}, &RBFNeuron{}, &RBFNeuron{}}
+	layers[1].Neurons = []Neuron{&TanhNeuron, &TanhNeuron, &TanhNeuron}
+	layers[2].Neurons = []Neuron{&LinearNeuron, &LinearNeuron}
+	net := NewNet(nInputs, layers)
+	net.Losser = loss.SquaredDistance{}
+	net.InputScaler = &scale.Normal{}
+	net.InputScaler.SetScale(RandomData(nInputs, 10))
+	net.OutputScaler = &scale.Normal{}
+	net.OutputScaler.SetScale(RandomData(nOutputs, 10))
+
+	inputs := RandomSliceOfSlice(10, nInputs)
+	truths := RandomSliceOfSlice(10, nOutputs)
+	weights := RandomWeights(10)
+	dLossDParam, dLossFlat := net.NewPerParameterMemory()
+	SeqLossDeriv(inputs, truths, weights, net, dLossDParam, NewParLossDerivMemory(net))
+
+	params := make([]float64, net.TotalNumParameters())
+	net.ParametersSlice(params)
+	fdDLossFlat := make([]float64, len(params))
+	d, _ := net.NewPerParameterMemory()
+	for i := range params {
+		params[i] += netFDStep
+		net.SetParametersSlice(params)
+		loss1 := SeqLossDeriv(inputs, truths, weights, net, d, NewParLossDerivMemory(net))
+		params[i] -= 2 * netFDStep
+		net.SetParametersSlice(params)
+		loss2 := SeqLossDeriv(inputs, truths, weights, net, d, NewParLossDerivMemory(net))
+		params[i] += netFDStep
+		net.SetParametersSlice(params)
+		fdDLossFlat[i] = (loss1 - loss2) / (2 * netFDStep)
+	}
+	for i := range params {
+		if !floats.EqualWithinAbsOrRel(dLossFlat[i], fdDLossFlat[i], 1e-5, 1e-5) {
+			t.Errorf("Finite difference doesn't match derivative for RBF net")
+			for i := range dLossFlat {
+				fmt.Println(i, dLossFlat[i], fdDLossFlat[i], dLossFlat[i]-fdDLossFlat[i])
+			}
+			break
+		}
+	}
+
+	b, err := json.Marshal(net)
+	if err != nil {
+		t.Fatalf("Error marshaling: %v", err)
+	}
+	net2 := &Net{}
+	if err := json.Unmarshal(b, net2); err != nil {
+		t.Fatalf("Error unmarshaling: %v", err)
+	}
+	if !reflect.DeepEqual(net, net2) {
+		t.Errorf("Nets don't match after JSON")
+	}
+}
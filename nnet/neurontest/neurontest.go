@@ -0,0 +1,188 @@
+// Package neurontest checks that implementations of nnet.Neuron satisfy the
+// contract of the interface, so that nets which use them can be built, changed,
+// saved and loaded. The derivatives of a Neuron can be checked with package gradcheck.
+package neurontest
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/rand"
+	"testing"
+
+	"github.com/btracey/nnet/common"
+	"github.com/btracey/nnet/nnet"
+	"github.com/gonum/floats"
+)
+
+// resizeTol is the tolerance of the combination after inserting an input
+const resizeTol = 1e-12
+
+// Test checks the neuron with 1 to maxInputs inputs at random inputs. It checks that
+//   - NumParameters is not negative, and is the same when called twice
+//   - Randomize, Combine, DCombineDParameters and DCombineDInput accept slices of
+//     the lengths given by NumParameters and the number of inputs, and Combine and
+//     the derivatives do not modify the parameters or the inputs
+//   - RandomizeFrom gives the same parameters for the same seed if the neuron is a
+//     nnet.SeededRandomizer
+//   - InsertInput and RemoveInput return parameters with the length given by
+//     NumParameters if the neuron is a nnet.InputResizer, that inserting an input does
+//     not change the combination, and that removing the inserted input restores the
+//     parameters
+//   - The neuron is the same after JSON encoding through common.InterfaceMarshaler
+//     (so the type must be registered with common.Register) and after gob encoding
+//     as a nnet.Neuron (so the type must be registered with gob.Register)
+func Test(t testing.TB, n nnet.Neuron, maxInputs int) {
+	rnd := rand.New(rand.NewSource(1))
+	for nInputs := 1; nInputs <= maxInputs; nInputs++ {
+		nParameters := n.NumParameters(nInputs)
+		if nParameters < 0 {
+			t.Errorf("neurontest: %T: NumParameters(%v) is negative", n, nInputs)
+			return
+		}
+		if n.NumParameters(nInputs) != nParameters {
+			t.Errorf("neurontest: %T: NumParameters(%v) changed when called again", n, nInputs)
+		}
+		params := make([]float64, nParameters)
+		inputs := make([]float64, nInputs)
+		for i := range inputs {
+			inputs[i] = rnd.NormFloat64()
+		}
+		if !noPanic(t, n, nInputs, "Randomize", func() { n.Randomize(params) }) {
+			continue
+		}
+		if s, ok := n.(nnet.SeededRandomizer); ok {
+			params2 := make([]float64, nParameters)
+			s.RandomizeFrom(params, rand.New(rand.NewSource(2)))
+			s.RandomizeFrom(params2, rand.New(rand.NewSource(2)))
+			if !floats.Equal(params, params2) {
+				t.Errorf("neurontest: %T: RandomizeFrom gave different parameters for the same seed", n)
+			}
+		}
+		origParams := append([]float64(nil), params...)
+		origInputs := append([]float64(nil), inputs...)
+
+		var comb float64
+		if !noPanic(t, n, nInputs, "Combine", func() { comb = n.Combine(params, inputs) }) {
+			continue
+		}
+		dParams := make([]float64, nParameters)
+		noPanic(t, n, nInputs, "DCombineDParameters", func() { n.DCombineDParameters(params, inputs, comb, dParams) })
+		dInputs := make([]float64, nInputs)
+		noPanic(t, n, nInputs, "DCombineDInput", func() { n.DCombineDInput(params, inputs, comb, dInputs) })
+		if !floats.Equal(params, origParams) {
+			t.Errorf("neurontest: %T: parameters modified with %v inputs", n, nInputs)
+		}
+		if !floats.Equal(inputs, origInputs) {
+			t.Errorf("neurontest: %T: inputs modified with %v inputs", n, nInputs)
+		}
+
+		if r, ok := n.(nnet.InputResizer); ok {
+			checkInputResizer(t, n, r, params, inputs, comb)
+		}
+	}
+
+	im := &common.InterfaceMarshaler{I: n}
+	b, err := im.MarshalJSON()
+	if err != nil {
+		t.Errorf("neurontest: %T: error marshaling JSON: %v", n, err)
+	} else {
+		im2 := &common.InterfaceMarshaler{}
+		err = im2.UnmarshalJSON(b)
+		if err != nil {
+			t.Errorf("neurontest: %T: error unmarshaling JSON: %v", n, err)
+		} else {
+			checkSame(t, "JSON", n, im2.I, maxInputs)
+		}
+	}
+
+	w := &bytes.Buffer{}
+	err = gob.NewEncoder(w).Encode(&n)
+	if err != nil {
+		t.Errorf("neurontest: %T: error gob encoding: %v", n, err)
+		return
+	}
+	var n2 nnet.Neuron
+	err = gob.NewDecoder(w).Decode(&n2)
+	if err != nil {
+		t.Errorf("neurontest: %T: error gob decoding: %v", n, err)
+		return
+	}
+	checkSame(t, "gob", n, n2, maxInputs)
+}
+
+// noPanic calls f, and returns false and reports an error if it panics
+func noPanic(t testing.TB, n nnet.Neuron, nInputs int, name string, f func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("neurontest: %T: %v panicked with %v inputs: %v", n, name, nInputs, r)
+			ok = false
+		}
+	}()
+	f()
+	return true
+}
+
+// checkInputResizer checks that inserting and removing each input gives parameters
+// of the right length, and that inserting an input does not change the combination
+func checkInputResizer(t testing.TB, n nnet.Neuron, r nnet.InputResizer, params, inputs []float64, comb float64) {
+	nInputs := len(inputs)
+	for i := 0; i <= nInputs; i++ {
+		var inserted []float64
+		if !noPanic(t, n, nInputs, "InsertInput", func() { inserted = r.InsertInput(params, nInputs, i) }) {
+			return
+		}
+		if len(inserted) != n.NumParameters(nInputs+1) {
+			t.Errorf("neurontest: %T: InsertInput returned %v parameters, but NumParameters(%v) is %v", n, len(inserted), nInputs+1, n.NumParameters(nInputs+1))
+			return
+		}
+		newInputs := make([]float64, 0, nInputs+1)
+		newInputs = append(newInputs, inputs[:i]...)
+		newInputs = append(newInputs, 3.7)
+		newInputs = append(newInputs, inputs[i:]...)
+		if c := n.Combine(inserted, newInputs); !floats.EqualWithinAbsOrRel(c, comb, resizeTol, resizeTol) {
+			t.Errorf("neurontest: %T: inserting input %v changed the combination from %v to %v", n, i, comb, c)
+		}
+		var removed []float64
+		if !noPanic(t, n, nInputs+1, "RemoveInput", func() { removed = r.RemoveInput(inserted, nInputs+1, i) }) {
+			return
+		}
+		if len(removed) != n.NumParameters(nInputs) {
+			t.Errorf("neurontest: %T: RemoveInput returned %v parameters, but NumParameters(%v) is %v", n, len(removed), nInputs, n.NumParameters(nInputs))
+			return
+		}
+		if !floats.Equal(removed, params) {
+			t.Errorf("neurontest: %T: removing inserted input %v did not restore the parameters", n, i)
+		}
+	}
+}
+
+// checkSame checks that the decoded neuron has the same parameters and outputs as n
+func checkSame(t testing.TB, encoding string, n nnet.Neuron, decoded interface{}, maxInputs int) {
+	n2, ok := decoded.(nnet.Neuron)
+	if !ok {
+		t.Errorf("neurontest: %T: decoded %v is %T, which is not a nnet.Neuron", n, encoding, decoded)
+		return
+	}
+	rnd := rand.New(rand.NewSource(3))
+	for nInputs := 1; nInputs <= maxInputs; nInputs++ {
+		if n2.NumParameters(nInputs) != n.NumParameters(nInputs) {
+			t.Errorf("neurontest: %T: NumParameters(%v) changed after %v decoding", n, nInputs, encoding)
+			return
+		}
+		params := make([]float64, n.NumParameters(nInputs))
+		n.Randomize(params)
+		inputs := make([]float64, nInputs)
+		for i := range inputs {
+			inputs[i] = rnd.NormFloat64()
+		}
+		comb := n.Combine(params, inputs)
+		if comb2 := n2.Combine(params, inputs); comb2 != comb {
+			t.Errorf("neurontest: %T: combination changed after %v decoding. Expected: %v, found %v", n, encoding, comb, comb2)
+			return
+		}
+		if out, out2 := n.Activate(comb), n2.Activate(comb); out != out2 {
+			t.Errorf("neurontest: %T: output changed after %v decoding. Expected: %v, found %v", n, encoding, out, out2)
+			return
+		}
+	}
+}
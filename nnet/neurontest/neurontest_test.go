@@ -0,0 +1,47 @@
+package neurontest
+
+import (
+	"testing"
+
+	"github.com/btracey/nnet/nnet"
+)
+
+func TestNeurons(t *testing.T) {
+	for _, n := range []nnet.Neuron{
+		&nnet.TanhNeuron,
+		&nnet.LinearNeuron,
+		&nnet.SigmoidNeuron,
+		&nnet.LinearTanhNeuron,
+		&nnet.RBFNeuron{},
+		&nnet.RBFNeuron{PerDimensionWidth: true},
+	} {
+		Test(t, n, 4)
+	}
+}
+
+// shortNeuron is a SumNeuron whose NumParameters is one too short for the weights and bias
+type shortNeuron struct {
+	*nnet.SumNeuron
+}
+
+func (s shortNeuron) NumParameters(nInputs int) int {
+	return nInputs
+}
+
+func TestShortNeuron(t *testing.T) {
+	ft := &fakeT{}
+	Test(ft, shortNeuron{&nnet.TanhNeuron}, 3)
+	if !ft.failed {
+		t.Errorf("Neuron with too few parameters passed")
+	}
+}
+
+// fakeT records whether a test failed
+type fakeT struct {
+	testing.TB
+	failed bool
+}
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.failed = true
+}
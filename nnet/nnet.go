@@ -1,3 +1,5 @@
+// Package nnet implements feed-forward neural networks, their predictions, and the
+// loss and derivative of their parameters for training.
 package nnet
 
 import (
@@ -5,6 +7,7 @@ import (
 	"fmt"
 	"github.com/btracey/nnet/loss"
 	"github.com/btracey/nnet/scale"
+	"math/rand"
 	"sync"
 )
 
@@ -15,6 +18,17 @@ const (
 	Ascii
 )
 
+// Mode sets how SeqLossDeriv and ParLossDeriv compute the loss of a Net
+type Mode int
+
+const (
+	// Train applies dropout, and batch normalization uses the statistics of the samples
+	Train Mode = iota
+	// Inference does not apply dropout, and batch normalization uses the running
+	// statistics. This is the same as Predict.
+	Inference
+)
+
 // Net is the structure representing a feed-forward artificial network.
 // Parameters and ParametersVector are accessible for training purposes,
 // but they should not be resliced or appended to. The memories are linked
@@ -23,6 +37,15 @@ type Net struct {
 	InputScaler  scale.Scaler // The way in which the data should be scaled (and unscaled)
 	OutputScaler scale.Scaler // The way in which the data should be scaled (and unscaled)
 
+	// DropoutSource is the source of randomness for the dropout masks. If it is nil,
+	// the global source in math/rand is used. The source is only used to seed the
+	// masks of each call, so setting it makes training runs reproducible.
+	DropoutSource rand.Source
+
+	Mode Mode // Train or Inference. Predict always uses Inference
+
+	Reduction Reduction // How ParLossDeriv and Evaluator sum the results of the chunks
+
 	nInputs            int
 	nOutputs           int
 	totalNumParameters int
@@ -31,62 +54,115 @@ type Net struct {
 	parameterIdx [][]int // The starting index of the weights of the neuron
 
 	layers          []Layer
+	sources         [][]int // The sources of each layer (see NewGraphNet). nil for a sequential net
 	parameters      [][][]float64
 	parametersSlice []float64
+
+	frozen  [][]bool        // Which entries of parameters are frozen. nil if none are
+	shared  [][]NeuronIndex // Groups of neurons which share parameters
+	aliased [][]bool        // Which entries of parameters share the memory of an earlier entry. nil if none do
+
+	pruned    []bool    // Which elements of parametersSlice are pruned. nil if none are
+	sparse    bool      // Whether sparse inference is on
+	sparseIdx [][][]int // The unpruned weights of each neuron for sparse inference. nil if not used
 }
 
-// new fills a net that already has the nInputs and the layers specified
+// new fills a net that already has the nInputs and the layers specified. The
+// parameters are all zero
 func (net *Net) new() {
 	layers := net.layers
-	nInputs := net.nInputs
-	totalNumParameters := 0
-	nParameters := make([][]int, len(layers))
-	parameterIdx := make([][]int, len(layers))
-	// Count up the number of parameters
+	layerInputs := net.layerInputs()
+	for i := range layers {
+		if layers[i].BatchNorm != nil {
+			layers[i].BatchNorm.init(len(layers[i].Neurons))
+		}
+	}
+	net.nParameters, net.parameterIdx, net.totalNumParameters = parameterLayout(layers, layerInputs)
+	if net.shared != nil {
+		// The neurons which share parameters use the same block
+		net.parameterIdx, net.totalNumParameters = sharedLayout(net.nParameters, net.shared)
+	}
+	net.aliased = aliasedEntries(net.parameterIdx)
+	// Make memory for all the parameters (we want a vector to allow easy training)
+	// and reslice it to make it a slice of slice of slices
+	net.parameters, net.parametersSlice = newParameterMemory(net.nParameters, net.parameterIdx, net.totalNumParameters)
+	net.nOutputs = len(layers[len(layers)-1].Neurons)
+	// The layout has changed, so the pruning no longer applies
+	net.pruned = nil
+	net.sparseIdx = nil
+}
+
+// parameterLayout counts up the number of parameters of each neuron given the
+// number of inputs to each layer, and finds the starting index of the parameters
+// of each neuron. Layers with batch normalization have one extra entry after the
+// neurons for the gammas and betas.
+func parameterLayout(layers []Layer, layerInputs []int) (nParameters, parameterIdx [][]int, totalNumParameters int) {
+	nParameters = make([][]int, len(layers))
+	parameterIdx = make([][]int, len(layers))
 	for i, layer := range layers {
-		nParameters[i] = make([]int, len(layer.Neurons))
-		parameterIdx[i] = make([]int, len(layer.Neurons))
+		nNeurons := len(layer.Neurons)
+		nEntries := nNeurons
+		if layer.BatchNorm != nil {
+			nEntries++
+		}
+		nParameters[i] = make([]int, nEntries)
+		parameterIdx[i] = make([]int, nEntries)
 		for j, neuron := range layer.Neurons {
-			var neuronParams int
-			if i == 0 {
-				// If it is the first layer...
-				neuronParams = neuron.NumParameters(nInputs)
-			} else {
-				neuronParams = neuron.NumParameters(len(layers[i-1].Neurons))
-			}
+			neuronParams := neuron.NumParameters(layerInputs[i])
 			nParameters[i][j] = neuronParams
 			parameterIdx[i][j] = totalNumParameters
 			totalNumParameters += neuronParams
 		}
+		if layer.BatchNorm != nil {
+			nParameters[i][nNeurons] = 2 * nNeurons
+			parameterIdx[i][nNeurons] = totalNumParameters
+			totalNumParameters += 2 * nNeurons
+		}
 	}
-	net.totalNumParameters = totalNumParameters
-	net.parameterIdx = parameterIdx
-	net.nParameters = nParameters
-	// Make memory for all the parameters (we want a vector to allow easy training)
-	net.parametersSlice = make([]float64, totalNumParameters)
+	return nParameters, parameterIdx, totalNumParameters
+}
 
-	// Reslice it to make it a slice of slice of slices
-	net.parameters = make([][][]float64, len(layers))
-	for i, layer := range layers {
-		net.parameters[i] = make([][]float64, len(layer.Neurons))
-		for j := range layer.Neurons {
-			net.parameters[i][j] = net.parametersSlice[net.parameterIdx[i][j] : net.parameterIdx[i][j]+net.nParameters[i][j]]
+// newParameterMemory makes memory for the parameters as a flat slice and as
+// a slice indexed by layer, neuron and then parameter
+func newParameterMemory(nParameters, parameterIdx [][]int, totalNumParameters int) (tiered [][][]float64, flat []float64) {
+	flat = make([]float64, totalNumParameters)
+	tiered = make([][][]float64, len(nParameters))
+	for i := range nParameters {
+		tiered[i] = make([][]float64, len(nParameters[i]))
+		for j := range nParameters[i] {
+			tiered[i][j] = flat[parameterIdx[i][j] : parameterIdx[i][j]+nParameters[i][j]]
 		}
 	}
-	net.nOutputs = len(layers[len(layers)-1].Neurons)
-	net.RandomizeParameters()
+	return tiered, flat
 }
 
-// NewNet creates a new net
+// NewNet creates a new net with every neuron randomized on its own as in
+// RandomizeParameters
 func NewNet(nInputs int, layers []Layer) *Net {
 	net := &Net{
 		layers:  layers,
 		nInputs: nInputs,
 	}
 	net.new()
+	net.RandomizeParameters()
 	return net
 }
 
+// NewNetInit creates a new net with the parameters set by init, using src as the
+// source of randomness (see Initialize). Returns an error if the initialization fails.
+func NewNetInit(nInputs int, layers []Layer, init Initializer, src rand.Source) (*Net, error) {
+	net := &Net{
+		layers:  layers,
+		nInputs: nInputs,
+	}
+	net.new()
+	err := net.Initialize(init, src)
+	if err != nil {
+		return nil, err
+	}
+	return net, nil
+}
+
 // Inputs returns the number of inputs in the net
 func (net *Net) Inputs() int {
 	return net.nInputs
@@ -102,13 +178,15 @@ func (net *Net) TotalNumParameters() int {
 	return net.totalNumParameters
 }
 
-// RandomizeParameters randomizes the parameters of the net
+// RandomizeParameters randomizes the parameters of the net. The gammas of batch
+// normalization are set to one and the betas to zero
 func (net *Net) RandomizeParameters() {
 	for i, layer := range net.layers {
 		for j, neuron := range layer.Neurons {
 			neuron.Randomize(net.parameters[i][j])
 		}
 	}
+	net.resetBatchNorm()
 }
 
 // ParametersSlice copies the parameters into dst
@@ -125,6 +203,7 @@ func (net *Net) SetParametersSlice(src []float64) {
 		panic("length of src does not match len of net")
 	}
 	copy(net.parametersSlice, src)
+	net.zeroPrunedParameters()
 }
 
 // MakeNeuronMemory creates new memory with one value per
@@ -141,36 +220,18 @@ func (net *Net) NewPerNeuronMemory() [][]float64 {
 // per parameter in the net. Indexed by layer then neuron
 // then parameter
 func (net *Net) NewPerParameterMemory() (tiered [][][]float64, flat []float64) {
-	count := 0
-	flat = make([]float64, net.totalNumParameters)
-	tiered = make([][][]float64, len(net.layers))
-	for i, layer := range net.layers {
-		tiered[i] = make([][]float64, len(layer.Neurons))
-		for j := range layer.Neurons {
-			tiered[i][j] = flat[count : count+net.nParameters[i][j]]
-			count += net.nParameters[i][j]
-		}
-	}
-	return
+	return newParameterMemory(net.nParameters, net.parameterIdx, net.totalNumParameters)
 }
 
 // MakeInputMemory creates new memory with one value per
 // input to each neuron
 func (net *Net) NewPerInputMemory() [][][]float64 {
+	layerInputs := net.layerInputs()
 	mem := make([][][]float64, len(net.layers))
 	for i, layer := range net.layers {
 		mem[i] = make([][]float64, len(layer.Neurons))
-	}
-	// First layer has number of inputs equal to the number
-	// of inputs of the net
-	for i := range net.layers[0].Neurons {
-		mem[0][i] = make([]float64, net.nInputs)
-	}
-	// All other layers have a number of inputs equal to the
-	// number of nodes in the previous layer
-	for i := 1; i < len(net.layers); i++ {
-		for j := range net.layers[i].Neurons {
-			mem[i][j] = make([]float64, len(net.layers[i-1].Neurons))
+		for j := range mem[i] {
+			mem[i][j] = make([]float64, layerInputs[i])
 		}
 	}
 	return mem
@@ -185,38 +246,35 @@ func (i InputMismatch) Error() string {
 	return fmt.Sprintf("Length of input must match the number of inputs of the net. %d inputs prodived, but the net has %d inputs", i.Provided, i.Expected)
 }
 
-// Predict predicts the value at the input location. Panics if
-// len(input) != net.NumInputs() and if len(output) != net.NumOutputs()
+// Predict predicts the value at the (unscaled) input location. The input is not
+// modified, and Predict may be called concurrently from multiple goroutines as long as
+// the net is not changed.
 func (net *Net) Predict(input []float64) (pred []float64, err error) {
-	if len(input) != net.nInputs {
-		return nil, InputMismatch{Provided: len(input), Expected: net.nInputs}
+	pred = make([]float64, net.nOutputs)
+	err = net.PredictInto(input, pred)
+	if err != nil {
+		return nil, err
 	}
+	return pred, nil
+}
 
-	predOutput := make([]float64, net.nOutputs)
-	predictTmpMemory := net.NewPredictTmpMemory()
-
-	if !net.InputScaler.IsScaled() {
-		return nil, errors.New("Scale must be set before calling predict")
-	}
-	if !net.OutputScaler.IsScaled() {
-		return nil, errors.New("Scale must be set before calling predict")
+// PredictInto is Predict, but stores the prediction into pred, which must have
+// length net.Outputs(). The scratch memory is reused between calls, so PredictInto
+// does not allocate.
+func (net *Net) PredictInto(input, pred []float64) error {
+	if err := net.checkPredict(input, pred); err != nil {
+		return err
 	}
-
-	net.InputScaler.Scale(input)
-	defer net.InputScaler.Unscale(input)
-
-	Predict(input, net, predOutput, predictTmpMemory.combinations, predictTmpMemory.outputs)
-	defer net.OutputScaler.Unscale(predOutput)
-	return predOutput, nil
+	s := net.getPredictScratch()
+	defer predictPool.Put(s)
+	return net.predict(input, pred, s)
 }
 
+// PredictSlice predicts the values at all of the (unscaled) inputs in parallel.
+// The inputs are not modified.
 func (net *Net) PredictSlice(inputs [][]float64) (predictions [][]float64, err error) {
-
-	if !net.InputScaler.IsScaled() {
-		return nil, errors.New("Scale must be set before calling predict")
-	}
-	if !net.OutputScaler.IsScaled() {
-		return nil, errors.New("Scale must be set before calling predict")
+	if err := net.checkPredict(nil, nil); err != nil {
+		return nil, err
 	}
 	for i, input := range inputs {
 		if len(input) != net.nInputs {
@@ -228,56 +286,225 @@ func (net *Net) PredictSlice(inputs [][]float64) (predictions [][]float64, err e
 		predictions[i] = make([]float64, net.nOutputs)
 	}
 
-	err = scale.ScaleData(net.InputScaler, inputs)
-	if err != nil {
-		return nil, errors.New("Error using ScaleData: " + err.Error())
-	}
-	defer scale.UnscaleData(net.InputScaler, inputs)
-
-	w := sync.WaitGroup{}
 	// Predict samples in parallel
 	chunkSize := 100
-	count := 0
-	var endInd int
-	for {
-		if count+chunkSize > len(inputs) {
+	nChunks := (len(inputs) + chunkSize - 1) / chunkSize
+	errs := make([]error, nChunks)
+	w := sync.WaitGroup{}
+	for c := 0; c < nChunks; c++ {
+		startInd := c * chunkSize
+		endInd := startInd + chunkSize
+		if endInd > len(inputs) {
 			endInd = len(inputs)
-		} else {
-			endInd = count + chunkSize
 		}
 		w.Add(1)
-		go func(startInd, endInd int) {
-			p := net.NewPredictTmpMemory()
+		go func(c, startInd, endInd int) {
+			defer w.Done()
+			s := net.getPredictScratch()
+			defer predictPool.Put(s)
 			for i := startInd; i < endInd; i++ {
-				Predict(inputs[i], net, predictions[i], p.combinations, p.outputs)
+				if err := net.predict(inputs[i], predictions[i], s); err != nil {
+					errs[c] = err
+					return
+				}
 			}
-			w.Done()
-		}(count, endInd)
-		if endInd == len(inputs) {
-			break
-		}
-		count += chunkSize
+		}(c, startInd, endInd)
 	}
 	w.Wait()
-	defer scale.UnscaleData(net.OutputScaler, predictions)
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
 	return predictions, nil
 }
 
+// checkPredict checks that the scalers are set and, if they are not nil, the lengths
+// of the input and the prediction
+func (net *Net) checkPredict(input, pred []float64) error {
+	if input != nil && len(input) != net.nInputs {
+		return InputMismatch{Provided: len(input), Expected: net.nInputs}
+	}
+	if pred != nil && len(pred) != net.nOutputs {
+		return errors.New("nnet: prediction length must match the number of outputs")
+	}
+	if !net.InputScaler.IsScaled() {
+		return errors.New("Scale must be set before calling predict")
+	}
+	if !net.OutputScaler.IsScaled() {
+		return errors.New("Scale must be set before calling predict")
+	}
+	return nil
+}
+
+// predict scales a copy of the input into the scratch memory, predicts, and unscales
+// the prediction
+func (net *Net) predict(input, pred []float64, s *predictScratch) error {
+	copy(s.input, input)
+	if err := net.InputScaler.Scale(s.input); err != nil {
+		return err
+	}
+	forward(s.input, net, pred, s.tmp.combinations, s.tmp.outputs, s.tmp.layerInputs)
+	return net.OutputScaler.Unscale(pred)
+}
+
+// InputJacobian computes the derivative of the outputs of the net with respect
+// to the inputs at the input location, and stores it into jac. jac[i][j] is the
+// derivative of the ith output with respect to the jth input. The Jacobian is
+// in unscaled units, so the scalers of the net must implement scale.Differentiable
+func (net *Net) InputJacobian(input []float64, jac [][]float64) error {
+	if len(input) != net.nInputs {
+		return InputMismatch{Provided: len(input), Expected: net.nInputs}
+	}
+	if len(jac) != net.nOutputs {
+		return fmt.Errorf("Length of jac must match the number of outputs. Net outputs: %v, len(jac): %v", net.nOutputs, len(jac))
+	}
+	for i := range jac {
+		if len(jac[i]) != net.nInputs {
+			return fmt.Errorf("Lengths of all the rows of jac must match net.nInputs. Net inputs: %v, Row %v: %v", net.nInputs, i, len(jac[i]))
+		}
+	}
+	if !net.InputScaler.IsScaled() {
+		return errors.New("Scale must be set before calling InputJacobian")
+	}
+	if !net.OutputScaler.IsScaled() {
+		return errors.New("Scale must be set before calling InputJacobian")
+	}
+	inputScaler, ok := net.InputScaler.(scale.Differentiable)
+	if !ok {
+		return errors.New("InputScaler must implement scale.Differentiable")
+	}
+	outputScaler, ok := net.OutputScaler.(scale.Differentiable)
+	if !ok {
+		return errors.New("OutputScaler must implement scale.Differentiable")
+	}
+
+	// Chain rule through the scaling of the input
+	scaledInput := make([]float64, net.nInputs)
+	copy(scaledInput, input)
+	dScaledInput := make([]float64, net.nInputs)
+	err := inputScaler.DScaleDPoint(input, dScaledInput)
+	if err != nil {
+		return err
+	}
+	err = net.InputScaler.Scale(scaledInput)
+	if err != nil {
+		return err
+	}
+
+	tmp := net.NewPredLossDerivTmpMemory()
+	pred := make([]float64, net.nOutputs)
+	forward(scaledInput, net, pred, tmp.combinations, tmp.outputs, tmp.layerInputs)
+
+	// Chain rule through the unscaling of the output
+	dUnscaledOutput := make([]float64, net.nOutputs)
+	err = outputScaler.DUnscaleDPoint(pred, dUnscaledOutput)
+	if err != nil {
+		return err
+	}
+
+	// Backpropagate each of the outputs in turn
+	for i := range jac {
+		for j := range tmp.dLossDPred {
+			tmp.dLossDPred[j] = 0
+		}
+		tmp.dLossDPred[i] = 1
+		inputDerivative(scaledInput, net, tmp.dLossDPred, tmp, jac[i])
+		for j := range jac[i] {
+			jac[i][j] *= dUnscaledOutput[i] * dScaledInput[j]
+		}
+	}
+	return nil
+}
+
 type PredictTmpMemory struct {
 	combinations [][]float64
 	outputs      [][]float64
+	layerInputs  [][]float64 // The concatenated inputs of the layers of a graph net
 }
 
 func (net *Net) NewPredictTmpMemory() *PredictTmpMemory {
 	return &PredictTmpMemory{
 		combinations: net.NewPerNeuronMemory(),
 		outputs:      net.NewPerNeuronMemory(),
+		layerInputs:  net.newLayerInputMemory(),
 	}
 }
 
+// predictPool holds the scratch memory for predicting so that the methods which predict
+// do not allocate. It is shared by all nets, and the memory is resliced to fit the net
+// it is used with.
+var predictPool = sync.Pool{New: func() interface{} { return &predictScratch{} }}
+
+// predictScratch is the memory for predicting at one input
+type predictScratch struct {
+	input []float64 // The scaled input
+	tmp   PredictTmpMemory
+	buf   []float64 // The memory of the combinations, outputs and inputs of the layers
+}
+
+// getPredictScratch returns scratch memory from predictPool which fits the net. It must
+// be put back with predictPool.Put.
+func (net *Net) getPredictScratch() *predictScratch {
+	s := predictPool.Get().(*predictScratch)
+	s.input = resizeFloats(s.input, net.nInputs)
+	// The layers of a graph net with more than one source also need memory for
+	// their concatenated inputs
+	var nBuf int
+	for i, layer := range net.layers {
+		nBuf += 2*len(layer.Neurons) + net.concatLen(i)
+	}
+	s.buf = resizeFloats(s.buf, nBuf)
+	nLayers := len(net.layers)
+	if cap(s.tmp.combinations) < nLayers {
+		s.tmp.combinations = make([][]float64, nLayers)
+		s.tmp.outputs = make([][]float64, nLayers)
+		s.tmp.layerInputs = make([][]float64, nLayers)
+	}
+	s.tmp.combinations = s.tmp.combinations[:nLayers]
+	s.tmp.outputs = s.tmp.outputs[:nLayers]
+	s.tmp.layerInputs = s.tmp.layerInputs[:nLayers]
+	buf := s.buf
+	for i, layer := range net.layers {
+		n := len(layer.Neurons)
+		s.tmp.combinations[i] = buf[:n:n]
+		s.tmp.outputs[i] = buf[n : 2*n : 2*n]
+		buf = buf[2*n:]
+		n = net.concatLen(i)
+		s.tmp.layerInputs[i] = buf[:n:n]
+		buf = buf[n:]
+	}
+	return s
+}
+
+// resizeFloats returns x with length n, reusing its memory if it is large enough
+func resizeFloats(x []float64, n int) []float64 {
+	if cap(x) < n {
+		return make([]float64, n)
+	}
+	return x[:n]
+}
+
 // DefaultRegression returns the default network for regression problems of the given size
 // nHiddenLayers must be at least 1, and nNeuronsPerLayer must be at least zero
 func DefaultRegression(nInputs, nOutputs, nHiddenLayers, nNeuronsPerHiddenLayer int) *Net {
+	net := NewNet(nInputs, defaultRegressionLayers(nInputs, nOutputs, nHiddenLayers, nNeuronsPerHiddenLayer))
+	net.setDefaultRegression()
+	return net
+}
+
+// DefaultRegressionInit is DefaultRegression with the parameters set by init as in NewNetInit
+func DefaultRegressionInit(nInputs, nOutputs, nHiddenLayers, nNeuronsPerHiddenLayer int, init Initializer, src rand.Source) (*Net, error) {
+	net, err := NewNetInit(nInputs, defaultRegressionLayers(nInputs, nOutputs, nHiddenLayers, nNeuronsPerHiddenLayer), init, src)
+	if err != nil {
+		return nil, err
+	}
+	net.setDefaultRegression()
+	return net, nil
+}
+
+// defaultRegressionLayers returns the layers of DefaultRegression
+func defaultRegressionLayers(nInputs, nOutputs, nHiddenLayers, nNeuronsPerHiddenLayer int) []Layer {
 	if nHiddenLayers < 1 {
 		panic("number of hidden layers must be at least 1")
 	}
@@ -305,13 +532,48 @@ func DefaultRegression(nInputs, nOutputs, nHiddenLayers, nNeuronsPerHiddenLayer
 	for j := range layers[len(layers)-1].Neurons {
 		layers[len(layers)-1].Neurons[j] = &LinearNeuron
 	}
-	net := NewNet(nInputs, layers)
+	return layers
+}
+
+func (net *Net) setDefaultRegression() {
 	net.Losser = loss.SquaredDistance{}
 	net.InputScaler = &scale.Normal{}
 	net.OutputScaler = &scale.Normal{}
+}
+
+// DefaultClassification returns the default network for classification problems with
+// nClasses classes. The outputs are the logits of each class, and the loss is the
+// cross-entropy. The probabilities of the classes are the softmax of the outputs (see
+// activator.Softmax). The outputs are not scaled.
+// nHiddenLayers must be at least 1, and nNeuronsPerLayer must be at least zero
+func DefaultClassification(nInputs, nClasses, nHiddenLayers, nNeuronsPerHiddenLayer int) *Net {
+	if nClasses < 2 {
+		panic("number of classes must be at least 2")
+	}
+	net := DefaultRegression(nInputs, nClasses, nHiddenLayers, nNeuronsPerHiddenLayer)
+	net.setDefaultClassification()
 	return net
 }
 
+// DefaultClassificationInit is DefaultClassification with the parameters set by init
+// as in NewNetInit
+func DefaultClassificationInit(nInputs, nClasses, nHiddenLayers, nNeuronsPerHiddenLayer int, init Initializer, src rand.Source) (*Net, error) {
+	if nClasses < 2 {
+		panic("number of classes must be at least 2")
+	}
+	net, err := DefaultRegressionInit(nInputs, nClasses, nHiddenLayers, nNeuronsPerHiddenLayer, init, src)
+	if err != nil {
+		return nil, err
+	}
+	net.setDefaultClassification()
+	return net, nil
+}
+
+func (net *Net) setDefaultClassification() {
+	net.Losser = loss.CrossEntropy{}
+	net.OutputScaler = &scale.None{}
+}
+
 func (net *Net) NewPredLossDerivTmpMemory() *PredLossDerivTmpMemory {
 	return &PredLossDerivTmpMemory{
 		combinations: net.NewPerNeuronMemory(),
@@ -319,5 +581,9 @@ func (net *Net) NewPredLossDerivTmpMemory() *PredLossDerivTmpMemory {
 		dLossDPred:   make([]float64, net.nOutputs),
 		dLossDOutput: net.NewPerNeuronMemory(),
 		dLossDInput:  net.NewPerInputMemory(),
+
+		layerInputs:      net.newLayerInputMemory(),
+		dLossDLayerInput: net.newDLossDLayerInputMemory(),
+		unnormalized:     net.newUnnormalizedMemory(),
 	}
 }
@@ -10,7 +10,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 )
 
@@ -47,6 +49,26 @@ func (net *Net) GobEncode() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	// Sequential nets without shared parameters or pruning are encoded as before
+	if net.shared != nil || net.pruned != nil || net.sources != nil {
+		err = encoder.Encode(net.shared)
+		if err != nil {
+			return nil, fmt.Errorf("Error encoding shared parameters: %v", err)
+		}
+	}
+	if net.pruned != nil || net.sources != nil {
+		err = encoder.Encode(net.prunedIndices())
+		if err != nil {
+			return nil, fmt.Errorf("Error encoding pruned weights: %v", err)
+		}
+	}
+	if net.sources != nil {
+		err = encoder.Encode(net.sources)
+		if err != nil {
+			return nil, fmt.Errorf("Error encoding sources: %v", err)
+		}
+	}
 	return w.Bytes(), nil
 }
 
@@ -63,6 +85,9 @@ type netMarshal struct {
 	NumLayers              int
 	NumNeuronsPerLayer     []int
 	Layers                 []Layer
+	Sources                [][]int         `json:",omitempty"` // The sources of the layers of a graph net
+	SharedParameters       [][]NeuronIndex `json:",omitempty"`
+	Pruned                 []int           `json:",omitempty"` // Indices in Parameters of the pruned weights
 	PredictionCheck        []predictionCheck
 }
 
@@ -78,10 +103,10 @@ const nPredictionCheck = 5
 // interfaces are used, they will be marshaled with custom and if the custom type is a text
 // marshaller it will write
 func (net *Net) MarshalJSON() (b []byte, err error) {
-	nLayers := len(net.nParameters)
+	nLayers := len(net.layers)
 	nNeuronsPerLayer := make([]int, nLayers)
 	for i := range nNeuronsPerLayer {
-		nNeuronsPerLayer[i] = len(net.nParameters[i])
+		nNeuronsPerLayer[i] = len(net.layers[i].Neurons)
 	}
 
 	predChecks := make([]predictionCheck, nPredictionCheck)
@@ -99,7 +124,7 @@ func (net *Net) MarshalJSON() (b []byte, err error) {
 		}
 	}
 
-	outputs, err := net.PredictSlice(inputs)
+	outputs, err := net.predictCheck(inputs)
 	if err != nil {
 		return nil, err
 	}
@@ -123,6 +148,9 @@ func (net *Net) MarshalJSON() (b []byte, err error) {
 		ParameterIndex:         net.parameterIdx,
 		Parameters:             net.parametersSlice,
 		Layers:                 net.layers,
+		Sources:                net.sources,
+		SharedParameters:       net.shared,
+		Pruned:                 net.prunedIndices(),
 		PredictionCheck:        predChecks,
 	}
 	return json.Marshal(n)
@@ -132,7 +160,8 @@ type lossUnmarshaler struct {
 	Losser *common.InterfaceMarshaler
 }
 
-// UnmarshalJSON unmarshals the net. If the interfaces are not part
+// UnmarshalJSON unmarshals the net, and returns an error if the predictions of the
+// unmarshaled net do not match the prediction check. If the interfaces are not part
 // of the nnet suite, they must be
 func (net *Net) UnmarshalJSON(data []byte) error {
 	v := &netMarshal{}
@@ -153,15 +182,93 @@ func (net *Net) UnmarshalJSON(data []byte) error {
 	net.parameterIdx = v.ParameterIndex
 	//net.parametersSlice = v.Parameters
 	net.layers = v.Layers
+	net.sources = nil
+	if v.Sources != nil {
+		err = checkSources(net.layers, v.Sources)
+		if err != nil {
+			return err
+		}
+		net.sources = copySources(v.Sources)
+	}
+	net.shared = v.SharedParameters
+	net.aliased = aliasedEntries(net.parameterIdx)
 
 	net.parameters, net.parametersSlice = net.NewPerParameterMemory()
 	for i, val := range v.Parameters {
 		net.parametersSlice[i] = val
 	}
+	net.sparse = false
+	err = net.setPrunedIndices(v.Pruned)
+	if err != nil {
+		return err
+	}
+	return net.verifyPredictions(v.PredictionCheck)
+}
+
+// predictionCheckTol is the relative tolerance of the prediction check when unmarshaling
+const predictionCheckTol = 1e-12
 
+// verifyPredictions returns an error if the predictions of the net do not match
+// the prediction checks
+func (net *Net) verifyPredictions(checks []predictionCheck) error {
+	inputs := make([][]float64, len(checks))
+	for i, check := range checks {
+		inputs[i] = check.Input
+	}
+	preds, err := net.predictCheck(inputs)
+	if err != nil {
+		return err
+	}
+	for i, check := range checks {
+		if !predictionMatches(preds[i], check.Output) {
+			return errors.New("nnet/net/unmarshaljson: prediction check failed")
+		}
+	}
 	return nil
 }
 
+// predictCheck returns the predictions of the prediction check at the (unscaled)
+// inputs. For a mixture density net, whose OutputScaler scales the targets rather
+// than the outputs, they are the (scaled) outputs of the net, which are the parameters
+// of the mixture. Otherwise they are the predictions from PredictSlice.
+func (net *Net) predictCheck(inputs [][]float64) ([][]float64, error) {
+	if _, err := net.mixtureLosser(); err != nil {
+		return net.PredictSlice(inputs)
+	}
+	if !net.InputScaler.IsScaled() {
+		return nil, errors.New("Scale must be set before calling predict")
+	}
+	tmp := net.NewPredictTmpMemory()
+	preds := make([][]float64, len(inputs))
+	for i, input := range inputs {
+		if len(input) != net.nInputs {
+			return nil, InputMismatch{Provided: len(input), Expected: net.nInputs}
+		}
+		scaled := append([]float64(nil), input...)
+		err := net.InputScaler.Scale(scaled)
+		if err != nil {
+			return nil, err
+		}
+		preds[i] = make([]float64, net.nOutputs)
+		forward(scaled, net, preds[i], tmp.combinations, tmp.outputs, tmp.layerInputs)
+	}
+	return preds, nil
+}
+
+// predictionMatches returns true if the prediction matches the saved prediction
+// to within predictionCheckTol
+func predictionMatches(pred, saved []float64) bool {
+	if len(pred) != len(saved) {
+		return false
+	}
+	for i := range pred {
+		if math.Abs(pred[i]-saved[i]) > predictionCheckTol*math.Max(1, math.Abs(saved[i])) {
+			return false
+		}
+	}
+	return true
+}
+
 // GobDecode some comment about needing to register custom types
 func (net *Net) GobDecode(buf []byte) error {
 	r := bytes.NewBuffer(buf)
@@ -192,13 +299,50 @@ func (net *Net) GobDecode(buf []byte) error {
 	if err != nil {
 		return fmt.Errorf("Error decoding layers: %v", err)
 	}
-	net.new()
-	err = decoder.Decode(&net.parameters)
+	var parameters [][][]float64
+	err = decoder.Decode(&parameters)
 	if err != nil {
 		return fmt.Errorf("Error decoding parameters: %v", err)
 	}
-
-	return nil
+	// The shared parameters and the pruned weights are only encoded if there are any
+	net.shared = nil
+	err = decoder.Decode(&net.shared)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("Error decoding shared parameters: %v", err)
+	}
+	if len(net.shared) == 0 {
+		net.shared = nil
+	}
+	var pruned []int
+	if err == nil {
+		err = decoder.Decode(&pruned)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("Error decoding pruned weights: %v", err)
+		}
+	}
+	var sources [][]int
+	if err == nil {
+		err = decoder.Decode(&sources)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("Error decoding sources: %v", err)
+		}
+	}
+	net.sources = nil
+	if sources != nil {
+		err = checkSources(net.layers, sources)
+		if err != nil {
+			return err
+		}
+		net.sources = copySources(sources)
+	}
+	net.sparse = false
+	net.new()
+	for i := range parameters {
+		for j := range parameters[i] {
+			copy(net.parameters[i][j], parameters[i][j])
+		}
+	}
+	return net.setPrunedIndices(pruned)
 }
 
 // Save saves the neural net
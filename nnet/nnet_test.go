@@ -2,6 +2,7 @@ package nnet
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/btracey/nnet/loss"
 	"github.com/btracey/nnet/scale"
 	"github.com/gonum/floats"
@@ -10,6 +11,7 @@ import (
 
 	"fmt"
 	"reflect"
+	"sync"
 )
 
 const (
@@ -155,7 +157,7 @@ func TestNetPredictMatchPredict(t *testing.T) {
 	os.Mu = make([]float64, 2)
 	os.Sigma = []float64{1, 1}
 	os.Scaled = true
-	is.Dim = 2
+	os.Dim = 2
 	net.OutputScaler = os
 	input := []float64{1, 2, 3}
 	net.RandomizeParameters()
@@ -279,3 +281,222 @@ func TestPredLossDeriv(t *testing.T) {
 		}
 	}
 }
+
+func TestInputJacobian(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	net := DefaultRegression(nInputs, nOutputs, 2, 8)
+	net.InputScaler = &scale.Linear{}
+	net.InputScaler.SetScale(RandomData(nInputs, 100))
+	net.OutputScaler = &scale.Normal{}
+	net.OutputScaler.SetScale(RandomSliceOfSlice(100, nOutputs))
+
+	slow := newPerNeuronNet(net)
+	slow.InputScaler = net.InputScaler
+	slow.OutputScaler = net.OutputScaler
+
+	for _, n := range []*Net{net, slow} {
+		input := []float64{0.3, -0.2, 0.8}
+		jac := make([][]float64, nOutputs)
+		for i := range jac {
+			jac[i] = make([]float64, nInputs)
+		}
+		err := n.InputJacobian(input, jac)
+		if err != nil {
+			t.Errorf("Error computing the Jacobian: %v", err)
+			return
+		}
+
+		// Compare with finite difference
+		for j := range input {
+			input[j] += netFDStep
+			pred1, err := n.Predict(input)
+			if err != nil {
+				t.Errorf("Error predicting: %v", err)
+			}
+			input[j] -= 2 * netFDStep
+			pred2, err := n.Predict(input)
+			if err != nil {
+				t.Errorf("Error predicting: %v", err)
+			}
+			input[j] += netFDStep
+			for i := range jac {
+				fd := (pred1[i] - pred2[i]) / (2 * netFDStep)
+				if !floats.EqualWithinAbsOrRel(fd, jac[i][j], 1e-6, 1e-6) {
+					t.Errorf("Finite difference doesn't match Jacobian. Output %v, input %v: %v found, %v expected", i, j, jac[i][j], fd)
+				}
+			}
+		}
+	}
+}
+
+// newTestNet returns a net with the layers and the squared distance loss, whose
+// parameters are initialized with a fixed seed. The scalers are set from random data.
+func newTestNet(nInputs int, layers []Layer, inputScaler, outputScaler scale.Scaler) *Net {
+	net, err := NewNetInit(nInputs, layers, nil, rand.NewSource(1))
+	if err != nil {
+		panic(err)
+	}
+	net.Losser = loss.SquaredDistance{}
+	net.InputScaler = inputScaler
+	net.InputScaler.SetScale(RandomData(nInputs, 10))
+	net.OutputScaler = outputScaler
+	net.OutputScaler.SetScale(RandomData(net.Outputs(), 10))
+	return net
+}
+
+// newRegressionTestNet returns a test net with the layers of DefaultRegression
+// with two hidden layers and Normal scalers
+func newRegressionTestNet(nInputs, nOutputs, nNeurons int) *Net {
+	return newTestNet(nInputs, defaultRegressionLayers(nInputs, nOutputs, 2, nNeurons), &scale.Normal{}, &scale.Normal{})
+}
+
+func TestPredictConcurrent(t *testing.T) {
+	// Two nets of different sizes share the scratch memory
+	nets := []*Net{newRegressionTestNet(3, 2, 5), newRegressionTestNet(4, 1, 12)}
+	inputs := make([][][]float64, len(nets))
+	want := make([][][]float64, len(nets))
+	for i, net := range nets {
+		inputs[i] = RandomSliceOfSlice(20, net.Inputs())
+		want[i] = make([][]float64, len(inputs[i]))
+		for j, input := range inputs[i] {
+			// Predict the old way on a copy
+			in := append([]float64(nil), input...)
+			net.InputScaler.Scale(in)
+			want[i][j] = make([]float64, net.Outputs())
+			Predict(in, net, want[i][j], net.NewPredictTmpMemory().combinations, net.NewPredictTmpMemory().outputs)
+			net.OutputScaler.Unscale(want[i][j])
+		}
+	}
+	orig := make([][][]float64, len(inputs))
+	for i := range inputs {
+		orig[i] = make([][]float64, len(inputs[i]))
+		for j := range inputs[i] {
+			orig[i][j] = append([]float64(nil), inputs[i][j]...)
+		}
+	}
+
+	// All of the goroutines read the same input rows
+	nGoroutines := 8
+	errs := make(chan error, nGoroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < nGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for rep := 0; rep < 10; rep++ {
+				i := (g + rep) % len(nets)
+				net := nets[i]
+				pred := make([]float64, net.Outputs())
+				for j, input := range inputs[i] {
+					p, err := net.Predict(input)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if err := net.PredictInto(input, pred); err != nil {
+						errs <- err
+						return
+					}
+					if !floats.Equal(p, want[i][j]) || !floats.Equal(pred, want[i][j]) {
+						errs <- fmt.Errorf("prediction mismatch for net %v input %v", i, j)
+						return
+					}
+				}
+				preds, err := net.PredictSlice(inputs[i])
+				if err != nil {
+					errs <- err
+					return
+				}
+				for j := range preds {
+					if !floats.Equal(preds[j], want[i][j]) {
+						errs <- fmt.Errorf("PredictSlice mismatch for net %v input %v", i, j)
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for i := range inputs {
+		for j := range inputs[i] {
+			if !floats.Equal(inputs[i][j], orig[i][j]) {
+				t.Fatalf("Input modified by predicting")
+			}
+		}
+	}
+}
+
+// failingScaler is a scaler which returns an error from Scale and Unscale
+type failingScaler struct {
+	scale.None
+}
+
+func (failingScaler) IsScaled() bool { return true }
+
+func (failingScaler) Scale(x []float64) error { return errors.New("scaling failed") }
+
+func (failingScaler) Unscale(x []float64) error { return errors.New("unscaling failed") }
+
+func TestPredictScalerError(t *testing.T) {
+	net := newRegressionTestNet(3, 2, 5)
+	inputs := RandomSliceOfSlice(5, 3)
+	orig := make([][]float64, len(inputs))
+	for i := range inputs {
+		orig[i] = append([]float64(nil), inputs[i]...)
+	}
+	net.InputScaler = &failingScaler{}
+	if _, err := net.Predict(inputs[0]); err == nil {
+		t.Errorf("No error from Predict when scaling fails")
+	}
+	if err := net.PredictInto(inputs[0], make([]float64, 2)); err == nil {
+		t.Errorf("No error from PredictInto when scaling fails")
+	}
+	if _, err := net.PredictSlice(inputs); err == nil {
+		t.Errorf("No error from PredictSlice when scaling fails")
+	}
+	for i := range inputs {
+		if !floats.Equal(inputs[i], orig[i]) {
+			t.Errorf("Input modified when scaling fails")
+		}
+	}
+	net.InputScaler = &scale.None{Dim: 3, Scaled: true}
+	if err := net.PredictInto(inputs[0], make([]float64, 3)); err == nil {
+		t.Errorf("No error from PredictInto for a prediction of the wrong length")
+	}
+}
+
+func TestPredictIntoAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items with the race detector")
+	}
+	input := RandomSliceOfSlice(1, 3)[0]
+	pred := make([]float64, 2)
+	for _, net := range []*Net{newRegressionTestNet(3, 2, 10), newSkipGraphNet(t, 3, 2)} {
+		allocs := testing.AllocsPerRun(100, func() {
+			if err := net.PredictInto(input, pred); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("PredictInto allocates %v times per call", allocs)
+		}
+	}
+}
+
+func BenchmarkNetPredictInto(b *testing.B) {
+	net := newRegressionTestNet(10, 3, 50)
+	input := RandomSliceOfSlice(1, net.Inputs())[0]
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		pred := make([]float64, net.Outputs())
+		for pb.Next() {
+			net.PredictInto(input, pred)
+		}
+	})
+}
@@ -1,9 +1,30 @@
-// package par implements computing loss and derivative in parallel. Right now just has shared-memory parallel,
-// but should eventually have more
+// Computing the loss and derivative in parallel with shared memory. Package
+// github.com/btracey/nnet/par computes them over multiple processes.
+
 package nnet
 
 import (
-//"fmt"
+	//"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Reduction sets how ParLossDeriv and Evaluator sum the losses and derivatives of
+// the chunks
+type Reduction int
+
+const (
+	// Unordered adds the chunks in the order in which they finish, so the rounding
+	// of the sums can change from call to call
+	Unordered Reduction = iota
+	// Ordered adds the chunks with a pairwise tree in the order of the chunks, so the
+	// result only depends on the chunk size and not on the scheduling of the
+	// goroutines or the number of processors. Two adjacent sums are added as soon as
+	// both are done, so only a few copies of the derivative memory (about the
+	// logarithm of the number of chunks per goroutine) are kept at a time.
+	Ordered
 )
 
 type ParLossDerivMemory struct {
@@ -11,6 +32,11 @@ type ParLossDerivMemory struct {
 	predictionTmp      []float64
 	dLossDParamTmp     [][][]float64
 	dLossDParamTmpFlat []float64
+	dense              *denseBatchMemory // Allocated the first time it is needed
+	dropout            *dropoutMemory    // Allocated the first time it is needed
+	batch              *batchMemory      // Allocated the first time it is needed
+	rand               *rand.Rand        // Source of the dropout masks. Seeded from the net if nil
+	untied             [][][]float64     // Derivatives of neurons which share parameters. Allocated the first time it is needed
 }
 
 func NewParLossDerivMemory(net *Net) *ParLossDerivMemory {
@@ -18,16 +44,44 @@ func NewParLossDerivMemory(net *Net) *ParLossDerivMemory {
 		derivTmp:      net.NewPredLossDerivTmpMemory(),
 		predictionTmp: make([]float64, net.Outputs()),
 	}
-	p.dLossDParamTmp, p.dLossDParamTmpFlat = net.NewPerParameterMemory()
+	p.dLossDParamTmp, p.dLossDParamTmpFlat = net.newUntiedParameterMemory()
 	return p
 }
 
 func SeqLossDeriv(inputs, truths [][]float64, weights []float64, net *Net, dLossDParam [][][]float64, p *ParLossDerivMemory) (loss float64) {
+	defer net.zeroFrozen(dLossDParam)
+	if net.aliased == nil {
+		return seqLossDeriv(inputs, truths, weights, net, dLossDParam, p)
+	}
+	// The derivatives are computed for every neuron, and then summed into the
+	// shared parameters
+	if p.untied == nil {
+		p.untied, _ = net.newUntiedParameterMemory()
+	}
+	loss = seqLossDeriv(inputs, truths, weights, net, p.untied, p)
+	net.sumShared(p.untied, dLossDParam)
+	return loss
+}
+
+// seqLossDeriv is SeqLossDeriv, but dLossDParam has a separate entry for every
+// neuron as in newUntiedParameterMemory
+func seqLossDeriv(inputs, truths [][]float64, weights []float64, net *Net, dLossDParam [][][]float64, p *ParLossDerivMemory) (loss float64) {
+	if net.Mode == Train {
+		if hasBatchNorm(net.layers) {
+			return seqLossDerivBatch(inputs, truths, weights, net, dLossDParam, p)
+		}
+		if net.hasDropout() {
+			return seqLossDerivDropout(inputs, truths, weights, net, dLossDParam, p)
+		}
+	}
+	if net.isDenseNet() {
+		return seqLossDerivDense(inputs, truths, weights, net, dLossDParam, p)
+	}
 	// Compute first loss and store in it dLossDParam
-	loss = PredLossDeriv(inputs[0], truths[0], weights[0], net, p.derivTmp, p.predictionTmp, dLossDParam)
+	loss = predLossDeriv(inputs[0], truths[0], weights[0], net, p.derivTmp, p.predictionTmp, dLossDParam)
 	// Sum up the next losses and derivatives
 	for i := 1; i < len(inputs); i++ {
-		newLoss := PredLossDeriv(inputs[i], truths[i], weights[i], net, p.derivTmp, p.predictionTmp, p.dLossDParamTmp)
+		newLoss := predLossDeriv(inputs[i], truths[i], weights[i], net, p.derivTmp, p.predictionTmp, p.dLossDParamTmp)
 
 		//fmt.Println("input", inputs[i])
 		//fmt.Println("truth", truths[i])
@@ -44,56 +98,292 @@ func SeqLossDeriv(inputs, truths [][]float64, weights []float64, net *Net, dLoss
 	return loss
 }
 
+// seqLossDerivDense is SeqLossDeriv for nets of SumNeurons. The samples are processed
+// in batches using matrix-matrix products
+func seqLossDerivDense(inputs, truths [][]float64, weights []float64, net *Net, dLossDParam [][][]float64, p *ParLossDerivMemory) (loss float64) {
+	if p.dense == nil {
+		p.dense = net.newDenseBatchMemory()
+	}
+	for i := range p.dLossDParamTmpFlat {
+		p.dLossDParamTmpFlat[i] = 0
+	}
+	for start := 0; start < len(inputs); start += denseBatchSize {
+		end := start + denseBatchSize
+		if end > len(inputs) {
+			end = len(inputs)
+		}
+		loss += denseBatchLossDeriv(inputs[start:end], truths[start:end], weights[start:end], net, p.dense, p.derivTmp.dLossDPred, p.dLossDParamTmpFlat)
+	}
+	for i, lay := range p.dLossDParamTmp {
+		for j, neur := range lay {
+			copy(dLossDParam[i][j], neur)
+		}
+	}
+	return loss
+}
+
+// seqLossDerivDropout is SeqLossDeriv for nets with dropout. A new dropout mask
+// is sampled for every sample
+func seqLossDerivDropout(inputs, truths [][]float64, weights []float64, net *Net, dLossDParam [][][]float64, p *ParLossDerivMemory) (loss float64) {
+	if p.dropout == nil {
+		p.dropout = net.newDropoutMemory()
+	}
+	if p.rand == nil {
+		p.rand = rand.New(rand.NewSource(net.dropoutSeed()))
+	}
+	loss = predLossDerivDropout(inputs[0], truths[0], weights[0], net, p.derivTmp, p.dropout, p.rand, p.predictionTmp, dLossDParam)
+	for i := 1; i < len(inputs); i++ {
+		loss += predLossDerivDropout(inputs[i], truths[i], weights[i], net, p.derivTmp, p.dropout, p.rand, p.predictionTmp, p.dLossDParamTmp)
+		for i, lay := range p.dLossDParamTmp {
+			for j, neur := range lay {
+				for k, val := range neur {
+					dLossDParam[i][j][k] += val
+				}
+			}
+		}
+	}
+	return loss
+}
+
 type Result struct {
 	dLossDParam [][][]float64
 	loss        float64
 }
 
+// ParLossDeriv computes the loss and derivative of the samples in parallel, with
+// chunkSize samples per chunk. The chunks are taken in order by at most GOMAXPROCS
+// goroutines, and summed as set by net.Reduction. For a net with batch normalization
+// in the Train mode, each chunk is a batch. The batch statistics are discarded, so
+// ParLossDerivStatistics should be used to update the running statistics.
 func ParLossDeriv(inputs, truths [][]float64, weights []float64, net *Net, dLossDParam [][][]float64, chunkSize int) (loss float64) {
-	// Zero out dLossDParam
-	for i, lay := range dLossDParam {
-		for j, neur := range lay {
-			for k := range neur {
-				dLossDParam[i][j][k] = 0
+	loss, _ = ParLossDerivStatistics(inputs, truths, weights, net, dLossDParam, chunkSize)
+	return loss
+}
+
+// ParLossDerivStatistics is ParLossDeriv which also returns the batch statistics of
+// batch normalization over all of the samples for UpdateRunningStatistics. stats is
+// nil if the net is not in the Train mode, has no batch normalization or there are
+// no samples.
+func ParLossDerivStatistics(inputs, truths [][]float64, weights []float64, net *Net, dLossDParam [][][]float64, chunkSize int) (loss float64, stats *BatchStatistics) {
+	nChunks := numChunks(len(inputs), chunkSize)
+
+	// The seeds of the dropout masks are drawn here rather than in the goroutines
+	// so the DropoutSource of the net is not shared, and in the order of the chunks
+	// so the masks do not depend on which goroutine processes which chunk
+	dropout := net.Mode == Train && net.hasDropout()
+	batchNorm := net.Mode == Train && hasBatchNorm(net.layers)
+	var seeds []int64
+	if dropout {
+		seeds = make([]int64, nChunks)
+		for c := range seeds {
+			seeds[c] = net.dropoutSeed()
+		}
+	}
+	var batches []*BatchStatistics
+	if batchNorm {
+		batches = make([]*BatchStatistics, nChunks)
+		for c := range batches {
+			batches[c] = net.newBatchStatistics()
+		}
+	}
+
+	loss = net.parChunks(nChunks, net.Reduction, dLossDParam, func() func(c int, dLossDParam [][][]float64) float64 {
+		p := NewParLossDerivMemory(net)
+		return func(c int, dLossDParam [][][]float64) float64 {
+			start, end := chunkBounds(c, chunkSize, len(inputs))
+			if dropout {
+				p.seed(seeds[c])
+			}
+			loss := SeqLossDeriv(inputs[start:end], truths[start:end], weights[start:end], net, dLossDParam, p)
+			if batchNorm {
+				batches[c].copyStatistics(p.batch.BatchStatistics)
 			}
+			return loss
 		}
+	})
+	if batchNorm {
+		stats = net.poolBatchStatistics(net.newBatchStatistics(), batches)
 	}
+	return loss, stats
+}
 
-	receiveChan := make(chan *Result, 10) // Add a buffer so there is no blocking
+// seed seeds the source of the dropout masks
+func (p *ParLossDerivMemory) seed(seed int64) {
+	if p.rand == nil {
+		p.rand = rand.New(rand.NewSource(seed))
+		return
+	}
+	p.rand.Seed(seed)
+}
 
-	count := 0
-	nSent := 0
-	var startInd, endInd int
-	for {
-		startInd = count
-		if count+chunkSize > len(inputs) {
-			endInd = len(inputs)
-		} else {
-			endInd = count + chunkSize
-		}
-		nSent++
-		go func(startInd, endInd int, c chan *Result) {
-			dLossDParam, _ := net.NewPerParameterMemory()
-			loss := SeqLossDeriv(inputs[startInd:endInd], truths[startInd:endInd], weights[startInd:endInd], net, dLossDParam, NewParLossDerivMemory(net))
-			c <- &Result{loss: loss, dLossDParam: dLossDParam}
-		}(startInd, endInd, receiveChan)
-
-		if endInd == len(inputs) {
-			break
-		}
-		count += chunkSize
+// numChunks returns the number of chunks of chunkSize samples
+func numChunks(nSamples, chunkSize int) int {
+	return (nSamples + chunkSize - 1) / chunkSize
+}
+
+// chunkBounds returns the range of samples in chunk c
+func chunkBounds(c, chunkSize, nSamples int) (start, end int) {
+	start = c * chunkSize
+	end = start + chunkSize
+	if end > nSamples {
+		end = nSamples
 	}
+	return start, end
+}
 
-	for i := 0; i < nSent; i++ {
-		r := <-receiveChan
-		loss += r.loss
-		for i, lay := range r.dLossDParam {
-			for j, neur := range lay {
-				for k, val := range neur {
-					dLossDParam[i][j][k] += val
+// parChunks computes the losses and derivatives of nChunks chunks in parallel and
+// sums them into dst as set by reduction. The chunks are taken in order by at
+// most GOMAXPROCS goroutines. Each goroutine calls newChunk once to get a function
+// with its own memory, which computes the loss and derivative of chunk c and stores
+// the derivative into dLossDParam.
+func (net *Net) parChunks(nChunks int, reduction Reduction, dst [][][]float64, newChunk func() func(c int, dLossDParam [][][]float64) float64) (loss float64) {
+	zeroParameterMemory(dst)
+	if nChunks == 0 {
+		return 0
+	}
+	nWorkers := runtime.GOMAXPROCS(0)
+	if nWorkers > nChunks {
+		nWorkers = nChunks
+	}
+	var tree *chunkTree
+	ordered := reduction == Ordered
+	if ordered {
+		tree = &chunkTree{net: net}
+		tree.reset(nChunks)
+	}
+	results := make([]Result, nWorkers) // The sum of the chunks of each goroutine for Unordered
+	var next int64
+	var wg sync.WaitGroup
+	for w := range results {
+		wg.Add(1)
+		go func(r *Result) {
+			defer wg.Done()
+			chunk := newChunk()
+			var dLossDParam [][][]float64
+			if !ordered {
+				dLossDParam, _ = net.NewPerParameterMemory()
+				r.dLossDParam, _ = net.NewPerParameterMemory()
+			}
+			for {
+				c := int(atomic.AddInt64(&next, 1) - 1)
+				if c >= nChunks {
+					return
+				}
+				if ordered {
+					d := tree.memory()
+					tree.add(c, chunk(c, d), d)
+					continue
 				}
+				r.loss += chunk(c, dLossDParam)
+				net.addParameterMemory(r.dLossDParam, dLossDParam)
 			}
+		}(&results[w])
+	}
+	wg.Wait()
+	if ordered {
+		return tree.sum(dst)
+	}
+	for _, r := range results {
+		loss += r.loss
+		net.addParameterMemory(dst, r.dLossDParam)
+	}
+	return loss
+}
+
+// chunkTree sums the losses and derivatives of the chunks with a pairwise tree in the
+// order of the chunks. Two adjacent sums are added as soon as both are done, so when
+// the chunks are processed roughly in order only about log2(nChunks) sums are pending
+// at a time. The memory of the sums is kept for the later calls.
+type chunkTree struct {
+	net     *Net
+	nChunks int
+
+	mu      sync.Mutex
+	pending map[chunkNode]Result // Sums which are waiting for the adjacent sum
+	root    Result
+	free    [][][][]float64 // Derivative memory which is not in use
+	nMemory int             // The number of derivative memories allocated
+}
+
+// chunkNode is a node of the tree. The node at level l and index i is the sum of
+// chunks i to i+2^l-1 (or to the last chunk).
+type chunkNode struct {
+	level, index int
+}
+
+// reset prepares the tree for the sum of nChunks chunks. The memory of the pending
+// sums of the last call, if it was stopped early, is reused.
+func (t *chunkTree) reset(nChunks int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range t.pending {
+		t.free = append(t.free, r.dLossDParam)
+	}
+	if t.root.dLossDParam != nil {
+		t.free = append(t.free, t.root.dLossDParam)
+	}
+	t.nChunks = nChunks
+	t.pending = make(map[chunkNode]Result)
+	t.root = Result{}
+}
+
+// memory returns derivative memory for a chunk
+func (t *chunkTree) memory() [][][]float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n := len(t.free); n > 0 {
+		mem := t.free[n-1]
+		t.free = t.free[:n-1]
+		return mem
+	}
+	t.nMemory++
+	mem, _ := t.net.NewPerParameterMemory()
+	return mem
+}
+
+// add adds the loss and derivative of chunk c to the tree. The derivative memory
+// must be from memory, and is owned by the tree after the call.
+func (t *chunkTree) add(c int, loss float64, dLossDParam [][][]float64) {
+	r := Result{loss: loss, dLossDParam: dLossDParam}
+	node := chunkNode{0, c}
+	t.mu.Lock()
+	for width := 1; width < t.nChunks; width *= 2 {
+		left := node.index%(2*width) == 0
+		sibling := chunkNode{node.level, node.index + width}
+		if !left {
+			sibling.index = node.index - width
 		}
+		if left && sibling.index >= t.nChunks {
+			// There are no more chunks to the right at this level
+			node.level++
+			continue
+		}
+		other, ok := t.pending[sibling]
+		if !ok {
+			t.pending[node] = r
+			t.mu.Unlock()
+			return
+		}
+		delete(t.pending, sibling)
+		t.mu.Unlock()
+		if !left {
+			r, other = other, r
+			node = sibling
+		}
+		r.loss += other.loss
+		t.net.addParameterMemory(r.dLossDParam, other.dLossDParam)
+		t.mu.Lock()
+		t.free = append(t.free, other.dLossDParam)
+		node.level++
 	}
-	return
+	t.root = r
+	t.mu.Unlock()
+}
+
+// sum stores the derivative of all of the chunks into dst and returns the loss.
+// All of the chunks must have been added.
+func (t *chunkTree) sum(dst [][][]float64) (loss float64) {
+	zeroParameterMemory(dst)
+	t.net.addParameterMemory(dst, t.root.dLossDParam)
+	return t.root.loss
 }
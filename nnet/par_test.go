@@ -1,6 +1,9 @@
 package nnet
 
 import (
+	"context"
+	"math/bits"
+	"runtime"
 	"testing"
 
 	"github.com/btracey/nnet/loss"
@@ -55,3 +58,138 @@ func TestParLossDeriv(t *testing.T) {
 		t.Errorf("Par and seq don't match")
 	}
 }
+
+func TestOrderedReduction(t *testing.T) {
+	nSamples := 1000
+	chunkSize := 7
+	inputs := RandomSliceOfSlice(nSamples, 3)
+	truths := RandomSliceOfSlice(nSamples, 2)
+	weights := RandomWeights(nSamples)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	for _, test := range []struct {
+		name string
+		net  *Net
+	}{
+		{"dense", newPruneNet(3, 2)},
+		{"dropout", newDropoutNet(3, 2)},
+		{"batch norm", newBatchNormNet(3, 2)},
+	} {
+		net := test.net
+		net.Reduction = Ordered
+		stats := runningStatistics(net)
+		var wantLoss float64
+		var wantFlat []float64
+		var wantStats [][]float64
+		for i, procs := range []int{1, 2, 8, 8, 3} {
+			runtime.GOMAXPROCS(procs)
+			for _, evaluator := range []bool{false, true} {
+				setRunningStatistics(net, stats)
+				net.DropoutSource = rand.NewSource(1)
+				dLossDParam, flat := net.NewPerParameterMemory()
+				var loss float64
+				if evaluator {
+					var err error
+					loss, err = NewEvaluator(net, procs, chunkSize).LossDeriv(context.Background(), inputs, truths, weights, dLossDParam)
+					if err != nil {
+						t.Fatal(err)
+					}
+				} else {
+					loss = ParLossDeriv(inputs, truths, weights, net, dLossDParam, chunkSize)
+				}
+				if i == 0 && !evaluator {
+					wantLoss, wantFlat, wantStats = loss, flat, runningStatistics(net)
+					continue
+				}
+				if loss != wantLoss || !floats.Equal(flat, wantFlat) || !predictionsMatch(runningStatistics(net), wantStats, 0) {
+					t.Errorf("%v: result not identical with GOMAXPROCS %v (evaluator %v)", test.name, procs, evaluator)
+				}
+			}
+		}
+
+		// The ordered sum is the same as the unordered sum up to rounding
+		setRunningStatistics(net, stats)
+		net.DropoutSource = rand.NewSource(1)
+		net.Reduction = Unordered
+		dLossDParam, flat := net.NewPerParameterMemory()
+		loss := ParLossDeriv(inputs, truths, weights, net, dLossDParam, chunkSize)
+		if !floats.EqualWithinRel(loss, wantLoss, 1e-12) || !floats.EqualApprox(flat, wantFlat, 1e-12) {
+			t.Errorf("%v: ordered and unordered reductions do not match", test.name)
+		}
+	}
+}
+
+func TestChunkTree(t *testing.T) {
+	net := newPruneNet(3, 2)
+	for _, nChunks := range []int{1, 2, 3, 5, 6, 7, 8, 100} {
+		losses := make([]float64, nChunks)
+		derivs := make([][]float64, nChunks)
+		for c := range losses {
+			losses[c] = rand.NormFloat64()
+			derivs[c] = make([]float64, net.TotalNumParameters())
+			for i := range derivs[c] {
+				derivs[c][i] = rand.NormFloat64()
+			}
+		}
+		// Sum level by level as the reference
+		wantLosses := append([]float64(nil), losses...)
+		want := make([][]float64, nChunks)
+		for c := range want {
+			want[c] = append([]float64(nil), derivs[c]...)
+		}
+		for step := 1; step < nChunks; step *= 2 {
+			for i := 0; i+step < nChunks; i += 2 * step {
+				wantLosses[i] += wantLosses[i+step]
+				floats.Add(want[i], want[i+step])
+			}
+		}
+
+		for _, order := range [][]int{rand.Perm(nChunks), rand.Perm(nChunks), nil} {
+			tree := &chunkTree{net: net}
+			tree.reset(nChunks)
+			for i := 0; i < nChunks; i++ {
+				c := i
+				if order != nil {
+					c = order[i]
+				}
+				var d [][][]float64
+				if order == nil {
+					d = tree.memory()
+				} else {
+					d, _ = net.NewPerParameterMemory()
+				}
+				idx := 0
+				for _, lay := range d {
+					for _, neur := range lay {
+						idx += copy(neur, derivs[c][idx:])
+					}
+				}
+				tree.add(c, losses[c], d)
+			}
+			dst, flat := net.NewPerParameterMemory()
+			loss := tree.sum(dst)
+			if loss != wantLosses[0] || !floats.Equal(flat, want[0]) {
+				t.Errorf("%v chunks: sum does not match the pairwise sum with order %v", nChunks, order)
+			}
+			// Added in order, only the pending sums need memory
+			if order == nil && tree.nMemory > bits.Len(uint(nChunks))+1 {
+				t.Errorf("%v chunks: %v derivative memories allocated", nChunks, tree.nMemory)
+			}
+		}
+	}
+
+	// The Evaluator reuses the memory of the tree
+	nSamples := 500
+	chunkSize := 5
+	net.Reduction = Ordered
+	e := NewEvaluator(net, 1, chunkSize)
+	d, _ := net.NewPerParameterMemory()
+	for i := 0; i < 3; i++ {
+		_, err := e.LossDeriv(context.Background(), RandomSliceOfSlice(nSamples, 3), RandomSliceOfSlice(nSamples, 2), RandomWeights(nSamples), d)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if max := bits.Len(uint(nSamples/chunkSize)) + 1; e.tree.nMemory > max {
+		t.Errorf("Evaluator allocated %v derivative memories, want at most %v", e.tree.nMemory, max)
+	}
+}
@@ -0,0 +1,252 @@
+package nnet
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// The weights of the SumNeurons of a net can be pruned, which sets them to zero and
+// keeps them there: their derivatives from PredLossDeriv, SeqLossDeriv and ParLossDeriv
+// are zero, and SetParametersSlice and SetTrainableParametersSlice do not change them.
+// The biases and the parameters of other neurons and of batch normalization are never
+// pruned. The pruned weights are saved with the net. The structure of a net with pruned
+// weights cannot be changed and its parameters cannot be shared, so Unprune must be
+// called first (the pruned weights stay zero).
+//
+// In sparse inference mode, the layers of SumNeurons with pruned weights skip the
+// pruned connections when predicting instead of multiplying them by zero, which is
+// faster for nets with most of their weights pruned.
+
+// PruneThreshold prunes the weights whose magnitude is less than threshold, and
+// returns the number of pruned weights in the net.
+func (net *Net) PruneThreshold(threshold float64) int {
+	for _, layer := range net.prunableWeights() {
+		for _, idx := range layer {
+			if math.Abs(net.parametersSlice[idx]) < threshold {
+				net.prune(idx)
+			}
+		}
+	}
+	net.applyPruning()
+	return net.NumPruned()
+}
+
+// PruneFraction prunes the fraction of the weights of the net with the smallest
+// magnitude. Weights which are already pruned count towards the fraction.
+func (net *Net) PruneFraction(fraction float64) error {
+	if fraction < 0 || fraction > 1 {
+		return errors.New("nnet: prune fraction must be between 0 and 1")
+	}
+	var weights []int
+	for _, layer := range net.prunableWeights() {
+		weights = append(weights, layer...)
+	}
+	net.pruneSmallest(weights, fraction)
+	net.applyPruning()
+	return nil
+}
+
+// PruneLayerFraction prunes the fraction of the weights of each layer with the
+// smallest magnitude. Weights which are already pruned count towards the fraction.
+func (net *Net) PruneLayerFraction(fraction float64) error {
+	if fraction < 0 || fraction > 1 {
+		return errors.New("nnet: prune fraction must be between 0 and 1")
+	}
+	for _, layer := range net.prunableWeights() {
+		net.pruneSmallest(layer, fraction)
+	}
+	net.applyPruning()
+	return nil
+}
+
+// Unprune clears the pruning, so the pruned weights (which are zero) can be trained again
+func (net *Net) Unprune() {
+	net.pruned = nil
+	net.updateSparse()
+}
+
+// NumPruned returns the number of pruned weights
+func (net *Net) NumPruned() int {
+	var n int
+	for _, pruned := range net.pruned {
+		if pruned {
+			n++
+		}
+	}
+	return n
+}
+
+// IsPruned returns true if parameter k of the neuron is a pruned weight
+func (net *Net) IsPruned(layer, neuron, k int) bool {
+	if net.pruned == nil {
+		return false
+	}
+	if k < 0 || k >= net.nParameters[layer][neuron] {
+		panic("nnet: parameter index out of range")
+	}
+	return net.pruned[net.parameterIdx[layer][neuron]+k]
+}
+
+// SetSparseInference turns sparse inference on or off. Sparse inference is not saved
+// with the net.
+func (net *Net) SetSparseInference(sparse bool) {
+	net.sparse = sparse
+	net.updateSparse()
+}
+
+// SparseInference returns true if sparse inference is on
+func (net *Net) SparseInference() bool {
+	return net.sparse
+}
+
+// prunableWeights returns the indices in parametersSlice of the weights of the
+// SumNeurons of each layer. Shared weights are only listed once.
+func (net *Net) prunableWeights() [][]int {
+	layerInputs := net.layerInputs()
+	weights := make([][]int, len(net.layers))
+	for i, layer := range net.layers {
+		for j, neuron := range layer.Neurons {
+			if _, ok := neuron.(*SumNeuron); !ok {
+				continue
+			}
+			if net.aliased != nil && net.aliased[i][j] {
+				continue
+			}
+			start := net.parameterIdx[i][j]
+			for k := 0; k < layerInputs[i]; k++ {
+				weights[i] = append(weights[i], start+k)
+			}
+		}
+	}
+	return weights
+}
+
+// pruneSmallest prunes the fraction of the weights with the smallest magnitude
+func (net *Net) pruneSmallest(weights []int, fraction float64) {
+	sorted := make([]int, len(weights))
+	copy(sorted, weights)
+	sort.Sort(byMagnitude{idx: sorted, values: net.parametersSlice})
+	n := int(fraction * float64(len(sorted)))
+	for _, idx := range sorted[:n] {
+		net.prune(idx)
+	}
+}
+
+type byMagnitude struct {
+	idx    []int
+	values []float64
+}
+
+func (b byMagnitude) Len() int      { return len(b.idx) }
+func (b byMagnitude) Swap(i, j int) { b.idx[i], b.idx[j] = b.idx[j], b.idx[i] }
+func (b byMagnitude) Less(i, j int) bool {
+	return math.Abs(b.values[b.idx[i]]) < math.Abs(b.values[b.idx[j]])
+}
+
+// prune marks the parameter at index idx of parametersSlice as pruned
+func (net *Net) prune(idx int) {
+	if net.pruned == nil {
+		net.pruned = make([]bool, net.totalNumParameters)
+	}
+	net.pruned[idx] = true
+}
+
+// applyPruning sets the pruned weights to zero and updates the sparse inference
+func (net *Net) applyPruning() {
+	net.zeroPrunedParameters()
+	net.updateSparse()
+}
+
+// zeroPrunedParameters sets the pruned weights to zero
+func (net *Net) zeroPrunedParameters() {
+	for idx, pruned := range net.pruned {
+		if pruned {
+			net.parametersSlice[idx] = 0
+		}
+	}
+}
+
+// zeroPruned sets the derivatives of the pruned weights to zero. dLossDParam may
+// have separate entries for neurons which share parameters.
+func (net *Net) zeroPruned(dLossDParam [][][]float64) {
+	if net.pruned == nil {
+		return
+	}
+	for i := range dLossDParam {
+		for j := range dLossDParam[i] {
+			start := net.parameterIdx[i][j]
+			for k := range dLossDParam[i][j] {
+				if net.pruned[start+k] {
+					dLossDParam[i][j][k] = 0
+				}
+			}
+		}
+	}
+}
+
+// updateSparse finds the unpruned weights of each neuron for sparse inference.
+// sparseIdx[i] is nil for layers which are not computed sparsely.
+func (net *Net) updateSparse() {
+	net.sparseIdx = nil
+	if !net.sparse || net.pruned == nil {
+		return
+	}
+	layerInputs := net.layerInputs()
+	net.sparseIdx = make([][][]int, len(net.layers))
+	for i := range net.layers {
+		layer := &net.layers[i]
+		if !layer.isSumLayer() {
+			continue
+		}
+		idx := make([][]int, len(layer.Neurons))
+		var anyPruned bool
+		for j := range layer.Neurons {
+			start := net.parameterIdx[i][j]
+			for k := 0; k < layerInputs[i]; k++ {
+				if net.pruned[start+k] {
+					anyPruned = true
+					continue
+				}
+				idx[j] = append(idx[j], k)
+			}
+		}
+		if anyPruned {
+			net.sparseIdx[i] = idx
+		}
+	}
+}
+
+// prunedIndices returns the indices in parametersSlice of the pruned weights
+func (net *Net) prunedIndices() []int {
+	var indices []int
+	for idx, pruned := range net.pruned {
+		if pruned {
+			indices = append(indices, idx)
+		}
+	}
+	return indices
+}
+
+// setPrunedIndices prunes the weights at the indices in parametersSlice
+func (net *Net) setPrunedIndices(indices []int) error {
+	net.pruned = nil
+	for _, idx := range indices {
+		if idx < 0 || idx >= net.totalNumParameters {
+			return errors.New("nnet: pruned index out of range")
+		}
+		net.prune(idx)
+	}
+	net.applyPruning()
+	return nil
+}
+
+// processSparseLayer is ProcessLayer for a layer of SumNeurons which only uses the
+// weights at the indices in idx for each neuron
+func processSparseLayer(layer *Layer, parameters [][]float64, idx [][]int, inputs []float64, combinations, outputs []float64) {
+	for j, neuron := range layer.Neurons {
+		combinations[j] = neuron.(*SumNeuron).CombineSparse(parameters[j], inputs, idx[j])
+	}
+	layer.normalize(parameters, combinations)
+	layer.activate(combinations, outputs)
+}
@@ -0,0 +1,327 @@
+package nnet
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/gonum/floats"
+)
+
+func newPruneNet(nInputs, nOutputs int) *Net {
+	net := newRegressionTestNet(nInputs, nOutputs, 8)
+	// Make the biases non-zero so it can be checked that they are not pruned
+	for i := range net.layers {
+		for j := range net.layers[i].Neurons {
+			p := net.parameters[i][j]
+			p[len(p)-1] = 0.01 * rand.NormFloat64()
+		}
+	}
+	return net
+}
+
+// checkPruned checks that the pruned parameters are exactly the weights of
+// SumNeurons for which isPruned is true, and that they are zero
+func checkPruned(t *testing.T, net *Net, name string, isPruned func(i, j, k int) bool) {
+	layerInputs := net.layerInputs()
+	for i := range net.parameters {
+		for j := range net.parameters[i] {
+			for k, val := range net.parameters[i][j] {
+				want := k < layerInputs[i] && isPruned(i, j, k)
+				if net.IsPruned(i, j, k) != want {
+					t.Errorf("%v: wrong pruning of parameter %v of neuron %v of layer %v", name, k, j, i)
+				}
+				if want && val != 0 {
+					t.Errorf("%v: pruned parameter is not zero", name)
+				}
+			}
+		}
+	}
+}
+
+func TestPruneThreshold(t *testing.T) {
+	net := newPruneNet(3, 2)
+	old := net.copyParameters()
+	threshold := 0.3
+	n := net.PruneThreshold(threshold)
+	if n != net.NumPruned() || n == 0 {
+		t.Errorf("Wrong number of pruned weights returned")
+	}
+	checkPruned(t, net, "threshold", func(i, j, k int) bool {
+		return math.Abs(old[i][j][k]) < threshold
+	})
+}
+
+func TestPruneFraction(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	net := newPruneNet(nInputs, nOutputs)
+	if err := net.PruneFraction(1.5); err == nil {
+		t.Errorf("No error for a fraction above one")
+	}
+	old := net.copyParameters()
+	fraction := 0.4
+	if err := net.PruneFraction(fraction); err != nil {
+		t.Fatal(err)
+	}
+	var nWeights int
+	for _, layer := range net.prunableWeights() {
+		nWeights += len(layer)
+	}
+	if net.NumPruned() != int(fraction*float64(nWeights)) {
+		t.Errorf("Wrong number of pruned weights. Want %v, got %v", int(fraction*float64(nWeights)), net.NumPruned())
+	}
+	// Every pruned weight must have been smaller than every unpruned weight
+	maxPruned := 0.0
+	minUnpruned := math.Inf(1)
+	layerInputs := net.layerInputs()
+	for i := range old {
+		for j := range net.layers[i].Neurons {
+			for k := 0; k < layerInputs[i]; k++ {
+				if net.IsPruned(i, j, k) {
+					maxPruned = math.Max(maxPruned, math.Abs(old[i][j][k]))
+				} else {
+					minUnpruned = math.Min(minUnpruned, math.Abs(old[i][j][k]))
+				}
+			}
+		}
+	}
+	if maxPruned > minUnpruned {
+		t.Errorf("Pruned weight larger than an unpruned weight")
+	}
+	checkPruned(t, net, "fraction", func(i, j, k int) bool {
+		return math.Abs(old[i][j][k]) <= maxPruned
+	})
+
+	net = newPruneNet(nInputs, nOutputs)
+	if err := net.PruneLayerFraction(0.5); err != nil {
+		t.Fatal(err)
+	}
+	for i := range net.layers {
+		var nPruned int
+		for j := range net.layers[i].Neurons {
+			for k := 0; k < layerInputs[i]; k++ {
+				if net.IsPruned(i, j, k) {
+					nPruned++
+				}
+			}
+		}
+		want := int(0.5 * float64(len(net.layers[i].Neurons)*layerInputs[i]))
+		if nPruned != want {
+			t.Errorf("Wrong number of pruned weights in layer %v. Want %v, got %v", i, want, nPruned)
+		}
+	}
+
+	net.Unprune()
+	if net.NumPruned() != 0 || net.IsPruned(0, 0, 0) {
+		t.Errorf("Pruning not cleared")
+	}
+}
+
+func TestPruneTraining(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	nSamples := 20
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := RandomSliceOfSlice(nSamples, nOutputs)
+	weights := RandomWeights(nSamples)
+
+	dense := newPruneNet(nInputs, nOutputs)
+	for _, test := range []struct {
+		name string
+		net  *Net
+	}{
+		{"dense", dense},
+		{"per neuron", newPerNeuronNet(dense)},
+		{"batch norm", newBatchNormNet(nInputs, nOutputs)},
+	} {
+		net := test.net
+		if err := net.PruneFraction(0.5); err != nil {
+			t.Fatal(err)
+		}
+		pruned := net.prunedIndices()
+
+		// The derivatives of the pruned weights are zero, and the others are as
+		// for the same (zero) weights without pruning
+		dLossDParam, dLossFlat := net.NewPerParameterMemory()
+		loss := SeqLossDeriv(inputs, truths, weights, net, dLossDParam, NewParLossDerivMemory(net))
+		parDLossDParam, parDLossFlat := net.NewPerParameterMemory()
+		parLoss := ParLossDeriv(inputs, truths, weights, net, parDLossDParam, nSamples)
+		predDLossDParam, predDLossFlat := net.NewPerParameterMemory()
+		PredLossDeriv(inputs[0], truths[0], weights[0], net, net.NewPredLossDerivTmpMemory(), make([]float64, nOutputs), predDLossDParam)
+		for _, idx := range pruned {
+			if dLossFlat[idx] != 0 || parDLossFlat[idx] != 0 || predDLossFlat[idx] != 0 {
+				t.Errorf("%v: derivative of pruned weight is not zero", test.name)
+				break
+			}
+		}
+
+		net.Unprune()
+		unprunedDLossDParam, unprunedDLossFlat := net.NewPerParameterMemory()
+		unprunedLoss := SeqLossDeriv(inputs, truths, weights, net, unprunedDLossDParam, NewParLossDerivMemory(net))
+		if math.Abs(loss-unprunedLoss) > 1e-14 || math.Abs(parLoss-unprunedLoss) > 1e-12 {
+			t.Errorf("%v: loss changed by pruning", test.name)
+		}
+		if err := net.setPrunedIndices(pruned); err != nil {
+			t.Fatal(err)
+		}
+		for _, idx := range pruned {
+			unprunedDLossFlat[idx] = 0
+		}
+		if !floats.EqualApprox(dLossFlat, unprunedDLossFlat, 1e-12) {
+			t.Errorf("%v: derivative of unpruned weights changed by pruning", test.name)
+		}
+
+		// Setting the parameters does not change the pruned weights
+		params := RandomSliceOfSlice(1, net.TotalNumParameters())[0]
+		net.SetParametersSlice(params)
+		net.frozen = nil
+		net.SetLayerFrozen(len(net.layers)-1, true)
+		trainable := RandomSliceOfSlice(1, net.NumTrainableParameters())[0]
+		net.SetTrainableParametersSlice(trainable)
+		for _, idx := range pruned {
+			if net.parametersSlice[idx] != 0 {
+				t.Errorf("%v: pruned weight changed by setting the parameters", test.name)
+				break
+			}
+		}
+		net.frozen = nil
+	}
+}
+
+func TestSparseInference(t *testing.T) {
+	nInputs := 4
+	nOutputs := 2
+	inputs := RandomSliceOfSlice(20, nInputs)
+	for _, test := range []struct {
+		name string
+		net  *Net
+	}{
+		{"dense", newPruneNet(nInputs, nOutputs)},
+		{"batch norm", newBatchNormNet(nInputs, nOutputs)},
+	} {
+		net := test.net
+		net.SetSparseInference(true)
+		if !net.SparseInference() {
+			t.Errorf("%v: sparse inference not set", test.name)
+		}
+		if net.sparseIdx != nil {
+			t.Errorf("%v: sparse layers without pruning", test.name)
+		}
+		if err := net.PruneFraction(0.7); err != nil {
+			t.Fatal(err)
+		}
+		if net.sparseIdx == nil {
+			t.Fatalf("%v: no sparse layers", test.name)
+		}
+		sparse := predictAll(net, inputs)
+		net.SetSparseInference(false)
+		if net.sparseIdx != nil {
+			t.Errorf("%v: sparse layers after turning sparse inference off", test.name)
+		}
+		dense := predictAll(net, inputs)
+		if !predictionsMatch(sparse, dense, 1e-12) {
+			t.Errorf("%v: sparse predictions do not match", test.name)
+		}
+	}
+}
+
+func TestPruneSerialize(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	inputs := RandomSliceOfSlice(10, nInputs)
+	for _, test := range []struct {
+		name string
+		net  *Net
+	}{
+		{"not shared", newPruneNet(nInputs, nOutputs)},
+		{"shared", newSharedNet(t)},
+	} {
+		net := test.net
+		// The wrapped neuron is not registered
+		net.layers[1].Neurons[1] = &TanhNeuron
+		net.PruneThreshold(0.4)
+		if net.NumPruned() == 0 {
+			t.Fatalf("%v: nothing pruned", test.name)
+		}
+		pred := predictAll(net, inputs)
+
+		b, err := json.Marshal(net)
+		if err != nil {
+			t.Fatalf("%v: error marshaling: %v", test.name, err)
+		}
+		net2 := &Net{}
+		if err := json.Unmarshal(b, net2); err != nil {
+			t.Fatalf("%v: error unmarshaling: %v", test.name, err)
+		}
+		b, err = net.GobEncode()
+		if err != nil {
+			t.Fatalf("%v: error gob encoding: %v", test.name, err)
+		}
+		net3 := &Net{}
+		if err := net3.GobDecode(b); err != nil {
+			t.Fatalf("%v: error gob decoding: %v", test.name, err)
+		}
+		for name, n := range map[string]*Net{"JSON": net2, "gob": net3} {
+			if !intsEqual(n.prunedIndices(), net.prunedIndices()) {
+				t.Errorf("%v: pruned weights don't match after %v", test.name, name)
+			}
+			if (n.shared == nil) != (net.shared == nil) {
+				t.Errorf("%v: shared parameters changed after %v", test.name, name)
+			}
+			if !predictionsMatch(pred, predictAll(n, inputs), 1e-14) {
+				t.Errorf("%v: predictions don't match after %v", test.name, name)
+			}
+		}
+	}
+}
+
+func TestSurgeryPruned(t *testing.T) {
+	net := newPruneNet(3, 2)
+	net.SetSparseInference(true)
+	net.PruneThreshold(0.3)
+	nPruned := net.NumPruned()
+	nParameters := net.TotalNumParameters()
+	if err := net.AddNeurons(0, nil, &TanhNeuron); err == nil {
+		t.Errorf("No error changing the structure of a pruned net")
+	}
+	if err := net.RemoveInput(0); err == nil {
+		t.Errorf("No error removing an input of a pruned net")
+	}
+	if net.NumPruned() != nPruned || net.TotalNumParameters() != nParameters {
+		t.Errorf("Pruned net changed by a failed change of the structure")
+	}
+
+	net.Unprune()
+	if err := net.AddNeurons(0, nil, &TanhNeuron); err != nil {
+		t.Fatal(err)
+	}
+	if net.sparseIdx != nil {
+		t.Errorf("Sparse inference memory not cleared by changing the structure")
+	}
+	if !net.SparseInference() {
+		t.Errorf("Sparse inference turned off by changing the structure")
+	}
+}
+
+func BenchmarkPredictPrunedDense(b *testing.B) {
+	benchmarkPredictPruned(b, false)
+}
+
+func BenchmarkPredictPrunedSparse(b *testing.B) {
+	benchmarkPredictPruned(b, true)
+}
+
+func benchmarkPredictPruned(b *testing.B, sparse bool) {
+	net := DefaultRegression(10, 3, 2, 50)
+	net.PruneFraction(0.9)
+	net.SetSparseInference(sparse)
+	input := RandomSliceOfSlice(1, net.Inputs())[0]
+	pred := make([]float64, net.Outputs())
+	tmp := net.NewPredictTmpMemory()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Predict(input, net, pred, tmp.combinations, tmp.outputs)
+	}
+}
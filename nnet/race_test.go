@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package nnet
+
+// raceEnabled is true if the tests are run with the race detector, which makes
+// sync.Pool drop items
+const raceEnabled = true
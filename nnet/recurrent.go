@@ -0,0 +1,427 @@
+package nnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/btracey/nnet/common"
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/scale"
+
+	"github.com/gonum/floats"
+)
+
+// RecurrentNet is a recurrent network for sequences. At every time step, the
+// first layer reads the inputs at that time step followed by the context, which
+// is the outputs of the context layer at the previous time step (zero at the
+// first time step). The outputs of the last layer are the predictions at that time step.
+// An Elman network has a hidden layer as the context layer, and a Jordan network
+// has the output layer as the context layer.
+//
+// Every time step is computed with the same sequential Net, whose inputs are the
+// inputs followed by the context, so the parameters have the same layout as that Net
+// and a RecurrentNet can be trained in the same way. Gradients are computed with
+// backpropagation through time. If Truncation is greater than zero, the sequence is
+// split into windows of that many steps, and the gradient is not propagated through
+// the context between windows.
+type RecurrentNet struct {
+	Losser       loss.Losser
+	InputScaler  scale.Scaler
+	OutputScaler scale.Scaler
+	Truncation   int
+	Reduction    Reduction // How ParLossDeriv sums the results of the chunks
+
+	net          *Net // The net for one time step
+	nInputs      int
+	contextLayer int
+}
+
+// NewRecurrentNet creates a new recurrent net where the outputs of layer contextLayer
+// are fed back into the first layer at the next time step. Every neuron is randomized
+// on its own as in RandomizeParameters.
+func NewRecurrentNet(nInputs int, layers []Layer, contextLayer int) (*RecurrentNet, error) {
+	r, err := newRecurrentNet(nInputs, layers, contextLayer)
+	if err != nil {
+		return nil, err
+	}
+	r.RandomizeParameters()
+	return r, nil
+}
+
+// NewRecurrentNetInit is NewRecurrentNet with the parameters set by init, using src
+// as the source of randomness (see Initialize).
+func NewRecurrentNetInit(nInputs int, layers []Layer, contextLayer int, init Initializer, src rand.Source) (*RecurrentNet, error) {
+	r, err := newRecurrentNet(nInputs, layers, contextLayer)
+	if err != nil {
+		return nil, err
+	}
+	err = r.Initialize(init, src)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewElman creates a recurrent net where the outputs of the first layer are the context
+func NewElman(nInputs int, layers []Layer) *RecurrentNet {
+	r, err := NewRecurrentNet(nInputs, layers, 0)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// NewJordan creates a recurrent net where the outputs of the net are the context
+func NewJordan(nInputs int, layers []Layer) *RecurrentNet {
+	r, err := NewRecurrentNet(nInputs, layers, len(layers)-1)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// newRecurrentNet checks the layers and makes the net for one time step. The
+// parameters are all zero
+func newRecurrentNet(nInputs int, layers []Layer, contextLayer int) (*RecurrentNet, error) {
+	if len(layers) == 0 {
+		return nil, errors.New("nnet: recurrent net must have at least one layer")
+	}
+	if contextLayer < 0 || contextLayer >= len(layers) {
+		return nil, fmt.Errorf("nnet: context layer %v out of range", contextLayer)
+	}
+	if hasBatchNorm(layers) {
+		return nil, errors.New("nnet: batch normalization not supported in a recurrent net")
+	}
+	net := &Net{
+		layers:  layers,
+		nInputs: nInputs + len(layers[contextLayer].Neurons),
+	}
+	net.new()
+	return &RecurrentNet{
+		net:          net,
+		nInputs:      nInputs,
+		contextLayer: contextLayer,
+	}, nil
+}
+
+// Inputs returns the number of inputs at each time step
+func (r *RecurrentNet) Inputs() int {
+	return r.nInputs
+}
+
+// Outputs returns the number of outputs at each time step
+func (r *RecurrentNet) Outputs() int {
+	return r.net.nOutputs
+}
+
+// ContextLayer returns the index of the layer whose outputs are fed back
+func (r *RecurrentNet) ContextLayer() int {
+	return r.contextLayer
+}
+
+// nContext returns the length of the context
+func (r *RecurrentNet) nContext() int {
+	return r.net.nInputs - r.nInputs
+}
+
+// TotalNumParameters returns the total number of parameters in the net
+func (r *RecurrentNet) TotalNumParameters() int {
+	return r.net.TotalNumParameters()
+}
+
+// RandomizeParameters randomizes the parameters of the net as Net.RandomizeParameters
+func (r *RecurrentNet) RandomizeParameters() {
+	r.net.RandomizeParameters()
+}
+
+// Initialize sets the parameters of the net with the initializer as Net.Initialize.
+// The initializer sees the net for one time step, whose first layer reads the
+// inputs and the context.
+func (r *RecurrentNet) Initialize(init Initializer, src rand.Source) error {
+	return r.net.Initialize(init, src)
+}
+
+// ParametersSlice copies the parameters into dst
+func (r *RecurrentNet) ParametersSlice(dst []float64) {
+	r.net.ParametersSlice(dst)
+}
+
+// SetParametersSlice sets the paramaters to the values in src
+func (r *RecurrentNet) SetParametersSlice(src []float64) {
+	r.net.SetParametersSlice(src)
+}
+
+// NewPerParameterMemory creates new memory with one value per parameter in
+// the net. Indexed by layer then neuron then parameter
+func (r *RecurrentNet) NewPerParameterMemory() (tiered [][][]float64, flat []float64) {
+	return r.net.NewPerParameterMemory()
+}
+
+// recurrentStep is the memory for one time step
+type recurrentStep struct {
+	firstInput   []float64 // The input and the context
+	combinations [][]float64
+	outputs      [][]float64
+}
+
+// RecurrentTmpMemory is the temporary memory for predicting and computing derivatives
+// of a sequence. It grows as needed for longer sequences.
+type RecurrentTmpMemory struct {
+	steps            []*recurrentStep
+	derivTmp         *PredLossDerivTmpMemory // The combinations and outputs are those of the current step
+	dLossDFirstInput []float64
+	context          []float64
+	dLossDParamTmp   [][][]float64
+	dLossDParamSeq   [][][]float64 // The derivative of one sequence for SeqLossDeriv
+	preds            [][]float64   // The predictions at each time step for SeqLossDeriv
+}
+
+func (r *RecurrentNet) NewRecurrentTmpMemory() *RecurrentTmpMemory {
+	tmp := &RecurrentTmpMemory{
+		derivTmp:         r.net.NewPredLossDerivTmpMemory(),
+		dLossDFirstInput: make([]float64, r.net.nInputs),
+		context:          make([]float64, r.nContext()),
+	}
+	tmp.dLossDParamTmp, _ = r.NewPerParameterMemory()
+	tmp.dLossDParamSeq, _ = r.NewPerParameterMemory()
+	return tmp
+}
+
+// grow makes sure there is memory for at least n time steps
+func (r *RecurrentNet) grow(tmp *RecurrentTmpMemory, n int) {
+	for len(tmp.steps) < n {
+		tmp.steps = append(tmp.steps, &recurrentStep{
+			firstInput:   make([]float64, r.net.nInputs),
+			combinations: r.net.NewPerNeuronMemory(),
+			outputs:      r.net.NewPerNeuronMemory(),
+		})
+		tmp.preds = append(tmp.preds, make([]float64, r.Outputs()))
+	}
+}
+
+// RecurrentPredict feeds the sequence of inputs through the net starting from a zero
+// context, and stores the prediction at each time step into predOutputs. Assumes
+// the inputs are appropriately scaled.
+func RecurrentPredict(inputs [][]float64, r *RecurrentNet, predOutputs [][]float64, tmp *RecurrentTmpMemory) {
+	r.grow(tmp, len(inputs))
+	for i := range tmp.context {
+		tmp.context[i] = 0
+	}
+	for t, input := range inputs {
+		s := tmp.steps[t]
+		copy(s.firstInput, input)
+		copy(s.firstInput[r.nInputs:], tmp.context)
+		forward(s.firstInput, r.net, predOutputs[t], s.combinations, s.outputs, nil)
+		copy(tmp.context, s.outputs[r.contextLayer])
+	}
+}
+
+// RecurrentLossDeriv predicts the sequence, computes the sum of the losses at every
+// time step multiplied by the weight, and computes the derivative of the loss with respect
+// to the parameters using (truncated) backpropagation through time. The derivative
+// is stored into dLossDParam. predOutputs stores the prediction at each time step.
+func RecurrentLossDeriv(inputs, truths [][]float64, weight float64, r *RecurrentNet, tmp *RecurrentTmpMemory, predOutputs [][]float64, dLossDParam [][][]float64) (loss float64) {
+	RecurrentPredict(inputs, r, predOutputs, tmp)
+	zeroParameterMemory(dLossDParam)
+
+	net := r.net
+	d := tmp.derivTmp
+	nLayers := len(net.layers)
+	// carry is the derivative of the loss with respect to the context that
+	// flows back from the next time step
+	carry := tmp.context
+	for i := range carry {
+		carry[i] = 0
+	}
+	for t := len(inputs) - 1; t >= 0; t-- {
+		s := tmp.steps[t]
+		d.combinations = s.combinations
+		d.outputs = s.outputs
+		loss += weight * r.Losser.LossAndDeriv(predOutputs[t], truths[t], d.dLossDPred)
+		for i, val := range d.dLossDPred {
+			d.dLossDOutput[nLayers-1][i] = weight * val
+		}
+		for l := nLayers - 1; l >= 0; l-- {
+			if l == r.contextLayer {
+				floats.Add(d.dLossDOutput[l], carry)
+			}
+			derivativeLayer(l, 0, s.firstInput, s.outputs, net, d, tmp.dLossDParamTmp, tmp.dLossDFirstInput)
+		}
+		net.addParameterMemory(dLossDParam, tmp.dLossDParamTmp)
+		copy(carry, tmp.dLossDFirstInput[r.nInputs:])
+		// Don't propagate the gradient past the start of the window
+		if r.Truncation > 0 && t%r.Truncation == 0 {
+			for i := range carry {
+				carry[i] = 0
+			}
+		}
+	}
+	return loss
+}
+
+// SeqLossDeriv computes the sum of the losses and the derivatives over all of the
+// sequences. The derivative is stored into dLossDParam
+func (r *RecurrentNet) SeqLossDeriv(inputs, truths [][][]float64, weights []float64, dLossDParam [][][]float64) (loss float64) {
+	return r.seqLossDeriv(inputs, truths, weights, dLossDParam, r.NewRecurrentTmpMemory())
+}
+
+// seqLossDeriv is SeqLossDeriv with the temporary memory tmp
+func (r *RecurrentNet) seqLossDeriv(inputs, truths [][][]float64, weights []float64, dLossDParam [][][]float64, tmp *RecurrentTmpMemory) (loss float64) {
+	zeroParameterMemory(dLossDParam)
+	for i := range inputs {
+		r.grow(tmp, len(inputs[i]))
+		loss += RecurrentLossDeriv(inputs[i], truths[i], weights[i], r, tmp, tmp.preds[:len(inputs[i])], tmp.dLossDParamSeq)
+		r.net.addParameterMemory(dLossDParam, tmp.dLossDParamSeq)
+	}
+	return loss
+}
+
+// ParLossDeriv computes the sum of the losses and the derivatives over all of the
+// sequences in parallel, with chunkSize sequences per chunk. The chunks are summed
+// as set by r.Reduction, as in the ParLossDeriv function.
+func (r *RecurrentNet) ParLossDeriv(inputs, truths [][][]float64, weights []float64, dLossDParam [][][]float64, chunkSize int) (loss float64) {
+	return r.net.parChunks(numChunks(len(inputs), chunkSize), r.Reduction, dLossDParam, func() func(c int, dLossDParam [][][]float64) float64 {
+		tmp := r.NewRecurrentTmpMemory()
+		return func(c int, dLossDParam [][][]float64) float64 {
+			start, end := chunkBounds(c, chunkSize, len(inputs))
+			return r.seqLossDeriv(inputs[start:end], truths[start:end], weights[start:end], dLossDParam, tmp)
+		}
+	})
+}
+
+// PredictSequence predicts the outputs at every step of the sequence of inputs,
+// starting from a zero context. The inputs are not modified.
+func (r *RecurrentNet) PredictSequence(inputs [][]float64) (preds [][]float64, err error) {
+	if !r.InputScaler.IsScaled() {
+		return nil, errors.New("Scale must be set before calling predict")
+	}
+	if !r.OutputScaler.IsScaled() {
+		return nil, errors.New("Scale must be set before calling predict")
+	}
+	scaled := make([][]float64, len(inputs))
+	preds = make([][]float64, len(inputs))
+	for i, input := range inputs {
+		if len(input) != r.nInputs {
+			return nil, InputMismatch{Provided: len(input), Expected: r.nInputs}
+		}
+		scaled[i] = make([]float64, len(input))
+		copy(scaled[i], input)
+		preds[i] = make([]float64, r.Outputs())
+	}
+	err = scale.ScaleData(r.InputScaler, scaled)
+	if err != nil {
+		return nil, err
+	}
+	RecurrentPredict(scaled, r, preds, r.NewRecurrentTmpMemory())
+	err = scale.UnscaleData(r.OutputScaler, preds)
+	if err != nil {
+		return nil, err
+	}
+	return preds, nil
+}
+
+type recurrentNetMarshal struct {
+	Losser                 *common.InterfaceMarshaler
+	InputScaler            *common.InterfaceMarshaler
+	OutputScaler           *common.InterfaceMarshaler
+	NumInputs              int
+	NumOutputs             int
+	ContextLayer           int
+	Truncation             int
+	TotalNumParameters     int
+	NumParametersPerNeuron [][]int
+	ParameterIndex         [][]int
+	Parameters             []float64
+	Layers                 []Layer
+	PredictionCheck        []sequencePredictionCheck
+}
+
+// sequencePredictionCheck is a predictionCheck for a sequence
+type sequencePredictionCheck struct {
+	Inputs  [][]float64
+	Outputs [][]float64
+}
+
+// sequenceCheckLength is the length of the sequences of the prediction check
+const sequenceCheckLength = 3
+
+// MarshalJSON saves the recurrent net in the same format as Net, with the
+// addition of the context layer and the truncation
+func (r *RecurrentNet) MarshalJSON() ([]byte, error) {
+	predChecks := make([]sequencePredictionCheck, nPredictionCheck)
+	for i := range predChecks {
+		inputs := make([][]float64, sequenceCheckLength)
+		for t := range inputs {
+			inputs[t] = make([]float64, r.nInputs)
+			for j := range inputs[t] {
+				inputs[t][j] = rand.Float64()
+			}
+			err := r.InputScaler.Unscale(inputs[t])
+			if err != nil {
+				return nil, err
+			}
+		}
+		outputs, err := r.PredictSequence(inputs)
+		if err != nil {
+			return nil, err
+		}
+		predChecks[i].Inputs = inputs
+		predChecks[i].Outputs = outputs
+	}
+	return json.Marshal(&recurrentNetMarshal{
+		Losser:                 &common.InterfaceMarshaler{I: r.Losser},
+		InputScaler:            &common.InterfaceMarshaler{I: r.InputScaler},
+		OutputScaler:           &common.InterfaceMarshaler{I: r.OutputScaler},
+		NumInputs:              r.nInputs,
+		NumOutputs:             r.Outputs(),
+		ContextLayer:           r.contextLayer,
+		Truncation:             r.Truncation,
+		TotalNumParameters:     r.TotalNumParameters(),
+		NumParametersPerNeuron: r.net.nParameters,
+		ParameterIndex:         r.net.parameterIdx,
+		Parameters:             r.net.parametersSlice,
+		Layers:                 r.net.layers,
+		PredictionCheck:        predChecks,
+	})
+}
+
+// UnmarshalJSON unmarshals the recurrent net, and returns an error if the
+// predictions of the unmarshaled net do not match the prediction check
+func (r *RecurrentNet) UnmarshalJSON(data []byte) error {
+	v := &recurrentNetMarshal{}
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("nnet/recurrentnet/unmarshaljson: error unmarshaling data: " + err.Error())
+	}
+	r2, err := newRecurrentNet(v.NumInputs, v.Layers, v.ContextLayer)
+	if err != nil {
+		return err
+	}
+	if r2.TotalNumParameters() != len(v.Parameters) {
+		return errors.New("nnet/recurrentnet/unmarshaljson: number of parameters does not match the layers")
+	}
+	*r = *r2
+	r.Losser = v.Losser.I.(loss.Losser)
+	r.InputScaler = v.InputScaler.I.(scale.Scaler)
+	r.OutputScaler = v.OutputScaler.I.(scale.Scaler)
+	r.Truncation = v.Truncation
+	r.SetParametersSlice(v.Parameters)
+
+	for _, check := range v.PredictionCheck {
+		preds, err := r.PredictSequence(check.Inputs)
+		if err != nil {
+			return err
+		}
+		if len(preds) != len(check.Outputs) {
+			return errors.New("nnet/recurrentnet/unmarshaljson: prediction check failed")
+		}
+		for t := range preds {
+			if !predictionMatches(preds[t], check.Outputs[t]) {
+				return errors.New("nnet/recurrentnet/unmarshaljson: prediction check failed")
+			}
+		}
+	}
+	return nil
+}
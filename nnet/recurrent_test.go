@@ -0,0 +1,276 @@
+package nnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/scale"
+	"github.com/gonum/floats"
+)
+
+func recurrentLayers(nOutputs int) []Layer {
+	layers := make([]Layer, 3)
+	layers[0].Neurons = []Neuron{&TanhNeuron, &TanhNeuron, &SigmoidNeuron, perNeuronSumNeuron{&TanhNeuron}}
+	layers[1].Neurons = []Neuron{&TanhNeuron, &TanhNeuron, &TanhNeuron}
+	layers[2].Neurons = make([]Neuron, nOutputs)
+	for j := range layers[2].Neurons {
+		layers[2].Neurons[j] = &LinearNeuron
+	}
+	return layers
+}
+
+func randomSequences(nSequences, length, dim int) [][][]float64 {
+	seqs := make([][][]float64, nSequences)
+	for i := range seqs {
+		seqs[i] = RandomSliceOfSlice(length+i, dim)
+	}
+	return seqs
+}
+
+// recurrentFDStep is the step of the finite differences of the recurrent nets. The
+// losses summed over the time steps are large, so the step is larger than netFDStep
+// to keep the rounding error of the finite differences below the tolerance.
+const recurrentFDStep = 1e-5
+
+func TestRecurrentDeriv(t *testing.T) {
+	nInputs := 2
+	nOutputs := 2
+	for _, contextLayer := range []int{0, 1, 2} {
+		r, err := NewRecurrentNet(nInputs, recurrentLayers(nOutputs), contextLayer)
+		if err != nil {
+			t.Fatalf("Error creating recurrent net: %v", err)
+		}
+		r.Losser = loss.SquaredDistance{}
+
+		inputs := randomSequences(3, 5, nInputs)
+		truths := randomSequences(3, 5, nOutputs)
+		weights := RandomWeights(3)
+
+		dLossDParam, dLossFlat := r.NewPerParameterMemory()
+		r.SeqLossDeriv(inputs, truths, weights, dLossDParam)
+
+		params := make([]float64, r.TotalNumParameters())
+		r.ParametersSlice(params)
+		fdDLossFlat := make([]float64, len(params))
+		d, _ := r.NewPerParameterMemory()
+		for i := range params {
+			params[i] += recurrentFDStep
+			r.SetParametersSlice(params)
+			loss1 := r.SeqLossDeriv(inputs, truths, weights, d)
+			params[i] -= 2 * recurrentFDStep
+			r.SetParametersSlice(params)
+			loss2 := r.SeqLossDeriv(inputs, truths, weights, d)
+			params[i] += recurrentFDStep
+			r.SetParametersSlice(params)
+			fdDLossFlat[i] = (loss1 - loss2) / (2 * recurrentFDStep)
+		}
+		for i := range params {
+			if !floats.EqualWithinAbsOrRel(dLossFlat[i], fdDLossFlat[i], 1e-6, 1e-6) {
+				t.Errorf("Finite difference doesn't match derivative for context layer %v", contextLayer)
+				for i := range dLossFlat {
+					fmt.Println(i, dLossFlat[i], fdDLossFlat[i], dLossFlat[i]-fdDLossFlat[i])
+				}
+				return
+			}
+		}
+
+		// Parallel should match sequential
+		dLossDParamPar, dLossParFlat := r.NewPerParameterMemory()
+		r.ParLossDeriv(inputs, truths, weights, dLossDParamPar, 2)
+		if !floats.EqualApprox(dLossFlat, dLossParFlat, 1e-12) {
+			t.Errorf("Par and seq don't match")
+		}
+
+		// The ordered sum does not depend on GOMAXPROCS
+		r.Reduction = Ordered
+		var want []float64
+		for _, procs := range []int{1, 2, 8} {
+			old := runtime.GOMAXPROCS(procs)
+			r.ParLossDeriv(inputs, truths, weights, dLossDParamPar, 1)
+			runtime.GOMAXPROCS(old)
+			if !floats.EqualApprox(dLossFlat, dLossParFlat, 1e-12) {
+				t.Errorf("Ordered par and seq don't match")
+			}
+			if want == nil {
+				want = append([]float64(nil), dLossParFlat...)
+			} else if !floats.Equal(dLossParFlat, want) {
+				t.Errorf("Ordered derivative changes with GOMAXPROCS = %v", procs)
+			}
+		}
+		r.Reduction = Unordered
+
+		// Truncation of at least the sequence length should be the same as no truncation
+		truncated, truncatedFlat := r.NewPerParameterMemory()
+		r.Truncation = 100
+		r.SeqLossDeriv(inputs, truths, weights, truncated)
+		if !floats.EqualApprox(dLossFlat, truncatedFlat, 1e-10) {
+			t.Errorf("Long truncation doesn't match full backpropagation")
+		}
+		r.Truncation = 2
+		r.SeqLossDeriv(inputs, truths, weights, truncated)
+		if floats.EqualApprox(dLossFlat, truncatedFlat, 1e-6) {
+			t.Errorf("Truncation should change the derivative")
+		}
+	}
+}
+
+// windowedLoss computes the loss of the sequences where every window of truncation
+// steps starts from the fixed context in contexts instead of the context computed
+// by the previous window
+func windowedLoss(r *RecurrentNet, inputs, truths [][][]float64, weights []float64, truncation int, contexts [][][]float64) float64 {
+	combinations := r.net.NewPerNeuronMemory()
+	outputs := r.net.NewPerNeuronMemory()
+	pred := make([]float64, r.Outputs())
+	var loss float64
+	for i := range inputs {
+		var context []float64
+		for t := range inputs[i] {
+			if t%truncation == 0 {
+				context = contexts[i][t/truncation]
+			}
+			input := append(append([]float64{}, inputs[i][t]...), context...)
+			forward(input, r.net, pred, combinations, outputs, nil)
+			loss += weights[i] * r.Losser.LossAndDeriv(pred, truths[i][t], make([]float64, len(pred)))
+			context = append([]float64{}, outputs[r.contextLayer]...)
+		}
+	}
+	return loss
+}
+
+func TestRecurrentTruncation(t *testing.T) {
+	nInputs := 2
+	nOutputs := 2
+	truncation := 2
+	for _, contextLayer := range []int{0, 1, 2} {
+		r, err := NewRecurrentNet(nInputs, recurrentLayers(nOutputs), contextLayer)
+		if err != nil {
+			t.Fatalf("Error creating recurrent net: %v", err)
+		}
+		r.Losser = loss.SquaredDistance{}
+		r.Truncation = truncation
+
+		inputs := randomSequences(3, 5, nInputs)
+		truths := randomSequences(3, 5, nOutputs)
+		weights := RandomWeights(3)
+
+		// The context at the start of each window from the full forward pass
+		contexts := make([][][]float64, len(inputs))
+		tmp := r.NewRecurrentTmpMemory()
+		for i := range inputs {
+			preds := RandomSliceOfSlice(len(inputs[i]), nOutputs)
+			RecurrentPredict(inputs[i], r, preds, tmp)
+			for a := 0; a < len(inputs[i]); a += truncation {
+				contexts[i] = append(contexts[i], append([]float64{}, tmp.steps[a].firstInput[nInputs:]...))
+			}
+		}
+
+		dLossDParam, dLossFlat := r.NewPerParameterMemory()
+		lossTrunc := r.SeqLossDeriv(inputs, truths, weights, dLossDParam)
+		lossWindow := windowedLoss(r, inputs, truths, weights, truncation, contexts)
+		if !floats.EqualWithinAbsOrRel(lossTrunc, lossWindow, 1e-12, 1e-12) {
+			t.Errorf("Loss mismatch. Truncated %v, windowed %v", lossTrunc, lossWindow)
+		}
+
+		// The truncated derivative is the derivative of the windowed loss with the
+		// contexts held fixed
+		params := make([]float64, r.TotalNumParameters())
+		r.ParametersSlice(params)
+		for i := range params {
+			params[i] += recurrentFDStep
+			r.SetParametersSlice(params)
+			loss1 := windowedLoss(r, inputs, truths, weights, truncation, contexts)
+			params[i] -= 2 * recurrentFDStep
+			r.SetParametersSlice(params)
+			loss2 := windowedLoss(r, inputs, truths, weights, truncation, contexts)
+			params[i] += recurrentFDStep
+			r.SetParametersSlice(params)
+			fd := (loss1 - loss2) / (2 * recurrentFDStep)
+			if !floats.EqualWithinAbsOrRel(dLossFlat[i], fd, 1e-6, 1e-6) {
+				t.Errorf("Truncated derivative doesn't match windowed reference for context layer %v, parameter %v. Got %v, want %v", contextLayer, i, dLossFlat[i], fd)
+			}
+		}
+	}
+}
+
+func TestRecurrentInit(t *testing.T) {
+	nInputs := 2
+	nOutputs := 2
+	init := Xavier{}
+	r1, err := NewRecurrentNetInit(nInputs, recurrentLayers(nOutputs), 1, init, rand.NewSource(1))
+	if err != nil {
+		t.Fatalf("Error creating recurrent net: %v", err)
+	}
+	r2, err := NewRecurrentNetInit(nInputs, recurrentLayers(nOutputs), 1, init, rand.NewSource(1))
+	if err != nil {
+		t.Fatalf("Error creating recurrent net: %v", err)
+	}
+	p1 := make([]float64, r1.TotalNumParameters())
+	r1.ParametersSlice(p1)
+	p2 := make([]float64, r2.TotalNumParameters())
+	r2.ParametersSlice(p2)
+	if !floats.Equal(p1, p2) {
+		t.Errorf("Same seed gives different parameters")
+	}
+}
+
+func TestRecurrentJSON(t *testing.T) {
+	nInputs := 2
+	nOutputs := 3
+	layers := recurrentLayers(nOutputs)
+	layers[0].Neurons[3] = &LinearTanhNeuron
+	r := NewJordan(nInputs, layers)
+	r.Losser = loss.SquaredDistance{}
+	r.Truncation = 4
+	r.InputScaler = &scale.Normal{}
+	r.InputScaler.SetScale(RandomData(nInputs, 50))
+	r.OutputScaler = &scale.Linear{}
+	r.OutputScaler.SetScale(RandomData(nOutputs, 50))
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("Error marshaling: %v", err)
+	}
+	r2 := &RecurrentNet{}
+	err = json.Unmarshal(data, r2)
+	if err != nil {
+		t.Fatalf("Error unmarshaling: %v", err)
+	}
+	if !reflect.DeepEqual(r, r2) {
+		t.Errorf("RecurrentNet not equal after encoding and decoding")
+	}
+
+	seq := RandomData(nInputs, 6)
+	pred1, err := r.PredictSequence(seq)
+	if err != nil {
+		t.Fatalf("Error predicting: %v", err)
+	}
+	pred2, err := r2.PredictSequence(seq)
+	if err != nil {
+		t.Fatalf("Error predicting: %v", err)
+	}
+	for i := range pred1 {
+		if !floats.Equal(pred1[i], pred2[i]) {
+			t.Errorf("Predictions don't match after encoding and decoding")
+		}
+	}
+	// The context should change the predictions for identical inputs
+	copy(seq[1], seq[0])
+	pred1, _ = r.PredictSequence(seq)
+	if floats.Equal(pred1[0], pred1[1]) {
+		t.Errorf("Context has no effect on the predictions")
+	}
+
+	// Changing a parameter should cause the prediction check to fail
+	v := &recurrentNetMarshal{}
+	json.Unmarshal(data, v)
+	v.Parameters[0] += 1
+	data, _ = json.Marshal(v)
+	if json.Unmarshal(data, &RecurrentNet{}) == nil {
+		t.Errorf("Prediction check should fail for modified parameters")
+	}
+}
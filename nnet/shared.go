@@ -0,0 +1,209 @@
+package nnet
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Neurons of a net can share one block of parameters, for example to tie the
+// weights of symmetric parts of a net. The shared parameters are stored once, so
+// they appear once in the parameters slice and TotalNumParameters counts them once.
+// The derivative of the loss with respect to a shared block is the sum of the
+// derivatives through all of the neurons which use it. In memory from
+// NewPerParameterMemory, the entries of neurons which share parameters are the
+// same slice. A shared block is frozen if any of the neurons which use it are frozen.
+
+// NeuronIndex identifies a neuron of a net by its layer and its position in the layer
+type NeuronIndex struct {
+	Layer  int
+	Neuron int
+}
+
+// ShareParameters makes the neurons use one block of parameters. All of the neurons
+// must have the same number of parameters. Neurons which already share parameters
+// with one of the neurons also join the block. The block starts with the current
+// parameters of the first neuron, and the other parameters of the net are not changed.
+// The parameters of a net with pruned weights cannot be shared (see Unprune).
+//
+// The layout of the parameters changes, so memory from NewPerParameterMemory (and
+// anything which holds it, such as the memory for ParLossDeriv) must be allocated again.
+func (net *Net) ShareParameters(neurons ...NeuronIndex) error {
+	if len(neurons) < 2 {
+		return errors.New("nnet: at least two neurons are needed to share parameters")
+	}
+	if net.pruned != nil {
+		return errors.New("nnet: cannot share the parameters of a net with pruned weights (see Unprune)")
+	}
+	for _, neuron := range neurons {
+		if neuron.Layer < 0 || neuron.Layer >= len(net.layers) {
+			return fmt.Errorf("nnet: layer %v out of range", neuron.Layer)
+		}
+		if neuron.Neuron < 0 || neuron.Neuron >= len(net.layers[neuron.Layer].Neurons) {
+			return fmt.Errorf("nnet: neuron %v out of range for layer %v", neuron.Neuron, neuron.Layer)
+		}
+		if net.nParameters[neuron.Layer][neuron.Neuron] != net.nParameters[neurons[0].Layer][neurons[0].Neuron] {
+			return fmt.Errorf("nnet: neuron %v of layer %v does not have the same number of parameters as neuron %v of layer %v",
+				neuron.Neuron, neuron.Layer, neurons[0].Neuron, neurons[0].Layer)
+		}
+	}
+
+	// Merge with the groups which contain one of the neurons
+	group := make([]NeuronIndex, 0, len(neurons))
+	add := func(n NeuronIndex) {
+		for _, m := range group {
+			if m == n {
+				return
+			}
+		}
+		group = append(group, n)
+	}
+	for _, n := range neurons {
+		add(n)
+	}
+	var shared [][]NeuronIndex
+	for _, g := range net.shared {
+		var overlap bool
+		for _, n := range g {
+			for _, m := range neurons {
+				if n == m {
+					overlap = true
+				}
+			}
+		}
+		if !overlap {
+			shared = append(shared, g)
+			continue
+		}
+		for _, n := range g {
+			add(n)
+		}
+	}
+	shared = append(shared, group)
+
+	// Lay out the parameters again, and copy over the old values. The first neuron
+	// is copied last so the block has its parameters
+	oldParameters := net.parameters
+	net.shared = shared
+	net.new()
+	for i := range oldParameters {
+		for j := range oldParameters[i] {
+			copy(net.parameters[i][j], oldParameters[i][j])
+		}
+	}
+	first := neurons[0]
+	copy(net.parameters[first.Layer][first.Neuron], oldParameters[first.Layer][first.Neuron])
+	return nil
+}
+
+// SharedParameters returns the groups of neurons which share parameters
+func (net *Net) SharedParameters() [][]NeuronIndex {
+	shared := make([][]NeuronIndex, len(net.shared))
+	for i, g := range net.shared {
+		shared[i] = append([]NeuronIndex(nil), g...)
+	}
+	return shared
+}
+
+// sharedLayout finds the starting index of the parameters of each entry given the
+// number of parameters of each entry. The entries of the neurons in each of the
+// shared groups have the same starting index, and all of the other entries are
+// stored contiguously in order.
+func sharedLayout(nParameters [][]int, shared [][]NeuronIndex) (parameterIdx [][]int, totalNumParameters int) {
+	// group[i][j] is the index of the group of the entry, or -1 if it is not shared
+	group := make([][]int, len(nParameters))
+	for i := range group {
+		group[i] = make([]int, len(nParameters[i]))
+		for j := range group[i] {
+			group[i][j] = -1
+		}
+	}
+	for g, neurons := range shared {
+		for _, n := range neurons {
+			group[n.Layer][n.Neuron] = g
+		}
+	}
+	groupIdx := make([]int, len(shared))
+	for g := range groupIdx {
+		groupIdx[g] = -1
+	}
+	parameterIdx = make([][]int, len(nParameters))
+	for i := range nParameters {
+		parameterIdx[i] = make([]int, len(nParameters[i]))
+		for j, n := range nParameters[i] {
+			g := group[i][j]
+			if g != -1 && groupIdx[g] != -1 {
+				parameterIdx[i][j] = groupIdx[g]
+				continue
+			}
+			if g != -1 {
+				groupIdx[g] = totalNumParameters
+			}
+			parameterIdx[i][j] = totalNumParameters
+			totalNumParameters += n
+		}
+	}
+	return parameterIdx, totalNumParameters
+}
+
+// aliasedEntries returns which entries share their parameters with an earlier
+// entry, or nil if no entries do
+func aliasedEntries(parameterIdx [][]int) [][]bool {
+	var found bool
+	seen := make(map[int]bool)
+	aliased := make([][]bool, len(parameterIdx))
+	for i := range parameterIdx {
+		aliased[i] = make([]bool, len(parameterIdx[i]))
+		for j, idx := range parameterIdx[i] {
+			if seen[idx] {
+				aliased[i][j] = true
+				found = true
+			}
+			seen[idx] = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return aliased
+}
+
+// newUntiedParameterMemory makes memory with one entry per neuron like NewPerParameterMemory,
+// but the entries of neurons which share parameters are separate. The derivatives are
+// computed in this memory and then summed into the shared blocks with sumShared.
+func (net *Net) newUntiedParameterMemory() (tiered [][][]float64, flat []float64) {
+	parameterIdx, total := sharedLayout(net.nParameters, nil)
+	return newParameterMemory(net.nParameters, parameterIdx, total)
+}
+
+// sumShared stores the sum of the entries of untied into the (shared) entries of dst
+func (net *Net) sumShared(untied, dst [][][]float64) {
+	for i := range dst {
+		for j := range dst[i] {
+			for k := range dst[i][j] {
+				dst[i][j][k] = 0
+			}
+		}
+	}
+	for i := range dst {
+		for j := range dst[i] {
+			for k, val := range untied[i][j] {
+				dst[i][j][k] += val
+			}
+		}
+	}
+}
+
+// addParameterMemory adds src into dst, where both have the layout of NewPerParameterMemory.
+// Shared blocks are only added once.
+func (net *Net) addParameterMemory(dst, src [][][]float64) {
+	for i, lay := range src {
+		for j, neur := range lay {
+			if net.aliased != nil && net.aliased[i][j] {
+				continue
+			}
+			for k, val := range neur {
+				dst[i][j][k] += val
+			}
+		}
+	}
+}
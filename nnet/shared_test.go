@@ -0,0 +1,228 @@
+package nnet
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/btracey/nnet/scale"
+	"github.com/gonum/floats"
+)
+
+// newSharedNet returns a net where neurons in the same layer and in different
+// layers share parameters
+func newSharedNet(t *testing.T) *Net {
+	nInputs := 4
+	layers := make([]Layer, 3)
+	layers[0].Neurons = []Neuron{&TanhNeuron, &TanhNeuron, &SigmoidNeuron, &TanhNeuron}
+	layers[1].Neurons = []Neuron{&TanhNeuron, perNeuronSumNeuron{&TanhNeuron}, &TanhNeuron}
+	layers[2].Neurons = []Neuron{&LinearNeuron, &LinearNeuron}
+	net := newTestNet(nInputs, layers, &scale.Normal{}, &scale.Normal{})
+	for _, neurons := range [][]NeuronIndex{
+		{{0, 0}, {1, 2}},
+		{{0, 1}, {0, 3}},
+		{{1, 1}, {0, 3}}, // Merges with the group above
+	} {
+		if err := net.ShareParameters(neurons...); err != nil {
+			t.Fatalf("Error sharing parameters: %v", err)
+		}
+	}
+	return net
+}
+
+func TestShareParameters(t *testing.T) {
+	net := NewNet(4, newSharedNet(t).layers)
+	total := net.TotalNumParameters()
+	first := append([]float64(nil), net.parameters[1][1]...)
+	unshared := append([]float64(nil), net.parameters[2][0]...)
+	for _, neurons := range [][]NeuronIndex{{{0, 1}, {0, 3}}, {{1, 1}, {0, 3}}} {
+		if err := net.ShareParameters(neurons...); err != nil {
+			t.Fatalf("Error sharing parameters: %v", err)
+		}
+	}
+	if net.TotalNumParameters() != total-2*5 {
+		t.Errorf("Wrong number of parameters. Want %v, got %v", total-2*5, net.TotalNumParameters())
+	}
+	want := [][]NeuronIndex{{{1, 1}, {0, 3}, {0, 1}}}
+	if !reflect.DeepEqual(net.SharedParameters(), want) {
+		t.Errorf("Wrong shared groups. Want %v, got %v", want, net.SharedParameters())
+	}
+	for _, n := range want[0] {
+		p := net.parameters[n.Layer][n.Neuron]
+		if &p[0] != &net.parameters[0][1][0] {
+			t.Errorf("Neuron %v does not share parameters", n)
+		}
+		if !floats.Equal(p, first) {
+			t.Errorf("Shared parameters do not start from the first neuron")
+		}
+	}
+	if !floats.Equal(net.parameters[2][0], unshared) {
+		t.Errorf("Parameters which are not shared changed")
+	}
+
+	if err := net.ShareParameters(NeuronIndex{0, 0}); err == nil {
+		t.Errorf("No error for one neuron")
+	}
+	if err := net.ShareParameters(NeuronIndex{0, 0}, NeuronIndex{2, 0}); err == nil {
+		t.Errorf("No error for a different number of parameters")
+	}
+	if err := net.ShareParameters(NeuronIndex{0, 0}, NeuronIndex{0, 4}); err == nil {
+		t.Errorf("No error for a neuron out of range")
+	}
+	if net.HessVecSupported() == nil {
+		t.Errorf("No error for Hessian-vector products with shared parameters")
+	}
+
+	// The pruning would be lost when the parameters are laid out again
+	net = newPruneNet(3, 2)
+	net.PruneThreshold(0.3)
+	nPruned := net.NumPruned()
+	if err := net.ShareParameters(NeuronIndex{0, 0}, NeuronIndex{0, 1}); err == nil {
+		t.Errorf("No error for a net with pruned weights")
+	}
+	if net.NumPruned() != nPruned || len(net.SharedParameters()) != 0 {
+		t.Errorf("Pruned net changed by a failed ShareParameters")
+	}
+	net.Unprune()
+	if err := net.ShareParameters(NeuronIndex{0, 0}, NeuronIndex{0, 1}); err != nil {
+		t.Errorf("Error sharing the parameters after Unprune: %v", err)
+	}
+}
+
+func TestSharedDeriv(t *testing.T) {
+	nSamples := 20
+	net := newSharedNet(t)
+	dropout := newDropoutNet(3, 2)
+	if err := dropout.ShareParameters(NeuronIndex{0, 0}, NeuronIndex{0, 3}); err != nil {
+		t.Fatalf("Error sharing parameters: %v", err)
+	}
+	if err := dropout.ShareParameters(NeuronIndex{1, 1}, NeuronIndex{1, 3}); err != nil {
+		t.Fatalf("Error sharing parameters: %v", err)
+	}
+	batch := newBatchNormNet(3, 2)
+	if err := batch.ShareParameters(NeuronIndex{0, 0}, NeuronIndex{0, 2}); err != nil {
+		t.Fatalf("Error sharing parameters: %v", err)
+	}
+	if err := batch.ShareParameters(NeuronIndex{1, 0}, NeuronIndex{1, 1}); err != nil {
+		t.Fatalf("Error sharing parameters: %v", err)
+	}
+	for _, test := range []struct {
+		name string
+		net  *Net
+	}{
+		{"shared", net},
+		{"shared dropout", dropout},
+		{"shared batch norm", batch},
+	} {
+		nInputs := test.net.Inputs()
+		inputs := RandomSliceOfSlice(nSamples, nInputs)
+		truths := RandomSliceOfSlice(nSamples, 2)
+		weights := RandomWeights(nSamples)
+		batchNormFD(t, test.net, inputs, truths, weights, test.name)
+	}
+
+	// PredLossDeriv and ParLossDeriv sum the derivatives in the same way
+	inputs := RandomSliceOfSlice(nSamples, net.Inputs())
+	truths := RandomSliceOfSlice(nSamples, 2)
+	weights := RandomWeights(nSamples)
+	dLossDParam, dLossFlat := net.NewPerParameterMemory()
+	seqLoss := SeqLossDeriv(inputs, truths, weights, net, dLossDParam, NewParLossDerivMemory(net))
+	d, dFlat := net.NewPerParameterMemory()
+	sum := make([]float64, len(dFlat))
+	tmp := net.NewPredLossDerivTmpMemory()
+	pred := make([]float64, net.Outputs())
+	var predLoss float64
+	for i := range inputs {
+		predLoss += PredLossDeriv(inputs[i], truths[i], weights[i], net, tmp, pred, d)
+		floats.Add(sum, dFlat)
+	}
+	if !floats.EqualWithinAbsOrRel(seqLoss, predLoss, 1e-12, 1e-12) || !floats.EqualApprox(sum, dLossFlat, 1e-10) {
+		t.Errorf("PredLossDeriv does not match SeqLossDeriv")
+	}
+	parLoss := ParLossDeriv(inputs, truths, weights, net, d, 3)
+	if !floats.EqualWithinAbsOrRel(seqLoss, parLoss, 1e-12, 1e-12) || !floats.EqualApprox(dFlat, dLossFlat, 1e-10) {
+		t.Errorf("ParLossDeriv does not match SeqLossDeriv")
+	}
+}
+
+func TestSharedFreeze(t *testing.T) {
+	net := newSharedNet(t)
+	// Neuron 2 of layer 1 shares with neuron 0 of layer 0
+	net.SetLayerFrozen(0, true)
+	// Only neuron 0 of layer 1 and the output layer are trainable
+	want := 5 + 2*4
+	if net.NumTrainableParameters() != want {
+		t.Errorf("Wrong number of trainable parameters. Want %v, got %v", want, net.NumTrainableParameters())
+	}
+	nSamples := 10
+	inputs := RandomSliceOfSlice(nSamples, net.Inputs())
+	truths := RandomSliceOfSlice(nSamples, 2)
+	dLossDParam, _ := net.NewPerParameterMemory()
+	SeqLossDeriv(inputs, truths, RandomWeights(nSamples), net, dLossDParam, NewParLossDerivMemory(net))
+	for _, n := range []NeuronIndex{{1, 1}, {1, 2}} {
+		for _, val := range dLossDParam[n.Layer][n.Neuron] {
+			if val != 0 {
+				t.Errorf("Non-zero derivative for frozen shared parameters of neuron %v", n)
+				break
+			}
+		}
+	}
+
+	trainable := RandomSliceOfSlice(1, want)[0]
+	net.SetTrainableParametersSlice(trainable)
+	got := make([]float64, want)
+	net.TrainableParametersSlice(got)
+	if !floats.Equal(got, trainable) {
+		t.Errorf("Trainable parameters not set")
+	}
+}
+
+func TestSharedSerialize(t *testing.T) {
+	net := newSharedNet(t)
+	// The wrapped neuron is not registered
+	net.layers[1].Neurons[1] = &TanhNeuron
+	inputs := RandomSliceOfSlice(10, net.Inputs())
+	pred1, err := net.PredictSlice(inputs)
+	if err != nil {
+		t.Fatalf("Error predicting: %v", err)
+	}
+
+	b, err := json.Marshal(net)
+	if err != nil {
+		t.Fatalf("Error marshaling: %v", err)
+	}
+	net2 := &Net{}
+	if err := json.Unmarshal(b, net2); err != nil {
+		t.Fatalf("Error unmarshaling: %v", err)
+	}
+	b, err = net.GobEncode()
+	if err != nil {
+		t.Fatalf("Error gob encoding: %v", err)
+	}
+	net3 := &Net{}
+	if err := net3.GobDecode(b); err != nil {
+		t.Fatalf("Error gob decoding: %v", err)
+	}
+
+	for name, n := range map[string]*Net{"JSON": net2, "gob": net3} {
+		if !reflect.DeepEqual(n.SharedParameters(), net.SharedParameters()) {
+			t.Errorf("Shared parameters don't match after %v", name)
+		}
+		if n.TotalNumParameters() != net.TotalNumParameters() {
+			t.Errorf("Number of parameters doesn't match after %v", name)
+		}
+		if &n.parameters[0][0][0] != &n.parameters[1][2][0] {
+			t.Errorf("Parameters not shared after %v", name)
+		}
+		pred2, err := n.PredictSlice(inputs)
+		if err != nil {
+			t.Fatalf("Error predicting: %v", err)
+		}
+		for i := range pred1 {
+			if !floats.EqualApprox(pred1[i], pred2[i], 1e-14) {
+				t.Errorf("Predictions don't match after %v", name)
+				break
+			}
+		}
+	}
+}
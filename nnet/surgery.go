@@ -0,0 +1,299 @@
+package nnet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// The structure of a net can be changed after it is created, for example to grow a
+// net which underfits. The parameters which are not affected by the change are kept,
+// and the layout of the parameters is rebuilt, so memory from NewPerParameterMemory (and
+// anything which holds it, such as the memory for ParLossDeriv) must be allocated again.
+// New neurons are not frozen. The structure of nets with shared parameters, of nets with
+// pruned weights (see Unprune) and of graph nets cannot be changed.
+
+// InputResizer is a Neuron whose parameters can be changed when an input is added to
+// or removed from its layer. Adding or removing neurons in a layer needs all of the
+// neurons of the next layer to be InputResizers, and removing an input of the net
+// needs all of the neurons of the first layer to be.
+type InputResizer interface {
+	// InsertInput returns the parameters for nInputs+1 inputs, where the new input
+	// is at index i. The output of the neuron must not depend on the new input.
+	InsertInput(parameters []float64, nInputs, i int) []float64
+	// RemoveInput returns the parameters for nInputs-1 inputs, without the input at index i
+	RemoveInput(parameters []float64, nInputs, i int) []float64
+}
+
+// InsertLayer inserts a hidden layer before layer i, initialized so that it is close
+// to the identity. The layer must have one neuron per output of the layer before (or
+// per input of the net if i is zero), and all of the neurons must be SumNeurons. The
+// weight matrix of the layer is the identity and the biases are zero, so the layer is
+// exactly the identity for linear activators and close to it for small inputs to
+// activators like tanh. Batch normalization starts with unit gammas and zero betas.
+func (net *Net) InsertLayer(i int, layer Layer) error {
+	if err := net.checkSurgery(); err != nil {
+		return err
+	}
+	if i < 0 || i >= len(net.layers) {
+		return fmt.Errorf("nnet: cannot insert a layer at %v in a net with %v layers", i, len(net.layers))
+	}
+	nInputs := net.layerInputs()[i]
+	if len(layer.Neurons) != nInputs {
+		return fmt.Errorf("nnet: inserted layer must have %v neurons, but has %v", nInputs, len(layer.Neurons))
+	}
+	if !layer.isSumLayer() {
+		return errors.New("nnet: inserted layer must only have SumNeurons")
+	}
+
+	entries := make([][]float64, 0, nInputs+1)
+	for j := range layer.Neurons {
+		p := make([]float64, nInputs+1)
+		p[j] = 1
+		entries = append(entries, p)
+	}
+	if layer.BatchNorm != nil {
+		entries = append(entries, identityBatchNorm(nInputs))
+	}
+
+	layers := make([]Layer, 0, len(net.layers)+1)
+	layers = append(layers, net.layers[:i]...)
+	layers = append(layers, layer)
+	layers = append(layers, net.layers[i:]...)
+
+	old := net.copyParameters()
+	parameters := make([][][]float64, 0, len(old)+1)
+	parameters = append(parameters, old[:i]...)
+	parameters = append(parameters, entries)
+	parameters = append(parameters, old[i:]...)
+
+	var frozen [][]bool
+	if net.frozen != nil {
+		frozen = make([][]bool, 0, len(net.frozen)+1)
+		frozen = append(frozen, net.frozen[:i]...)
+		frozen = append(frozen, make([]bool, len(entries)))
+		frozen = append(frozen, net.frozen[i:]...)
+	}
+	net.rebuild(net.nInputs, layers, parameters, frozen)
+	return nil
+}
+
+// AddNeurons adds neurons to the end of hidden layer l. The parameters of the new
+// neurons are randomized from src (or from a source seeded by the global source in
+// math/rand if src is nil), so the neurons must be SeededRandomizers. The neurons of
+// the next layer get a weight of zero for them, so the predictions of the net do not
+// change.
+func (net *Net) AddNeurons(l int, src rand.Source, neurons ...Neuron) error {
+	if err := net.checkSurgery(); err != nil {
+		return err
+	}
+	if l < 0 || l >= len(net.layers)-1 {
+		return fmt.Errorf("nnet: layer %v is not a hidden layer", l)
+	}
+	if err := checkInputResizers(net.layers[l+1], l+1); err != nil {
+		return err
+	}
+	for _, neuron := range neurons {
+		if _, ok := neuron.(SeededRandomizer); !ok {
+			return fmt.Errorf("nnet: neuron of type %T does not implement SeededRandomizer", neuron)
+		}
+	}
+	if src == nil {
+		src = rand.NewSource(rand.Int63())
+	}
+	rnd := rand.New(src)
+	nInputs := net.layerInputs()[l]
+	nOld := len(net.layers[l].Neurons)
+	nNew := nOld + len(neurons)
+
+	layers := make([]Layer, len(net.layers))
+	copy(layers, net.layers)
+	layers[l].Neurons = make([]Neuron, 0, nNew)
+	layers[l].Neurons = append(layers[l].Neurons, net.layers[l].Neurons...)
+	layers[l].Neurons = append(layers[l].Neurons, neurons...)
+
+	parameters := net.copyParameters()
+	entries := make([][]float64, 0, nNew+1)
+	entries = append(entries, parameters[l][:nOld]...)
+	for _, neuron := range neurons {
+		p := make([]float64, neuron.NumParameters(nInputs))
+		neuron.(SeededRandomizer).RandomizeFrom(p, rnd)
+		entries = append(entries, p)
+	}
+	if b := layers[l].BatchNorm; b != nil {
+		bn := identityBatchNorm(nNew)
+		gamma, beta := net.layers[l].batchNormParameters(parameters[l])
+		copy(bn, gamma)
+		copy(bn[nNew:], beta)
+		entries = append(entries, bn)
+		for j := nOld; j < nNew; j++ {
+			b.RunningMean = append(b.RunningMean, 0)
+			b.RunningVar = append(b.RunningVar, 1)
+		}
+	}
+	parameters[l] = entries
+
+	for j, neuron := range layers[l+1].Neurons {
+		r := neuron.(InputResizer)
+		for k := nOld; k < nNew; k++ {
+			parameters[l+1][j] = r.InsertInput(parameters[l+1][j], k, k)
+		}
+	}
+
+	var frozen [][]bool
+	if net.frozen != nil {
+		frozen = make([][]bool, len(net.frozen))
+		copy(frozen, net.frozen)
+		frozen[l] = make([]bool, len(entries))
+		copy(frozen[l], net.frozen[l][:nOld])
+		if layers[l].BatchNorm != nil {
+			frozen[l][nNew] = net.frozen[l][nOld]
+		}
+	}
+	net.rebuild(net.nInputs, layers, parameters, frozen)
+	return nil
+}
+
+// RemoveNeuron removes neuron j from hidden layer l. The neurons of the next layer
+// lose their parameters for the neuron.
+func (net *Net) RemoveNeuron(l, j int) error {
+	if err := net.checkSurgery(); err != nil {
+		return err
+	}
+	if l < 0 || l >= len(net.layers)-1 {
+		return fmt.Errorf("nnet: layer %v is not a hidden layer", l)
+	}
+	nOld := len(net.layers[l].Neurons)
+	if j < 0 || j >= nOld {
+		return fmt.Errorf("nnet: neuron %v out of range for layer %v", j, l)
+	}
+	if nOld == 1 {
+		return fmt.Errorf("nnet: cannot remove the only neuron of layer %v", l)
+	}
+	if err := checkInputResizers(net.layers[l+1], l+1); err != nil {
+		return err
+	}
+
+	layers := make([]Layer, len(net.layers))
+	copy(layers, net.layers)
+	layers[l].Neurons = make([]Neuron, 0, nOld-1)
+	layers[l].Neurons = append(layers[l].Neurons, net.layers[l].Neurons[:j]...)
+	layers[l].Neurons = append(layers[l].Neurons, net.layers[l].Neurons[j+1:]...)
+
+	parameters := net.copyParameters()
+	entries := make([][]float64, 0, len(parameters[l])-1)
+	entries = append(entries, parameters[l][:j]...)
+	entries = append(entries, parameters[l][j+1:nOld]...)
+	if b := layers[l].BatchNorm; b != nil {
+		gamma, beta := net.layers[l].batchNormParameters(parameters[l])
+		bn := make([]float64, 0, 2*(nOld-1))
+		bn = append(bn, gamma[:j]...)
+		bn = append(bn, gamma[j+1:]...)
+		bn = append(bn, beta[:j]...)
+		bn = append(bn, beta[j+1:]...)
+		entries = append(entries, bn)
+		b.RunningMean = append(b.RunningMean[:j], b.RunningMean[j+1:]...)
+		b.RunningVar = append(b.RunningVar[:j], b.RunningVar[j+1:]...)
+	}
+	parameters[l] = entries
+
+	for k, neuron := range layers[l+1].Neurons {
+		parameters[l+1][k] = neuron.(InputResizer).RemoveInput(parameters[l+1][k], nOld, j)
+	}
+
+	var frozen [][]bool
+	if net.frozen != nil {
+		frozen = make([][]bool, len(net.frozen))
+		copy(frozen, net.frozen)
+		frozen[l] = make([]bool, 0, len(entries))
+		frozen[l] = append(frozen[l], net.frozen[l][:j]...)
+		frozen[l] = append(frozen[l], net.frozen[l][j+1:]...)
+	}
+	net.rebuild(net.nInputs, layers, parameters, frozen)
+	return nil
+}
+
+// RemoveInput removes input i of the net. The neurons of the first layer lose their
+// parameters for the input. The scalers of the net are not changed, so the InputScaler
+// must be set again with data without the input before predicting.
+func (net *Net) RemoveInput(i int) error {
+	if err := net.checkSurgery(); err != nil {
+		return err
+	}
+	if i < 0 || i >= net.nInputs {
+		return fmt.Errorf("nnet: input %v out of range", i)
+	}
+	if net.nInputs == 1 {
+		return errors.New("nnet: cannot remove the only input")
+	}
+	if err := checkInputResizers(net.layers[0], 0); err != nil {
+		return err
+	}
+	parameters := net.copyParameters()
+	for j, neuron := range net.layers[0].Neurons {
+		parameters[0][j] = neuron.(InputResizer).RemoveInput(parameters[0][j], net.nInputs, i)
+	}
+	net.rebuild(net.nInputs-1, net.layers, parameters, net.frozen)
+	return nil
+}
+
+// checkSurgery returns an error if the structure of the net cannot be changed
+func (net *Net) checkSurgery() error {
+	if net.shared != nil {
+		return errors.New("nnet: cannot change the structure of a net with shared parameters")
+	}
+	if net.pruned != nil {
+		return errors.New("nnet: cannot change the structure of a net with pruned weights (see Unprune)")
+	}
+	if !net.isSequential() {
+		return errors.New("nnet: cannot change the structure of a graph net")
+	}
+	return nil
+}
+
+// checkInputResizers returns an error if any of the neurons of layer l are not InputResizers
+func checkInputResizers(layer Layer, l int) error {
+	for j, neuron := range layer.Neurons {
+		if _, ok := neuron.(InputResizer); !ok {
+			return fmt.Errorf("nnet: neuron %v of layer %v does not implement InputResizer", j, l)
+		}
+	}
+	return nil
+}
+
+// identityBatchNorm returns the gammas and betas of batch normalization for n neurons
+// with unit gammas and zero betas
+func identityBatchNorm(n int) []float64 {
+	bn := make([]float64, 2*n)
+	for j := 0; j < n; j++ {
+		bn[j] = 1
+	}
+	return bn
+}
+
+// copyParameters returns a copy of the parameters of the net
+func (net *Net) copyParameters() [][][]float64 {
+	parameters := make([][][]float64, len(net.parameters))
+	for i := range net.parameters {
+		parameters[i] = make([][]float64, len(net.parameters[i]))
+		for j, p := range net.parameters[i] {
+			parameters[i][j] = append([]float64(nil), p...)
+		}
+	}
+	return parameters
+}
+
+// rebuild lays out the parameters of the net again for the new number of inputs and
+// layers, and sets the parameters and the frozen entries. parameters and frozen
+// must have one entry per entry of the new layout.
+func (net *Net) rebuild(nInputs int, layers []Layer, parameters [][][]float64, frozen [][]bool) {
+	net.nInputs = nInputs
+	net.layers = layers
+	net.new()
+	for i := range parameters {
+		for j := range parameters[i] {
+			copy(net.parameters[i][j], parameters[i][j])
+		}
+	}
+	net.frozen = frozen
+}
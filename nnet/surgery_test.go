@@ -0,0 +1,202 @@
+package nnet
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/btracey/nnet/loss"
+	"github.com/gonum/floats"
+)
+
+// predictAll predicts all of the inputs without scaling
+func predictAll(net *Net, inputs [][]float64) [][]float64 {
+	tmp := net.NewPredictTmpMemory()
+	preds := make([][]float64, len(inputs))
+	for i, input := range inputs {
+		preds[i] = make([]float64, net.Outputs())
+		Predict(input, net, preds[i], tmp.combinations, tmp.outputs)
+	}
+	return preds
+}
+
+func predictionsMatch(a, b [][]float64, tol float64) bool {
+	for i := range a {
+		if !floats.EqualApprox(a[i], b[i], tol) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkLayout checks that the parameter layout of the net is the same as for a new
+// net with the same structure
+func checkLayout(t *testing.T, net *Net, name string) {
+	nParameters, parameterIdx, total := parameterLayout(net.layers, net.layerInputs())
+	if total != net.TotalNumParameters() || len(net.parametersSlice) != total {
+		t.Errorf("Wrong number of parameters after %v", name)
+	}
+	for i := range nParameters {
+		if !intsEqual(nParameters[i], net.nParameters[i]) || !intsEqual(parameterIdx[i], net.parameterIdx[i]) {
+			t.Errorf("Wrong parameter layout after %v", name)
+		}
+	}
+}
+
+func intsEqual(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestInsertLayer(t *testing.T) {
+	nInputs := 3
+	net := DefaultRegression(nInputs, 2, 1, 4)
+	inputs := RandomSliceOfSlice(10, nInputs)
+	preds := predictAll(net, inputs)
+
+	layer := Layer{Neurons: []Neuron{&LinearNeuron, &LinearNeuron, &LinearNeuron, &LinearNeuron}}
+	if err := net.InsertLayer(1, layer); err != nil {
+		t.Fatalf("Error inserting layer: %v", err)
+	}
+	layer = Layer{Neurons: []Neuron{&LinearNeuron, &LinearNeuron, &LinearNeuron}}
+	if err := net.InsertLayer(0, layer); err != nil {
+		t.Fatalf("Error inserting layer: %v", err)
+	}
+	if len(net.layers) != 4 {
+		t.Errorf("Wrong number of layers")
+	}
+	checkLayout(t, net, "InsertLayer")
+	if !predictionsMatch(preds, predictAll(net, inputs), 1e-12) {
+		t.Errorf("Predictions changed by inserting identity layers")
+	}
+	if err := net.InsertLayer(2, layer); err == nil {
+		t.Errorf("No error for the wrong number of neurons")
+	}
+	if err := net.InsertLayer(4, layer); err == nil {
+		t.Errorf("No error for inserting after the output layer")
+	}
+}
+
+func TestAddRemoveNeurons(t *testing.T) {
+	nInputs := 3
+	nSamples := 10
+	inputs := RandomSliceOfSlice(nSamples, nInputs)
+	truths := RandomSliceOfSlice(nSamples, 2)
+	weights := RandomWeights(nSamples)
+	dense := DefaultRegression(nInputs, 2, 2, 4)
+	dense.Losser = loss.SquaredDistance{}
+	for _, test := range []struct {
+		name string
+		net  *Net
+	}{
+		{"dense", dense},
+		{"batch norm", newBatchNormNet(nInputs, 2)},
+	} {
+		net := test.net
+		net.Mode = Inference
+		preds := predictAll(net, inputs)
+		net.SetLayerFrozen(1, true)
+
+		if err := net.AddNeurons(0, rand.NewSource(1), &TanhNeuron, &SigmoidNeuron); err != nil {
+			t.Fatalf("Error adding neurons: %v", err)
+		}
+		checkLayout(t, net, "AddNeurons")
+		if !predictionsMatch(preds, predictAll(net, inputs), 1e-12) {
+			t.Errorf("Predictions changed by adding neurons for %v", test.name)
+		}
+		if net.NeuronFrozen(0, 4) || !net.NeuronFrozen(1, 0) {
+			t.Errorf("Frozen neurons changed by adding neurons for %v", test.name)
+		}
+		if b := net.layers[0].BatchNorm; b != nil && (len(b.RunningMean) != 6 || len(b.RunningVar) != 6) {
+			t.Errorf("Running statistics not extended for %v", test.name)
+		}
+
+		// Removing a neuron is the same as setting its outgoing weights to zero
+		for _, p := range net.parameters[1][:len(net.layers[1].Neurons)] {
+			p[2] = 0
+		}
+		preds = predictAll(net, inputs)
+		if err := net.RemoveNeuron(0, 2); err != nil {
+			t.Fatalf("Error removing neuron: %v", err)
+		}
+		checkLayout(t, net, "RemoveNeuron")
+		if !predictionsMatch(preds, predictAll(net, inputs), 1e-12) {
+			t.Errorf("Predictions changed by removing neuron for %v", test.name)
+		}
+		if len(net.layers[0].Neurons) != 5 {
+			t.Errorf("Wrong number of neurons after removing for %v", test.name)
+		}
+
+		// The rebuilt net still has the right derivatives
+		net.SetLayerFrozen(1, false)
+		net.Mode = Train
+		batchNormFD(t, net, inputs, truths, weights, test.name)
+	}
+
+	// The new neurons are randomized from the source
+	var params [][]float64
+	for rep := 0; rep < 2; rep++ {
+		net := newRegressionTestNet(nInputs, 2, 4)
+		if err := net.AddNeurons(0, rand.NewSource(2), &TanhNeuron, &TanhNeuron); err != nil {
+			t.Fatal(err)
+		}
+		p := make([]float64, net.TotalNumParameters())
+		net.ParametersSlice(p)
+		params = append(params, p)
+	}
+	if !floats.Equal(params[0], params[1]) {
+		t.Errorf("AddNeurons is not reproducible from the source")
+	}
+
+	net := DefaultRegression(nInputs, 2, 1, 4)
+	if err := net.AddNeurons(0, nil, struct{ Neuron }{&TanhNeuron}); err == nil {
+		t.Errorf("No error adding a neuron which is not a SeededRandomizer")
+	}
+	if err := net.AddNeurons(1, nil, &TanhNeuron); err == nil {
+		t.Errorf("No error adding neurons to the output layer")
+	}
+	if err := net.RemoveNeuron(0, 4); err == nil {
+		t.Errorf("No error for a neuron out of range")
+	}
+	net.layers[1].Neurons[0] = &RBFNeuron{}
+	if err := net.AddNeurons(0, nil, &TanhNeuron); err == nil {
+		t.Errorf("No error for a next layer which cannot be resized")
+	}
+	net = DefaultRegression(nInputs, 2, 1, 4)
+	net.ShareParameters(NeuronIndex{0, 0}, NeuronIndex{0, 1})
+	if err := net.RemoveNeuron(0, 3); err == nil {
+		t.Errorf("No error for a net with shared parameters")
+	}
+}
+
+func TestRemoveInput(t *testing.T) {
+	nInputs := 4
+	net := DefaultRegression(nInputs, 2, 1, 5)
+	for _, p := range net.parameters[0] {
+		p[1] = 0
+	}
+	inputs := RandomSliceOfSlice(10, nInputs)
+	preds := predictAll(net, inputs)
+	if err := net.RemoveInput(1); err != nil {
+		t.Fatalf("Error removing input: %v", err)
+	}
+	if net.Inputs() != nInputs-1 {
+		t.Errorf("Wrong number of inputs")
+	}
+	checkLayout(t, net, "RemoveInput")
+	for i := range inputs {
+		inputs[i] = append(inputs[i][:1], inputs[i][2:]...)
+	}
+	if !predictionsMatch(preds, predictAll(net, inputs), 1e-12) {
+		t.Errorf("Predictions changed by removing an input with zero weights")
+	}
+	if err := net.RemoveInput(3); err == nil {
+		t.Errorf("No error for an input out of range")
+	}
+}
@@ -0,0 +1,158 @@
+package par
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/rpc"
+
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/nnet"
+	"github.com/btracey/nnet/train"
+	"github.com/gonum/floats"
+)
+
+// Coordinator computes the loss and derivative of a net over data split across
+// workers. It has the same ObjGrad as train.TrainAll, so it can be used in its place.
+// The data is split into contiguous shards in the order of the workers, and the
+// results of the workers are summed in the same order, so ObjGrad returns the same
+// result for the same parameters.
+//
+// The running statistics of batch normalization are not updated in Train mode.
+type Coordinator struct {
+	net             *nnet.Net
+	clients         []*rpc.Client
+	replies         []LossDerivReply
+	parameters      []float64
+	dLossDParamFlat []float64
+	dLossDTrainable []float64
+}
+
+// NewCoordinator connects to the workers at the addresses and sends each a shard of
+// the data and the net (with the losser set). The weights are normalized to sum to one
+// with train.NormalizeWeights, without modifying the slice, and an error is returned if
+// any are negative or they sum to zero. The data must already be scaled, for example
+// with train.ScaleTrainingData.
+func NewCoordinator(addrs []string, net *nnet.Net, losser loss.Losser, inputs, outputs [][]float64, weights []float64) (*Coordinator, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("par: no workers")
+	}
+	if len(outputs) != len(inputs) || len(weights) != len(inputs) {
+		return nil, errors.New("par: number of inputs, outputs and weights must match")
+	}
+	scaled := make([]float64, len(weights))
+	copy(scaled, weights)
+	if err := train.NormalizeWeights(scaled); err != nil {
+		return nil, errors.New("par: " + err.Error())
+	}
+	net.Losser = losser
+
+	c := &Coordinator{
+		net:             net,
+		clients:         make([]*rpc.Client, 0, len(addrs)),
+		replies:         make([]LossDerivReply, len(addrs)),
+		parameters:      make([]float64, net.TotalNumParameters()),
+		dLossDParamFlat: make([]float64, net.TotalNumParameters()),
+	}
+	for _, addr := range addrs {
+		client, err := rpc.Dial("tcp", addr)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("par: error connecting to worker %v: %v", addr, err)
+		}
+		c.clients = append(c.clients, client)
+	}
+	calls := make([]*rpc.Call, len(addrs))
+	for i, client := range c.clients {
+		start, end := shard(i, len(addrs), len(inputs))
+		args := &InitArgs{
+			Net:     net,
+			Inputs:  inputs[start:end],
+			Truths:  outputs[start:end],
+			Weights: scaled[start:end],
+		}
+		calls[i] = client.Go("Worker.Init", args, &InitReply{}, nil)
+	}
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil {
+			c.Close()
+			return nil, fmt.Errorf("par: error initializing worker %v: %v", addrs[i], call.Error)
+		}
+	}
+	return c, nil
+}
+
+// shard returns the range of the samples of worker i
+func shard(i, nWorkers, nSamples int) (start, end int) {
+	return i * nSamples / nWorkers, (i + 1) * nSamples / nWorkers
+}
+
+// ObjGrad sets the trainable parameters of the net (see nnet.Net.TrainableParametersSlice),
+// sends all of the parameters to the workers, and returns the total loss and the
+// derivative with respect to the trainable parameters. The derivative is reused by the
+// next call.
+func (c *Coordinator) ObjGrad(parameters []float64) (loss float64, deriv []float64, err error) {
+	net := c.net
+	net.SetTrainableParametersSlice(parameters)
+	net.ParametersSlice(c.parameters)
+
+	calls := make([]*rpc.Call, len(c.clients))
+	for i, client := range c.clients {
+		args := &LossDerivArgs{
+			Parameters: c.parameters,
+			Mode:       net.Mode,
+			Seed:       c.dropoutSeed(),
+		}
+		c.replies[i] = LossDerivReply{}
+		calls[i] = client.Go("Worker.LossDeriv", args, &c.replies[i], nil)
+	}
+	for _, call := range calls {
+		<-call.Done
+		if call.Error != nil && err == nil {
+			err = call.Error
+		}
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("par: error computing the loss: %v", err)
+	}
+
+	for i := range c.dLossDParamFlat {
+		c.dLossDParamFlat[i] = 0
+	}
+	for _, reply := range c.replies {
+		if len(reply.DLossDParam) != len(c.dLossDParamFlat) {
+			return 0, nil, errors.New("par: worker returned the wrong number of derivatives")
+		}
+		loss += reply.Loss
+		floats.Add(c.dLossDParamFlat, reply.DLossDParam)
+	}
+
+	// The net may have been frozen after the Coordinator was created
+	nTrainable := net.NumTrainableParameters()
+	if len(c.dLossDTrainable) != nTrainable {
+		c.dLossDTrainable = make([]float64, nTrainable)
+	}
+	net.TrainableSlice(c.dLossDParamFlat, c.dLossDTrainable)
+	return loss, c.dLossDTrainable, nil
+}
+
+// dropoutSeed returns a seed for the dropout masks of a worker from the DropoutSource
+// of the net
+func (c *Coordinator) dropoutSeed() int64 {
+	if c.net.DropoutSource == nil {
+		return rand.Int63()
+	}
+	return c.net.DropoutSource.Int63()
+}
+
+// Close closes the connections to the workers
+func (c *Coordinator) Close() error {
+	var err error
+	for _, client := range c.clients {
+		if e := client.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,215 @@
+package par
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/nnet"
+	"github.com/btracey/nnet/scale"
+	"github.com/btracey/nnet/train"
+	"github.com/gonum/floats"
+)
+
+// workerEnv is set in the environment of the worker processes started by the tests
+const workerEnv = "NNET_PAR_TEST_WORKER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(workerEnv) != "" {
+		// Run as a worker, and print the address for the test
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(l.Addr().String())
+		Serve(l)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// startWorkers starts n worker processes on localhost and returns their addresses
+func startWorkers(t *testing.T, n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		cmd := exec.Command(os.Args[0])
+		cmd.Env = append(os.Environ(), workerEnv+"=1")
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		})
+		addr, err := bufio.NewReader(stdout).ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading the address of worker %v: %v", i, err)
+		}
+		addrs[i] = strings.TrimSpace(addr)
+	}
+	return addrs
+}
+
+func newTestNet(nInputs, nOutputs int) *nnet.Net {
+	net := nnet.DefaultRegression(nInputs, nOutputs, 2, 6)
+	if err := net.Initialize(nil, rand.NewSource(1)); err != nil {
+		panic(err)
+	}
+	net.InputScaler = &scale.Normal{}
+	net.OutputScaler = &scale.Normal{}
+	return net
+}
+
+func randomData(nSamples, dim int) [][]float64 {
+	data := make([][]float64, nSamples)
+	for i := range data {
+		data[i] = make([]float64, dim)
+		for j := range data[i] {
+			data[i][j] = rand.NormFloat64()
+		}
+	}
+	return data
+}
+
+func TestCoordinator(t *testing.T) {
+	nInputs := 3
+	nOutputs := 2
+	nSamples := 203
+	inputs := randomData(nSamples, nInputs)
+	outputs := randomData(nSamples, nOutputs)
+	weights := make([]float64, nSamples)
+	for i := range weights {
+		weights[i] = rand.Float64()
+	}
+	net := newTestNet(nInputs, nOutputs)
+	if err := train.SetScale(inputs, outputs, net); err != nil {
+		t.Fatal(err)
+	}
+	scale.ScaleData(net.InputScaler, inputs)
+	scale.ScaleData(net.OutputScaler, outputs)
+
+	addrs := startWorkers(t, 3)
+	c, err := NewCoordinator(addrs, net, loss.SquaredDistance{}, inputs, outputs, weights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Compare with training on all of the data in this process
+	local := newTestNet(nInputs, nOutputs)
+	local.InputScaler = net.InputScaler
+	local.OutputScaler = net.OutputScaler
+	all := train.NewTrainAll(local, loss.SquaredDistance{}, inputs, outputs, append([]float64(nil), weights...))
+
+	for _, frozen := range []bool{false, true} {
+		net.SetLayerFrozen(0, frozen)
+		local.SetLayerFrozen(0, frozen)
+		parameters := make([]float64, net.NumTrainableParameters())
+		for i := range parameters {
+			parameters[i] = rand.NormFloat64()
+		}
+		value, deriv, err := c.ObjGrad(parameters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deriv = append([]float64(nil), deriv...)
+		wantValue, wantDeriv, _ := all.ObjGrad(parameters)
+		if !floats.EqualWithinRel(value, wantValue, 1e-12) {
+			t.Errorf("Loss mismatch. Want %v, got %v", wantValue, value)
+		}
+		if !floats.EqualApprox(deriv, wantDeriv, 1e-12) {
+			t.Errorf("Derivative mismatch with frozen %v", frozen)
+		}
+
+		// The same parameters give identical results
+		value2, deriv2, err := c.ObjGrad(parameters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value2 != value || !floats.Equal(deriv2, deriv) {
+			t.Errorf("Result changed for the same parameters")
+		}
+	}
+
+	if _, err := NewCoordinator(addrs, net, loss.SquaredDistance{}, inputs, outputs[:10], weights); err == nil {
+		t.Errorf("No error for mismatched data")
+	}
+	if _, err := NewCoordinator(addrs, net, loss.SquaredDistance{}, inputs, outputs, make([]float64, nSamples)); err == nil {
+		t.Errorf("No error for weights which sum to zero")
+	}
+}
+
+func TestWorker(t *testing.T) {
+	w := &Worker{}
+	if err := w.LossDeriv(&LossDerivArgs{}, &LossDerivReply{}); err == nil {
+		t.Errorf("No error for a worker which is not initialized")
+	}
+	net := newTestNet(2, 1)
+	net.Losser = loss.SquaredDistance{}
+	inputs := randomData(10, 2)
+	if err := w.Init(&InitArgs{Net: net, Inputs: inputs, Truths: randomData(9, 1), Weights: make([]float64, 10)}, &InitReply{}); err == nil {
+		t.Errorf("No error for mismatched data")
+	}
+	var reply InitReply
+	if err := w.Init(&InitArgs{Net: net, Inputs: inputs, Truths: randomData(10, 1), Weights: make([]float64, 10)}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.NumParameters != net.TotalNumParameters() {
+		t.Errorf("Wrong number of parameters in the reply")
+	}
+	if err := w.LossDeriv(&LossDerivArgs{Parameters: make([]float64, 3)}, &LossDerivReply{}); err == nil {
+		t.Errorf("No error for the wrong number of parameters")
+	}
+}
+
+func TestWorkerOrdered(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(-1))
+	nSamples := 200
+	net := newTestNet(3, 2)
+	net.Losser = loss.SquaredDistance{}
+	inputs := randomData(nSamples, 3)
+	truths := randomData(nSamples, 2)
+	weights := make([]float64, nSamples)
+	for i := range weights {
+		weights[i] = rand.Float64()
+	}
+	args := &LossDerivArgs{Parameters: make([]float64, net.TotalNumParameters())}
+	net.ParametersSlice(args.Parameters)
+
+	var want LossDerivReply
+	for i, procs := range []int{1, 2, 3, 8} {
+		// The chunk size is chosen when the worker is initialized
+		runtime.GOMAXPROCS(procs)
+		w := &Worker{}
+		if err := w.Init(&InitArgs{Net: net, Inputs: inputs, Truths: truths, Weights: weights}, &InitReply{}); err != nil {
+			t.Fatal(err)
+		}
+		var reply LossDerivReply
+		if err := w.LossDeriv(args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			want = reply
+			continue
+		}
+		if reply.Loss != want.Loss {
+			t.Errorf("Loss changes with GOMAXPROCS = %v. Want %v, got %v", procs, want.Loss, reply.Loss)
+		}
+		if !floats.Equal(reply.DLossDParam, want.DLossDParam) {
+			t.Errorf("Derivative changes with GOMAXPROCS = %v", procs)
+		}
+	}
+}
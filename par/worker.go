@@ -0,0 +1,113 @@
+// Package par computes the loss and derivative of a net over training data which is
+// split across processes. Each worker process serves a Worker over net/rpc and holds
+// one shard of the data, and a Coordinator sends the parameters of the net to all of
+// the workers and sums their partial losses and derivatives.
+package par
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"sync"
+
+	"github.com/btracey/nnet/nnet"
+	"github.com/btracey/nnet/train"
+)
+
+// InitArgs are the arguments of Worker.Init
+type InitArgs struct {
+	Net     *nnet.Net // The net, which is gob encoded with its Losser and scalers
+	Inputs  [][]float64
+	Truths  [][]float64
+	Weights []float64
+}
+
+// InitReply is the reply of Worker.Init
+type InitReply struct {
+	NumParameters int
+}
+
+// LossDerivArgs are the arguments of Worker.LossDeriv
+type LossDerivArgs struct {
+	Parameters []float64 // All of the parameters of the net
+	Mode       nnet.Mode
+	Seed       int64 // The seed of the dropout masks
+}
+
+// LossDerivReply is the reply of Worker.LossDeriv
+type LossDerivReply struct {
+	Loss        float64
+	DLossDParam []float64 // The derivative with respect to all of the parameters
+}
+
+// Worker computes the loss and derivative of a net on its shard of the data. It is
+// served over net/rpc with the name "Worker" (see Serve). The chunks of the shard are
+// summed in order and their size is from train.OrderedChunkSize, so the result only
+// depends on the shard and not on the number of processors of the worker.
+type Worker struct {
+	mu              sync.Mutex
+	net             *nnet.Net
+	inputs          [][]float64
+	truths          [][]float64
+	weights         []float64
+	chunkSize       int
+	dLossDParam     [][][]float64
+	dLossDParamFlat []float64
+}
+
+// Init sets the net and the shard of the data of the worker
+func (w *Worker) Init(args *InitArgs, reply *InitReply) error {
+	if args.Net == nil {
+		return errors.New("par: no net")
+	}
+	if len(args.Truths) != len(args.Inputs) || len(args.Weights) != len(args.Inputs) {
+		return errors.New("par: number of inputs, truths and weights must match")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.net = args.Net
+	w.net.Reduction = nnet.Ordered
+	w.inputs = args.Inputs
+	w.truths = args.Truths
+	w.weights = args.Weights
+	w.chunkSize = train.OrderedChunkSize(len(w.inputs))
+	w.dLossDParam, w.dLossDParamFlat = w.net.NewPerParameterMemory()
+	reply.NumParameters = w.net.TotalNumParameters()
+	return nil
+}
+
+// LossDeriv computes the loss and the derivative of the loss with respect to all of
+// the parameters over the shard at the parameters
+func (w *Worker) LossDeriv(args *LossDerivArgs, reply *LossDerivReply) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.net == nil {
+		return errors.New("par: worker not initialized")
+	}
+	if len(args.Parameters) != w.net.TotalNumParameters() {
+		return errors.New("par: number of parameters does not match the net")
+	}
+	reply.DLossDParam = make([]float64, len(w.dLossDParamFlat))
+	if len(w.inputs) == 0 {
+		return nil
+	}
+	w.net.SetParametersSlice(args.Parameters)
+	w.net.Mode = args.Mode
+	w.net.DropoutSource = rand.NewSource(args.Seed)
+	reply.Loss = nnet.ParLossDeriv(w.inputs, w.truths, w.weights, w.net, w.dLossDParam, w.chunkSize)
+	copy(reply.DLossDParam, w.dLossDParamFlat)
+	return nil
+}
+
+// Serve serves a new Worker over net/rpc on the connections from the listener. It
+// returns when the listener is closed.
+func Serve(l net.Listener) error {
+	server := rpc.NewServer()
+	err := server.RegisterName("Worker", &Worker{})
+	if err != nil {
+		return err
+	}
+	server.Accept(l)
+	return nil
+}
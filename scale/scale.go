@@ -50,6 +50,16 @@ type Scaler interface {
 	SetScale(data [][]float64) error // Uses the input data to set the scale
 }
 
+// Differentiable is a Scaler which scales each dimension independently and can
+// compute the derivative of the transformation. The derivatives are of each dimension
+// with respect to itself (the diagonal of the Jacobian), and are stored in place
+// in deriv.
+type Differentiable interface {
+	Scaler
+	DScaleDPoint(point, deriv []float64) error   // point is unscaled
+	DUnscaleDPoint(point, deriv []float64) error // point is scaled
+}
+
 // ScaleData scales every point in the data using the scaler
 func ScaleData(scaler Scaler, data [][]float64) error {
 	if len(data) == 0 {
@@ -112,6 +122,20 @@ func (n None) Dimensions() int {
 	return n.Dim
 }
 
+func (n None) DScaleDPoint(x, deriv []float64) error {
+	for i := range deriv {
+		deriv[i] = 1
+	}
+	return nil
+}
+
+func (n None) DUnscaleDPoint(x, deriv []float64) error {
+	for i := range deriv {
+		deriv[i] = 1
+	}
+	return nil
+}
+
 func (n *None) SetScale(data [][]float64) error {
 	err := checkInputs(data)
 	if err != nil {
@@ -224,6 +248,28 @@ func (l *Linear) Unscale(point []float64) error {
 	return nil
 }
 
+// DScaleDPoint stores the derivative of the scaled point with respect to the point
+func (l *Linear) DScaleDPoint(point, deriv []float64) error {
+	if len(point) != l.Dim || len(deriv) != l.Dim {
+		return UnequalLength{}
+	}
+	for i := range deriv {
+		deriv[i] = 1 / (l.Max[i] - l.Min[i])
+	}
+	return nil
+}
+
+// DUnscaleDPoint stores the derivative of the unscaled point with respect to the point
+func (l *Linear) DUnscaleDPoint(point, deriv []float64) error {
+	if len(point) != l.Dim || len(deriv) != l.Dim {
+		return UnequalLength{}
+	}
+	for i := range deriv {
+		deriv[i] = l.Max[i] - l.Min[i]
+	}
+	return nil
+}
+
 // Normal scales the data to have a mean of 0 and a variance of 1
 // in each dimension
 type Normal struct {
@@ -322,6 +368,28 @@ func (n *Normal) Unscale(point []float64) error {
 	return nil
 }
 
+// DScaleDPoint stores the derivative of the scaled point with respect to the point
+func (n *Normal) DScaleDPoint(point, deriv []float64) error {
+	if len(point) != n.Dim || len(deriv) != n.Dim {
+		return UnequalLength{}
+	}
+	for i := range deriv {
+		deriv[i] = 1 / n.Sigma[i]
+	}
+	return nil
+}
+
+// DUnscaleDPoint stores the derivative of the unscaled point with respect to the point
+func (n *Normal) DUnscaleDPoint(point, deriv []float64) error {
+	if len(point) != n.Dim || len(deriv) != n.Dim {
+		return UnequalLength{}
+	}
+	for i := range deriv {
+		deriv[i] = n.Sigma[i]
+	}
+	return nil
+}
+
 type ProbabilityDistribution interface {
 	Fit([]float64) error
 	CumProb(float64) float64
@@ -370,6 +438,7 @@ func (p *Probability) SetScale(data [][]float64) error {
 		// Fit the probability distribution using the samples
 		p.UnscaledDistribution[i].Fit(tmp)
 	}
+	p.Scaled = true
 	return nil
 }
 
@@ -412,3 +481,31 @@ func (p *Probability) Unscale(point []float64) error {
 	}
 	return nil
 }
+
+// DScaleDPoint stores the derivative of the scaled point with respect to the point.
+// The scaling maps the cumulative probability of one distribution to the other,
+// so the derivative is the ratio of the probability densities
+func (p *Probability) DScaleDPoint(point, deriv []float64) error {
+	if len(point) != p.Dim || len(deriv) != p.Dim {
+		return UnequalLength{}
+	}
+	for i := range point {
+		prob := p.UnscaledDistribution[i].CumProb(point[i])
+		scaled := p.ScaledDistribution[i].Quantile(prob)
+		deriv[i] = p.UnscaledDistribution[i].Prob(point[i]) / p.ScaledDistribution[i].Prob(scaled)
+	}
+	return nil
+}
+
+// DUnscaleDPoint stores the derivative of the unscaled point with respect to the point
+func (p *Probability) DUnscaleDPoint(point, deriv []float64) error {
+	if len(point) != p.Dim || len(deriv) != p.Dim {
+		return UnequalLength{}
+	}
+	for i := range point {
+		prob := p.ScaledDistribution[i].CumProb(point[i])
+		unscaled := p.UnscaledDistribution[i].Quantile(prob)
+		deriv[i] = p.ScaledDistribution[i].Prob(point[i]) / p.UnscaledDistribution[i].Prob(unscaled)
+	}
+	return nil
+}
@@ -73,6 +73,58 @@ func testScaling(t *testing.T, u Scaler, data [][]float64, scaledData [][]float6
 	}
 }
 
+const (
+	scaleFDStep = 1e-6
+	scaleFDTol  = 1e-8
+)
+
+// testDerivative checks the derivatives of the scaling with finite difference
+func testDerivative(t *testing.T, u Differentiable, data [][]float64, name string) {
+	deriv := make([]float64, u.Dimensions())
+	for _, point := range data {
+		x := make([]float64, len(point))
+		copy(x, point)
+		err := u.DScaleDPoint(x, deriv)
+		if err != nil {
+			t.Errorf("Error in DScaleDPoint for case " + name + ": " + err.Error())
+		}
+		for i := range x {
+			plus := make([]float64, len(x))
+			minus := make([]float64, len(x))
+			copy(plus, x)
+			copy(minus, x)
+			plus[i] += scaleFDStep
+			minus[i] -= scaleFDStep
+			u.Scale(plus)
+			u.Scale(minus)
+			fd := (plus[i] - minus[i]) / (2 * scaleFDStep)
+			if math.Abs(fd-deriv[i]) > scaleFDTol {
+				t.Errorf("DScaleDPoint mismatch for case "+name+". Expected: %v, Found: %v", fd, deriv[i])
+			}
+		}
+
+		u.Scale(x)
+		err = u.DUnscaleDPoint(x, deriv)
+		if err != nil {
+			t.Errorf("Error in DUnscaleDPoint for case " + name + ": " + err.Error())
+		}
+		for i := range x {
+			plus := make([]float64, len(x))
+			minus := make([]float64, len(x))
+			copy(plus, x)
+			copy(minus, x)
+			plus[i] += scaleFDStep
+			minus[i] -= scaleFDStep
+			u.Unscale(plus)
+			u.Unscale(minus)
+			fd := (plus[i] - minus[i]) / (2 * scaleFDStep)
+			if math.Abs(fd-deriv[i]) > scaleFDTol*math.Max(1, math.Abs(fd)) {
+				t.Errorf("DUnscaleDPoint mismatch for case "+name+". Expected: %v, Found: %v", fd, deriv[i])
+			}
+		}
+	}
+}
+
 func testLinear(t *testing.T, kind linearTest) {
 	u := &Linear{}
 	fmt.Println("In test linear")
@@ -90,6 +142,7 @@ func testLinear(t *testing.T, kind linearTest) {
 		t.Errorf("Max doesn't match for case " + kind.name)
 	}
 	testScaling(t, u, kind.data, kind.scaledData, kind.name)
+	testDerivative(t, u, kind.data, kind.name)
 	u2 := &Linear{}
 	testGob(u, u2, t)
 }
@@ -188,6 +241,7 @@ func testNormal(t *testing.T, kind normalTest) {
 		t.Errorf("Sigma doesn't match for case "+kind.name+". Expected: %v, Found: %v", kind.sigma, u.Sigma)
 	}
 	testScaling(t, u, kind.data, kind.scaledData, kind.name)
+	testDerivative(t, u, kind.data, kind.name)
 
 	u2 := &Normal{}
 	testGob(u, u2, t)
@@ -262,6 +316,58 @@ type probabilityTest struct {
 	unscaledData [][]float64
 }
 
+// uniform is a uniform distribution between Min and Max for testing Probability
+type uniform struct {
+	Min, Max float64
+}
+
+func (u *uniform) Fit(x []float64) error {
+	u.Min = floats.Min(x)
+	u.Max = floats.Max(x)
+	return nil
+}
+
+func (u *uniform) CumProb(x float64) float64 {
+	return (x - u.Min) / (u.Max - u.Min)
+}
+
+func (u *uniform) Quantile(p float64) float64 {
+	return u.Min + p*(u.Max-u.Min)
+}
+
+func (u *uniform) Prob(x float64) float64 {
+	return 1 / (u.Max - u.Min)
+}
+
+func TestProbabilitySetScale(t *testing.T) {
+	data := [][]float64{{1, 4}, {2, 9}, {-3, 12}, {-4, 15}}
+	p := &Probability{
+		UnscaledDistribution: []ProbabilityDistribution{&uniform{}, &uniform{}},
+		ScaledDistribution:   []ProbabilityDistribution{&uniform{0, 1}, &uniform{-1, 1}},
+	}
+	if p.IsScaled() {
+		t.Errorf("Probability is scaled before SetScale")
+	}
+	err := p.SetScale(data)
+	if err != nil {
+		t.Fatalf("Error setting the scale: %v", err)
+	}
+	if !p.IsScaled() {
+		t.Errorf("Probability is not scaled after SetScale")
+	}
+	x := []float64{0.5, 10}
+	orig := append([]float64(nil), x...)
+	if err := p.Scale(x); err != nil {
+		t.Fatalf("Error scaling: %v", err)
+	}
+	if err := p.Unscale(x); err != nil {
+		t.Fatalf("Error unscaling: %v", err)
+	}
+	if !floats.EqualApprox(x, orig, 1e-14) {
+		t.Errorf("Unscale(Scale(x)) is not x. Want %v, got %v", orig, x)
+	}
+}
+
 /*
 func TestProbability(t *testing.T) {
 	cases := []probabilityTest{
@@ -0,0 +1,202 @@
+// Package scaletest checks that implementations of scale.Scaler satisfy the
+// contract of the interface, so that nets which use them can be trained, saved
+// and loaded.
+package scaletest
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/btracey/nnet/common"
+	"github.com/btracey/nnet/scale"
+	"github.com/gonum/floats"
+)
+
+// roundTripTol is the tolerance of Unscale(Scale(x)) == x
+const roundTripTol = 1e-10
+
+// Test checks the Scalers returned by newScaler, which must return a new Scaler
+// whose scale has not been set. data is used to set the scale, and must have at
+// least two points of the same length with no uniform dimensions. Test checks that
+//   - IsScaled is false before SetScale and true after it
+//   - SetScale does not modify the data, and Dimensions is the length of the points
+//   - Scale and Unscale are inverses
+//   - SetScale returns scale.UnequalLength for points of unequal length, and Scale
+//     and Unscale (and DScaleDPoint and DUnscaleDPoint for scale.Differentiable)
+//     either return scale.UnequalLength for points of the wrong length or, for a
+//     scaler which does not transform the points such as scale.None, leave them unchanged
+//   - The scaler is the same after JSON encoding through common.InterfaceMarshaler
+//     (so the type must be registered with common.Register) and after gob encoding
+//     as a scale.Scaler (so the type must be registered with gob.Register)
+func Test(t testing.TB, newScaler func() scale.Scaler, data [][]float64) {
+	s := newScaler()
+	if s.IsScaled() {
+		t.Errorf("scaletest: %T: IsScaled is true before SetScale", s)
+	}
+	orig := copyData(data)
+	err := s.SetScale(data)
+	if err != nil {
+		t.Errorf("scaletest: %T: error setting the scale: %v", s, err)
+		return
+	}
+	if !equalData(data, orig) {
+		t.Errorf("scaletest: %T: SetScale modified the data", s)
+	}
+	if !s.IsScaled() {
+		t.Errorf("scaletest: %T: IsScaled is false after SetScale", s)
+	}
+	dim := len(data[0])
+	if s.Dimensions() != dim {
+		t.Errorf("scaletest: %T: Dimensions is %v, but the data have %v", s, s.Dimensions(), dim)
+	}
+
+	for _, point := range data {
+		x := append([]float64(nil), point...)
+		if err := s.Scale(x); err != nil {
+			t.Errorf("scaletest: %T: error scaling %v: %v", s, point, err)
+			continue
+		}
+		scaled := append([]float64(nil), x...)
+		if err := s.Unscale(x); err != nil {
+			t.Errorf("scaletest: %T: error unscaling %v: %v", s, scaled, err)
+			continue
+		}
+		if !floats.EqualApprox(x, point, roundTripTol) {
+			t.Errorf("scaletest: %T: Unscale(Scale(x)) is not x. x: %v, found: %v", s, point, x)
+		}
+		if err := s.Scale(x); err != nil {
+			t.Errorf("scaletest: %T: error scaling %v: %v", s, x, err)
+			continue
+		}
+		if !floats.EqualApprox(x, scaled, roundTripTol) {
+			t.Errorf("scaletest: %T: Scale(Unscale(y)) is not y. y: %v, found: %v", s, scaled, x)
+		}
+	}
+
+	checkUnequalLength(t, s, dim)
+
+	unequal := copyData(data)
+	unequal[len(unequal)-1] = unequal[len(unequal)-1][:dim-1]
+	err = newScaler().SetScale(unequal)
+	if _, ok := err.(scale.UnequalLength); !ok {
+		t.Errorf("scaletest: %T: SetScale with points of unequal length returned %v, not scale.UnequalLength", s, err)
+	}
+
+	im := &common.InterfaceMarshaler{I: s}
+	b, err := im.MarshalJSON()
+	if err != nil {
+		t.Errorf("scaletest: %T: error marshaling JSON: %v", s, err)
+	} else {
+		im2 := &common.InterfaceMarshaler{}
+		err = im2.UnmarshalJSON(b)
+		if err != nil {
+			t.Errorf("scaletest: %T: error unmarshaling JSON: %v", s, err)
+		} else {
+			checkSame(t, "JSON", s, im2.I, data)
+		}
+	}
+
+	w := &bytes.Buffer{}
+	err = gob.NewEncoder(w).Encode(&s)
+	if err != nil {
+		t.Errorf("scaletest: %T: error gob encoding: %v", s, err)
+		return
+	}
+	var s2 scale.Scaler
+	err = gob.NewDecoder(w).Decode(&s2)
+	if err != nil {
+		t.Errorf("scaletest: %T: error gob decoding: %v", s, err)
+		return
+	}
+	checkSame(t, "gob", s, s2, data)
+}
+
+// checkUnequalLength checks that points of the wrong length return UnequalLength,
+// or are not changed
+func checkUnequalLength(t testing.TB, s scale.Scaler, dim int) {
+	for _, n := range []int{dim - 1, dim + 1} {
+		x := make([]float64, n)
+		for i := range x {
+			x[i] = 1.5
+		}
+		orig := append([]float64(nil), x...)
+		if !unequalOrUnchanged(s.Scale(x), x, orig) {
+			t.Errorf("scaletest: %T: Scale of a point of length %v does not return scale.UnequalLength", s, n)
+		}
+		if !unequalOrUnchanged(s.Unscale(x), x, orig) {
+			t.Errorf("scaletest: %T: Unscale of a point of length %v does not return scale.UnequalLength", s, n)
+		}
+		d, ok := s.(scale.Differentiable)
+		if !ok {
+			continue
+		}
+		deriv := make([]float64, n)
+		if !unequalOrUnchanged(d.DScaleDPoint(x, deriv), x, orig) {
+			t.Errorf("scaletest: %T: DScaleDPoint of a point of length %v does not return scale.UnequalLength", s, n)
+		}
+		if !unequalOrUnchanged(d.DUnscaleDPoint(x, deriv), x, orig) {
+			t.Errorf("scaletest: %T: DUnscaleDPoint of a point of length %v does not return scale.UnequalLength", s, n)
+		}
+	}
+}
+
+// unequalOrUnchanged returns true if err is UnequalLength, or if err is nil and
+// x is unchanged from orig
+func unequalOrUnchanged(err error, x, orig []float64) bool {
+	if _, ok := err.(scale.UnequalLength); ok {
+		return true
+	}
+	return err == nil && floats.Equal(x, orig)
+}
+
+// checkSame checks that the decoded scaler scales the data exactly as s does
+func checkSame(t testing.TB, encoding string, s scale.Scaler, decoded interface{}, data [][]float64) {
+	s2, ok := decoded.(scale.Scaler)
+	if !ok {
+		t.Errorf("scaletest: %T: decoded %v is %T, which is not a scale.Scaler", s, encoding, decoded)
+		return
+	}
+	if s2.IsScaled() != s.IsScaled() {
+		t.Errorf("scaletest: %T: IsScaled is %v after %v decoding", s, s2.IsScaled(), encoding)
+	}
+	if s2.Dimensions() != s.Dimensions() {
+		t.Errorf("scaletest: %T: Dimensions is %v after %v decoding, not %v", s, s2.Dimensions(), encoding, s.Dimensions())
+	}
+	if _, ok := s.(scale.Differentiable); ok {
+		if _, ok := s2.(scale.Differentiable); !ok {
+			t.Errorf("scaletest: %T: decoded %v is %T, which is not a scale.Differentiable", s, encoding, s2)
+		}
+	}
+	for _, point := range data {
+		x := append([]float64(nil), point...)
+		x2 := append([]float64(nil), point...)
+		err := s.Scale(x)
+		err2 := s2.Scale(x2)
+		if err != nil || err2 != nil {
+			t.Errorf("scaletest: %T: error scaling after %v decoding: %v", s, encoding, err2)
+			return
+		}
+		if !floats.Equal(x, x2) {
+			t.Errorf("scaletest: %T: scaling changed after %v decoding. Expected: %v, found %v", s, encoding, x, x2)
+			return
+		}
+	}
+}
+
+func copyData(data [][]float64) [][]float64 {
+	c := make([][]float64, len(data))
+	for i := range data {
+		c[i] = append([]float64(nil), data[i]...)
+	}
+	return c
+}
+
+func equalData(a, b [][]float64) bool {
+	for i := range a {
+		if !floats.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
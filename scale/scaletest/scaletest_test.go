@@ -0,0 +1,46 @@
+package scaletest
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/btracey/nnet/scale"
+)
+
+func TestScalers(t *testing.T) {
+	data := make([][]float64, 20)
+	for i := range data {
+		data[i] = []float64{rand.NormFloat64(), 3*rand.NormFloat64() + 2, rand.Float64()}
+	}
+	for _, newScaler := range []func() scale.Scaler{
+		func() scale.Scaler { return &scale.None{} },
+		func() scale.Scaler { return &scale.Linear{} },
+		func() scale.Scaler { return &scale.Normal{} },
+	} {
+		Test(t, newScaler, data)
+	}
+}
+
+// unregistered is a scaler which has not been registered with common or gob
+type unregistered struct {
+	scale.Normal
+}
+
+func TestUnregistered(t *testing.T) {
+	data := [][]float64{{1, 2}, {3, 5}, {4, 1}}
+	ft := &fakeT{}
+	Test(ft, func() scale.Scaler { return &unregistered{} }, data)
+	if !ft.failed {
+		t.Errorf("Unregistered scaler passed")
+	}
+}
+
+// fakeT records whether a test failed
+type fakeT struct {
+	testing.TB
+	failed bool
+}
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.failed = true
+}
@@ -0,0 +1,29 @@
+// par_worker serves a worker for package github.com/btracey/nnet/par, which holds a
+// shard of the training data sent by the coordinator.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/btracey/nnet/par"
+)
+
+func main() {
+	addr := flag.String("addr", ":7070", "address to listen on")
+	flag.Parse()
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Println("Error listening: " + err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("Serving on " + l.Addr().String())
+	err = par.Serve(l)
+	if err != nil {
+		fmt.Println("Error serving: " + err.Error())
+		os.Exit(2)
+	}
+}
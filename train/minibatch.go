@@ -0,0 +1,155 @@
+package train
+
+import (
+	"math/rand"
+
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/nnet"
+)
+
+// MiniBatch trains on random minibatches of the data. ObjGrad evaluates the loss and
+// derivative on the current batch, and Next moves to the next batch of a random
+// permutation of the samples, so each epoch uses every sample once, and a new
+// permutation is drawn at the start of each epoch. ObjGrad does not change the batch,
+// so an optimizer may call it several times per step (as in a line search) and must
+// call Next between steps. The weights are normalized to sum to one as in TrainAll,
+// and the loss of a batch is scaled by the number of samples over the batch size, so
+// that the expected loss and derivative of a batch are those of TrainAll.
+// As in TrainAll, the optimization vector is the trainable parameters of the net.
+type MiniBatch struct {
+	net       *nnet.Net
+	Inputs    [][]float64
+	Outputs   [][]float64
+	Weights   []float64
+	batchSize int
+	chunkSize int
+	rnd       *rand.Rand
+
+	perm  []int // The order of the samples in the current epoch
+	next  int   // The index in perm of the start of the next batch
+	epoch int
+	step  int
+
+	batchInputs     [][]float64
+	batchOutputs    [][]float64
+	batchWeights    []float64
+	dLossDParam     [][][]float64
+	dLossDParamFlat []float64
+	dLossDTrainable []float64
+	stats           *nnet.BatchStatistics // The batch statistics of the last call to ObjGrad
+}
+
+// NewMiniBatch returns a MiniBatch with batches of batchSize samples. The batches
+// are drawn from src, or from a source seeded by the global source in math/rand if
+// src is nil. If the number of samples is not a multiple of the batch size, the last
+// batch of each epoch is smaller.
+func NewMiniBatch(net *nnet.Net, losser loss.Losser, inputs, outputs [][]float64, weights []float64, batchSize int, src rand.Source) *MiniBatch {
+	if len(inputs) != len(outputs) || len(inputs) != len(weights) {
+		panic("input, output and weight lengths must match")
+	}
+	if batchSize < 1 {
+		panic("batch size must be at least one")
+	}
+	if batchSize > len(inputs) {
+		batchSize = len(inputs)
+	}
+	if src == nil {
+		src = rand.NewSource(rand.Int63())
+	}
+	m := &MiniBatch{
+		net:          net,
+		Inputs:       inputs,
+		Outputs:      outputs,
+		Weights:      weights,
+		batchSize:    batchSize,
+		rnd:          rand.New(src),
+		batchInputs:  make([][]float64, batchSize),
+		batchOutputs: make([][]float64, batchSize),
+		batchWeights: make([]float64, batchSize),
+	}
+	net.Losser = losser
+	if err := NormalizeWeights(m.Weights); err != nil {
+		panic(err)
+	}
+
+	m.dLossDParam, m.dLossDParamFlat = net.NewPerParameterMemory()
+	m.perm = m.rnd.Perm(len(inputs))
+	return m
+}
+
+// SetChunkSize sets the number of samples of a batch per goroutine. The default is
+// as for TrainAll with the batch size as the number of samples
+func (m *MiniBatch) SetChunkSize(chunkSize int) {
+	if chunkSize < 1 {
+		panic("chunk size must be at least one")
+	}
+	m.chunkSize = chunkSize
+}
+
+// BatchSize returns the number of samples per batch
+func (m *MiniBatch) BatchSize() int {
+	return m.batchSize
+}
+
+// Epoch returns the number of complete passes through the data
+func (m *MiniBatch) Epoch() int {
+	return m.epoch
+}
+
+// Step returns the number of calls to Next
+func (m *MiniBatch) Step() int {
+	return m.step
+}
+
+// batch returns the indices of the samples of the current batch
+func (m *MiniBatch) batch() []int {
+	end := m.next + m.batchSize
+	if end > len(m.perm) {
+		end = len(m.perm)
+	}
+	return m.perm[m.next:end]
+}
+
+// Next moves to the next batch, and draws a new permutation of the samples at the
+// end of an epoch. The running statistics of batch normalization are updated with the
+// statistics of the last call to ObjGrad (see nnet.Net.UpdateRunningStatistics).
+func (m *MiniBatch) Next() {
+	m.net.UpdateRunningStatistics(m.stats)
+	m.stats = nil
+	m.step++
+	m.next += len(m.batch())
+	if m.next == len(m.perm) {
+		m.epoch++
+		m.next = 0
+		m.rnd.Shuffle(len(m.perm), func(i, j int) { m.perm[i], m.perm[j] = m.perm[j], m.perm[i] })
+	}
+}
+
+// ObjGrad sets the trainable parameters of the net, and returns the loss and the
+// derivative with respect to the trainable parameters on the current batch
+func (m *MiniBatch) ObjGrad(parameters []float64) (loss float64, deriv []float64, err error) {
+	m.net.SetTrainableParametersSlice(parameters)
+
+	batch := m.batch()
+	// Scale the weights so the batch is an unbiased estimate of the full loss
+	factor := float64(len(m.perm)) / float64(len(batch))
+	for i, idx := range batch {
+		m.batchInputs[i] = m.Inputs[idx]
+		m.batchOutputs[i] = m.Outputs[idx]
+		m.batchWeights[i] = factor * m.Weights[idx]
+	}
+	n := len(batch)
+	chunkSize := chunkSizeFor(m.net.Reduction, m.chunkSize, m.batchSize)
+	loss, m.stats = nnet.ParLossDerivStatistics(m.batchInputs[:n], m.batchOutputs[:n], m.batchWeights[:n], m.net, m.dLossDParam, chunkSize)
+
+	m.dLossDTrainable = trainableDeriv(m.net, m.dLossDParamFlat, m.dLossDTrainable)
+	return loss, m.dLossDTrainable, nil
+}
+
+func (m *MiniBatch) Scale() error {
+	return scaleTrainingData(m.net.InputScaler, m.net.OutputScaler, m.Inputs, m.Outputs)
+}
+
+func (m *MiniBatch) Unscale() error {
+	return unscaleTrainingData(m.net.InputScaler, m.net.OutputScaler, m.Inputs, m.Outputs)
+}
@@ -0,0 +1,149 @@
+package train
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/nnet"
+	"github.com/btracey/nnet/scale"
+	"github.com/gonum/floats"
+)
+
+func newMiniBatchData(nSamples int) (net *nnet.Net, inputs, outputs [][]float64, weights []float64) {
+	net = nnet.DefaultRegression(3, 2, 1, 5)
+	if err := net.Initialize(nil, rand.NewSource(1)); err != nil {
+		panic(err)
+	}
+	net.InputScaler = &scale.None{}
+	net.OutputScaler = &scale.None{}
+	inputs = make([][]float64, nSamples)
+	outputs = make([][]float64, nSamples)
+	weights = make([]float64, nSamples)
+	for i := range inputs {
+		inputs[i] = []float64{rand.NormFloat64(), rand.NormFloat64(), rand.NormFloat64()}
+		outputs[i] = []float64{rand.NormFloat64(), rand.NormFloat64()}
+		weights[i] = rand.Float64()
+	}
+	return net, inputs, outputs, weights
+}
+
+func TestMiniBatch(t *testing.T) {
+	nSamples := 23
+	batchSize := 5
+	net, inputs, outputs, weights := newMiniBatchData(nSamples)
+	params := make([]float64, net.NumTrainableParameters())
+	net.TrainableParametersSlice(params)
+
+	all := NewTrainAll(net, loss.SquaredDistance{}, inputs, outputs, append([]float64(nil), weights...))
+	wantLoss, d, _ := all.ObjGrad(params)
+	wantDeriv := append([]float64(nil), d...)
+
+	m := NewMiniBatch(net, loss.SquaredDistance{}, inputs, outputs, append([]float64(nil), weights...), batchSize, rand.NewSource(1))
+	nBatches := (nSamples + batchSize - 1) / batchSize
+	for epoch := 0; epoch < 3; epoch++ {
+		// Each sample is used once per epoch, and the losses of the batches
+		// weighted by their sizes sum to the loss on all of the data
+		count := make([]int, nSamples)
+		var sumLoss float64
+		sumDeriv := make([]float64, len(params))
+		for b := 0; b < nBatches; b++ {
+			if m.Epoch() != epoch || m.Step() != epoch*nBatches+b {
+				t.Fatalf("Wrong counters. Want epoch %v and step %v, got %v and %v", epoch, epoch*nBatches+b, m.Epoch(), m.Step())
+			}
+			batch := m.perm[m.next:]
+			if len(batch) > batchSize {
+				batch = batch[:batchSize]
+			}
+			for _, idx := range batch {
+				count[idx]++
+			}
+			l, deriv, err := m.ObjGrad(params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// ObjGrad does not change the batch
+			l2, _, _ := m.ObjGrad(params)
+			if l2 != l {
+				t.Errorf("ObjGrad changed the batch. First loss %v, second %v", l, l2)
+			}
+			m.Next()
+			frac := float64(len(batch)) / float64(nSamples)
+			sumLoss += frac * l
+			floats.AddScaled(sumDeriv, frac, deriv)
+		}
+		for i, c := range count {
+			if c != 1 {
+				t.Errorf("Sample %v used %v times in epoch %v", i, c, epoch)
+			}
+		}
+		if !floats.EqualWithinAbsOrRel(sumLoss, wantLoss, 1e-12, 1e-12) {
+			t.Errorf("Epoch loss mismatch. Want %v, got %v", wantLoss, sumLoss)
+		}
+		if !floats.EqualApprox(sumDeriv, wantDeriv, 1e-12) {
+			t.Errorf("Epoch derivative mismatch")
+		}
+	}
+	if m.Epoch() != 3 {
+		t.Errorf("Wrong number of epochs")
+	}
+
+	// The same seed gives the same batches
+	m1 := NewMiniBatch(net, loss.SquaredDistance{}, inputs, outputs, append([]float64(nil), weights...), batchSize, rand.NewSource(2))
+	m2 := NewMiniBatch(net, loss.SquaredDistance{}, inputs, outputs, append([]float64(nil), weights...), batchSize, rand.NewSource(2))
+	for step := 0; step < 2*nBatches; step++ {
+		l1, _, _ := m1.ObjGrad(params)
+		l2, _, _ := m2.ObjGrad(params)
+		if l1 != l2 {
+			t.Fatalf("Batches differ for the same seed")
+		}
+		m1.Next()
+		m2.Next()
+	}
+
+	// A batch of all of the samples is the same as TrainAll
+	full := NewMiniBatch(net, loss.SquaredDistance{}, inputs, outputs, append([]float64(nil), weights...), 2*nSamples, nil)
+	l, deriv, _ := full.ObjGrad(params)
+	if !floats.EqualWithinAbsOrRel(l, wantLoss, 1e-12, 1e-12) || !floats.EqualApprox(deriv, wantDeriv, 1e-12) {
+		t.Errorf("Full batch does not match TrainAll")
+	}
+	full.Next()
+	if full.Epoch() != 1 || full.Step() != 1 {
+		t.Errorf("Full batch is not one epoch")
+	}
+}
+
+func TestMiniBatchRunningStatistics(t *testing.T) {
+	_, inputs, outputs, weights := newMiniBatchData(20)
+	b := nnet.NewBatchNorm()
+	layers := []nnet.Layer{
+		{Neurons: []nnet.Neuron{&nnet.TanhNeuron, &nnet.TanhNeuron, &nnet.TanhNeuron}, BatchNorm: b},
+		{Neurons: []nnet.Neuron{&nnet.LinearNeuron, &nnet.LinearNeuron}},
+	}
+	net := nnet.NewNet(3, layers)
+	net.Mode = nnet.Train
+	net.InputScaler = &scale.None{}
+	net.OutputScaler = &scale.None{}
+	params := make([]float64, net.NumTrainableParameters())
+	net.TrainableParametersSlice(params)
+
+	m := NewMiniBatch(net, loss.SquaredDistance{}, inputs, outputs, weights, 5, rand.NewSource(1))
+	mean := append([]float64(nil), b.RunningMean...)
+	// Evaluating several times in a step (as in a line search) does not update the
+	// running statistics, and Next does
+	for i := 0; i < 3; i++ {
+		m.ObjGrad(params)
+	}
+	if !floats.Equal(b.RunningMean, mean) {
+		t.Errorf("Running statistics updated by ObjGrad")
+	}
+	m.Next()
+	if floats.Equal(b.RunningMean, mean) {
+		t.Errorf("Running statistics not updated by Next")
+	}
+	mean = append([]float64(nil), b.RunningMean...)
+	m.Next()
+	if !floats.Equal(b.RunningMean, mean) {
+		t.Errorf("Running statistics updated by Next without ObjGrad")
+	}
+}
@@ -0,0 +1,73 @@
+package train
+
+import (
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/nnet"
+)
+
+// TrainSequences trains a recurrent net on all of the input sequences. It is
+// the recurrent equivalent of TrainAll. Each sequence has its own weight, and
+// the loss of a sequence is the sum of the losses at each of its time steps.
+type TrainSequences struct {
+	net             *nnet.RecurrentNet
+	Inputs          [][][]float64
+	Outputs         [][][]float64
+	Weights         []float64
+	chunkSize       int
+	dLossDParam     [][][]float64
+	dLossDParamFlat []float64
+}
+
+func NewTrainSequences(net *nnet.RecurrentNet, losser loss.Losser, inputs, outputs [][][]float64, weights []float64) *TrainSequences {
+	if len(inputs) != len(outputs) || len(inputs) != len(weights) {
+		panic("input, output and weight lengths must match")
+	}
+	t := &TrainSequences{
+		net:     net,
+		Inputs:  inputs,
+		Outputs: outputs,
+		Weights: weights,
+	}
+	net.Losser = losser
+	if err := NormalizeWeights(t.Weights); err != nil {
+		panic(err)
+	}
+
+	t.dLossDParam, t.dLossDParamFlat = net.NewPerParameterMemory()
+	return t
+}
+
+// SetChunkSize sets the number of sequences per goroutine. The default is as for
+// TrainAll with the number of sequences as the number of samples
+func (t *TrainSequences) SetChunkSize(chunkSize int) {
+	if chunkSize < 1 {
+		panic("chunk size must be at least one")
+	}
+	t.chunkSize = chunkSize
+}
+
+func (t *TrainSequences) ObjGrad(parameters []float64) (loss float64, deriv []float64, err error) {
+	t.net.SetParametersSlice(parameters)
+	chunkSize := chunkSizeFor(t.net.Reduction, t.chunkSize, len(t.Inputs))
+	loss = t.net.ParLossDeriv(t.Inputs, t.Outputs, t.Weights, t.dLossDParam, chunkSize)
+	return loss, t.dLossDParamFlat, nil
+}
+
+// allSteps returns all of the time steps of all of the sequences
+func allSteps(sequences [][][]float64) [][]float64 {
+	var steps [][]float64
+	for _, seq := range sequences {
+		steps = append(steps, seq...)
+	}
+	return steps
+}
+
+// Scale sets the scale of the net using all of the time steps of all of the
+// sequences, and scales the data
+func (t *TrainSequences) Scale() error {
+	return scaleTrainingData(t.net.InputScaler, t.net.OutputScaler, allSteps(t.Inputs), allSteps(t.Outputs))
+}
+
+func (t *TrainSequences) Unscale() error {
+	return unscaleTrainingData(t.net.InputScaler, t.net.OutputScaler, allSteps(t.Inputs), allSteps(t.Outputs))
+}
@@ -0,0 +1,89 @@
+package train
+
+import (
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/nnet"
+	"github.com/btracey/nnet/scale"
+	"github.com/gonum/floats"
+)
+
+func newSequenceData(nSequences, length int) (r *nnet.RecurrentNet, inputs, outputs [][][]float64, weights []float64) {
+	layers := make([]nnet.Layer, 2)
+	layers[0].Neurons = []nnet.Neuron{&nnet.TanhNeuron, &nnet.TanhNeuron, &nnet.TanhNeuron}
+	layers[1].Neurons = []nnet.Neuron{&nnet.LinearNeuron, &nnet.LinearNeuron}
+	r, err := nnet.NewRecurrentNetInit(3, layers, 0, nil, rand.NewSource(1))
+	if err != nil {
+		panic(err)
+	}
+	r.InputScaler = &scale.Normal{}
+	r.OutputScaler = &scale.Normal{}
+	inputs = make([][][]float64, nSequences)
+	outputs = make([][][]float64, nSequences)
+	weights = make([]float64, nSequences)
+	for i := range inputs {
+		inputs[i] = make([][]float64, length)
+		outputs[i] = make([][]float64, length)
+		for j := range inputs[i] {
+			inputs[i][j] = []float64{rand.NormFloat64(), rand.NormFloat64(), rand.NormFloat64()}
+			outputs[i][j] = []float64{10 + rand.NormFloat64(), 100 * rand.NormFloat64()}
+		}
+		weights[i] = rand.Float64()
+	}
+	return r, inputs, outputs, weights
+}
+
+func TestTrainSequences(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(-1))
+	r, inputs, outputs, weights := newSequenceData(100, 4)
+	r.Reduction = nnet.Ordered
+	seq := NewTrainSequences(r, loss.SquaredDistance{}, inputs, outputs, weights)
+	if sum := floats.Sum(seq.Weights); sum < 1-1e-14 || sum > 1+1e-14 {
+		t.Errorf("Weights not normalized. Sum is %v", sum)
+	}
+
+	// Scale must scale the outputs as well as the inputs
+	origOutputs := [][]float64{append([]float64(nil), outputs[0][0]...)}
+	if err := seq.Scale(); err != nil {
+		t.Fatal(err)
+	}
+	if !r.OutputScaler.IsScaled() {
+		t.Errorf("Output scaler not set")
+	}
+	if floats.Equal(outputs[0][0], origOutputs[0]) {
+		t.Errorf("Outputs not scaled")
+	}
+
+	params := make([]float64, r.TotalNumParameters())
+	r.ParametersSlice(params)
+	var wantLoss float64
+	var wantDeriv []float64
+	for i, procs := range []int{1, 2, 3, 8} {
+		runtime.GOMAXPROCS(procs)
+		l, deriv, err := seq.ObjGrad(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			wantLoss = l
+			wantDeriv = append([]float64(nil), deriv...)
+			continue
+		}
+		if l != wantLoss {
+			t.Errorf("Loss changes with GOMAXPROCS = %v. Want %v, got %v", procs, wantLoss, l)
+		}
+		if !floats.Equal(deriv, wantDeriv) {
+			t.Errorf("Derivative changes with GOMAXPROCS = %v", procs)
+		}
+	}
+
+	if err := seq.Unscale(); err != nil {
+		t.Fatal(err)
+	}
+	if !floats.EqualApprox(outputs[0][0], origOutputs[0], 1e-10) {
+		t.Errorf("Outputs not unscaled. Want %v, got %v", origOutputs[0], outputs[0][0])
+	}
+}
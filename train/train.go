@@ -1,6 +1,8 @@
 package train
 
 import (
+	"errors"
+
 	"github.com/btracey/gofunopter/common"
 	//"github.com/btracey/gofunopter/common/display"
 	"github.com/btracey/nnet/loss"
@@ -17,7 +19,11 @@ import (
 
 // TrainAll trains on all of the input data. This is prone to overfitting,
 // but may not be a problem if the input data is a good representation of
-// the true underlying data. The input and output data are modified
+// the true underlying data. The input and output data are modified.
+// The optimization vector of ObjGrad is the trainable parameters of the net (see
+// nnet.Net.TrainableParametersSlice), so frozen parameters are held fixed. ObjGrad does
+// not update the running statistics of batch normalization, so nnet.Net.UpdateRunningStatistics
+// should be called with BatchStatistics once per step of the optimizer.
 // TODO: Should Inputs/Outputs really be public?
 type TrainAll struct {
 	net             *nnet.Net
@@ -27,7 +33,9 @@ type TrainAll struct {
 	chunkSize       int
 	dLossDParam     [][][]float64
 	dLossDParamFlat []float64
+	dLossDTrainable []float64
 	nInputs         int
+	stats           *nnet.BatchStatistics // The batch statistics of the last call to ObjGrad
 }
 
 func NewTrainAll(net *nnet.Net, losser loss.Losser, inputs, outputs [][]float64, weights []float64) *TrainAll {
@@ -38,45 +46,122 @@ func NewTrainAll(net *nnet.Net, losser loss.Losser, inputs, outputs [][]float64,
 		Weights: weights,
 	}
 	net.Losser = losser
+	if err := NormalizeWeights(t.Weights); err != nil {
+		panic(err)
+	}
+
+	t.dLossDParam, t.dLossDParamFlat = net.NewPerParameterMemory()
+	return t
+}
+
+// NormalizeWeights scales the weights in place to sum to one. It returns an error
+// if any of the weights are negative or if all of the weights are zero.
+func NormalizeWeights(weights []float64) error {
 	for _, weight := range weights {
 		if weight < 0 {
-			panic("negative weight")
+			return errors.New("negative weight")
 		}
 	}
-	// Scale the weights
 	sumWeights := floats.Sum(weights)
-	floats.Scale(1/sumWeights, t.Weights)
+	if len(weights) > 0 && sumWeights == 0 {
+		return errors.New("weights sum to zero")
+	}
+	floats.Scale(1/sumWeights, weights)
+	return nil
+}
 
-	t.dLossDParam, t.dLossDParamFlat = net.NewPerParameterMemory()
-	t.chunkSize = GetChunkSize(len(t.Inputs))
-	return t
+// SetChunkSize sets the number of samples per goroutine. By default, the chunk size
+// is from OrderedChunkSize if the Reduction of the net is nnet.Ordered, so that ObjGrad
+// returns identical results for the same parameters at any GOMAXPROCS, and otherwise
+// from GetChunkSize.
+func (t *TrainAll) SetChunkSize(chunkSize int) {
+	if chunkSize < 1 {
+		panic("chunk size must be at least one")
+	}
+	t.chunkSize = chunkSize
+}
+
+// getChunkSize returns the chunk size set with SetChunkSize, or the default for the
+// Reduction of the net
+func (t *TrainAll) getChunkSize() int {
+	return chunkSizeFor(t.net.Reduction, t.chunkSize, len(t.Inputs))
+}
+
+// chunkSizeFor returns chunkSize if it is set, and otherwise the default chunk size
+// of nSamples samples for the reduction
+func chunkSizeFor(reduction nnet.Reduction, chunkSize, nSamples int) int {
+	if chunkSize != 0 {
+		return chunkSize
+	}
+	if reduction == nnet.Ordered {
+		return OrderedChunkSize(nSamples)
+	}
+	return GetChunkSize(nSamples)
 }
 
 func (t *TrainAll) ObjGrad(parameters []float64) (loss float64, deriv []float64, err error) {
-	t.net.SetParametersSlice(parameters)
-	loss = nnet.ParLossDeriv(t.Inputs, t.Outputs, t.Weights, t.net, t.dLossDParam, t.chunkSize)
+	t.net.SetTrainableParametersSlice(parameters)
+	loss, t.stats = nnet.ParLossDerivStatistics(t.Inputs, t.Outputs, t.Weights, t.net, t.dLossDParam, t.getChunkSize())
 
 	// Don't need these here with weights
 	//loss /= float64(len(t.Inputs))
 	//floats.Scale(1/float64(len(t.Inputs)), t.dLossDParamFlat)
-	return loss, t.dLossDParamFlat, nil
+
+	t.dLossDTrainable = trainableDeriv(t.net, t.dLossDParamFlat, t.dLossDTrainable)
+	return loss, t.dLossDTrainable, nil
+}
+
+// BatchStatistics returns the batch statistics of batch normalization of the last call
+// to ObjGrad (see nnet.ParLossDerivStatistics)
+func (t *TrainAll) BatchStatistics() *nnet.BatchStatistics {
+	return t.stats
+}
+
+// trainableDeriv copies the derivative with respect to the trainable parameters
+// of the net out of the derivative with respect to all of the parameters into dst,
+// which is reallocated if it has the wrong length (the net may have been frozen
+// after the trainer was created)
+func trainableDeriv(net *nnet.Net, dLossDParamFlat, dst []float64) []float64 {
+	nTrainable := net.NumTrainableParameters()
+	if len(dst) != nTrainable {
+		dst = make([]float64, nTrainable)
+	}
+	net.TrainableSlice(dLossDParamFlat, dst)
+	return dst
 }
 
 func (t *TrainAll) Scale() error {
-	SetScale(t.Inputs, t.Outputs, t.net)
-	err := scale.ScaleData(t.net.InputScaler, t.Inputs)
+	return scaleTrainingData(t.net.InputScaler, t.net.OutputScaler, t.Inputs, t.Outputs)
+}
+
+func (t *TrainAll) Unscale() error {
+	return unscaleTrainingData(t.net.InputScaler, t.net.OutputScaler, t.Inputs, t.Outputs)
+}
+
+// scaleTrainingData sets the scalers from the data and scales the data in place
+func scaleTrainingData(inputScaler, outputScaler scale.Scaler, inputs, outputs [][]float64) error {
+	err := inputScaler.SetScale(inputs)
+	if err != nil {
+		return err
+	}
+	err = outputScaler.SetScale(outputs)
+	if err != nil {
+		return err
+	}
+	err = scale.ScaleData(inputScaler, inputs)
 	if err != nil {
 		return err
 	}
-	return scale.ScaleData(t.net.OutputScaler, t.Outputs)
+	return scale.ScaleData(outputScaler, outputs)
 }
 
-func (t *TrainAll) Unscale() error {
-	err := scale.UnscaleData(t.net.InputScaler, t.Inputs)
+// unscaleTrainingData unscales the data in place
+func unscaleTrainingData(inputScaler, outputScaler scale.Scaler, inputs, outputs [][]float64) error {
+	err := scale.UnscaleData(inputScaler, inputs)
 	if err != nil {
 		return err
 	}
-	return scale.UnscaleData(t.net.OutputScaler, t.Outputs)
+	return scale.UnscaleData(outputScaler, outputs)
 }
 
 var TestLossIncrease common.Status = 100
@@ -95,6 +180,24 @@ func GetChunkSize(inputs int) int {
 	return chunkSize
 }
 
+// orderedChunks is the nominal number of chunks of OrderedChunkSize
+const orderedChunks = 16
+
+// OrderedChunkSize returns the number of inputs per parallel goroutine for a net
+// whose Reduction is nnet.Ordered. Unlike GetChunkSize it does not depend on
+// GOMAXPROCS, so the chunks, and so the result of the reduction, only depend on
+// the number of inputs.
+func OrderedChunkSize(inputs int) int {
+	chunkSize := inputs / orderedChunks
+	if chunkSize < 5 {
+		chunkSize = 5
+	}
+	if chunkSize > 1000 {
+		chunkSize = 1000
+	}
+	return chunkSize
+}
+
 func SetScale(inputs, outputs [][]float64, net *nnet.Net) error {
 	err := net.InputScaler.SetScale(inputs)
 	if err != nil {
@@ -0,0 +1,57 @@
+package train
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/btracey/nnet/loss"
+	"github.com/btracey/nnet/nnet"
+	"github.com/gonum/floats"
+)
+
+func TestTrainAllOrdered(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(-1))
+	nSamples := 200
+	net, inputs, outputs, weights := newMiniBatchData(nSamples)
+	net.Reduction = nnet.Ordered
+	params := make([]float64, net.NumTrainableParameters())
+	net.TrainableParametersSlice(params)
+	all := NewTrainAll(net, loss.SquaredDistance{}, inputs, outputs, weights)
+
+	var wantLoss float64
+	var wantDeriv []float64
+	for i, procs := range []int{1, 2, 3, 8} {
+		runtime.GOMAXPROCS(procs)
+		l, deriv, err := all.ObjGrad(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			wantLoss = l
+			wantDeriv = append([]float64(nil), deriv...)
+			continue
+		}
+		if l != wantLoss {
+			t.Errorf("Loss changes with GOMAXPROCS = %v. Want %v, got %v", procs, wantLoss, l)
+		}
+		if !floats.Equal(deriv, wantDeriv) {
+			t.Errorf("Derivative changes with GOMAXPROCS = %v", procs)
+		}
+	}
+}
+
+func TestNormalizeWeights(t *testing.T) {
+	weights := []float64{1, 3, 0, 4}
+	if err := NormalizeWeights(weights); err != nil {
+		t.Fatal(err)
+	}
+	if !floats.Equal(weights, []float64{0.125, 0.375, 0, 0.5}) {
+		t.Errorf("Wrong normalized weights. Got %v", weights)
+	}
+	if err := NormalizeWeights([]float64{1, -1, 2}); err == nil {
+		t.Errorf("No error for a negative weight")
+	}
+	if err := NormalizeWeights([]float64{0, 0}); err == nil {
+		t.Errorf("No error for weights which sum to zero")
+	}
+}